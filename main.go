@@ -10,8 +10,22 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/amqp"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/auto"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/cassandra"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/generic"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/grpc"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/http"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/kafka"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/memcached"
 	"github.com/honeycombio/honeycomb-tcpagent/protocols/mongodb"
 	"github.com/honeycombio/honeycomb-tcpagent/protocols/mysql"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/mysqlx"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/nats"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/postgres"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/redis"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tds"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/zookeeper"
 	"github.com/honeycombio/honeycomb-tcpagent/publish"
 	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
 	libhoney "github.com/honeycombio/libhoney-go"
@@ -27,16 +41,30 @@ type RequiredOptions struct {
 }
 
 type GlobalOptions struct {
-	Debug          bool            `long:"debug" description:"Print verbose debug logs"`
-	Required       RequiredOptions `group:"Required options"`
-	ConfigFile     string          `short:"c" long:"config" description:"Config file for honeycomb-tcpagent in INI format." no-ini:"true"`
-	APIHost        string          `long:"api_host" description:"Hostname for the Honeycomb API server" default:"https://api.honeycomb.io/"`
-	SampleRate     uint            `long:"samplerate" short:"r" description:"When sample rate is N, only send 1 / N events" default:"1"`
-	MySQL          mysql.Options   `group:"MySQL parser options" namespace:"mysql"`
-	MongoDB        mongodb.Options `group:"MongoDB parser options" namespace:"mongodb"`
-	Sniffer        sniffer.Options `group:"Packet capture options (advanced)" namespace:"capture"`
-	ParserName     string          `short:"p" long:"parser" default:"mongodb" description:"Which protocol to parse (MySQL or MongoDB)"` // TODO: just support both
-	StatusInterval int             `long:"status_interval" default:"60" description:"How frequently to print summary statistics, in seconds"`
+	Debug          bool              `long:"debug" description:"Print verbose debug logs"`
+	Required       RequiredOptions   `group:"Required options"`
+	ConfigFile     string            `short:"c" long:"config" description:"Config file for honeycomb-tcpagent in INI format." no-ini:"true"`
+	APIHost        string            `long:"api_host" description:"Hostname for the Honeycomb API server" default:"https://api.honeycomb.io/"`
+	SampleRate     uint              `long:"samplerate" short:"r" description:"When sample rate is N, only send 1 / N events" default:"1"`
+	MySQL          mysql.Options     `group:"MySQL parser options" namespace:"mysql"`
+	MySQLX         mysqlx.Options    `group:"MySQL X Protocol parser options" namespace:"mysqlx"`
+	MongoDB        mongodb.Options   `group:"MongoDB parser options" namespace:"mongodb"`
+	Postgres       postgres.Options  `group:"PostgreSQL parser options" namespace:"postgres"`
+	Redis          redis.Options     `group:"Redis parser options" namespace:"redis"`
+	Memcached      memcached.Options `group:"memcached parser options" namespace:"memcached"`
+	Cassandra      cassandra.Options `group:"Cassandra parser options" namespace:"cassandra"`
+	HTTP           http.Options      `group:"HTTP parser options" namespace:"http"`
+	Kafka          kafka.Options     `group:"Kafka parser options" namespace:"kafka"`
+	TDS            tds.Options       `group:"SQL Server (TDS) parser options" namespace:"tds"`
+	AMQP           amqp.Options      `group:"AMQP parser options" namespace:"amqp"`
+	ZooKeeper      zookeeper.Options `group:"ZooKeeper parser options" namespace:"zookeeper"`
+	GRPC           grpc.Options      `group:"gRPC (HTTP/2) parser options" namespace:"grpc"`
+	NATS           nats.Options      `group:"NATS parser options" namespace:"nats"`
+	Auto           auto.Options      `group:"Protocol auto-detection options" namespace:"auto"`
+	Generic        generic.Options   `group:"Generic request/response timing options" namespace:"generic"`
+	Sniffer        sniffer.Options   `group:"Packet capture options (advanced)" namespace:"capture"`
+	ParserName     string            `short:"p" long:"parser" default:"mongodb" description:"Which protocol to parse (mysql, mysqlx, mongodb, postgres, redis, memcached, cassandra, http, kafka, tds, amqp, zookeeper, grpc or nats, auto to detect each connection's protocol, or generic to time request/response turns of any protocol)"`
+	StatusInterval int               `long:"status_interval" default:"60" description:"How frequently to print summary statistics, in seconds"`
 
 	// Alternative modes
 	Help               bool `short:"h" long:"help" description:"Show this help message"`
@@ -81,16 +109,95 @@ func run(options *GlobalOptions) error {
 		publisher = publish.NewHoneycombPublisher(libhoneyOptions)
 	}
 
-	if options.ParserName == "mysql" {
-		pf = &mysql.ParserFactory{Options: options.MySQL}
-	} else if options.ParserName == "mongodb" {
+	switch options.ParserName {
+	case "mysql":
+		pf = &mysql.ParserFactory{
+			Options:   options.MySQL,
+			Publisher: publisher,
+		}
+	case "mysqlx":
+		pf = &mysqlx.ParserFactory{
+			Options:   options.MySQLX,
+			Publisher: publisher,
+		}
+	case "mongodb":
 		pf = &mongodb.ParserFactory{
 			Options:   options.MongoDB,
 			Publisher: publisher,
 		}
-	} else {
+	case "postgres":
+		pf = &postgres.ParserFactory{
+			Options:   options.Postgres,
+			Publisher: publisher,
+		}
+	case "redis":
+		pf = &redis.ParserFactory{
+			Options:   options.Redis,
+			Publisher: publisher,
+		}
+	case "memcached":
+		pf = &memcached.ParserFactory{
+			Options:   options.Memcached,
+			Publisher: publisher,
+		}
+	case "cassandra":
+		pf = &cassandra.ParserFactory{
+			Options:   options.Cassandra,
+			Publisher: publisher,
+		}
+	case "http":
+		pf = &http.ParserFactory{
+			Options:   options.HTTP,
+			Publisher: publisher,
+		}
+	case "kafka":
+		pf = &kafka.ParserFactory{
+			Options:   options.Kafka,
+			Publisher: publisher,
+		}
+	case "tds":
+		pf = &tds.ParserFactory{
+			Options:   options.TDS,
+			Publisher: publisher,
+		}
+	case "amqp":
+		pf = &amqp.ParserFactory{
+			Options:   options.AMQP,
+			Publisher: publisher,
+		}
+	case "zookeeper":
+		pf = &zookeeper.ParserFactory{
+			Options:   options.ZooKeeper,
+			Publisher: publisher,
+		}
+	case "grpc":
+		pf = &grpc.ParserFactory{
+			Options:   options.GRPC,
+			Publisher: publisher,
+		}
+	case "nats":
+		pf = &nats.ParserFactory{
+			Options:   options.NATS,
+			Publisher: publisher,
+		}
+	case "auto":
+		pf = &auto.ParserFactory{
+			Options:   options.Auto,
+			MongoDB:   options.MongoDB,
+			MySQL:     options.MySQL,
+			Postgres:  options.Postgres,
+			Redis:     options.Redis,
+			HTTP:      options.HTTP,
+			Publisher: publisher,
+		}
+	case "generic":
+		pf = &generic.ParserFactory{
+			Options:   options.Generic,
+			Publisher: publisher,
+		}
+	default:
 		log.Printf("`%s` isn't a supported parser name.\n", options.ParserName)
-		log.Println("Valid parsers are `mongodb` and `mysql`.")
+		log.Println("Valid parsers are `mongodb`, `mysql`, `mysqlx`, `postgres`, `redis`, `memcached`, `cassandra`, `http`, `kafka`, `tds`, `amqp`, `zookeeper`, `grpc`, `nats`, `auto` and `generic`.")
 		os.Exit(1)
 	}
 
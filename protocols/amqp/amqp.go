@@ -0,0 +1,599 @@
+// Package amqp parses AMQP 0-9-1, as spoken by RabbitMQ. Frames from
+// different channels are interleaved, so state is kept per channel.
+//
+// Publishes and deliveries are settled asynchronously: with publisher
+// confirms, the broker acks or nacks each publish by its sequence number on
+// the channel, and consumers ack, nack or reject each delivery by its
+// delivery tag. Events for publishes and deliveries are published once
+// they're settled, with the time it took, or straight away if they won't be.
+package amqp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Port uint16 `long:"port" description:"AMQP port" default:"5672"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if flow.DstPort != pf.Options.Port {
+		flow = flow.Reverse()
+	}
+	return &Parser{
+		options:   pf.Options,
+		flow:      flow,
+		channels:  make(map[uint16]*channel),
+		logger:    logging.NewLogger(logrus.Fields{"flow": flow, "component": "amqp"}),
+		publisher: pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	return fmt.Sprintf("tcp port %d", pf.Options.Port)
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	options  Options
+	flow     sniffer.IPPortTuple
+	client   frameAssembler
+	server   frameAssembler
+	channels map[uint16]*channel
+	// From connection.start-ok and connection.open.
+	user        string
+	virtualHost string
+	closing     *Event // A connection.close awaiting connection.close-ok
+	tls         *tls.Connection
+	logger      *logging.Logger
+	publisher   publish.Publisher
+}
+
+// channel holds the state of a channel.
+type channel struct {
+	confirms    bool   // Whether publisher confirms are on
+	publishSeq  uint64 // The sequence number of the last publish
+	unconfirmed []*Event
+	unacked     []*Event        // Deliveries awaiting the consumer's ack
+	consumers   map[string]bool // Whether consumers are no-ack, by tag
+	// Whether basic.consumes awaiting basic.consume-ok are no-ack.
+	consumes []bool
+	declares []*Event // queue.declares awaiting queue.declare-ok
+	gets     []*Event // basic.gets awaiting their response
+	closing  *Event   // A channel.close awaiting channel.close-ok
+	// The messages whose content is arriving in each direction.
+	clientContent *content
+	serverContent *content
+}
+
+// content is a message whose content header and body frames are arriving.
+type content struct {
+	event     *Event
+	remaining int64
+	// Whether to publish the event once the content has arrived, rather
+	// than when it's settled.
+	publish bool
+}
+
+// Event describes a publish, delivery, basic.get, queue declaration, or
+// close.
+type Event struct {
+	// "publish", "deliver", "get", "queue_declare", "channel_close" or
+	// "connection_close".
+	EventType   string  `json:"event_type"`
+	ClientIP    string  `json:"client_ip"`
+	ServerIP    string  `json:"server_ip"`
+	DurationMs  float64 `json:"duration_ms"`
+	User        string  `json:"user,omitempty"`
+	VirtualHost string  `json:"vhost,omitempty"`
+	Channel     int     `json:"channel"`
+	// The default exchange is named "".
+	Exchange    string `json:"exchange,omitempty"`
+	RoutingKey  string `json:"routing_key,omitempty"`
+	BodySize    int64  `json:"body_size,omitempty"`
+	ConsumerTag string `json:"consumer_tag,omitempty"`
+	// For publishes, the sequence number publisher confirms refer to.
+	DeliveryTag uint64 `json:"delivery_tag,omitempty"`
+	Redelivered bool   `json:"redelivered,omitempty"`
+	// How a publish or delivery was settled: "ack" or "nack" by the broker
+	// for publishes when publisher confirms are on, or "ack", "nack" or
+	// "reject" by the consumer for deliveries. "closed" if the channel or
+	// connection closed first.
+	Outcome string `json:"outcome,omitempty"`
+	// Whether the broker returned a mandatory publish as unroutable.
+	Returned bool `json:"returned,omitempty"`
+	// For queue declarations and basic.get.
+	Queue         string `json:"queue,omitempty"`
+	Passive       bool   `json:"passive,omitempty"`
+	Durable       bool   `json:"durable,omitempty"`
+	Exclusive     bool   `json:"exclusive,omitempty"`
+	AutoDelete    bool   `json:"auto_delete,omitempty"`
+	MessageCount  int    `json:"message_count,omitempty"`
+	ConsumerCount int    `json:"consumer_count,omitempty"`
+	Empty         bool   `json:"empty,omitempty"`
+	// For closes, and returned publishes.
+	ReplyCode int    `json:"reply_code,omitempty"`
+	ReplyText string `json:"reply_text,omitempty"`
+	// Whether a queue declaration or basic.get was abandoned before we
+	// saw its response, because the channel closed or we lost our place.
+	NoResponse bool `json:"no_response,omitempty"`
+	// "client" or "server".
+	ClosedBy string `json:"closed_by,omitempty"`
+	// The method that caused an error close, e.g. "queue.declare".
+	FailedMethod string `json:"failed_method,omitempty"`
+	Error        bool   `json:"error"`
+	timestamp    time.Time
+}
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			} else {
+				p.connectionClosed(time.Time{})
+			}
+			return
+		}
+		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		a := &p.server
+		if toServer {
+			a = &p.client
+		}
+		if m.Skipped() > 0 {
+			// The message most likely starts partway through a frame;
+			// the next one in this direction should start afresh.
+			p.desynchronize(a, "skipped bytes")
+			io.Copy(ioutil.Discard, m)
+			continue
+		}
+		br := bufio.NewReader(m)
+		if toServer && a.idle() {
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				p.logger.Debug("Connection uses TLS", logrus.Fields{})
+				p.channels = make(map[uint16]*channel)
+				p.tls = tls.NewConnection("amqp", p.flow, m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), toServer)
+				continue
+			}
+		}
+		if a.idle() {
+			if b, err := br.Peek(len(protocolHeader)); err == nil && bytes.HasPrefix(b, []byte("AMQP")) {
+				// The client's protocol header, or the server's, if it
+				// doesn't support the version the client asked for.
+				br.Discard(len(protocolHeader))
+			}
+		}
+		err := p.parseFrames(a, br, m.Timestamp(), toServer)
+		if err != io.EOF {
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("amqp.parse_errors").Add()
+			p.desynchronize(a, err.Error())
+			io.Copy(ioutil.Discard, br)
+		}
+	}
+}
+
+// desynchronize forgets about any partial frame in one direction once we
+// can no longer tell where frames start. Content that was arriving in that
+// direction is lost too, and if it was the server's, so may be responses,
+// so requests awaiting them are abandoned.
+func (p *Parser) desynchronize(a *frameAssembler, reason string) {
+	p.logger.Debug("Stream desynchronized", logrus.Fields{"reason": reason})
+	metrics.Counter("amqp.desyncs").Add()
+	a.reset()
+	for _, ch := range p.channels {
+		if a == &p.client {
+			ch.clientContent = nil
+		} else {
+			ch.serverContent = nil
+			p.abandonRequests(ch)
+		}
+	}
+}
+
+func (p *Parser) parseFrames(a *frameAssembler, r io.Reader, timestamp time.Time, toServer bool) error {
+	for {
+		f, err := a.next(r, timestamp)
+		if err != nil {
+			return err
+		}
+		switch f.Type {
+		case FRAME_METHOD:
+			err = p.parseMethod(f, toServer)
+		case FRAME_HEADER:
+			err = p.parseContentHeader(f, toServer)
+		case FRAME_BODY:
+			p.contentArrived(f, toServer, int64(f.Length))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// channel returns the state of a channel, creating it if need be.
+func (p *Parser) channel(id uint16) *channel {
+	ch, ok := p.channels[id]
+	if !ok {
+		ch = &channel{consumers: make(map[string]bool)}
+		if len(p.channels) < maxChannels {
+			p.channels[id] = ch
+		}
+	}
+	return ch
+}
+
+func (p *Parser) newEvent(eventType string, f *frame) *Event {
+	return &Event{
+		EventType:   eventType,
+		User:        p.user,
+		VirtualHost: p.virtualHost,
+		Channel:     int(f.Channel),
+		timestamp:   f.timestamp,
+	}
+}
+
+func (p *Parser) parseMethod(f *frame, toServer bool) error {
+	r := newReader(f)
+	method := uint32(r.Short())<<16 | uint32(r.Short())
+	if r.err != nil {
+		return r.Err()
+	}
+	p.logger.Debug("Parsed method", logrus.Fields{
+		"method":   methodName(method),
+		"channel":  f.Channel,
+		"toServer": toServer})
+	ch := p.channel(f.Channel)
+	switch method {
+	case CONNECTION_START_OK:
+		r.Table() // client properties
+		mechanism := r.ShortStr()
+		response := r.LongStr()
+		if mechanism == "PLAIN" {
+			// "\x00user\x00password"
+			if parts := bytes.Split(response, []byte{0}); len(parts) == 3 {
+				p.user = string(parts[1])
+			}
+		}
+	case CONNECTION_OPEN:
+		p.virtualHost = r.ShortStr()
+	case CONNECTION_CLOSE, CHANNEL_CLOSE:
+		eventType := "channel_close"
+		if method == CONNECTION_CLOSE {
+			eventType = "connection_close"
+		}
+		e := p.newEvent(eventType, f)
+		e.ReplyCode = int(r.Short())
+		e.ReplyText = r.ShortStr()
+		if failed := uint32(r.Short())<<16 | uint32(r.Short()); failed != 0 {
+			e.FailedMethod = methodName(failed)
+		}
+		e.Error = e.ReplyCode != replySuccess
+		e.ClosedBy = "server"
+		if toServer {
+			e.ClosedBy = "client"
+		}
+		if method == CONNECTION_CLOSE {
+			p.closing = e
+		} else {
+			ch.closing = e
+		}
+	case CONNECTION_CLOSE_OK:
+		p.connectionClosed(f.timestamp)
+	case CHANNEL_CLOSE_OK:
+		p.channelClosed(ch, f.timestamp)
+		delete(p.channels, f.Channel)
+	case CONFIRM_SELECT:
+		ch.confirms = true
+	case QUEUE_DECLARE:
+		r.Short() // reserved
+		e := p.newEvent("queue_declare", f)
+		e.Queue = r.ShortStr()
+		bits := r.Octet()
+		e.Passive = bits&0x01 != 0
+		e.Durable = bits&0x02 != 0
+		e.Exclusive = bits&0x04 != 0
+		e.AutoDelete = bits&0x08 != 0
+		if bits&0x10 != 0 {
+			// no-wait
+			p.publish(e, f.timestamp)
+		} else {
+			p.addPending(ch, &ch.declares, e)
+		}
+	case QUEUE_DECLARE_OK:
+		if len(ch.declares) == 0 {
+			break
+		}
+		e := ch.declares[0]
+		ch.declares = ch.declares[1:]
+		// The server names queues declared with an empty name.
+		e.Queue = r.ShortStr()
+		e.MessageCount = int(r.Long())
+		e.ConsumerCount = int(r.Long())
+		p.publish(e, f.timestamp)
+	case BASIC_CONSUME:
+		r.Short()    // reserved
+		r.ShortStr() // queue
+		tag := r.ShortStr()
+		bits := r.Octet()
+		noAck := bits&0x02 != 0
+		if bits&0x08 != 0 {
+			// no-wait, so the client must have chosen the tag.
+			if len(ch.consumers) < maxConsumers {
+				ch.consumers[tag] = noAck
+			}
+		} else {
+			ch.consumes = append(ch.consumes, noAck)
+			if len(ch.consumes) > maxPendingRequests {
+				p.tooManyPending(ch)
+			}
+		}
+	case BASIC_CONSUME_OK:
+		if len(ch.consumes) == 0 {
+			break
+		}
+		if tag := r.ShortStr(); len(ch.consumers) < maxConsumers {
+			ch.consumers[tag] = ch.consumes[0]
+		}
+		ch.consumes = ch.consumes[1:]
+	case BASIC_PUBLISH:
+		r.Short() // reserved
+		e := p.newEvent("publish", f)
+		e.Exchange = r.ShortStr()
+		e.RoutingKey = r.ShortStr()
+		if ch.confirms {
+			ch.publishSeq++
+			e.DeliveryTag = ch.publishSeq
+			p.addUnsettled(&ch.unconfirmed, e)
+			ch.clientContent = &content{event: e}
+		} else {
+			ch.clientContent = &content{event: e, publish: true}
+		}
+	case BASIC_RETURN:
+		code := int(r.Short())
+		text := r.ShortStr()
+		exchange := r.ShortStr()
+		routingKey := r.ShortStr()
+		// Skip the returned message's content.
+		ch.serverContent = nil
+		for _, e := range ch.unconfirmed {
+			if !e.Returned && e.Exchange == exchange && e.RoutingKey == routingKey {
+				e.Returned = true
+				e.ReplyCode = code
+				e.ReplyText = text
+				e.Error = true
+				return r.Err()
+			}
+		}
+		metrics.Counter("amqp.unmatched_returns").Add()
+	case BASIC_DELIVER:
+		e := p.newEvent("deliver", f)
+		e.ConsumerTag = r.ShortStr()
+		e.DeliveryTag = r.LongLong()
+		e.Redelivered = r.Octet()&0x01 != 0
+		e.Exchange = r.ShortStr()
+		e.RoutingKey = r.ShortStr()
+		// If we missed the basic.consume, assume the consumer acks.
+		noAck := ch.consumers[e.ConsumerTag]
+		if !noAck {
+			p.addUnsettled(&ch.unacked, e)
+		}
+		ch.serverContent = &content{event: e, publish: noAck}
+	case BASIC_GET:
+		r.Short() // reserved
+		e := p.newEvent("get", f)
+		e.Queue = r.ShortStr()
+		p.addPending(ch, &ch.gets, e)
+	case BASIC_GET_OK, BASIC_GET_EMPTY:
+		if len(ch.gets) == 0 {
+			break
+		}
+		e := ch.gets[0]
+		ch.gets = ch.gets[1:]
+		if method == BASIC_GET_EMPTY {
+			e.Empty = true
+			p.publish(e, f.timestamp)
+			break
+		}
+		e.DeliveryTag = r.LongLong()
+		e.Redelivered = r.Octet()&0x01 != 0
+		e.Exchange = r.ShortStr()
+		e.RoutingKey = r.ShortStr()
+		e.MessageCount = int(r.Long())
+		ch.serverContent = &content{event: e, publish: true}
+	case BASIC_ACK, BASIC_NACK, BASIC_REJECT:
+		tag := r.LongLong()
+		bits := r.Octet()
+		outcome := "ack"
+		multiple := bits&0x01 != 0
+		if method == BASIC_NACK {
+			outcome = "nack"
+		} else if method == BASIC_REJECT {
+			outcome = "reject"
+			multiple = false
+		}
+		if r.err != nil {
+			break
+		}
+		if toServer {
+			p.settle(&ch.unacked, tag, multiple, outcome, f.timestamp)
+		} else {
+			p.settle(&ch.unconfirmed, tag, multiple, outcome, f.timestamp)
+		}
+	}
+	return r.Err()
+}
+
+func (p *Parser) parseContentHeader(f *frame, toServer bool) error {
+	ch := p.channel(f.Channel)
+	c := ch.serverContent
+	if toServer {
+		c = ch.clientContent
+	}
+	if c == nil {
+		return nil
+	}
+	r := newReader(f)
+	r.Short() // class
+	r.Short() // weight
+	size := r.LongLong()
+	if r.err != nil {
+		return r.Err()
+	}
+	c.event.BodySize = int64(size)
+	c.remaining = int64(size)
+	p.contentArrived(f, toServer, 0)
+	return nil
+}
+
+// contentArrived notes that n bytes of a message's body have arrived, and
+// once all of it has, that the message is complete.
+func (p *Parser) contentArrived(f *frame, toServer bool, n int64) {
+	ch := p.channel(f.Channel)
+	c := &ch.serverContent
+	if toServer {
+		c = &ch.clientContent
+	}
+	if *c == nil {
+		return
+	}
+	(*c).remaining -= n
+	if (*c).remaining > 0 {
+		return
+	}
+	if (*c).publish {
+		p.publish((*c).event, f.timestamp)
+	}
+	*c = nil
+}
+
+// addPending adds a queue declaration or basic.get to those awaiting a
+// response on ch.
+func (p *Parser) addPending(ch *channel, list *[]*Event, e *Event) {
+	*list = append(*list, e)
+	if len(*list) > maxPendingRequests {
+		p.tooManyPending(ch)
+	}
+}
+
+// tooManyPending gives up on the requests awaiting responses on ch. Dropping
+// only the oldest would pair each later response with the request after the
+// one it answers.
+func (p *Parser) tooManyPending(ch *channel) {
+	p.logger.Debug("Too many requests awaiting responses", logrus.Fields{})
+	metrics.Counter("amqp.requests_dropped").Add()
+	p.abandonRequests(ch)
+}
+
+// abandonRequests publishes the queue declarations and basic.gets on a
+// channel whose responses we won't see, and forgets about basic.consumes
+// awaiting basic.consume-ok, so that later responses aren't matched to
+// them.
+func (p *Parser) abandonRequests(ch *channel) {
+	for _, list := range [][]*Event{ch.declares, ch.gets} {
+		for _, e := range list {
+			e.NoResponse = true
+			p.publish(e, time.Time{})
+		}
+	}
+	ch.declares = nil
+	ch.gets = nil
+	ch.consumes = nil
+}
+
+// addUnsettled adds a publish or delivery to those awaiting an ack.
+func (p *Parser) addUnsettled(list *[]*Event, e *Event) {
+	if len(*list) >= maxUnsettled {
+		p.logger.Debug("Too many unsettled messages", logrus.Fields{})
+		metrics.Counter("amqp.unsettled_dropped").Add()
+		*list = (*list)[1:]
+	}
+	*list = append(*list, e)
+}
+
+// settle publishes the events for the publishes or deliveries an ack, nack
+// or reject applies to: the one with the given tag, or if multiple is true,
+// all of them up to it. A tag of zero with multiple set means all of them.
+func (p *Parser) settle(list *[]*Event, tag uint64, multiple bool, outcome string, timestamp time.Time) {
+	kept := (*list)[:0]
+	for _, e := range *list {
+		if e.DeliveryTag == tag || multiple && (tag == 0 || e.DeliveryTag < tag) {
+			e.Outcome = outcome
+			if e.EventType == "publish" && outcome == "nack" {
+				e.Error = true
+			}
+			p.publish(e, timestamp)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	*list = kept
+}
+
+// channelClosed publishes the close of a channel, and what was outstanding
+// on it.
+func (p *Parser) channelClosed(ch *channel, timestamp time.Time) {
+	for _, list := range [][]*Event{ch.unconfirmed, ch.unacked} {
+		for _, e := range list {
+			e.Outcome = "closed"
+			p.publish(e, time.Time{})
+		}
+	}
+	ch.unconfirmed = nil
+	ch.unacked = nil
+	p.abandonRequests(ch)
+	if ch.closing != nil {
+		p.publish(ch.closing, timestamp)
+		ch.closing = nil
+	}
+}
+
+// connectionClosed publishes the close of the connection, and what was
+// outstanding on its channels. If the TCP connection closed without
+// connection.close-ok, timestamp is zero.
+func (p *Parser) connectionClosed(timestamp time.Time) {
+	for id, ch := range p.channels {
+		p.channelClosed(ch, time.Time{})
+		delete(p.channels, id)
+	}
+	if p.closing != nil {
+		p.publish(p.closing, timestamp)
+		p.closing = nil
+	}
+}
+
+func (p *Parser) publish(e *Event, timestamp time.Time) {
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	if timestamp.After(e.timestamp) {
+		e.DurationMs = float64(timestamp.Sub(e.timestamp).Nanoseconds()) / 1e6
+	}
+	p.publisher.Publish(e, e.timestamp)
+	metrics.Counter("amqp.events_parsed").Add()
+}
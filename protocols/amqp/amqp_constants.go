@@ -0,0 +1,348 @@
+package amqp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// See https://www.rabbitmq.com/resources/specs/amqp0-9-1.pdf and
+// https://www.rabbitmq.com/amqp-0-9-1-reference.html
+const protocolHeader = "AMQP\x00\x00\x09\x01"
+
+const (
+	frameHeaderLength = 7
+	frameEnd          = 0xCE
+)
+
+// Frame types
+const (
+	FRAME_METHOD    byte = 1
+	FRAME_HEADER    byte = 2
+	FRAME_BODY      byte = 3
+	FRAME_HEARTBEAT byte = 8
+)
+
+// Classes
+const (
+	CLASS_CONNECTION uint16 = 10
+	CLASS_CHANNEL    uint16 = 20
+	CLASS_EXCHANGE   uint16 = 40
+	CLASS_QUEUE      uint16 = 50
+	CLASS_BASIC      uint16 = 60
+	CLASS_CONFIRM    uint16 = 85
+	CLASS_TX         uint16 = 90
+)
+
+// Methods we parse, as class ID << 16 | method ID.
+const (
+	CONNECTION_START_OK uint32 = 10<<16 | 11
+	CONNECTION_OPEN     uint32 = 10<<16 | 40
+	CONNECTION_CLOSE    uint32 = 10<<16 | 50
+	CONNECTION_CLOSE_OK uint32 = 10<<16 | 51
+	CHANNEL_CLOSE       uint32 = 20<<16 | 40
+	CHANNEL_CLOSE_OK    uint32 = 20<<16 | 41
+	QUEUE_DECLARE       uint32 = 50<<16 | 10
+	QUEUE_DECLARE_OK    uint32 = 50<<16 | 11
+	BASIC_CONSUME       uint32 = 60<<16 | 20
+	BASIC_CONSUME_OK    uint32 = 60<<16 | 21
+	BASIC_PUBLISH       uint32 = 60<<16 | 40
+	BASIC_RETURN        uint32 = 60<<16 | 50
+	BASIC_DELIVER       uint32 = 60<<16 | 60
+	BASIC_GET           uint32 = 60<<16 | 70
+	BASIC_GET_OK        uint32 = 60<<16 | 71
+	BASIC_GET_EMPTY     uint32 = 60<<16 | 72
+	BASIC_ACK           uint32 = 60<<16 | 80
+	BASIC_REJECT        uint32 = 60<<16 | 90
+	BASIC_NACK          uint32 = 60<<16 | 120
+	CONFIRM_SELECT      uint32 = 85<<16 | 10
+	CONFIRM_SELECT_OK   uint32 = 85<<16 | 11
+)
+
+var methodNames = map[uint32]string{
+	10<<16 | 10:  "connection.start",
+	10<<16 | 11:  "connection.start-ok",
+	10<<16 | 20:  "connection.secure",
+	10<<16 | 21:  "connection.secure-ok",
+	10<<16 | 30:  "connection.tune",
+	10<<16 | 31:  "connection.tune-ok",
+	10<<16 | 40:  "connection.open",
+	10<<16 | 41:  "connection.open-ok",
+	10<<16 | 50:  "connection.close",
+	10<<16 | 51:  "connection.close-ok",
+	10<<16 | 60:  "connection.blocked",
+	10<<16 | 61:  "connection.unblocked",
+	10<<16 | 70:  "connection.update-secret",
+	10<<16 | 71:  "connection.update-secret-ok",
+	20<<16 | 10:  "channel.open",
+	20<<16 | 11:  "channel.open-ok",
+	20<<16 | 20:  "channel.flow",
+	20<<16 | 21:  "channel.flow-ok",
+	20<<16 | 40:  "channel.close",
+	20<<16 | 41:  "channel.close-ok",
+	40<<16 | 10:  "exchange.declare",
+	40<<16 | 11:  "exchange.declare-ok",
+	40<<16 | 20:  "exchange.delete",
+	40<<16 | 21:  "exchange.delete-ok",
+	40<<16 | 30:  "exchange.bind",
+	40<<16 | 31:  "exchange.bind-ok",
+	40<<16 | 40:  "exchange.unbind",
+	40<<16 | 51:  "exchange.unbind-ok",
+	50<<16 | 10:  "queue.declare",
+	50<<16 | 11:  "queue.declare-ok",
+	50<<16 | 20:  "queue.bind",
+	50<<16 | 21:  "queue.bind-ok",
+	50<<16 | 30:  "queue.purge",
+	50<<16 | 31:  "queue.purge-ok",
+	50<<16 | 40:  "queue.delete",
+	50<<16 | 41:  "queue.delete-ok",
+	50<<16 | 50:  "queue.unbind",
+	50<<16 | 51:  "queue.unbind-ok",
+	60<<16 | 10:  "basic.qos",
+	60<<16 | 11:  "basic.qos-ok",
+	60<<16 | 20:  "basic.consume",
+	60<<16 | 21:  "basic.consume-ok",
+	60<<16 | 30:  "basic.cancel",
+	60<<16 | 31:  "basic.cancel-ok",
+	60<<16 | 40:  "basic.publish",
+	60<<16 | 50:  "basic.return",
+	60<<16 | 60:  "basic.deliver",
+	60<<16 | 70:  "basic.get",
+	60<<16 | 71:  "basic.get-ok",
+	60<<16 | 72:  "basic.get-empty",
+	60<<16 | 80:  "basic.ack",
+	60<<16 | 90:  "basic.reject",
+	60<<16 | 100: "basic.recover-async",
+	60<<16 | 110: "basic.recover",
+	60<<16 | 111: "basic.recover-ok",
+	60<<16 | 120: "basic.nack",
+	85<<16 | 10:  "confirm.select",
+	85<<16 | 11:  "confirm.select-ok",
+	90<<16 | 10:  "tx.select",
+	90<<16 | 11:  "tx.select-ok",
+	90<<16 | 20:  "tx.commit",
+	90<<16 | 21:  "tx.commit-ok",
+	90<<16 | 30:  "tx.rollback",
+	90<<16 | 31:  "tx.rollback-ok",
+}
+
+func methodName(method uint32) string {
+	if name, ok := methodNames[method]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d.%d", method>>16, method&0xFFFF)
+}
+
+// The reply code for a normal close.
+const replySuccess = 200
+
+// Safety constraints:
+// Don't buffer more than this much of a method or content header frame.
+// Content bodies are counted rather than buffered.
+const maxFrameLength = 1 << 20
+
+// Don't track more than this many unconfirmed publishes or unacknowledged
+// deliveries per channel; RabbitMQ clients typically limit them with
+// basic.qos and by waiting for confirms.
+const maxUnsettled = 4096
+
+// Don't track more than this many queue declarations, basic.gets or
+// basic.consumes awaiting responses per channel; clients usually wait for
+// each response.
+const maxPendingRequests = 1024
+
+// Don't track more than this many channels or consumers per connection.
+const (
+	maxChannels  = 2048
+	maxConsumers = 1024
+)
+
+// frame is a frame, without its header or end marker.
+type frame struct {
+	Type      byte
+	Channel   uint16
+	Length    int  // Length of the payload
+	Truncated bool // Whether body holds only a prefix of the payload
+	body      []byte
+	timestamp time.Time // When the frame started to arrive
+}
+
+// frameAssembler reads frames from one direction of a connection, keeping
+// the start of an incomplete frame until the rest arrives.
+type frameAssembler struct {
+	header    [frameHeaderLength]byte
+	headerLen int    // How much of the header has arrived
+	frame     *frame // The frame being read, once its header has arrived
+	body      bytes.Buffer
+	remaining int // Bytes of the payload still to arrive
+	start     time.Time
+}
+
+// next reads the rest of the current frame from r. It returns io.EOF if r
+// runs out first.
+func (a *frameAssembler) next(r io.Reader, timestamp time.Time) (*frame, error) {
+	if a.frame == nil {
+		n, err := io.ReadFull(r, a.header[a.headerLen:])
+		if a.headerLen == 0 && n > 0 {
+			a.start = timestamp
+		}
+		a.headerLen += n
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint32(a.header[3:])
+		if length > 1<<31 {
+			return nil, fmt.Errorf("Bad frame length %d", length)
+		}
+		a.frame = &frame{
+			Type:      a.header[0],
+			Channel:   binary.BigEndian.Uint16(a.header[1:]),
+			Length:    int(length),
+			timestamp: a.start,
+		}
+		// And the frame end marker.
+		a.remaining = int(length) + 1
+	}
+	for a.remaining > 1 {
+		toBuffer := maxFrameLength - a.body.Len()
+		if a.frame.Type == FRAME_BODY {
+			toBuffer = 0
+		}
+		if toBuffer > a.remaining-1 {
+			toBuffer = a.remaining - 1
+		}
+		var n int64
+		var err error
+		if toBuffer > 0 {
+			// Copying into a bytes.Buffer grows it as data actually
+			// arrives, rather than allocating based on the declared
+			// length up front.
+			n, err = io.CopyN(&a.body, r, int64(toBuffer))
+		} else {
+			n, err = io.CopyN(ioutil.Discard, r, int64(a.remaining-1))
+		}
+		a.remaining -= int(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var end [1]byte
+	if _, err := io.ReadFull(r, end[:]); err != nil {
+		return nil, err
+	}
+	if end[0] != frameEnd {
+		return nil, fmt.Errorf("Bad frame end 0x%02x", end[0])
+	}
+	f := a.frame
+	f.body = append([]byte(nil), a.body.Bytes()...)
+	f.Truncated = len(f.body) < f.Length
+	a.reset()
+	return f, nil
+}
+
+// idle reports whether no frame is partway through arriving.
+func (a *frameAssembler) idle() bool {
+	return a.headerLen == 0
+}
+
+func (a *frameAssembler) reset() {
+	a.headerLen = 0
+	a.frame = nil
+	a.body.Reset()
+	a.remaining = 0
+}
+
+var errTruncated = errors.New("Truncated frame")
+
+// reader wraps a frame's payload with convenience functions for parsing
+// AMQP's types. Like the Postgres parser's reader, it stores the first error
+// it encounters, and callers must check reader.Err().
+type reader struct {
+	b         []byte
+	truncated bool // Whether the frame is truncated
+	err       error
+}
+
+func newReader(f *frame) *reader {
+	return &reader{b: f.body, truncated: f.Truncated}
+}
+
+// Err returns the error the reader encountered, if any. Running out of a
+// truncated frame isn't an error; the fields that were cut off are just
+// left empty.
+func (r *reader) Err() error {
+	if r.err == errTruncated {
+		return nil
+	}
+	return r.err
+}
+
+// take returns the next n bytes. If the frame is truncated, it may return
+// fewer.
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		if r.truncated {
+			r.err = errTruncated
+		} else {
+			r.err = io.ErrUnexpectedEOF
+		}
+		b := r.b
+		r.b = nil
+		return b
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) Octet() byte {
+	if b := r.take(1); len(b) == 1 {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) Short() uint16 {
+	if b := r.take(2); len(b) == 2 {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) Long() uint32 {
+	if b := r.take(4); len(b) == 4 {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) LongLong() uint64 {
+	if b := r.take(8); len(b) == 8 {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// ShortStr reads a string of up to 255 bytes.
+func (r *reader) ShortStr() string {
+	return string(r.take(int(r.Octet())))
+}
+
+// LongStr reads a string with a 32-bit length.
+func (r *reader) LongStr() []byte {
+	return r.take(int(r.Long()))
+}
+
+// Table skips a field table.
+func (r *reader) Table() {
+	r.take(int(r.Long()))
+}
@@ -0,0 +1,491 @@
+package amqp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishWithConfirms(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		[]byte(protocolHeader),
+		genMethod(0, CONNECTION_START_OK,
+			table(), shortstr("PLAIN"), longstr("\x00guest\x00secret"), shortstr("en_US")),
+		genMethod(0, CONNECTION_OPEN, shortstr("/orders"), shortstr(""), []byte{0}),
+		genMethod(1, CONFIRM_SELECT, []byte{0}),
+		genPublish(1, "events", "order.created", 100),
+		genPublish(1, "events", "order.paid", 20)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genMethod(1, BASIC_ACK, uint64b(2), []byte{1}),
+		sniffertest.DefaultDate().Add(5*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 2, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "publish",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 5,
+			"user": "guest",
+			"vhost": "/orders",
+			"channel": 1,
+			"exchange": "events",
+			"routing_key": "order.created",
+			"body_size": 100,
+			"delivery_tag": 1,
+			"outcome": "ack",
+			"error": false
+		}`, string(tp.Output[0]))
+		events := tp.Events()
+		assert.Equal(t, "order.paid", events[1]["routing_key"])
+		assert.Equal(t, float64(2), events[1]["delivery_tag"])
+		assert.Equal(t, float64(20), events[1]["body_size"])
+		assert.NotContains(t, string(tp.Output[1]), "secret")
+	}
+}
+
+func TestPublishWithoutConfirms(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genPublish(1, "", "work", 10),
+		genPublish(1, "", "work", 0)), sniffertest.DefaultDate(), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "publish", events[0]["event_type"])
+		assert.Equal(t, nil, events[0]["exchange"])
+		assert.Equal(t, "work", events[0]["routing_key"])
+		assert.Equal(t, float64(10), events[0]["body_size"])
+		assert.Equal(t, nil, events[0]["outcome"])
+		assert.Equal(t, nil, events[1]["body_size"])
+	}
+}
+
+func TestPublisherNackAndReturn(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genMethod(1, CONFIRM_SELECT, []byte{0}),
+		genPublish(1, "events", "nowhere", 5),
+		genPublish(1, "events", "order.created", 5)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMethod(1, BASIC_RETURN,
+			uint16b(312), shortstr("NO_ROUTE"), shortstr("events"), shortstr("nowhere")),
+		genContentHeader(1, 5), genBody(1, 5),
+		genMethod(1, BASIC_ACK, uint64b(1), []byte{0}),
+		genMethod(1, BASIC_NACK, uint64b(2), []byte{0})),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "nowhere", events[0]["routing_key"])
+		assert.Equal(t, true, events[0]["returned"])
+		assert.Equal(t, float64(312), events[0]["reply_code"])
+		assert.Equal(t, "NO_ROUTE", events[0]["reply_text"])
+		assert.Equal(t, "ack", events[0]["outcome"])
+		assert.Equal(t, true, events[0]["error"])
+		assert.Equal(t, "order.created", events[1]["routing_key"])
+		assert.Equal(t, "nack", events[1]["outcome"])
+		assert.Equal(t, true, events[1]["error"])
+	}
+}
+
+func TestDeliverAck(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genMethod(1, BASIC_CONSUME,
+		uint16b(0), shortstr("work"), shortstr(""), []byte{0}, table()), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMethod(1, BASIC_CONSUME_OK, shortstr("ctag-1")),
+		genDeliver(1, "ctag-1", 1, false, "", "work", 30),
+		genDeliver(1, "ctag-1", 2, true, "", "work", 40),
+		genDeliver(1, "ctag-1", 3, false, "", "work", 50)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genMethod(1, BASIC_ACK, uint64b(2), []byte{1}),
+		sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "deliver", events[0]["event_type"])
+		assert.Equal(t, "ctag-1", events[0]["consumer_tag"])
+		assert.Equal(t, float64(1), events[0]["delivery_tag"])
+		assert.Equal(t, float64(30), events[0]["body_size"])
+		assert.Equal(t, "ack", events[0]["outcome"])
+		assert.Equal(t, float64(2), events[0]["duration_ms"])
+		assert.Equal(t, true, events[1]["redelivered"])
+		assert.Equal(t, "ack", events[1]["outcome"])
+		// Unsettled when the stream ended.
+		assert.Equal(t, float64(3), events[2]["delivery_tag"])
+		assert.Equal(t, "closed", events[2]["outcome"])
+	}
+}
+
+func TestDeliverNoAck(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genMethod(1, BASIC_CONSUME,
+		uint16b(0), shortstr("logs"), shortstr("tailer"), []byte{0x02 | 0x08}, table()),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genDeliver(1, "tailer", 1, false, "logs", "app.info", 12),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "deliver", events[0]["event_type"])
+		assert.Equal(t, "logs", events[0]["exchange"])
+		assert.Equal(t, "app.info", events[0]["routing_key"])
+		assert.Equal(t, float64(12), events[0]["body_size"])
+		assert.Equal(t, nil, events[0]["outcome"])
+	}
+}
+
+func TestDeliverRejectAndNack(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genDeliver(2, "ctag", 1, false, "", "work", 1),
+		genDeliver(2, "ctag", 2, false, "", "work", 1),
+		genDeliver(2, "ctag", 3, false, "", "work", 1)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(concat(
+		genMethod(2, BASIC_REJECT, uint64b(2), []byte{0}),
+		genMethod(2, BASIC_NACK, uint64b(0), []byte{0x01 | 0x02})),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, float64(2), events[0]["delivery_tag"])
+		assert.Equal(t, "reject", events[0]["outcome"])
+		assert.Equal(t, float64(1), events[1]["delivery_tag"])
+		assert.Equal(t, "nack", events[1]["outcome"])
+		assert.Equal(t, false, events[1]["error"])
+		assert.Equal(t, float64(3), events[2]["delivery_tag"])
+		assert.Equal(t, "nack", events[2]["outcome"])
+	}
+}
+
+func TestQueueDeclare(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genMethod(1, QUEUE_DECLARE, uint16b(0), shortstr("jobs"), []byte{0x02}, table()),
+		genMethod(1, QUEUE_DECLARE, uint16b(0), shortstr(""), []byte{0x04 | 0x08}, table()),
+		genMethod(1, QUEUE_DECLARE, uint16b(0), shortstr("fire-and-forget"), []byte{0x10}, table())),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMethod(1, QUEUE_DECLARE_OK, shortstr("jobs"), uint32b(17), uint32b(2)),
+		genMethod(1, QUEUE_DECLARE_OK, shortstr("amq.gen-abc"), uint32b(0), uint32b(0))),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "queue_declare", events[0]["event_type"])
+		assert.Equal(t, "fire-and-forget", events[0]["queue"])
+		assert.Equal(t, "jobs", events[1]["queue"])
+		assert.Equal(t, true, events[1]["durable"])
+		assert.Equal(t, float64(17), events[1]["message_count"])
+		assert.Equal(t, float64(2), events[1]["consumer_count"])
+		assert.Equal(t, float64(1), events[1]["duration_ms"])
+		assert.Equal(t, "amq.gen-abc", events[2]["queue"])
+		assert.Equal(t, true, events[2]["exclusive"])
+		assert.Equal(t, true, events[2]["auto_delete"])
+	}
+}
+
+func TestGet(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genMethod(1, BASIC_GET, uint16b(0), shortstr("jobs"), []byte{1}),
+		genMethod(1, BASIC_GET, uint16b(0), shortstr("jobs"), []byte{1})),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMethod(1, BASIC_GET_OK,
+			uint64b(1), []byte{0}, shortstr(""), shortstr("jobs"), uint32b(4)),
+		genContentHeader(1, 64), genBody(1, 64),
+		genMethod(1, BASIC_GET_EMPTY, shortstr(""))),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "get", events[0]["event_type"])
+		assert.Equal(t, "jobs", events[0]["queue"])
+		assert.Equal(t, float64(64), events[0]["body_size"])
+		assert.Equal(t, float64(4), events[0]["message_count"])
+		assert.Equal(t, float64(1), events[0]["duration_ms"])
+		assert.Equal(t, true, events[1]["empty"])
+	}
+}
+
+func TestChannelClose(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genMethod(3, CONFIRM_SELECT, []byte{0}),
+		genPublish(3, "events", "a", 1),
+		genMethod(3, QUEUE_DECLARE, uint16b(0), shortstr("jobs"), []byte{0x01}, table())),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genMethod(3, CHANNEL_CLOSE,
+		uint16b(404), shortstr("NOT_FOUND - no queue 'jobs'"), uint16b(50), uint16b(10)),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	ms.Append(genMethod(3, CHANNEL_CLOSE_OK),
+		sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "publish", events[0]["event_type"])
+		assert.Equal(t, "closed", events[0]["outcome"])
+		assert.Equal(t, "queue_declare", events[1]["event_type"])
+		assert.Equal(t, true, events[1]["no_response"])
+		assert.Equal(t, "channel_close", events[2]["event_type"])
+		assert.Equal(t, float64(3), events[2]["channel"])
+		assert.Equal(t, float64(404), events[2]["reply_code"])
+		assert.Equal(t, "NOT_FOUND - no queue 'jobs'", events[2]["reply_text"])
+		assert.Equal(t, "queue.declare", events[2]["failed_method"])
+		assert.Equal(t, "server", events[2]["closed_by"])
+		assert.Equal(t, true, events[2]["error"])
+		assert.Equal(t, float64(1), events[2]["duration_ms"])
+	}
+}
+
+func TestConnectionClose(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genMethod(0, CONNECTION_CLOSE, uint16b(200), shortstr("Goodbye"), uint16b(0), uint16b(0))),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genMethod(0, CONNECTION_CLOSE_OK),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "connection_close", events[0]["event_type"])
+		assert.Equal(t, float64(200), events[0]["reply_code"])
+		assert.Equal(t, "client", events[0]["closed_by"])
+		assert.Equal(t, nil, events[0]["failed_method"])
+		assert.Equal(t, false, events[0]["error"])
+	}
+}
+
+func TestFrameSplitAcrossMessages(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	b := concat(genMethod(1, CONFIRM_SELECT, []byte{0}), genPublish(1, "events", "x", 1000))
+	ms.Append(b[:3], sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(b[3:40], sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(b[40:], sniffertest.DefaultDate(), defaultFlow())
+	// Heartbeats are ignored.
+	ms.Append(concat(
+		[]byte{FRAME_HEARTBEAT, 0, 0, 0, 0, 0, 0, frameEnd},
+		genMethod(1, BASIC_ACK, uint64b(1), []byte{0})),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, float64(1000), events[0]["body_size"])
+		assert.Equal(t, "ack", events[0]["outcome"])
+		assert.Equal(t, float64(1), events[0]["duration_ms"])
+	}
+}
+
+func TestResyncAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	b := genPublish(1, "events", "lost", 10)
+	ms.Append(b[:20], sniffertest.DefaultDate(), defaultFlow())
+	ms.AppendSkipped(b[30:], sniffertest.DefaultDate(), defaultFlow(), 10)
+	ms.Append(genPublish(1, "events", "found", 10), sniffertest.DefaultDate(), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "found", events[0]["routing_key"])
+	}
+}
+
+func TestResponsesLost(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genMethod(1, QUEUE_DECLARE, uint16b(0), shortstr("a"), []byte{0}, table()),
+		sniffertest.DefaultDate(), defaultFlow())
+	b := genMethod(1, QUEUE_DECLARE_OK, shortstr("a"), uint32b(1), uint32b(1))
+	ms.AppendSkipped(b[10:], sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse(), 10)
+	ms.Append(concat(
+		genMethod(1, QUEUE_DECLARE, uint16b(0), shortstr("b"), []byte{0}, table()),
+		genMethod(1, BASIC_GET, uint16b(0), shortstr("jobs"), []byte{1})),
+		sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow())
+	ms.Append(genMethod(1, QUEUE_DECLARE_OK, shortstr("b"), uint32b(5), uint32b(2)),
+		sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "a", events[0]["queue"])
+		assert.Equal(t, true, events[0]["no_response"])
+		assert.Nil(t, events[0]["message_count"])
+		assert.Equal(t, "b", events[1]["queue"])
+		assert.Equal(t, float64(5), events[1]["message_count"])
+		assert.Equal(t, float64(1), events[1]["duration_ms"])
+		assert.Nil(t, events[1]["no_response"])
+		// The connection closed before the basic.get's response.
+		assert.Equal(t, "get", events[2]["event_type"])
+		assert.Equal(t, true, events[2]["no_response"])
+	}
+}
+
+func TestTooManyPending(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	var gets []byte
+	for i := 0; i <= maxPendingRequests; i++ {
+		gets = append(gets, genMethod(1, BASIC_GET, uint16b(0), shortstr("jobs"), []byte{1})...)
+	}
+	ms.Append(gets, sniffertest.DefaultDate(), defaultFlow())
+	// The response to the first basic.get, which we've given up on.
+	ms.Append(genMethod(1, BASIC_GET_EMPTY, shortstr("")),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, maxPendingRequests+1, len(events)) {
+		for _, e := range events {
+			assert.Equal(t, true, e["no_response"])
+			assert.Nil(t, e["empty"])
+		}
+	}
+}
+
+func TestBadFrameEnd(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	b := genPublish(1, "events", "bad", 0)
+	b[len(b)-1] = 0
+	ms.Append(b, sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPublish(1, "events", "good", 0), sniffertest.DefaultDate(), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "good", events[0]["routing_key"])
+	}
+}
+
+func genFrame(frameType byte, channel uint16, payload []byte) []byte {
+	return concat([]byte{frameType}, uint16b(channel), uint32b(uint32(len(payload))),
+		payload, []byte{frameEnd})
+}
+
+func genMethod(channel uint16, method uint32, args ...[]byte) []byte {
+	return genFrame(FRAME_METHOD, channel, concat(uint32b(method), concat(args...)))
+}
+
+func genContentHeader(channel uint16, bodySize int) []byte {
+	return genFrame(FRAME_HEADER, channel, concat(
+		uint16b(CLASS_BASIC), uint16b(0), uint64b(uint64(bodySize)),
+		uint16b(0x1000), // property flags: delivery mode
+		[]byte{2}))
+}
+
+// genBody generates the frames for a body of n bytes, split into frames of
+// at most 512 bytes.
+func genBody(channel uint16, n int) []byte {
+	var frames [][]byte
+	for n > 0 {
+		size := n
+		if size > 512 {
+			size = 512
+		}
+		frames = append(frames, genFrame(FRAME_BODY, channel, bytes.Repeat([]byte{'x'}, size)))
+		n -= size
+	}
+	return concat(frames...)
+}
+
+func genPublish(channel uint16, exchange string, routingKey string, bodySize int) []byte {
+	return concat(
+		genMethod(channel, BASIC_PUBLISH,
+			uint16b(0), shortstr(exchange), shortstr(routingKey), []byte{0}),
+		genContentHeader(channel, bodySize),
+		genBody(channel, bodySize))
+}
+
+func genDeliver(channel uint16, consumerTag string, deliveryTag uint64, redelivered bool,
+	exchange string, routingKey string, bodySize int) []byte {
+	var bits byte
+	if redelivered {
+		bits = 1
+	}
+	return concat(
+		genMethod(channel, BASIC_DELIVER,
+			shortstr(consumerTag), uint64b(deliveryTag), []byte{bits},
+			shortstr(exchange), shortstr(routingKey)),
+		genContentHeader(channel, bodySize),
+		genBody(channel, bodySize))
+}
+
+func uint16b(n uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, n)
+	return b
+}
+
+func uint32b(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func uint64b(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+func shortstr(s string) []byte {
+	return concat([]byte{byte(len(s))}, []byte(s))
+}
+
+func longstr(s string) []byte {
+	return concat(uint32b(uint32(len(s))), []byte(s))
+}
+
+// table generates an empty field table.
+func table() []byte {
+	return uint32b(0)
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(5672)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		Options:   Options{Port: 5672},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
@@ -0,0 +1,209 @@
+// Package auto detects which protocol each connection speaks from its first
+// bytes, and hands it to that protocol's parser, so that one agent can watch
+// a host running several services on whatever ports they use.
+//
+// It recognizes MongoDB, MySQL, PostgreSQL, Redis and HTTP, and connections
+// that start with a TLS handshake. Detection needs the start of a request
+// (or for MySQL, the server's greeting), so connections that were already
+// open when the capture started are only recognized if a later request is.
+package auto
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/http"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/mongodb"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/mysql"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/postgres"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/redis"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Ports []uint16 `long:"port" description:"Port to detect protocols on; repeat for several ports. By default, all TCP traffic is inspected"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory. The options for each
+// protocol apply to the connections detected as that protocol, except for
+// their ports, since the server's port is whatever the connection uses.
+type ParserFactory struct {
+	Options   Options
+	MongoDB   mongodb.Options
+	MySQL     mysql.Options
+	Postgres  postgres.Options
+	Redis     redis.Options
+	HTTP      http.Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	return &Parser{
+		factory: pf,
+		flow:    flow,
+		logger:  logging.NewLogger(logrus.Fields{"flow": flow, "component": "auto"}),
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	if len(pf.Options.Ports) == 0 {
+		return "tcp"
+	}
+	filters := make([]string, len(pf.Options.Ports))
+	for i, port := range pf.Options.Ports {
+		filters[i] = fmt.Sprintf("tcp port %d", port)
+	}
+	return strings.Join(filters, " or ")
+}
+
+// consumer returns a consumer for a connection speaking protocol, from the
+// client to serverPort.
+func (pf *ParserFactory) consumer(protocol string, flow sniffer.IPPortTuple, serverPort uint16, start time.Time) sniffer.Consumer {
+	switch protocol {
+	case "mongodb":
+		options := pf.MongoDB
+		options.Port = serverPort
+		return (&mongodb.ParserFactory{Options: options, Publisher: pf.Publisher}).New(flow)
+	case "mysql":
+		options := pf.MySQL
+		options.Port = serverPort
+		return (&mysql.ParserFactory{Options: options, Publisher: pf.Publisher}).New(flow)
+	case "postgres":
+		options := pf.Postgres
+		options.Port = serverPort
+		return (&postgres.ParserFactory{Options: options, Publisher: pf.Publisher}).New(flow)
+	case "redis":
+		options := pf.Redis
+		options.Port = serverPort
+		return (&redis.ParserFactory{Options: options, Publisher: pf.Publisher}).New(flow)
+	case "http":
+		options := pf.HTTP
+		options.Port = serverPort
+		return (&http.ParserFactory{Options: options, Publisher: pf.Publisher}).New(flow)
+	}
+	// TLS
+	if flow.DstPort != serverPort {
+		flow = flow.Reverse()
+	}
+	return &tlsConsumer{
+		conn:       tls.NewConnection(pf.protocolForPort(serverPort), flow, start),
+		serverPort: serverPort,
+		publisher:  pf.Publisher,
+	}
+}
+
+// protocolForPort guesses what an encrypted connection to port carries,
+// from the ports the protocols are configured with.
+func (pf *ParserFactory) protocolForPort(port uint16) string {
+	switch port {
+	case pf.MongoDB.Port:
+		return "mongodb"
+	case pf.MySQL.Port:
+		return "mysql"
+	case pf.Postgres.Port:
+		return "postgres"
+	case pf.Redis.Port:
+		return "redis"
+	case pf.HTTP.Port, 443:
+		return "http"
+	}
+	return "unknown"
+}
+
+// Parser implements sniffer.Consumer. It reads a connection until it
+// recognizes a protocol, and then hands the connection, starting with the
+// message it recognized, to that protocol's parser.
+type Parser struct {
+	factory *ParserFactory
+	flow    sniffer.IPPortTuple
+	logger  *logging.Logger
+}
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for i := 0; i < maxUndetectedMessages; i++ {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			return
+		}
+		br := bufio.NewReaderSize(m, peekLength)
+		// Peek returns what there is if the message is shorter.
+		b, _ := br.Peek(peekLength)
+		protocol, serverPort := detect(b, m.Flow())
+		if protocol == "" {
+			io.Copy(ioutil.Discard, br)
+			continue
+		}
+		p.logger.Debug("Detected protocol", logrus.Fields{
+			"protocol":   protocol,
+			"serverPort": serverPort})
+		metrics.Counter("auto.detected_" + protocol).Add()
+		c := p.factory.consumer(protocol, m.Flow(), serverPort, m.Timestamp())
+		c.On(&replayStream{first: &peekedMessage{Message: m, r: br}, rest: ms})
+		return
+	}
+	p.logger.Debug("Unrecognized protocol", logrus.Fields{})
+	metrics.Counter("auto.unrecognized_flows").Add()
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			return
+		}
+		io.Copy(ioutil.Discard, m)
+	}
+}
+
+// peekedMessage is a message whose first bytes have been read into a
+// bufio.Reader, which reads them again.
+type peekedMessage struct {
+	sniffer.Message
+	r io.Reader
+}
+
+func (m *peekedMessage) Read(b []byte) (int, error) {
+	return m.r.Read(b)
+}
+
+// replayStream is a message stream that starts with a message that was
+// already taken from the rest.
+type replayStream struct {
+	first sniffer.Message
+	rest  sniffer.MessageStream
+}
+
+func (s *replayStream) Next() (sniffer.Message, bool) {
+	if s.first != nil {
+		m := s.first
+		s.first = nil
+		return m, true
+	}
+	return s.rest.Next()
+}
+
+// tlsConsumer implements sniffer.Consumer for connections that start with a
+// TLS handshake, so whatever they carry is encrypted.
+type tlsConsumer struct {
+	conn       *tls.Connection
+	serverPort uint16
+	publisher  publish.Publisher
+}
+
+func (c *tlsConsumer) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			c.conn.Publish(c.publisher)
+			return
+		}
+		c.conn.Observe(m, m.Timestamp(), m.Flow().DstPort == c.serverPort)
+	}
+}
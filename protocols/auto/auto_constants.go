@@ -0,0 +1,178 @@
+package auto
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/mongodb"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/postgres"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+// How many bytes of a message detection looks at; enough for a MongoDB
+// message header.
+const peekLength = 16
+
+// Safety constraints:
+// Give up on a connection if none of its first few messages are recognized.
+const maxUndetectedMessages = 4
+
+// Don't believe MongoDB messages longer than this; the server's limit is
+// 48MB.
+const maxMongoDBMessageLength = 48 << 20
+
+// Don't believe PostgreSQL startup messages longer than this; the server's
+// limit is 10000 bytes.
+const maxStartupMessageLength = 10000
+
+// Don't believe MySQL greetings longer than this; they're usually under 100
+// bytes.
+const maxGreetingLength = 1024
+
+// The protocol version in a MySQL greeting.
+const mysqlProtocolVersion = 10
+
+// Opcodes that the MongoDB parser doesn't know: OP_COMPRESSED, and OP_MSG,
+// which replaced the legacy opcode 1000 of the same name, and which drivers
+// send everything with since MongoDB 3.6.
+const (
+	mongoDBOpCompressed = 2012
+	mongoDBOpMsg        = 2013
+)
+
+var mongoDBRequestOpCodes = map[int32]bool{
+	mongodb.OP_MSG:          true,
+	mongodb.OP_UPDATE:       true,
+	mongodb.OP_INSERT:       true,
+	mongodb.OP_QUERY:        true,
+	mongodb.OP_GET_MORE:     true,
+	mongodb.OP_DELETE:       true,
+	mongodb.OP_KILL_CURSORS: true,
+	mongodb.OP_COMMAND:      true,
+	mongoDBOpCompressed:     true,
+	mongoDBOpMsg:            true,
+}
+
+var postgresStartupCodes = map[uint32]bool{
+	postgres.PROTOCOL_VERSION_3:  true,
+	postgres.CANCEL_REQUEST_CODE: true,
+	postgres.SSL_REQUEST_CODE:    true,
+	postgres.GSSENC_REQUEST_CODE: true,
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("HEAD "),
+	[]byte("OPTIONS "),
+	[]byte("PATCH "),
+	[]byte("CONNECT "),
+	[]byte("TRACE "),
+}
+
+// detect returns the protocol that a message starting with b belongs to, and
+// the server's port, or an empty string if it doesn't recognize it.
+func detect(b []byte, flow sniffer.IPPortTuple) (string, uint16) {
+	switch {
+	case tls.IsClientHello(b):
+		return "tls", flow.DstPort
+	case isMongoDBRequest(b):
+		// Checked before MySQL greetings, which a MongoDB header can look
+		// like, while a greeting's version string can't hold a valid
+		// opcode.
+		return "mongodb", flow.DstPort
+	case isMySQLGreeting(b):
+		// The server speaks first.
+		return "mysql", flow.SrcPort
+	case isPostgresStartup(b):
+		return "postgres", flow.DstPort
+	case isHTTPRequest(b):
+		return "http", flow.DstPort
+	case isRESPCommand(b) && flow.SrcPort > flow.DstPort:
+		// Replies can be arrays too. Clients' ephemeral ports are almost
+		// always higher than servers' ports, so this avoids mistaking
+		// the server for the client when the connection was already open.
+		return "redis", flow.DstPort
+	}
+	return "", 0
+}
+
+// isMongoDBRequest reports whether b starts with the header of a MongoDB
+// request: a plausible length, and a known opcode, not responding to
+// anything.
+func isMongoDBRequest(b []byte) bool {
+	if len(b) < 16 {
+		return false
+	}
+	length := int32(binary.LittleEndian.Uint32(b))
+	responseTo := int32(binary.LittleEndian.Uint32(b[8:]))
+	opCode := int32(binary.LittleEndian.Uint32(b[12:]))
+	return length >= 16 && length <= maxMongoDBMessageLength &&
+		responseTo == 0 && mongoDBRequestOpCodes[opCode]
+}
+
+// isMySQLGreeting reports whether b starts with the handshake packet a MySQL
+// server sends when a client connects: a plausible length, sequence number
+// 0, protocol version 10 and a printable server version.
+func isMySQLGreeting(b []byte) bool {
+	if len(b) < 6 {
+		return false
+	}
+	length := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+	if length < 2 || length > maxGreetingLength || b[3] != 0 || b[4] != mysqlProtocolVersion {
+		return false
+	}
+	for _, c := range b[5:] {
+		if c == 0 {
+			break
+		}
+		if c < ' ' || c > '~' {
+			return false
+		}
+	}
+	// The version can't be empty.
+	return b[5] != 0
+}
+
+// isPostgresStartup reports whether b starts with a message a PostgreSQL
+// client can start a connection with: StartupMessage, SSLRequest,
+// GSSENCRequest or CancelRequest.
+func isPostgresStartup(b []byte) bool {
+	if len(b) < 8 {
+		return false
+	}
+	length := binary.BigEndian.Uint32(b)
+	return length >= 8 && length <= maxStartupMessageLength &&
+		postgresStartupCodes[binary.BigEndian.Uint32(b[4:])]
+}
+
+// isHTTPRequest reports whether b starts with an HTTP/1.x request method.
+func isHTTPRequest(b []byte) bool {
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(b, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRESPCommand reports whether b starts like a Redis command, which is an
+// array of bulk strings: "*<count>\r\n$".
+func isRESPCommand(b []byte) bool {
+	if len(b) < 2 || b[0] != '*' {
+		return false
+	}
+	i := 1
+	for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+		i++
+	}
+	if i == 1 {
+		return false
+	}
+	return bytes.HasPrefix(b[i:], []byte("\r\n$")) ||
+		// Cut off by peekLength, or a short message.
+		len(b[i:]) < 3 && bytes.HasPrefix([]byte("\r\n$"), b[i:])
+}
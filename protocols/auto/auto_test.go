@@ -0,0 +1,164 @@
+package auto
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/http"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/mongodb"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/mysql"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/postgres"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/redis"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisOnAnotherPort(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("*2\r\n$3\r\nGET\r\n$6\r\nuser:1\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("$5\r\nalice\r\n"), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "command",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 1,
+			"command": "GET",
+			"key": "user:1",
+			"arg_count": 1,
+			"request_bytes": 25,
+			"reply_type": "bulk_string",
+			"reply_bytes": 11,
+			"error": false
+		}`, string(tp.Output[0]))
+	}
+}
+
+func TestDetectsLaterRequest(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	// The capture started partway through a response.
+	ms.Append([]byte("\r\nContent-Length: 0\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("GET /status HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow())
+	ms.Append([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"),
+		sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "10.0.0.23", events[0]["server_ip"])
+		assert.Equal(t, 2., events[0]["duration_ms"])
+	}
+}
+
+func TestTLS(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	flow := defaultFlow()
+	flow.DstPort = 443
+	ms.Append([]byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00}, sniffertest.DefaultDate(), flow)
+	ms.Append(make([]byte, 100), sniffertest.DefaultDate().Add(time.Millisecond), flow.Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "tls_connection", events[0]["event_type"])
+		assert.Equal(t, "http", events[0]["protocol"])
+		assert.Equal(t, "10.0.0.23", events[0]["server_ip"])
+		assert.Equal(t, 9., events[0]["bytes_to_server"])
+		assert.Equal(t, 100., events[0]["bytes_from_server"])
+	}
+}
+
+func TestUnrecognized(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	for i := 0; i < 3*maxUndetectedMessages; i++ {
+		ms.Append([]byte("SSH-2.0-OpenSSH_8.9\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	}
+	// Too late to be looked at.
+	ms.Append([]byte("GET / HTTP/1.1\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	parser.On(ms)
+	assert.Equal(t, 0, len(tp.Output))
+	assert.True(t, ms.Done())
+}
+
+func TestDetect(t *testing.T) {
+	flow := defaultFlow()
+	mongoHeader := make([]byte, 16)
+	binary.LittleEndian.PutUint32(mongoHeader, 100)
+	binary.LittleEndian.PutUint32(mongoHeader[4:], 7)
+	binary.LittleEndian.PutUint32(mongoHeader[12:], mongodb.OP_MSG)
+	mongoReply := append([]byte(nil), mongoHeader...)
+	// A request ID of 0x410a looks like a MySQL greeting with version "A".
+	mongoQuery := make([]byte, 16)
+	binary.LittleEndian.PutUint32(mongoQuery, 100)
+	binary.LittleEndian.PutUint32(mongoQuery[4:], 0x410a)
+	binary.LittleEndian.PutUint32(mongoQuery[12:], mongodb.OP_QUERY)
+	mongoMsg := append([]byte(nil), mongoHeader...)
+	binary.LittleEndian.PutUint32(mongoMsg[12:], 2013)
+	binary.LittleEndian.PutUint32(mongoReply[8:], 7)
+	postgresStartup := make([]byte, 8)
+	binary.BigEndian.PutUint32(postgresStartup, 8)
+	binary.BigEndian.PutUint32(postgresStartup[4:], postgres.SSL_REQUEST_CODE)
+
+	testCases := []struct {
+		b        []byte
+		flow     sniffer.IPPortTuple
+		protocol string
+		port     uint16
+	}{
+		{mongoHeader, flow, "mongodb", 6380},
+		{mongoReply, flow.Reverse(), "", 0},
+		{mongoQuery, flow, "mongodb", 6380},
+		{mongoMsg, flow, "mongodb", 6380},
+		{postgresStartup, flow, "postgres", 6380},
+		{[]byte("J\x00\x00\x00\x0a8.0.36\x00"), flow.Reverse(), "mysql", 6380},
+		{[]byte("J\x00\x00\x00\x0a\x00"), flow.Reverse(), "", 0},
+		{[]byte("J\x00\x00\x01\x0a8.0.36\x00"), flow.Reverse(), "", 0},
+		{[]byte("DELETE /users/1 "), flow, "http", 6380},
+		{[]byte("HTTP/1.1 200 OK\r\n"), flow.Reverse(), "", 0},
+		{[]byte("*1\r\n$4\r\nPING\r\n"), flow, "redis", 6380},
+		{[]byte("*12"), flow, "redis", 6380},
+		{[]byte("*2\r\n$1\r\nx\r\n"), flow.Reverse(), "", 0},
+		{[]byte("*\r\n$"), flow, "", 0},
+		{[]byte{0x16, 0x03, 0x03, 0x00, 0x10, 0x01}, flow, "tls", 6380},
+		{[]byte{}, flow, "", 0},
+	}
+	for _, tc := range testCases {
+		protocol, port := detect(tc.b, tc.flow)
+		assert.Equal(t, tc.protocol, protocol, "%q", tc.b)
+		assert.Equal(t, tc.port, port, "%q", tc.b)
+	}
+}
+
+func TestBPFFilter(t *testing.T) {
+	pf := &ParserFactory{}
+	assert.Equal(t, "tcp", pf.BPFFilter())
+	pf.Options.Ports = []uint16{8080, 6380}
+	assert.Equal(t, "tcp port 8080 or tcp port 6380", pf.BPFFilter())
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(6380)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		MongoDB:   mongodb.Options{Port: 27017},
+		MySQL:     mysql.Options{Port: 3306, MaxPayloadSize: 1048576},
+		Postgres:  postgres.Options{Port: 5432, MaxMessageSize: 1048576},
+		Redis:     redis.Options{Port: 6379},
+		HTTP:      http.Options{Port: 80},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
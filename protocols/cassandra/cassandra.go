@@ -0,0 +1,462 @@
+// Package cassandra parses the CQL native protocol, versions 3 to 5. Clients
+// tag each request with a stream ID, which the server's response carries,
+// and the server may respond out of order, so responses are matched to
+// requests by stream ID rather than with a queue.
+package cassandra
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Port         uint16 `long:"port" description:"Cassandra native protocol port" default:"9042"`
+	MaxFrameSize int    `long:"max_frame_size" description:"Maximum number of bytes of a single frame body to buffer per connection; longer queries are truncated" default:"1048576"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if flow.DstPort != pf.Options.Port {
+		flow = flow.Reverse()
+	}
+	return &Parser{
+		options:    pf.Options,
+		flow:       flow,
+		pending:    make(map[int16]*Event),
+		statements: make(map[string]statement),
+		logger:     logging.NewLogger(logrus.Fields{"flow": flow, "component": "cassandra"}),
+		publisher:  pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	return fmt.Sprintf("tcp port %d", pf.Options.Port)
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	options    Options
+	flow       sniffer.IPPortTuple
+	client     direction
+	server     direction
+	pending    map[int16]*Event     // Requests awaiting responses, by stream ID
+	statements map[string]statement // Prepared statements, by ID
+	keyspace   string               // Set by USE
+	// The compression algorithm the client asked for in its STARTUP
+	// message. Protocol v5 compresses whole frames, which we can't read.
+	compression string
+	compressed  bool // Whether we've given up because of v5 compression
+	tls         *tls.Connection
+	logger      *logging.Logger
+	publisher   publish.Publisher
+}
+
+// direction holds the state of one direction of the connection.
+type direction struct {
+	frames frameAssembler
+	// Once a protocol v5 connection is established, messages are wrapped
+	// in frames.
+	segments *segmentReader
+}
+
+func (d *direction) idle() bool {
+	return d.frames.idle() && (d.segments == nil || d.segments.idle())
+}
+
+// reset forgets about any partial frame, so that we start afresh with the
+// next message.
+func (d *direction) reset() {
+	d.frames.reset()
+	if d.segments != nil {
+		d.segments = &segmentReader{}
+	}
+}
+
+type statement struct {
+	query    string
+	keyspace string
+}
+
+// Event describes a request and its response.
+type Event struct {
+	EventType       string  `json:"event_type"`
+	ClientIP        string  `json:"client_ip"`
+	ServerIP        string  `json:"server_ip"`
+	DurationMs      float64 `json:"duration_ms"`
+	ProtocolVersion int     `json:"protocol_version"`
+	StreamID        int     `json:"stream_id"`
+	// The request's opcode, e.g. "QUERY", "EXECUTE" or "BATCH".
+	Opcode string `json:"opcode"`
+	// The CQL text of a QUERY or PREPARE, or of the prepared statement an
+	// EXECUTE runs, if it was prepared on the same connection.
+	Query string `json:"query,omitempty"`
+	// Hex-encoded, for EXECUTE and PREPARE.
+	PreparedID        string `json:"prepared_id,omitempty"`
+	BatchType         string `json:"batch_type,omitempty"`
+	BatchStatements   int    `json:"batch_statements,omitempty"`
+	Consistency       string `json:"consistency,omitempty"`
+	SerialConsistency string `json:"serial_consistency,omitempty"`
+	// The keyspace named by the request (protocol v5), or the one the
+	// connection was using.
+	Keyspace string `json:"keyspace,omitempty"`
+	PageSize int    `json:"page_size,omitempty"`
+	// Whether the request or response was compressed, so that we couldn't
+	// read it.
+	Compressed bool `json:"compressed,omitempty"`
+	// The response's opcode, e.g. "RESULT", "ERROR" or "READY".
+	Response     string `json:"response"`
+	ResultKind   string `json:"result_kind,omitempty"`
+	RowsReturned int    `json:"rows_returned"`
+	HasMorePages bool   `json:"has_more_pages,omitempty"`
+	Warnings     int    `json:"warnings,omitempty"`
+	Error        bool   `json:"error"`
+	ErrorCode    int    `json:"error_code,omitempty"`
+	// e.g. "read_timeout", "syntax_error" or "unprepared".
+	ErrorName    string `json:"error_name,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+	timestamp    time.Time
+}
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
+			return
+		}
+		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		if p.compressed {
+			io.Copy(ioutil.Discard, m)
+			continue
+		}
+		d := &p.server
+		if toServer {
+			d = &p.client
+		}
+		if m.Skipped() > 0 {
+			// The message most likely starts partway through a frame;
+			// the next one in this direction should start afresh.
+			p.desynchronize(d, "skipped bytes")
+			io.Copy(ioutil.Discard, m)
+			continue
+		}
+		br := bufio.NewReader(m)
+		if toServer && d.segments == nil && d.idle() {
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				p.logger.Debug("Connection uses TLS", logrus.Fields{})
+				p.pending = nil
+				p.tls = tls.NewConnection("cassandra", p.flow, m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), toServer)
+				continue
+			}
+		}
+		err := p.parseFrames(d, br, m.Timestamp(), toServer)
+		if err != io.EOF {
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("cassandra.parse_errors").Add()
+			p.desynchronize(d, err.Error())
+			io.Copy(ioutil.Discard, br)
+		}
+	}
+}
+
+// desynchronize forgets about any partial frame in one direction once we
+// can no longer tell where frames start. Stream IDs still match responses
+// to requests, so pending requests are kept; ones whose responses we miss
+// are replaced when the client reuses their stream IDs.
+func (p *Parser) desynchronize(d *direction, reason string) {
+	p.logger.Debug("Stream desynchronized", logrus.Fields{"reason": reason})
+	metrics.Counter("cassandra.desyncs").Add()
+	d.reset()
+}
+
+func (p *Parser) parseFrames(d *direction, r io.Reader, timestamp time.Time, toServer bool) error {
+	for {
+		// Look at d.segments afresh for each frame, since the framing
+		// changes once the server has responded to STARTUP.
+		var src io.Reader = r
+		if d.segments != nil {
+			d.segments.r = r
+			src = d.segments
+		}
+		f, err := d.frames.next(src, p.options.MaxFrameSize, timestamp)
+		if err != nil {
+			return err
+		}
+		p.logger.Debug("Parsed frame", logrus.Fields{
+			"opcode":   opcodeNames[f.Opcode],
+			"stream":   f.Stream,
+			"length":   f.Length,
+			"toServer": toServer})
+		if f.Response == toServer {
+			return fmt.Errorf("Unexpected %s frame", opcodeNames[f.Opcode])
+		}
+		if toServer {
+			err = p.parseRequest(f)
+		} else {
+			err = p.parseResponse(f, timestamp)
+		}
+		if err != nil {
+			return err
+		}
+		if p.compressed {
+			return io.EOF
+		}
+	}
+}
+
+func (p *Parser) parseRequest(f *frame) error {
+	if f.Stream < 0 {
+		// Reserved for the server.
+		return nil
+	}
+	e := &Event{
+		ProtocolVersion: int(f.Version),
+		StreamID:        int(f.Stream),
+		Opcode:          opcodeNames[f.Opcode],
+		Keyspace:        p.keyspace,
+		Compressed:      f.Flags&FLAG_COMPRESSION != 0,
+		timestamp:       f.timestamp,
+	}
+	if old, ok := p.pending[f.Stream]; ok {
+		p.logger.Debug("Stream reused before response", logrus.Fields{
+			"stream": f.Stream,
+			"opcode": old.Opcode})
+	}
+	p.pending[f.Stream] = e
+	if e.Compressed {
+		return nil
+	}
+
+	r := newReader(f.body, f.Truncated)
+	if f.Flags&FLAG_CUSTOM_PAYLOAD != 0 {
+		r.BytesMap()
+	}
+	switch f.Opcode {
+	case OP_STARTUP:
+		p.compression = r.StringMap(false)["COMPRESSION"]
+	case OP_QUERY:
+		e.Query = r.LongString()
+		readQueryParameters(r, f.Version, e)
+	case OP_PREPARE:
+		e.Query = r.LongString()
+		if f.Version >= firstFramedVersion && r.Int()&PREPARE_KEYSPACE != 0 {
+			e.Keyspace = r.ShortString()
+		}
+	case OP_EXECUTE:
+		id := r.ShortBytes()
+		e.PreparedID = hex.EncodeToString(id)
+		if s, ok := p.statements[string(id)]; ok {
+			e.Query = s.query
+			if s.keyspace != "" {
+				e.Keyspace = s.keyspace
+			}
+		}
+		if f.Version >= firstFramedVersion {
+			r.ShortBytes() // result metadata ID
+		}
+		readQueryParameters(r, f.Version, e)
+	case OP_BATCH:
+		readBatch(r, f.Version, e)
+	}
+	return r.Err()
+}
+
+func readQueryParameters(r *reader, version byte, e *Event) {
+	e.Consistency = r.Consistency()
+	flags := r.QueryFlags(version)
+	if flags&QUERY_VALUES != 0 {
+		r.Values(int(r.Short()), flags&QUERY_NAMES_FOR_VALUES != 0)
+	}
+	if flags&QUERY_PAGE_SIZE != 0 {
+		e.PageSize = int(int32(r.Int()))
+	}
+	if flags&QUERY_PAGING_STATE != 0 {
+		r.Bytes()
+	}
+	if flags&QUERY_SERIAL_CONSISTENCY != 0 {
+		e.SerialConsistency = r.Consistency()
+	}
+	if flags&QUERY_DEFAULT_TIMESTAMP != 0 {
+		r.Skip(8)
+	}
+	if version >= firstFramedVersion && flags&QUERY_KEYSPACE != 0 {
+		e.Keyspace = r.ShortString()
+	}
+}
+
+func readBatch(r *reader, version byte, e *Event) {
+	e.BatchType = batchTypes[r.Byte()]
+	e.BatchStatements = int(r.Short())
+	for i := 0; i < e.BatchStatements && r.err == nil; i++ {
+		if r.Byte() == 0 {
+			r.LongString()
+		} else {
+			r.ShortBytes()
+		}
+		r.Values(int(r.Short()), false)
+	}
+	e.Consistency = r.Consistency()
+	flags := r.QueryFlags(version)
+	if flags&QUERY_SERIAL_CONSISTENCY != 0 {
+		e.SerialConsistency = r.Consistency()
+	}
+	if flags&QUERY_DEFAULT_TIMESTAMP != 0 {
+		r.Skip(8)
+	}
+	if version >= firstFramedVersion && flags&QUERY_KEYSPACE != 0 {
+		e.Keyspace = r.ShortString()
+	}
+}
+
+func (p *Parser) parseResponse(f *frame, timestamp time.Time) error {
+	if f.Stream < 0 || f.Opcode == OP_EVENT {
+		// Pushed to clients that asked for them with REGISTER.
+		metrics.Counter("cassandra.events").Add()
+		return nil
+	}
+	e, ok := p.pending[f.Stream]
+	if !ok {
+		return nil
+	}
+	delete(p.pending, f.Stream)
+	e.Response = opcodeNames[f.Opcode]
+	if f.Opcode == OP_READY || f.Opcode == OP_AUTHENTICATE {
+		p.startup(f)
+	}
+	var err error
+	if f.Flags&FLAG_COMPRESSION != 0 {
+		e.Compressed = true
+	} else {
+		err = p.readResponseBody(f, e)
+	}
+	p.requestDone(e, timestamp)
+	return err
+}
+
+// startup switches a protocol v5 connection to wrapping messages in frames
+// once the server has accepted the client's STARTUP. Versions of v5 from
+// before it was finalized, which clients opt into with the USE_BETA flag,
+// don't.
+func (p *Parser) startup(f *frame) {
+	if f.Version < firstFramedVersion || f.Flags&FLAG_USE_BETA != 0 {
+		return
+	}
+	if p.compression != "" {
+		p.logger.Debug("Connection uses compression", logrus.Fields{
+			"compression": p.compression})
+		metrics.Counter("cassandra.compressed_connections").Add()
+		p.compressed = true
+		p.pending = make(map[int16]*Event)
+		return
+	}
+	p.client.segments = &segmentReader{}
+	p.server.segments = &segmentReader{}
+}
+
+func (p *Parser) readResponseBody(f *frame, e *Event) error {
+	r := newReader(f.body, f.Truncated)
+	if f.Flags&FLAG_TRACING != 0 {
+		r.Skip(tracingIDLength)
+	}
+	if f.Flags&FLAG_WARNING != 0 {
+		e.Warnings = r.StringList()
+	}
+	if f.Flags&FLAG_CUSTOM_PAYLOAD != 0 {
+		r.BytesMap()
+	}
+	switch f.Opcode {
+	case OP_ERROR:
+		code := r.Int()
+		e.Error = true
+		e.ErrorCode = int(code)
+		e.ErrorName = errorNames[code]
+		e.ErrorMessage = r.ShortString()
+	case OP_RESULT:
+		kind := r.Int()
+		e.ResultKind = resultKinds[kind]
+		switch kind {
+		case RESULT_ROWS:
+			readRows(r, f.Version, e)
+		case RESULT_SET_KEYSPACE:
+			p.keyspace = r.ShortString()
+			e.Keyspace = p.keyspace
+		case RESULT_PREPARED:
+			id := r.ShortBytes()
+			if r.err == nil && e.Opcode == "PREPARE" {
+				e.PreparedID = hex.EncodeToString(id)
+				if len(p.statements) < maxStatements {
+					p.statements[string(id)] = statement{e.Query, e.Keyspace}
+				}
+			}
+		}
+	}
+	return r.Err()
+}
+
+// readRows reads the number of rows in a Rows result, which comes after
+// the metadata describing their columns.
+func readRows(r *reader, version byte, e *Event) {
+	flags := r.Int()
+	columns := int(int32(r.Int()))
+	if flags&ROWS_HAS_MORE_PAGES != 0 {
+		e.HasMorePages = true
+		r.Bytes()
+	}
+	if version >= firstFramedVersion && flags&ROWS_METADATA_CHANGED != 0 {
+		r.ShortBytes()
+	}
+	if flags&ROWS_NO_METADATA == 0 {
+		global := flags&ROWS_GLOBAL_TABLES_SPEC != 0
+		if global {
+			r.ShortString() // keyspace
+			r.ShortString() // table
+		}
+		for i := 0; i < columns && r.err == nil; i++ {
+			if !global {
+				r.ShortString()
+				r.ShortString()
+			}
+			r.ShortString() // name
+			r.Option(0)
+		}
+	}
+	e.RowsReturned = int(int32(r.Int()))
+}
+
+// requestDone publishes an event for a request once its response has
+// arrived.
+func (p *Parser) requestDone(e *Event, timestamp time.Time) {
+	e.EventType = "request"
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	if timestamp.After(e.timestamp) {
+		e.DurationMs = float64(timestamp.Sub(e.timestamp).Nanoseconds()) / 1e6
+	}
+	p.publisher.Publish(e, e.timestamp)
+	metrics.Counter("cassandra.requests_parsed").Add()
+}
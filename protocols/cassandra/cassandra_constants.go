@@ -0,0 +1,552 @@
+package cassandra
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// See https://github.com/apache/cassandra/tree/trunk/doc
+// (native_protocol_v3.spec through native_protocol_v5.spec)
+const (
+	headerLength        = 9
+	minProtocolVersion  = 3
+	maxProtocolVersion  = 5
+	firstFramedVersion  = 5 // Wraps messages in frames once connected
+	segmentHeaderLength = 6 // Uncompressed v5 frames
+	segmentCRCLength    = 4
+	tracingIDLength     = 16
+)
+
+// Opcodes
+const (
+	OP_ERROR          byte = 0x00
+	OP_STARTUP        byte = 0x01
+	OP_READY          byte = 0x02
+	OP_AUTHENTICATE   byte = 0x03
+	OP_OPTIONS        byte = 0x05
+	OP_SUPPORTED      byte = 0x06
+	OP_QUERY          byte = 0x07
+	OP_RESULT         byte = 0x08
+	OP_PREPARE        byte = 0x09
+	OP_EXECUTE        byte = 0x0A
+	OP_REGISTER       byte = 0x0B
+	OP_EVENT          byte = 0x0C
+	OP_BATCH          byte = 0x0D
+	OP_AUTH_CHALLENGE byte = 0x0E
+	OP_AUTH_RESPONSE  byte = 0x0F
+	OP_AUTH_SUCCESS   byte = 0x10
+)
+
+var opcodeNames = map[byte]string{
+	OP_ERROR:          "ERROR",
+	OP_STARTUP:        "STARTUP",
+	OP_READY:          "READY",
+	OP_AUTHENTICATE:   "AUTHENTICATE",
+	OP_OPTIONS:        "OPTIONS",
+	OP_SUPPORTED:      "SUPPORTED",
+	OP_QUERY:          "QUERY",
+	OP_RESULT:         "RESULT",
+	OP_PREPARE:        "PREPARE",
+	OP_EXECUTE:        "EXECUTE",
+	OP_REGISTER:       "REGISTER",
+	OP_EVENT:          "EVENT",
+	OP_BATCH:          "BATCH",
+	OP_AUTH_CHALLENGE: "AUTH_CHALLENGE",
+	OP_AUTH_RESPONSE:  "AUTH_RESPONSE",
+	OP_AUTH_SUCCESS:   "AUTH_SUCCESS",
+}
+
+// The high bit of the version byte is set on responses.
+const VERSION_RESPONSE byte = 0x80
+
+// Header flags
+const (
+	FLAG_COMPRESSION    byte = 0x01
+	FLAG_TRACING        byte = 0x02
+	FLAG_CUSTOM_PAYLOAD byte = 0x04
+	FLAG_WARNING        byte = 0x08
+	FLAG_USE_BETA       byte = 0x10
+)
+
+// Query parameter flags, which batches share. Protocol v5 widens them from
+// a byte to an int.
+const (
+	QUERY_VALUES             uint32 = 0x01
+	QUERY_SKIP_METADATA      uint32 = 0x02
+	QUERY_PAGE_SIZE          uint32 = 0x04
+	QUERY_PAGING_STATE       uint32 = 0x08
+	QUERY_SERIAL_CONSISTENCY uint32 = 0x10
+	QUERY_DEFAULT_TIMESTAMP  uint32 = 0x20
+	QUERY_NAMES_FOR_VALUES   uint32 = 0x40
+	QUERY_KEYSPACE           uint32 = 0x80 // v5
+	QUERY_NOW_IN_SECONDS     uint32 = 0x100
+)
+
+// PREPARE flags (v5)
+const PREPARE_KEYSPACE uint32 = 0x01
+
+// Result kinds
+const (
+	RESULT_VOID          uint32 = 0x0001
+	RESULT_ROWS          uint32 = 0x0002
+	RESULT_SET_KEYSPACE  uint32 = 0x0003
+	RESULT_PREPARED      uint32 = 0x0004
+	RESULT_SCHEMA_CHANGE uint32 = 0x0005
+)
+
+var resultKinds = map[uint32]string{
+	RESULT_VOID:          "void",
+	RESULT_ROWS:          "rows",
+	RESULT_SET_KEYSPACE:  "set_keyspace",
+	RESULT_PREPARED:      "prepared",
+	RESULT_SCHEMA_CHANGE: "schema_change",
+}
+
+// Rows metadata flags
+const (
+	ROWS_GLOBAL_TABLES_SPEC uint32 = 0x01
+	ROWS_HAS_MORE_PAGES     uint32 = 0x02
+	ROWS_NO_METADATA        uint32 = 0x04
+	ROWS_METADATA_CHANGED   uint32 = 0x08 // v5
+)
+
+// Column types with parameters; the rest are just an ID.
+const (
+	TYPE_CUSTOM uint16 = 0x0000
+	TYPE_LIST   uint16 = 0x0020
+	TYPE_MAP    uint16 = 0x0021
+	TYPE_SET    uint16 = 0x0022
+	TYPE_UDT    uint16 = 0x0030
+	TYPE_TUPLE  uint16 = 0x0031
+)
+
+var batchTypes = map[byte]string{
+	0: "logged",
+	1: "unlogged",
+	2: "counter",
+}
+
+var consistencyLevels = map[uint16]string{
+	0x0000: "ANY",
+	0x0001: "ONE",
+	0x0002: "TWO",
+	0x0003: "THREE",
+	0x0004: "QUORUM",
+	0x0005: "ALL",
+	0x0006: "LOCAL_QUORUM",
+	0x0007: "EACH_QUORUM",
+	0x0008: "SERIAL",
+	0x0009: "LOCAL_SERIAL",
+	0x000A: "LOCAL_ONE",
+}
+
+var errorNames = map[uint32]string{
+	0x0000: "server_error",
+	0x000A: "protocol_error",
+	0x0100: "bad_credentials",
+	0x1000: "unavailable",
+	0x1001: "overloaded",
+	0x1002: "is_bootstrapping",
+	0x1003: "truncate_error",
+	0x1100: "write_timeout",
+	0x1200: "read_timeout",
+	0x1300: "read_failure",
+	0x1400: "function_failure",
+	0x1500: "write_failure",
+	0x1600: "cdc_write_failure",
+	0x1700: "cas_write_unknown",
+	0x2000: "syntax_error",
+	0x2100: "unauthorized",
+	0x2200: "invalid",
+	0x2300: "config_error",
+	0x2400: "already_exists",
+	0x2500: "unprepared",
+}
+
+// Safety constraints:
+// Clients can have at most 32768 requests in flight per connection, since
+// stream IDs are signed shorts and negative ones are reserved for the
+// server, so the pending requests need no limit of their own.
+
+// Don't remember more than this many prepared statements per connection.
+const maxStatements = 1024
+
+// Don't accept frames longer than this, whatever the options say; the
+// server's own limit (native_transport_max_frame_size) is smaller.
+const maxFrameLength = 1 << 28
+
+// Don't follow column types nested more deeply than this.
+const maxTypeDepth = 32
+
+// frame is a protocol message (an "envelope" in v5 terms).
+type frame struct {
+	Version   byte // Without the direction bit
+	Response  bool
+	Flags     byte
+	Stream    int16
+	Opcode    byte
+	Length    int  // Length of the body
+	Truncated bool // Whether body holds only a prefix of the frame's body
+	body      []byte
+	timestamp time.Time // When the frame started to arrive
+}
+
+func parseHeader(b []byte) (*frame, error) {
+	f := &frame{
+		Version:  b[0] &^ VERSION_RESPONSE,
+		Response: b[0]&VERSION_RESPONSE != 0,
+		Flags:    b[1],
+		Stream:   int16(binary.BigEndian.Uint16(b[2:4])),
+		Opcode:   b[4],
+		Length:   int(binary.BigEndian.Uint32(b[5:9])),
+	}
+	if f.Version < minProtocolVersion || f.Version > maxProtocolVersion {
+		return nil, fmt.Errorf("Unsupported protocol version %d", f.Version)
+	}
+	if _, ok := opcodeNames[f.Opcode]; !ok {
+		return nil, fmt.Errorf("Bad opcode %#x", f.Opcode)
+	}
+	if f.Length < 0 || f.Length > maxFrameLength {
+		return nil, fmt.Errorf("Bad frame length %d", f.Length)
+	}
+	return f, nil
+}
+
+// frameAssembler reads frames from one direction of a connection. Frames
+// can be split across messages, since connections are multiplexed: the
+// client can send a request while the server is still sending a response,
+// which ends the message the response was part of. So the assembler keeps
+// the start of an incomplete frame until the rest arrives.
+type frameAssembler struct {
+	header    [headerLength]byte
+	headerLen int    // How much of header has arrived
+	frame     *frame // The frame being read, once its header has arrived
+	body      bytes.Buffer
+	remaining int       // Bytes of the body still to arrive
+	start     time.Time // When the frame started to arrive
+}
+
+// next reads the rest of the current frame from r, buffering at most
+// maxBodyLength bytes of its body. It returns io.EOF if r runs out first.
+func (a *frameAssembler) next(r io.Reader, maxBodyLength int, timestamp time.Time) (*frame, error) {
+	if a.frame == nil {
+		n, err := io.ReadFull(r, a.header[a.headerLen:])
+		if a.headerLen == 0 && n > 0 {
+			a.start = timestamp
+		}
+		a.headerLen += n
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		f, err := parseHeader(a.header[:])
+		if err != nil {
+			return nil, err
+		}
+		f.timestamp = a.start
+		a.frame = f
+		a.remaining = f.Length
+	}
+	for a.remaining > 0 {
+		toBuffer := maxBodyLength - a.body.Len()
+		if toBuffer > a.remaining {
+			toBuffer = a.remaining
+		}
+		var n int64
+		var err error
+		if toBuffer > 0 {
+			// Copying into a bytes.Buffer grows it as data actually
+			// arrives, rather than allocating based on the declared
+			// length up front.
+			n, err = io.CopyN(&a.body, r, int64(toBuffer))
+		} else {
+			n, err = io.CopyN(ioutil.Discard, r, int64(a.remaining))
+		}
+		a.remaining -= int(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f := a.frame
+	f.body = append([]byte(nil), a.body.Bytes()...)
+	f.Truncated = len(f.body) < f.Length
+	a.reset()
+	return f, nil
+}
+
+// idle reports whether no frame is partway through arriving.
+func (a *frameAssembler) idle() bool {
+	return a.headerLen == 0
+}
+
+func (a *frameAssembler) reset() {
+	a.headerLen = 0
+	a.frame = nil
+	a.body.Reset()
+	a.remaining = 0
+}
+
+// segmentReader unwraps the frames that protocol v5 puts messages in once
+// a connection is established (the server's code calls them segments, as
+// opposed to the envelopes inside). Each has a header with its payload's
+// length and a CRC24, and a CRC32 trailer; neither checksum is verified.
+// Like frameAssembler, it keeps its place across messages.
+type segmentReader struct {
+	r         io.Reader
+	header    [segmentHeaderLength]byte
+	headerLen int
+	payload   int // Bytes of the payload still to be read
+	trailer   int // Bytes of the trailer still to be skipped
+}
+
+func (s *segmentReader) Read(b []byte) (int, error) {
+	for s.payload == 0 {
+		if s.trailer > 0 {
+			n, err := io.CopyN(ioutil.Discard, s.r, int64(s.trailer))
+			s.trailer -= int(n)
+			if err != nil {
+				return 0, err
+			}
+		}
+		n, err := io.ReadFull(s.r, s.header[s.headerLen:])
+		s.headerLen += n
+		if err == io.ErrUnexpectedEOF {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		s.headerLen = 0
+		// The first three bytes are little-endian: 17 bits of payload
+		// length, then a flag saying whether the payload holds only whole
+		// envelopes, which doesn't matter when reading them as a stream.
+		h := uint32(s.header[0]) | uint32(s.header[1])<<8 | uint32(s.header[2])<<16
+		s.payload = int(h & 0x1FFFF)
+		s.trailer = segmentCRCLength
+	}
+	if len(b) > s.payload {
+		b = b[:s.payload]
+	}
+	n, err := s.r.Read(b)
+	s.payload -= n
+	return n, err
+}
+
+// idle reports whether no frame is partway through arriving.
+func (s *segmentReader) idle() bool {
+	return s.headerLen == 0 && s.payload == 0 && s.trailer == 0
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+var errTruncated = errors.New("Truncated frame")
+
+// reader wraps a frame body with convenience functions for parsing the
+// protocol's notation. Like the Postgres parser's reader, it stores the
+// first error it encounters, and callers must check reader.Err().
+type reader struct {
+	b         []byte
+	truncated bool // Whether the body is truncated
+	err       error
+}
+
+func newReader(body []byte, truncated bool) *reader {
+	return &reader{b: body, truncated: truncated}
+}
+
+// Err returns the error the reader encountered, if any. Running out of a
+// truncated body isn't an error; the fields that were cut off are just left
+// empty.
+func (r *reader) Err() error {
+	if r.err == errTruncated {
+		return nil
+	}
+	return r.err
+}
+
+func (r *reader) eof() error {
+	if r.truncated {
+		return errTruncated
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// take returns the next n bytes. If the body is truncated, it may return
+// fewer.
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 {
+		r.err = fmt.Errorf("Bad length %d", n)
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = r.eof()
+		b := r.b
+		r.b = nil
+		return b
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) Byte() byte {
+	if b := r.take(1); len(b) == 1 {
+		return b[0]
+	}
+	return 0
+}
+
+// Short reads an unsigned 16-bit integer.
+func (r *reader) Short() uint16 {
+	if b := r.take(2); len(b) == 2 {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// Int reads a 32-bit integer, which callers convert to int32 if it's
+// signed.
+func (r *reader) Int() uint32 {
+	if b := r.take(4); len(b) == 4 {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) Skip(n int) {
+	r.take(n)
+}
+
+// ShortString reads a [string], which has a short length.
+func (r *reader) ShortString() string {
+	return string(r.take(int(r.Short())))
+}
+
+// LongString reads a [long string], which has an int length.
+func (r *reader) LongString() string {
+	return string(r.take(int(int32(r.Int()))))
+}
+
+// ShortBytes reads [short bytes].
+func (r *reader) ShortBytes() []byte {
+	return r.take(int(r.Short()))
+}
+
+// Bytes reads [bytes] or a [value], which are null (or, for values, unset)
+// if the length is negative.
+func (r *reader) Bytes() []byte {
+	n := int32(r.Int())
+	if n < 0 {
+		return nil
+	}
+	return r.take(int(n))
+}
+
+// StringMap reads a [string map] or a [string multimap], depending on
+// whether multi is set.
+func (r *reader) StringMap(multi bool) map[string]string {
+	m := make(map[string]string)
+	n := int(r.Short())
+	for i := 0; i < n && r.err == nil; i++ {
+		k := r.ShortString()
+		if multi {
+			m[k] = ""
+			r.StringList()
+		} else {
+			m[k] = r.ShortString()
+		}
+	}
+	return m
+}
+
+// StringList reads a [string list], returning how many strings it held.
+func (r *reader) StringList() int {
+	n := int(r.Short())
+	for i := 0; i < n && r.err == nil; i++ {
+		r.ShortString()
+	}
+	return n
+}
+
+// BytesMap skips a [bytes map], as used for custom payloads.
+func (r *reader) BytesMap() {
+	n := int(r.Short())
+	for i := 0; i < n && r.err == nil; i++ {
+		r.ShortString()
+		r.Bytes()
+	}
+}
+
+// Values skips n [value]s, with names if names is set.
+func (r *reader) Values(n int, names bool) {
+	for i := 0; i < n && r.err == nil; i++ {
+		if names {
+			r.ShortString()
+		}
+		r.Bytes()
+	}
+}
+
+// Option skips a column type, which is an [option] whose value is further
+// types for collections, tuples and user-defined types.
+func (r *reader) Option(depth int) {
+	if depth > maxTypeDepth {
+		r.err = errors.New("Column type nested too deeply")
+		return
+	}
+	switch r.Short() {
+	case TYPE_CUSTOM:
+		r.ShortString()
+	case TYPE_LIST, TYPE_SET:
+		r.Option(depth + 1)
+	case TYPE_MAP:
+		r.Option(depth + 1)
+		r.Option(depth + 1)
+	case TYPE_UDT:
+		r.ShortString() // keyspace
+		r.ShortString() // type name
+		n := int(r.Short())
+		for i := 0; i < n && r.err == nil; i++ {
+			r.ShortString()
+			r.Option(depth + 1)
+		}
+	case TYPE_TUPLE:
+		n := int(r.Short())
+		for i := 0; i < n && r.err == nil; i++ {
+			r.Option(depth + 1)
+		}
+	}
+}
+
+// QueryFlags reads the flags of a QUERY, EXECUTE or BATCH.
+func (r *reader) QueryFlags(version byte) uint32 {
+	if version >= firstFramedVersion {
+		return r.Int()
+	}
+	return uint32(r.Byte())
+}
+
+// Consistency reads a [consistency] and returns its name.
+func (r *reader) Consistency() string {
+	c := r.Short()
+	if r.err != nil {
+		return ""
+	}
+	if name, ok := consistencyLevels[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("%#04x", c)
+}
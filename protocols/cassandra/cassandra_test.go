@@ -0,0 +1,402 @@
+package cassandra
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuery(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(4, false, 0, 3, OP_QUERY, concat(
+		longString("SELECT * FROM users WHERE id = ?"),
+		short(0x0006),
+		[]byte{byte(QUERY_VALUES | QUERY_PAGE_SIZE)},
+		short(1), cqlBytes([]byte{0, 0, 0, 42}),
+		integer(5000))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, 0, 3, OP_RESULT, concat(
+		integer(RESULT_ROWS),
+		integer(ROWS_GLOBAL_TABLES_SPEC), integer(2),
+		cqlString("app"), cqlString("users"),
+		cqlString("id"), short(0x0009),
+		cqlString("scores"), short(TYPE_MAP), short(0x000D), short(0x0009),
+		integer(1),
+		cqlBytes([]byte{0, 0, 0, 42}), cqlBytes([]byte{0, 0, 0, 0}))),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "request",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 1,
+			"protocol_version": 4,
+			"stream_id": 3,
+			"opcode": "QUERY",
+			"query": "SELECT * FROM users WHERE id = ?",
+			"consistency": "LOCAL_QUORUM",
+			"page_size": 5000,
+			"response": "RESULT",
+			"result_kind": "rows",
+			"rows_returned": 1,
+			"error": false
+		}`, string(tp.Output[0]))
+	}
+}
+
+func TestUseKeyspace(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genQuery(4, 1, "USE app"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, 0, 1, OP_RESULT, concat(integer(RESULT_SET_KEYSPACE), cqlString("app"))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genQuery(4, 2, "SELECT * FROM users"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, 0, 2, OP_RESULT, concat(
+		integer(RESULT_ROWS), integer(ROWS_NO_METADATA), integer(3), integer(0))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "set_keyspace", events[0]["result_kind"])
+		assert.Equal(t, "app", events[0]["keyspace"])
+		assert.Equal(t, "app", events[1]["keyspace"])
+		assert.Equal(t, float64(0), events[1]["rows_returned"])
+	}
+}
+
+func TestPrepareAndExecute(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	query := "INSERT INTO app.users (id, name) VALUES (?, ?)"
+	ms.Append(genFrame(4, false, 0, 1, OP_PREPARE, longString(query)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, 0, 1, OP_RESULT, concat(
+		integer(RESULT_PREPARED), shortBytes([]byte{0xab, 0xcd}),
+		// Metadata for the bound variables and the results, which are
+		// ignored.
+		integer(ROWS_GLOBAL_TABLES_SPEC), integer(2), integer(1), short(0),
+		cqlString("app"), cqlString("users"),
+		cqlString("id"), short(0x0009), cqlString("name"), short(0x000D),
+		integer(ROWS_NO_METADATA), integer(0))), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genFrame(4, false, 0, 2, OP_EXECUTE, concat(
+		shortBytes([]byte{0xab, 0xcd}),
+		short(0x0001), []byte{byte(QUERY_VALUES)},
+		short(2), cqlBytes([]byte{0, 0, 0, 1}), cqlBytes([]byte("alice")))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, 0, 2, OP_RESULT, integer(RESULT_VOID)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	// A statement prepared on another connection.
+	ms.Append(genFrame(4, false, 0, 3, OP_EXECUTE, concat(
+		shortBytes([]byte{0x12}), short(0x0001), []byte{0})), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, 0, 3, OP_ERROR, concat(
+		integer(0x2500), cqlString("Prepared query with ID 12 not found"), shortBytes([]byte{0x12}))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "PREPARE", events[0]["opcode"])
+		assert.Equal(t, "prepared", events[0]["result_kind"])
+		assert.Equal(t, "abcd", events[0]["prepared_id"])
+		assert.Equal(t, "EXECUTE", events[1]["opcode"])
+		assert.Equal(t, query, events[1]["query"])
+		assert.Equal(t, "abcd", events[1]["prepared_id"])
+		assert.Equal(t, "ONE", events[1]["consistency"])
+		assert.Equal(t, "void", events[1]["result_kind"])
+		assert.Nil(t, events[2]["query"])
+		assert.Equal(t, "12", events[2]["prepared_id"])
+		assert.Equal(t, true, events[2]["error"])
+		assert.Equal(t, "unprepared", events[2]["error_name"])
+	}
+}
+
+func TestOutOfOrderResponses(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genQuery(4, 1, "SELECT * FROM app.slow"),
+		genQuery(4, 2, "SELECT * FROM app.fast")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, 0, 2, OP_RESULT, integer(RESULT_VOID)),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	ms.Append(genFrame(4, true, 0, 1, OP_RESULT, integer(RESULT_VOID)),
+		sniffertest.DefaultDate().Add(5*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "SELECT * FROM app.fast", events[0]["query"])
+		assert.Equal(t, float64(1), events[0]["duration_ms"])
+		assert.Equal(t, "SELECT * FROM app.slow", events[1]["query"])
+		assert.Equal(t, float64(5), events[1]["duration_ms"])
+	}
+}
+
+func TestBatch(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(4, false, 0, 1, OP_BATCH, concat(
+		[]byte{0}, short(2),
+		[]byte{0}, longString("INSERT INTO app.users (id) VALUES (?)"), short(1), cqlBytes([]byte{0, 0, 0, 1}),
+		[]byte{1}, shortBytes([]byte{0xab, 0xcd}), short(0),
+		short(0x0004), []byte{byte(QUERY_SERIAL_CONSISTENCY | QUERY_DEFAULT_TIMESTAMP)},
+		short(0x0009), make([]byte, 8))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, 0, 1, OP_RESULT, integer(RESULT_VOID)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "BATCH", events[0]["opcode"])
+		assert.Equal(t, "logged", events[0]["batch_type"])
+		assert.Equal(t, float64(2), events[0]["batch_statements"])
+		assert.Equal(t, "QUORUM", events[0]["consistency"])
+		assert.Equal(t, "LOCAL_SERIAL", events[0]["serial_consistency"])
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genQuery(4, 1, "SELECT * FROM app.users"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, 0, 1, OP_ERROR, concat(
+		integer(0x1200), cqlString("Operation timed out - received only 1 responses."),
+		short(0x0006), integer(1), integer(2), []byte{0})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "ERROR", events[0]["response"])
+		assert.Equal(t, true, events[0]["error"])
+		assert.Equal(t, float64(0x1200), events[0]["error_code"])
+		assert.Equal(t, "read_timeout", events[0]["error_name"])
+		assert.Equal(t, "Operation timed out - received only 1 responses.", events[0]["error_message"])
+	}
+}
+
+func TestTracingAndWarnings(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(4, false, FLAG_TRACING, 1, OP_QUERY, concat(
+		longString("SELECT * FROM app.users"), short(0x0001), []byte{0})), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, FLAG_TRACING|FLAG_WARNING|FLAG_CUSTOM_PAYLOAD, 1, OP_RESULT, concat(
+		make([]byte, 16),
+		short(2), cqlString("Aggregation query used without partition key"), cqlString("Read 1000 live rows"),
+		short(1), cqlString("key"), cqlBytes([]byte("value")),
+		integer(RESULT_ROWS), integer(ROWS_NO_METADATA), integer(1), integer(7))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, float64(2), events[0]["warnings"])
+		assert.Equal(t, float64(7), events[0]["rows_returned"])
+	}
+}
+
+func TestFrameSplitAcrossMessages(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genQuery(4, 1, "SELECT * FROM app.users"), sniffertest.DefaultDate(), defaultFlow())
+	response := genFrame(4, true, 0, 1, OP_RESULT, concat(
+		integer(RESULT_ROWS), integer(ROWS_NO_METADATA), integer(1), integer(2),
+		cqlBytes(bytes.Repeat([]byte("a"), 100)), cqlBytes(bytes.Repeat([]byte("b"), 100))))
+	ms.Append(response[:5], sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	// The client sends another request while the response is arriving.
+	ms.Append(genQuery(4, 2, "SELECT * FROM app.items"), sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow())
+	ms.Append(concat(response[5:150]), sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	ms.Append(concat(response[150:], genFrame(4, true, 0, 2, OP_RESULT, integer(RESULT_VOID))),
+		sniffertest.DefaultDate().Add(4*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "SELECT * FROM app.users", events[0]["query"])
+		assert.Equal(t, float64(2), events[0]["rows_returned"])
+		assert.Equal(t, float64(4), events[0]["duration_ms"])
+		assert.Equal(t, "SELECT * FROM app.items", events[1]["query"])
+		assert.Equal(t, float64(2), events[1]["duration_ms"])
+	}
+}
+
+func TestProtocolV5Framing(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(5, false, 0, 0, OP_STARTUP, concat(
+		short(1), cqlString("CQL_VERSION"), cqlString("3.0.0"))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(5, true, 0, 0, OP_READY, nil), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	query := genFrame(5, false, 0, 1, OP_QUERY, concat(
+		longString("SELECT * FROM users"),
+		short(0x0001), integer(QUERY_KEYSPACE), cqlString("app")))
+	// A message can span frames.
+	ms.Append(concat(genSegment(query[:10]), genSegment(query[10:])), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genSegment(genFrame(5, true, 0, 1, OP_RESULT, concat(
+		integer(RESULT_ROWS), integer(ROWS_NO_METADATA|ROWS_METADATA_CHANGED), integer(1),
+		shortBytes([]byte{0x01}), integer(0)))), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "STARTUP", events[0]["opcode"])
+		assert.Equal(t, "READY", events[0]["response"])
+		assert.Equal(t, "QUERY", events[1]["opcode"])
+		assert.Equal(t, float64(5), events[1]["protocol_version"])
+		assert.Equal(t, "app", events[1]["keyspace"])
+		assert.Equal(t, "rows", events[1]["result_kind"])
+	}
+}
+
+func TestCompression(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(4, false, 0, 0, OP_STARTUP, concat(
+		short(2), cqlString("CQL_VERSION"), cqlString("3.0.0"), cqlString("COMPRESSION"), cqlString("lz4"))),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, 0, 0, OP_READY, nil), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	// Protocol v4 compresses frame bodies, but not headers.
+	ms.Append(genFrame(4, false, FLAG_COMPRESSION, 1, OP_QUERY, []byte{0xde, 0xad, 0xbe, 0xef}),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, FLAG_COMPRESSION, 1, OP_RESULT, []byte{0xde, 0xad}),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "QUERY", events[1]["opcode"])
+		assert.Equal(t, "RESULT", events[1]["response"])
+		assert.Equal(t, true, events[1]["compressed"])
+	}
+
+	// Protocol v5 compresses whole frames, so we give up.
+	tp = &sniffertest.Publisher{}
+	parser = newParser(tp)
+	ms = &sniffertest.MessageStream{}
+	ms.Append(genFrame(5, false, 0, 0, OP_STARTUP, concat(
+		short(1), cqlString("COMPRESSION"), cqlString("lz4"))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(5, true, 0, 0, OP_READY, nil), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a}, sniffertest.DefaultDate(), defaultFlow())
+	parser.On(ms)
+	assert.Equal(t, 1, len(tp.Output))
+}
+
+func TestServerEvents(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(4, false, 0, 1, OP_REGISTER, concat(short(1), cqlString("SCHEMA_CHANGE"))),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genFrame(4, true, 0, 1, OP_READY, nil),
+		genFrame(4, true, 0, -1, OP_EVENT, concat(
+			cqlString("SCHEMA_CHANGE"), cqlString("CREATED"), cqlString("KEYSPACE"), cqlString("app")))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "REGISTER", events[0]["opcode"])
+	}
+}
+
+func TestResyncAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genQuery(4, 1, "SELECT * FROM app.users"),
+		genQuery(4, 2, "SELECT * FROM app.items")), sniffertest.DefaultDate(), defaultFlow())
+	response := genFrame(4, true, 0, 1, OP_RESULT, integer(RESULT_VOID))
+	ms.AppendSkipped(response[3:], sniffertest.DefaultDate(), defaultFlow().Reverse(), 3)
+	ms.Append(genFrame(4, true, 0, 2, OP_RESULT, integer(RESULT_VOID)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "SELECT * FROM app.items", events[0]["query"])
+	}
+}
+
+func TestTruncatedQuery(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	pf := ParserFactory{
+		Options:   Options{Port: 9042, MaxFrameSize: 20},
+		Publisher: tp,
+	}
+	parser := pf.New(defaultFlow())
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genQuery(4, 1, "SELECT * FROM app.users WHERE id = 1"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(4, true, 0, 1, OP_RESULT, integer(RESULT_VOID)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "SELECT * FROM ap", events[0]["query"])
+		assert.Nil(t, events[0]["consistency"])
+	}
+}
+
+func genFrame(version byte, response bool, flags byte, stream int16, opcode byte, body []byte) []byte {
+	if response {
+		version |= VERSION_RESPONSE
+	}
+	return concat([]byte{version, flags}, short(uint16(stream)), []byte{opcode}, integer(uint32(len(body))), body)
+}
+
+func genQuery(version byte, stream int16, query string) []byte {
+	return genFrame(version, false, 0, stream, OP_QUERY, concat(longString(query), short(0x0001), []byte{0}))
+}
+
+// genSegment wraps payload in a protocol v5 frame, with dummy checksums.
+func genSegment(payload []byte) []byte {
+	h := uint32(len(payload)) | 1<<17
+	return concat([]byte{byte(h), byte(h >> 8), byte(h >> 16), 0, 0, 0}, payload, make([]byte, 4))
+}
+
+func short(n uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, n)
+	return b
+}
+
+func integer(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func cqlString(s string) []byte {
+	return concat(short(uint16(len(s))), []byte(s))
+}
+
+func longString(s string) []byte {
+	return concat(integer(uint32(len(s))), []byte(s))
+}
+
+func shortBytes(b []byte) []byte {
+	return concat(short(uint16(len(b))), b)
+}
+
+func cqlBytes(b []byte) []byte {
+	return concat(integer(uint32(len(b))), b)
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(9042)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		Options:   Options{Port: 9042, MaxFrameSize: 1048576},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
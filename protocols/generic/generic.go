@@ -0,0 +1,180 @@
+// Package generic times request/response protocols that we don't parse. It
+// treats each change of direction in a connection as a turn: what the client
+// sends until the server starts responding is a request, and what the server
+// sends until the client speaks again is its response. That's how most
+// protocols without pipelining behave, so turns approximate requests.
+package generic
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Ports []uint16 `long:"port" description:"Server port to time connections to; repeat for several ports. By default, all TCP traffic is timed, taking whoever sent the first packet seen as the client"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if !pf.isServerPort(flow.DstPort) && pf.isServerPort(flow.SrcPort) {
+		flow = flow.Reverse()
+	}
+	return &Parser{
+		flow:      flow,
+		logger:    logging.NewLogger(logrus.Fields{"flow": flow, "component": "generic"}),
+		publisher: pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	if len(pf.Options.Ports) == 0 {
+		return "tcp"
+	}
+	filters := make([]string, len(pf.Options.Ports))
+	for i, port := range pf.Options.Ports {
+		filters[i] = fmt.Sprintf("tcp port %d", port)
+	}
+	return strings.Join(filters, " or ")
+}
+
+func (pf *ParserFactory) isServerPort(port uint16) bool {
+	for _, p := range pf.Options.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	flow       sniffer.IPPortTuple // From the client to the server
+	turn       *Event              // The turn in progress
+	connection *Event              // Totals for the connection
+	logger     *logging.Logger
+	publisher  publish.Publisher
+}
+
+// Event describes a turn, or once a connection closes, the whole
+// connection.
+type Event struct {
+	// "turn" or "connection".
+	EventType  string `json:"event_type"`
+	ClientIP   string `json:"client_ip"`
+	ServerIP   string `json:"server_ip"`
+	ServerPort uint16 `json:"server_port"`
+	// For turns, the turn's number, starting at 1; for connections, how
+	// many turns there were.
+	Turn int `json:"turn"`
+	// For turns, the time from the start of the request to the first byte
+	// of the response; for connections, the time from the first message
+	// to the start of the last.
+	TimeToFirstByteMs float64 `json:"time_to_first_byte_ms,omitempty"`
+	DurationMs        float64 `json:"duration_ms,omitempty"`
+	RequestBytes      int64   `json:"request_bytes"`
+	ResponseBytes     int64   `json:"response_bytes"`
+	// Bytes lost to dropped packets, in either direction.
+	SkippedBytes int64 `json:"skipped_bytes,omitempty"`
+	// Whether the connection closed before the server responded.
+	NoResponse bool `json:"no_response,omitempty"`
+	timestamp  time.Time
+	responded  bool
+}
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.turn != nil {
+				p.turn.NoResponse = !p.turn.responded
+				p.publish(p.turn)
+			}
+			if p.connection != nil {
+				p.publish(p.connection)
+			}
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, m)
+		if n == 0 && m.Skipped() <= 0 {
+			continue
+		}
+		p.observe(m, n)
+	}
+}
+
+// observe adds a message of n bytes to the current turn, or starts a new
+// one if the client is speaking after the server responded. Messages end
+// whenever the direction changes, but also after skipped bytes, so several
+// messages in a row can go the same way.
+func (p *Parser) observe(m sniffer.Message, n int64) {
+	timestamp := m.Timestamp()
+	toServer := m.Flow().SrcPort == p.flow.SrcPort && m.Flow().DstPort == p.flow.DstPort
+	if p.connection == nil {
+		p.connection = p.newEvent("connection", timestamp)
+	}
+	p.connection.DurationMs = durationMs(p.connection.timestamp, timestamp)
+	if p.turn == nil || (toServer && p.turn.responded) {
+		if p.turn != nil {
+			p.publish(p.turn)
+		}
+		p.connection.Turn++
+		p.turn = p.newEvent("turn", timestamp)
+		p.turn.Turn = p.connection.Turn
+	}
+	if skipped := int64(m.Skipped()); skipped > 0 {
+		p.turn.SkippedBytes += skipped
+		p.connection.SkippedBytes += skipped
+	}
+	if toServer {
+		p.turn.RequestBytes += n
+		p.connection.RequestBytes += n
+		return
+	}
+	if !p.turn.responded {
+		// A server that speaks first, e.g. with a greeting, responds to
+		// nothing, so there's no time to report.
+		p.turn.responded = true
+		if p.turn.RequestBytes > 0 {
+			p.turn.TimeToFirstByteMs = durationMs(p.turn.timestamp, timestamp)
+		}
+	}
+	p.turn.ResponseBytes += n
+	p.connection.ResponseBytes += n
+}
+
+func (p *Parser) newEvent(eventType string, timestamp time.Time) *Event {
+	return &Event{
+		EventType:  eventType,
+		ClientIP:   p.flow.SrcIP.String(),
+		ServerIP:   p.flow.DstIP.String(),
+		ServerPort: p.flow.DstPort,
+		timestamp:  timestamp,
+	}
+}
+
+func durationMs(start, end time.Time) float64 {
+	if !end.After(start) {
+		return 0
+	}
+	return float64(end.Sub(start).Nanoseconds()) / 1e6
+}
+
+func (p *Parser) publish(e *Event) {
+	p.publisher.Publish(e, e.timestamp)
+	metrics.Counter("generic.events_parsed").Add()
+}
@@ -0,0 +1,137 @@
+package generic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTurns(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(make([]byte, 10), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(make([]byte, 100), sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow().Reverse())
+	ms.Append(make([]byte, 20), sniffertest.DefaultDate().Add(10*time.Millisecond), defaultFlow())
+	ms.Append(make([]byte, 200), sniffertest.DefaultDate().Add(15*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 3, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "turn",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"server_port": 7000,
+			"turn": 1,
+			"time_to_first_byte_ms": 2,
+			"request_bytes": 10,
+			"response_bytes": 100
+		}`, string(tp.Output[0]))
+		events := tp.Events()
+		assert.Equal(t, 2., events[1]["turn"])
+		assert.Equal(t, 5., events[1]["time_to_first_byte_ms"])
+		assert.Equal(t, 20., events[1]["request_bytes"])
+		assert.Equal(t, 200., events[1]["response_bytes"])
+		assert.Equal(t, "connection", events[2]["event_type"])
+		assert.Equal(t, 2., events[2]["turn"])
+		assert.Equal(t, 15., events[2]["duration_ms"])
+		assert.Equal(t, 30., events[2]["request_bytes"])
+		assert.Equal(t, 300., events[2]["response_bytes"])
+	}
+}
+
+func TestServerPortFromOptions(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	// The first packet seen is from the server.
+	parser := (&ParserFactory{
+		Options:   Options{Ports: []uint16{7000}},
+		Publisher: tp,
+	}).New(defaultFlow().Reverse())
+	ms := &sniffertest.MessageStream{}
+	ms.Append(make([]byte, 10), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(make([]byte, 100), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "10.0.0.23", events[0]["server_ip"])
+		assert.Equal(t, 7000., events[0]["server_port"])
+		assert.Equal(t, 10., events[0]["request_bytes"])
+	}
+}
+
+func TestServerSpeaksFirst(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("220 mail.example.com ESMTP\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("EHLO client\r\n"), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow())
+	ms.Append([]byte("250 OK\r\n"), sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, 0., events[0]["request_bytes"])
+		assert.Equal(t, 28., events[0]["response_bytes"])
+		assert.Nil(t, events[0]["time_to_first_byte_ms"])
+		assert.Equal(t, 2., events[1]["time_to_first_byte_ms"])
+	}
+}
+
+func TestSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	// Skipped bytes start a new message without changing direction.
+	ms.Append(make([]byte, 10), sniffertest.DefaultDate(), defaultFlow())
+	ms.AppendSkipped(make([]byte, 10), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow(), 1400)
+	ms.Append(make([]byte, 100), sniffertest.DefaultDate().Add(4*time.Millisecond), defaultFlow().Reverse())
+	ms.AppendSkipped(make([]byte, 100), sniffertest.DefaultDate().Add(5*time.Millisecond), defaultFlow().Reverse(), 1400)
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, 1., events[0]["turn"])
+		assert.Equal(t, 4., events[0]["time_to_first_byte_ms"])
+		assert.Equal(t, 20., events[0]["request_bytes"])
+		assert.Equal(t, 200., events[0]["response_bytes"])
+		assert.Equal(t, 2800., events[0]["skipped_bytes"])
+	}
+}
+
+func TestNoResponse(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(make([]byte, 10), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte{}, sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, true, events[0]["no_response"])
+		assert.Equal(t, 1., events[1]["turn"])
+	}
+}
+
+func TestEmptyConnection(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	parser.On(&sniffertest.MessageStream{})
+	assert.Equal(t, 0, len(tp.Output))
+}
+
+func TestBPFFilter(t *testing.T) {
+	pf := &ParserFactory{}
+	assert.Equal(t, "tcp", pf.BPFFilter())
+	pf.Options.Ports = []uint16{7000, 7001}
+	assert.Equal(t, "tcp port 7000 or tcp port 7001", pf.BPFFilter())
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(7000)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{Publisher: publisher}
+	return pf.New(defaultFlow())
+}
@@ -0,0 +1,514 @@
+// Package grpc parses gRPC, and HTTP/2 in general. Each RPC is a stream:
+// the client sends headers naming the method, then its messages, and the
+// server responds with headers, its messages, and trailers giving the
+// status. Streams are interleaved on the connection, and identified by the
+// stream ID in each frame's header.
+//
+// Headers are compressed with HPACK, which refers to a table of recently
+// sent headers that each side maintains for the headers it receives. So we
+// have to decode every header block, in order, to keep track of the
+// tables; once we've missed part of one, we can't decode any more headers
+// in that direction.
+package grpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"golang.org/x/net/http2/hpack"
+)
+
+type Options struct {
+	Port uint16 `long:"port" description:"gRPC (HTTP/2) server port" default:"50051"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if flow.DstPort != pf.Options.Port {
+		flow = flow.Reverse()
+	}
+	return &Parser{
+		options:   pf.Options,
+		flow:      flow,
+		client:    newHalf(),
+		server:    newHalf(),
+		streams:   make(map[uint32]*stream),
+		logger:    logging.NewLogger(logrus.Fields{"flow": flow, "component": "grpc"}),
+		publisher: pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	return fmt.Sprintf("tcp port %d", pf.Options.Port)
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	options   Options
+	flow      sniffer.IPPortTuple
+	client    *half
+	server    *half
+	streams   map[uint32]*stream // Open streams, by ID
+	preface   int                // How much of the client preface has arrived
+	tls       *tls.Connection
+	logger    *logging.Logger
+	publisher publish.Publisher
+}
+
+// half holds the state of one direction of a connection.
+type half struct {
+	frames frameAssembler
+	// Decodes the header blocks sent in this direction.
+	decoder *hpack.Decoder
+	// A header block continued by CONTINUATION frames.
+	headerBlock    bytes.Buffer
+	headerFrame    *frame // The HEADERS or PUSH_PROMISE frame that started it
+	headerFragment bool   // Whether a header block is being continued
+	// Whether we missed part of a header block, so that the decoder's
+	// table is out of date.
+	hpackLost bool
+}
+
+func newHalf() *half {
+	return &half{decoder: hpack.NewDecoder(defaultHeaderTableSize, nil)}
+}
+
+// stream is an open stream.
+type stream struct {
+	event            Event
+	grpc             bool // Whether the stream is an RPC
+	requestMessages  messageCounter
+	responseMessages messageCounter
+	responseHeaders  bool // Whether the response headers have arrived
+}
+
+// Event describes an RPC, or for other HTTP/2 traffic, a request and its
+// response.
+type Event struct {
+	EventType  string  `json:"event_type"`
+	ClientIP   string  `json:"client_ip"`
+	ServerIP   string  `json:"server_ip"`
+	DurationMs float64 `json:"duration_ms"`
+	StreamID   uint32  `json:"stream_id"`
+	// The path, e.g. "/etcdserverpb.KV/Range", and for RPCs, the service
+	// and method it names.
+	Path        string `json:"path,omitempty"`
+	Service     string `json:"service,omitempty"`
+	Method      string `json:"method,omitempty"`
+	HTTPMethod  string `json:"http_method,omitempty"`
+	Authority   string `json:"authority,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+	// The deadline the client gave, from grpc-timeout, and the compression
+	// used for messages, from grpc-encoding.
+	TimeoutMs float64 `json:"grpc_timeout_ms,omitempty"`
+	Encoding  string  `json:"grpc_encoding,omitempty"`
+	// The messages and bytes in each direction. Bytes are the lengths of
+	// DATA frames, which include gRPC's 5-byte message prefixes; messages
+	// are only counted for RPCs.
+	RequestMessages  int `json:"request_messages,omitempty"`
+	RequestBytes     int `json:"request_bytes,omitempty"`
+	ResponseMessages int `json:"response_messages,omitempty"`
+	ResponseBytes    int `json:"response_bytes,omitempty"`
+	HTTPStatus       int `json:"http_status,omitempty"`
+	// e.g. "OK" or "NOT_FOUND", and its code.
+	GRPCStatus     string `json:"grpc_status,omitempty"`
+	GRPCStatusCode int    `json:"grpc_status_code,omitempty"`
+	GRPCMessage    string `json:"grpc_message,omitempty"`
+	// If the stream was reset with RST_STREAM: by "client" or "server",
+	// and the error code, e.g. "CANCEL".
+	ResetBy   string `json:"reset_by,omitempty"`
+	ResetCode string `json:"reset_code,omitempty"`
+	// Whether the connection closed before the stream did.
+	Incomplete bool `json:"incomplete,omitempty"`
+	Error      bool `json:"error"`
+	timestamp  time.Time
+}
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
+			for id, s := range p.streams {
+				s.event.Incomplete = true
+				p.publish(s, time.Time{})
+				delete(p.streams, id)
+			}
+			return
+		}
+		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		h := p.server
+		if toServer {
+			h = p.client
+		}
+		if m.Skipped() > 0 {
+			// The message most likely starts partway through a frame;
+			// the next one in this direction should start afresh.
+			p.desynchronize(h, "skipped bytes")
+			io.Copy(ioutil.Discard, m)
+			continue
+		}
+		br := bufio.NewReader(m)
+		if toServer && h.frames.idle() {
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				p.logger.Debug("Connection uses TLS", logrus.Fields{})
+				p.streams = make(map[uint32]*stream)
+				p.tls = tls.NewConnection("grpc", p.flow, m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), toServer)
+				continue
+			}
+			if p.preface < len(clientPreface) {
+				p.skipPreface(br)
+			}
+		}
+		err := p.parseFrames(h, br, m.Timestamp(), toServer)
+		if err != io.EOF {
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("grpc.parse_errors").Add()
+			p.desynchronize(h, err.Error())
+			io.Copy(ioutil.Discard, br)
+		}
+	}
+}
+
+// skipPreface skips the client connection preface, which may be split
+// across messages. If the connection doesn't start with one, we must have
+// missed the start of it.
+func (p *Parser) skipPreface(br *bufio.Reader) {
+	b, _ := br.Peek(len(clientPreface) - p.preface)
+	if len(b) == 0 {
+		return
+	}
+	if string(b) != clientPreface[p.preface:p.preface+len(b)] {
+		p.preface = len(clientPreface)
+		return
+	}
+	br.Discard(len(b))
+	p.preface += len(b)
+}
+
+// desynchronize forgets about any partial frame in one direction once we
+// can no longer tell where frames start. If we miss a header block, we
+// can't decode headers in that direction any more, and since we can't tell
+// whether we did, we assume the worst.
+func (p *Parser) desynchronize(h *half, reason string) {
+	p.logger.Debug("Stream desynchronized", logrus.Fields{"reason": reason})
+	metrics.Counter("grpc.desyncs").Add()
+	h.frames.reset()
+	h.headerBlock.Reset()
+	h.headerFragment = false
+	p.loseHPACK(h)
+}
+
+func (p *Parser) loseHPACK(h *half) {
+	if !h.hpackLost {
+		metrics.Counter("grpc.hpack_lost").Add()
+	}
+	h.hpackLost = true
+}
+
+func (p *Parser) parseFrames(h *half, r io.Reader, timestamp time.Time, toServer bool) error {
+	for {
+		f, err := h.frames.next(r, timestamp)
+		if err != nil {
+			return err
+		}
+		p.logger.Debug("Parsed frame", logrus.Fields{
+			"type":     f.Type,
+			"stream":   f.StreamID,
+			"length":   f.Length,
+			"toServer": toServer})
+		if h.headerFragment && f.Type != FRAME_CONTINUATION {
+			return fmt.Errorf("Expected CONTINUATION, got frame type %d", f.Type)
+		}
+		switch f.Type {
+		case FRAME_HEADERS, FRAME_PUSH_PROMISE, FRAME_CONTINUATION:
+			err = p.parseHeaderFrame(h, f, timestamp, toServer)
+		case FRAME_DATA:
+			err = p.parseData(f, timestamp, toServer)
+		case FRAME_RST_STREAM:
+			p.parseReset(f, timestamp, toServer)
+		case FRAME_SETTINGS:
+			p.parseSettings(f, toServer)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseHeaderFrame collects a header block from HEADERS or PUSH_PROMISE
+// and any CONTINUATION frames, then decodes it.
+func (p *Parser) parseHeaderFrame(h *half, f *frame, timestamp time.Time, toServer bool) error {
+	var fragment []byte
+	switch f.Type {
+	case FRAME_HEADERS:
+		fields := 0
+		if f.has(FLAG_PRIORITY) {
+			fields = 5 // stream dependency and weight
+		}
+		var err error
+		fragment, _, err = payload(f, fields)
+		if err != nil {
+			return err
+		}
+		h.headerFrame = f
+	case FRAME_PUSH_PROMISE:
+		var err error
+		fragment, _, err = payload(f, 4) // promised stream ID
+		if err != nil {
+			return err
+		}
+		h.headerFrame = f
+	case FRAME_CONTINUATION:
+		if !h.headerFragment {
+			return fmt.Errorf("Unexpected CONTINUATION")
+		}
+		fragment = f.body
+	}
+	if f.Truncated {
+		p.loseHPACK(h)
+	}
+	if !h.hpackLost {
+		if h.headerBlock.Len()+len(fragment) > maxHeaderBlockLength {
+			p.loseHPACK(h)
+			h.headerBlock.Reset()
+		} else {
+			h.headerBlock.Write(fragment)
+		}
+	}
+	if !f.has(FLAG_END_HEADERS) {
+		h.headerFragment = true
+		return nil
+	}
+	h.headerFragment = false
+	var headers []hpack.HeaderField
+	if !h.hpackLost {
+		var err error
+		headers, err = h.decoder.DecodeFull(h.headerBlock.Bytes())
+		if err != nil {
+			p.logger.Debug("Error decoding headers", logrus.Fields{"error": err})
+			p.loseHPACK(h)
+		}
+	}
+	h.headerBlock.Reset()
+	if h.headerFrame.Type == FRAME_HEADERS {
+		p.headers(h.headerFrame, headers, timestamp, toServer)
+	}
+	return nil
+}
+
+// headers handles the headers or trailers sent on a stream.
+func (p *Parser) headers(f *frame, headers []hpack.HeaderField, timestamp time.Time, toServer bool) {
+	s, ok := p.streams[f.StreamID]
+	if toServer && !ok {
+		if len(p.streams) >= maxStreams {
+			p.logger.Debug("Too many open streams", logrus.Fields{})
+			metrics.Counter("grpc.streams_dropped").Add()
+			return
+		}
+		s = &stream{event: Event{
+			StreamID:  f.StreamID,
+			timestamp: f.timestamp,
+		}}
+		p.streams[f.StreamID] = s
+		requestHeaders(s, headers)
+	} else if !ok {
+		metrics.Counter("grpc.unmatched_streams").Add()
+		return
+	} else if !toServer {
+		if !s.responseHeaders {
+			s.responseHeaders = true
+			if status, err := strconv.Atoi(header(headers, ":status")); err == nil {
+				s.event.HTTPStatus = status
+			}
+		}
+		// The status is in the trailers, or in the headers if there's no
+		// response message.
+		if status := header(headers, "grpc-status"); status != "" {
+			setStatus(&s.event, status)
+		}
+		if message := header(headers, "grpc-message"); message != "" {
+			// Percent-encoded
+			if unescaped, err := url.PathUnescape(message); err == nil {
+				message = unescaped
+			}
+			s.event.GRPCMessage = message
+		}
+	}
+	if !toServer && f.has(FLAG_END_STREAM) {
+		p.streamDone(s, timestamp)
+	}
+}
+
+func requestHeaders(s *stream, headers []hpack.HeaderField) {
+	e := &s.event
+	e.Path = header(headers, ":path")
+	e.HTTPMethod = header(headers, ":method")
+	e.Authority = header(headers, ":authority")
+	e.ContentType = header(headers, "content-type")
+	e.UserAgent = header(headers, "user-agent")
+	e.Encoding = header(headers, "grpc-encoding")
+	s.grpc = strings.HasPrefix(e.ContentType, "application/grpc")
+	if !s.grpc {
+		return
+	}
+	// "/package.Service/Method"
+	if parts := strings.Split(e.Path, "/"); len(parts) == 3 && parts[0] == "" {
+		e.Service = parts[1]
+		e.Method = parts[2]
+	}
+	e.TimeoutMs = parseTimeout(header(headers, "grpc-timeout"))
+}
+
+// header returns the value of a header, or "" if it's missing.
+func header(headers []hpack.HeaderField, name string) string {
+	for _, h := range headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// parseTimeout parses a grpc-timeout header, e.g. "100m", into
+// milliseconds. It returns 0 if the header is missing or malformed.
+func parseTimeout(timeout string) float64 {
+	if len(timeout) < 2 {
+		return 0
+	}
+	unit, ok := timeoutUnits[timeout[len(timeout)-1]]
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseInt(timeout[:len(timeout)-1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return float64(n) * float64(unit) / float64(time.Millisecond)
+}
+
+func setStatus(e *Event, status string) {
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return
+	}
+	e.GRPCStatusCode = code
+	e.GRPCStatus = statusNames[code]
+	if e.GRPCStatus == "" {
+		e.GRPCStatus = status
+	}
+}
+
+func (p *Parser) parseData(f *frame, timestamp time.Time, toServer bool) error {
+	data, length, err := payload(f, 0)
+	if err != nil {
+		return err
+	}
+	s, ok := p.streams[f.StreamID]
+	if !ok {
+		return nil
+	}
+	if toServer {
+		s.event.RequestBytes += length
+		if s.grpc {
+			s.requestMessages.add(data, length)
+		}
+	} else {
+		s.event.ResponseBytes += length
+		if s.grpc {
+			s.responseMessages.add(data, length)
+		}
+		if f.has(FLAG_END_STREAM) {
+			p.streamDone(s, timestamp)
+		}
+	}
+	return nil
+}
+
+func (p *Parser) parseReset(f *frame, timestamp time.Time, toServer bool) {
+	s, ok := p.streams[f.StreamID]
+	if !ok || len(f.body) < 4 {
+		return
+	}
+	s.event.ResetBy = "server"
+	if toServer {
+		s.event.ResetBy = "client"
+	}
+	s.event.ResetCode = errorCodeName(binary.BigEndian.Uint32(f.body))
+	p.streamDone(s, timestamp)
+}
+
+// parseSettings applies a change to the size of the HPACK table to the
+// decoder for headers sent by the peer: a client's SETTINGS limit the table
+// the server encodes its headers with, and vice versa.
+func (p *Parser) parseSettings(f *frame, toServer bool) {
+	if f.has(FLAG_ACK) {
+		return
+	}
+	h := p.server
+	if !toServer {
+		h = p.client
+	}
+	for b := f.body; len(b) >= 6; b = b[6:] {
+		if binary.BigEndian.Uint16(b) == SETTINGS_HEADER_TABLE_SIZE {
+			h.decoder.SetAllowedMaxDynamicTableSize(binary.BigEndian.Uint32(b[2:]))
+		}
+	}
+}
+
+func (p *Parser) streamDone(s *stream, timestamp time.Time) {
+	delete(p.streams, s.event.StreamID)
+	p.publish(s, timestamp)
+}
+
+func (p *Parser) publish(s *stream, timestamp time.Time) {
+	e := &s.event
+	if s.grpc {
+		e.EventType = "rpc"
+		e.RequestMessages = s.requestMessages.messages
+		e.ResponseMessages = s.responseMessages.messages
+		e.Error = e.GRPCStatusCode != 0 || e.HTTPStatus != 0 && e.HTTPStatus != 200
+	} else {
+		e.EventType = "request"
+		e.Error = e.HTTPStatus >= 500
+	}
+	if e.ResetCode != "" && e.ResetCode != "NO_ERROR" {
+		e.Error = true
+	}
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	if timestamp.After(e.timestamp) {
+		e.DurationMs = float64(timestamp.Sub(e.timestamp).Nanoseconds()) / 1e6
+	}
+	p.publisher.Publish(e, e.timestamp)
+	metrics.Counter("grpc.requests_parsed").Add()
+}
@@ -0,0 +1,288 @@
+package grpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// See RFC 7540 for HTTP/2, RFC 7541 for HPACK, and
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md for how
+// gRPC uses them.
+
+// The client connection preface, which precedes the client's frames.
+const clientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const frameHeaderLength = 9
+
+// Frame types
+const (
+	FRAME_DATA          byte = 0x0
+	FRAME_HEADERS       byte = 0x1
+	FRAME_PRIORITY      byte = 0x2
+	FRAME_RST_STREAM    byte = 0x3
+	FRAME_SETTINGS      byte = 0x4
+	FRAME_PUSH_PROMISE  byte = 0x5
+	FRAME_PING          byte = 0x6
+	FRAME_GOAWAY        byte = 0x7
+	FRAME_WINDOW_UPDATE byte = 0x8
+	FRAME_CONTINUATION  byte = 0x9
+)
+
+// Frame flags
+const (
+	FLAG_END_STREAM  byte = 0x1
+	FLAG_ACK         byte = 0x1
+	FLAG_END_HEADERS byte = 0x4
+	FLAG_PADDED      byte = 0x8
+	FLAG_PRIORITY    byte = 0x20
+)
+
+// Settings
+const (
+	SETTINGS_HEADER_TABLE_SIZE uint16 = 0x1
+)
+
+// The size of the HPACK dynamic table until SETTINGS say otherwise.
+const defaultHeaderTableSize = 4096
+
+var errorCodeNames = map[uint32]string{
+	0x0: "NO_ERROR",
+	0x1: "PROTOCOL_ERROR",
+	0x2: "INTERNAL_ERROR",
+	0x3: "FLOW_CONTROL_ERROR",
+	0x4: "SETTINGS_TIMEOUT",
+	0x5: "STREAM_CLOSED",
+	0x6: "FRAME_SIZE_ERROR",
+	0x7: "REFUSED_STREAM",
+	0x8: "CANCEL",
+	0x9: "COMPRESSION_ERROR",
+	0xa: "CONNECT_ERROR",
+	0xb: "ENHANCE_YOUR_CALM",
+	0xc: "INADEQUATE_SECURITY",
+	0xd: "HTTP_1_1_REQUIRED",
+}
+
+func errorCodeName(code uint32) string {
+	if name, ok := errorCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", code)
+}
+
+var statusNames = map[int]string{
+	0:  "OK",
+	1:  "CANCELLED",
+	2:  "UNKNOWN",
+	3:  "INVALID_ARGUMENT",
+	4:  "DEADLINE_EXCEEDED",
+	5:  "NOT_FOUND",
+	6:  "ALREADY_EXISTS",
+	7:  "PERMISSION_DENIED",
+	8:  "RESOURCE_EXHAUSTED",
+	9:  "FAILED_PRECONDITION",
+	10: "ABORTED",
+	11: "OUT_OF_RANGE",
+	12: "UNIMPLEMENTED",
+	13: "INTERNAL",
+	14: "UNAVAILABLE",
+	15: "DATA_LOSS",
+	16: "UNAUTHENTICATED",
+}
+
+// grpc-timeout units
+var timeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// The length of the prefix of each gRPC message: a compressed flag and the
+// message's length.
+const messagePrefixLength = 5
+
+// Safety constraints:
+// Don't buffer more than this much of a frame. Frames are at most 16KB
+// unless SETTINGS_MAX_FRAME_SIZE allows more.
+const maxBufferedLength = 1 << 20
+
+// Don't buffer header blocks longer than this. Servers typically limit
+// them to 16KB with SETTINGS_MAX_HEADER_LIST_SIZE.
+const maxHeaderBlockLength = 1 << 20
+
+// Don't track more than this many open streams per connection; servers
+// typically allow 100 to 1000 concurrent streams.
+const maxStreams = 1024
+
+// frame is a frame, without its header.
+type frame struct {
+	Type      byte
+	Flags     byte
+	StreamID  uint32
+	Length    int  // Length of the payload
+	Truncated bool // Whether body holds only a prefix of the payload
+	body      []byte
+	timestamp time.Time // When the frame started to arrive
+}
+
+func (f *frame) has(flag byte) bool {
+	return f.Flags&flag != 0
+}
+
+// frameAssembler reads frames from one direction of a connection, keeping
+// the start of an incomplete frame until the rest arrives.
+type frameAssembler struct {
+	header    [frameHeaderLength]byte
+	headerLen int    // How much of the header has arrived
+	frame     *frame // The frame being read, once its header has arrived
+	body      bytes.Buffer
+	remaining int       // Bytes of the payload still to arrive
+	start     time.Time // When the frame started to arrive
+}
+
+// next reads the rest of the current frame from r. It returns io.EOF if r
+// runs out first.
+func (a *frameAssembler) next(r io.Reader, timestamp time.Time) (*frame, error) {
+	if a.frame == nil {
+		n, err := io.ReadFull(r, a.header[a.headerLen:])
+		if a.headerLen == 0 && n > 0 {
+			a.start = timestamp
+		}
+		a.headerLen += n
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		length := int(a.header[0])<<16 | int(a.header[1])<<8 | int(a.header[2])
+		a.frame = &frame{
+			Type:      a.header[3],
+			Flags:     a.header[4],
+			StreamID:  binary.BigEndian.Uint32(a.header[5:]) & 0x7fffffff,
+			Length:    length,
+			timestamp: a.start,
+		}
+		a.remaining = length
+	}
+	for a.remaining > 0 {
+		toBuffer := maxBufferedLength - a.body.Len()
+		if toBuffer > a.remaining {
+			toBuffer = a.remaining
+		}
+		var n int64
+		var err error
+		if toBuffer > 0 {
+			// Copying into a bytes.Buffer grows it as data actually
+			// arrives, rather than allocating based on the declared
+			// length up front.
+			n, err = io.CopyN(&a.body, r, int64(toBuffer))
+		} else {
+			n, err = io.CopyN(ioutil.Discard, r, int64(a.remaining))
+		}
+		a.remaining -= int(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f := a.frame
+	f.body = append([]byte(nil), a.body.Bytes()...)
+	f.Truncated = len(f.body) < f.Length
+	a.reset()
+	return f, nil
+}
+
+// idle reports whether no frame is partway through arriving.
+func (a *frameAssembler) idle() bool {
+	return a.headerLen == 0
+}
+
+func (a *frameAssembler) reset() {
+	a.headerLen = 0
+	a.frame = nil
+	a.body.Reset()
+	a.remaining = 0
+}
+
+var errBadPadding = errors.New("Bad padding")
+
+// payload returns the part of a DATA, HEADERS or PUSH_PROMISE frame's body
+// after the padding length and the given number of bytes of other fields,
+// without the padding, along with its length, which may be more than was
+// buffered.
+func payload(f *frame, fields int) ([]byte, int, error) {
+	b := f.body
+	length := f.Length
+	padding := 0
+	if f.has(FLAG_PADDED) {
+		if len(b) < 1 {
+			return nil, 0, errBadPadding
+		}
+		padding = int(b[0])
+		b = b[1:]
+		length--
+	}
+	if len(b) < fields {
+		return nil, 0, fmt.Errorf("Frame too short: %d bytes", f.Length)
+	}
+	b = b[fields:]
+	length -= fields + padding
+	if length < 0 {
+		return nil, 0, errBadPadding
+	}
+	if len(b) > length {
+		b = b[:length]
+	}
+	return b, length, nil
+}
+
+// messageCounter counts the gRPC messages sent in one direction of a
+// stream, by following their length prefixes through the DATA frames.
+type messageCounter struct {
+	prefix    [messagePrefixLength]byte
+	prefixLen int // How much of the next message's prefix has arrived
+	remaining int // Bytes of the current message still to arrive
+	messages  int
+	// Whether a prefix was lost to truncation, so that we can't tell where
+	// messages start any more.
+	lost bool
+}
+
+// add counts the messages that start in a DATA frame's payload, of which b
+// is the part that was buffered, and length the whole.
+func (c *messageCounter) add(b []byte, length int) {
+	for length > 0 && !c.lost {
+		if c.remaining > 0 {
+			n := c.remaining
+			if n > length {
+				n = length
+			}
+			c.remaining -= n
+			length -= n
+			if n > len(b) {
+				n = len(b)
+			}
+			b = b[n:]
+			continue
+		}
+		if len(b) == 0 {
+			c.lost = true
+			return
+		}
+		n := copy(c.prefix[c.prefixLen:], b)
+		c.prefixLen += n
+		b = b[n:]
+		length -= n
+		if c.prefixLen == messagePrefixLength {
+			c.prefixLen = 0
+			c.messages++
+			c.remaining = int(binary.BigEndian.Uint32(c.prefix[1:]))
+		}
+	}
+}
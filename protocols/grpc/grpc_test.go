@@ -0,0 +1,438 @@
+package grpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestUnaryRPC(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client, server := newEncoder(), newEncoder()
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		[]byte(clientPreface),
+		genFrame(FRAME_SETTINGS, 0, 0, nil),
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, client.encode(
+			rpcHeaders("/etcdserverpb.KV/Range", "grpc-timeout", "250m")...)),
+		genFrame(FRAME_DATA, FLAG_END_STREAM, 1, grpcMessage(20))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genFrame(FRAME_SETTINGS, 0, 0, nil),
+		genFrame(FRAME_SETTINGS, FLAG_ACK, 0, nil),
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, server.encode(
+			":status", "200", "content-type", "application/grpc")),
+		genFrame(FRAME_DATA, 0, 1, grpcMessage(100)),
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 1, server.encode(
+			"grpc-status", "0"))), sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "rpc",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 3,
+			"stream_id": 1,
+			"path": "/etcdserverpb.KV/Range",
+			"service": "etcdserverpb.KV",
+			"method": "Range",
+			"http_method": "POST",
+			"authority": "etcd:2379",
+			"content_type": "application/grpc",
+			"user_agent": "grpc-go/1.60.0",
+			"grpc_timeout_ms": 250,
+			"request_messages": 1,
+			"request_bytes": 25,
+			"response_messages": 1,
+			"response_bytes": 105,
+			"http_status": 200,
+			"grpc_status": "OK",
+			"error": false
+		}`, string(tp.Output[0]))
+	}
+}
+
+func TestDynamicTable(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client, server := newEncoder(), newEncoder()
+	first := client.encode(rpcHeaders("/kv.Store/Get")...)
+	second := client.encode(rpcHeaders("/kv.Store/Put")...)
+	// The second request's headers mostly refer to the first's.
+	assert.True(t, len(second) < len(first)/2)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		[]byte(clientPreface),
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, first),
+		genFrame(FRAME_DATA, FLAG_END_STREAM, 1, grpcMessage(1)),
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 3, second),
+		genFrame(FRAME_DATA, FLAG_END_STREAM, 3, grpcMessage(1))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 1, server.encode(
+			":status", "200", "content-type", "application/grpc", "grpc-status", "0")),
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 3, server.encode(
+			":status", "200", "content-type", "application/grpc", "grpc-status", "0"))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "Get", events[0]["method"])
+		assert.Equal(t, "Put", events[1]["method"])
+		assert.Equal(t, "kv.Store", events[1]["service"])
+		assert.Equal(t, float64(200), events[1]["http_status"])
+		assert.Equal(t, "OK", events[1]["grpc_status"])
+	}
+}
+
+func TestHeaderTableSizeSetting(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client, server := newEncoder(), newEncoder()
+	// The client lets the server use a larger table, which the server's
+	// encoder announces at the start of its first header block.
+	server.enc.SetMaxDynamicTableSizeLimit(65536)
+	server.enc.SetMaxDynamicTableSize(65536)
+	settings := concat([]byte{0, byte(SETTINGS_HEADER_TABLE_SIZE)}, uint32b(65536))
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		[]byte(clientPreface),
+		genFrame(FRAME_SETTINGS, 0, 0, settings),
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, client.encode(rpcHeaders("/kv.Store/Get")...)),
+		genFrame(FRAME_DATA, FLAG_END_STREAM, 1, grpcMessage(1))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genFrame(FRAME_SETTINGS, FLAG_ACK, 0, nil),
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 1, server.encode(
+			":status", "200", "content-type", "application/grpc", "grpc-status", "0"))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "Get", events[0]["method"])
+		assert.Equal(t, float64(200), events[0]["http_status"])
+		assert.Equal(t, "OK", events[0]["grpc_status"])
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client, server := newEncoder(), newEncoder()
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, client.encode(rpcHeaders("/kv.Store/Get")...)),
+		genFrame(FRAME_DATA, FLAG_END_STREAM, 1, grpcMessage(8))), sniffertest.DefaultDate(), defaultFlow())
+	// A Trailers-Only response.
+	ms.Append(genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 1, server.encode(
+		":status", "200", "content-type", "application/grpc",
+		"grpc-status", "5", "grpc-message", "key %22a%22 not found")),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "NOT_FOUND", events[0]["grpc_status"])
+		assert.Equal(t, float64(5), events[0]["grpc_status_code"])
+		assert.Equal(t, `key "a" not found`, events[0]["grpc_message"])
+		assert.Equal(t, nil, events[0]["response_messages"])
+		assert.Equal(t, true, events[0]["error"])
+	}
+}
+
+func TestStreamingMessages(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client, server := newEncoder(), newEncoder()
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, client.encode(rpcHeaders("/etcdserverpb.Watch/Watch")...)),
+		genFrame(FRAME_DATA, 0, 1, grpcMessage(10)),
+		genFrame(FRAME_DATA, FLAG_END_STREAM, 1, nil)), sniffertest.DefaultDate(), defaultFlow())
+	// Three messages, the second split across DATA frames, and the third
+	// sharing a frame with the end of the second.
+	messages := concat(grpcMessage(30), grpcMessage(40), grpcMessage(0))
+	ms.Append(concat(
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, server.encode(
+			":status", "200", "content-type", "application/grpc")),
+		genFrame(FRAME_DATA, 0, 1, messages[:37]),
+		genFrame(FRAME_DATA, 0, 1, messages[37:50]),
+		genFrame(FRAME_DATA, 0, 1, messages[50:]),
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 1, server.encode(
+			"grpc-status", "0"))), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, float64(1), events[0]["request_messages"])
+		assert.Equal(t, float64(3), events[0]["response_messages"])
+		assert.Equal(t, float64(len(messages)), events[0]["response_bytes"])
+	}
+}
+
+func TestInterleavedStreams(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client, server := newEncoder(), newEncoder()
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, client.encode(rpcHeaders("/svc.A/Slow")...)),
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 3, client.encode(rpcHeaders("/svc.A/Fast")...)),
+		genFrame(FRAME_DATA, FLAG_END_STREAM, 3, grpcMessage(1)),
+		genFrame(FRAME_DATA, FLAG_END_STREAM, 1, grpcMessage(1))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 3, server.encode(
+		":status", "200", "content-type", "application/grpc", "grpc-status", "0")),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	ms.Append(genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 1, server.encode(
+		":status", "200", "content-type", "application/grpc", "grpc-status", "4")),
+		sniffertest.DefaultDate().Add(9*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "Fast", events[0]["method"])
+		assert.Equal(t, float64(3), events[0]["stream_id"])
+		assert.Equal(t, float64(1), events[0]["duration_ms"])
+		assert.Equal(t, "Slow", events[1]["method"])
+		assert.Equal(t, "DEADLINE_EXCEEDED", events[1]["grpc_status"])
+		assert.Equal(t, float64(9), events[1]["duration_ms"])
+	}
+}
+
+func TestContinuation(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client, server := newEncoder(), newEncoder()
+	block := client.encode(rpcHeaders("/svc.A/Method", "x-trace", string(bytes.Repeat([]byte("t"), 100)))...)
+	// HEADERS with padding and priority, then CONTINUATION.
+	headers := concat([]byte{4}, make([]byte, 5), block[:30], make([]byte, 4))
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genFrame(FRAME_HEADERS, FLAG_PADDED|FLAG_PRIORITY, 1, headers),
+		genFrame(FRAME_CONTINUATION, 0, 1, block[30:60]),
+		genFrame(FRAME_CONTINUATION, FLAG_END_HEADERS, 1, block[60:]),
+		genFrame(FRAME_DATA, FLAG_END_STREAM|FLAG_PADDED, 1, concat([]byte{3}, grpcMessage(2), make([]byte, 3)))),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 1, server.encode(
+		":status", "200", "content-type", "application/grpc", "grpc-status", "0")),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "/svc.A/Method", events[0]["path"])
+		assert.Equal(t, float64(7), events[0]["request_bytes"])
+		assert.Equal(t, float64(1), events[0]["request_messages"])
+	}
+}
+
+func TestReset(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client := newEncoder()
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, client.encode(rpcHeaders("/svc.A/Slow")...)),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(FRAME_RST_STREAM, 0, 1, uint32b(0x8)),
+		sniffertest.DefaultDate().Add(5*time.Millisecond), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "client", events[0]["reset_by"])
+		assert.Equal(t, "CANCEL", events[0]["reset_code"])
+		assert.Equal(t, float64(5), events[0]["duration_ms"])
+		assert.Equal(t, true, events[0]["error"])
+	}
+}
+
+func TestIncompleteAtClose(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client := newEncoder()
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, client.encode(rpcHeaders("/svc.A/Watch")...)),
+		genFrame(FRAME_DATA, 0, 1, grpcMessage(3))), sniffertest.DefaultDate(), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "Watch", events[0]["method"])
+		assert.Equal(t, true, events[0]["incomplete"])
+		assert.Equal(t, float64(0), events[0]["duration_ms"])
+	}
+}
+
+func TestPlainHTTP2(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client, server := newEncoder(), newEncoder()
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 1, client.encode(
+		":method", "GET", ":scheme", "http", ":path", "/healthz", ":authority", "api")),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, server.encode(
+			":status", "503", "content-type", "text/plain")),
+		genFrame(FRAME_DATA, FLAG_END_STREAM, 1, []byte("unavailable"))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "request", events[0]["event_type"])
+		assert.Equal(t, "/healthz", events[0]["path"])
+		assert.Equal(t, "GET", events[0]["http_method"])
+		assert.Equal(t, nil, events[0]["service"])
+		assert.Equal(t, float64(503), events[0]["http_status"])
+		assert.Equal(t, float64(11), events[0]["response_bytes"])
+		assert.Equal(t, nil, events[0]["response_messages"])
+		assert.Equal(t, true, events[0]["error"])
+	}
+}
+
+func TestHPACKLostAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client, server := newEncoder(), newEncoder()
+	ms := &sniffertest.MessageStream{}
+	first := genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 1, client.encode(rpcHeaders("/svc.A/Lost")...))
+	ms.AppendSkipped(first[10:], sniffertest.DefaultDate(), defaultFlow(), 10)
+	// The second request's headers refer to the first's, which we missed.
+	ms.Append(genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 3, client.encode(rpcHeaders("/svc.A/Found")...)),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 3, server.encode(
+		":status", "200", "content-type", "application/grpc", "grpc-status", "0")),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, float64(3), events[0]["stream_id"])
+		assert.Equal(t, nil, events[0]["path"])
+		assert.Equal(t, float64(200), events[0]["http_status"])
+	}
+}
+
+func TestFrameSplitAcrossMessages(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client, server := newEncoder(), newEncoder()
+	ms := &sniffertest.MessageStream{}
+	request := concat(
+		[]byte(clientPreface),
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, client.encode(rpcHeaders("/svc.A/Method")...)),
+		genFrame(FRAME_DATA, FLAG_END_STREAM, 1, grpcMessage(200)))
+	ms.Append(request[:4], sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(request[4:30], sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(request[30:], sniffertest.DefaultDate(), defaultFlow())
+	response := concat(
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, server.encode(
+			":status", "200", "content-type", "application/grpc")),
+		genFrame(FRAME_DATA, 0, 1, grpcMessage(300)),
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 1, server.encode("grpc-status", "0")))
+	ms.Append(response[:100], sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	ms.Append(response[100:], sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "Method", events[0]["method"])
+		assert.Equal(t, float64(1), events[0]["response_messages"])
+		assert.Equal(t, float64(2), events[0]["duration_ms"])
+	}
+}
+
+func TestTruncatedData(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	client, server := newEncoder(), newEncoder()
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genFrame(FRAME_HEADERS, FLAG_END_HEADERS, 1, client.encode(rpcHeaders("/svc.A/Upload")...)),
+		genFrame(FRAME_DATA, 0, 1, grpcMessage(maxBufferedLength+100)),
+		genFrame(FRAME_DATA, FLAG_END_STREAM, 1, grpcMessage(10))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(FRAME_HEADERS, FLAG_END_HEADERS|FLAG_END_STREAM, 1, server.encode(
+		":status", "200", "content-type", "application/grpc", "grpc-status", "0")),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, float64(2), events[0]["request_messages"])
+		assert.Equal(t, float64(maxBufferedLength+100+5+15), events[0]["request_bytes"])
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	assert.Equal(t, float64(250), parseTimeout("250m"))
+	assert.Equal(t, float64(2000), parseTimeout("2S"))
+	assert.Equal(t, float64(0.5), parseTimeout("500u"))
+	assert.Equal(t, float64(0), parseTimeout("10x"))
+	assert.Equal(t, float64(0), parseTimeout(""))
+}
+
+// encoder HPACK-encodes header blocks for one direction of a connection.
+type encoder struct {
+	buf bytes.Buffer
+	enc *hpack.Encoder
+}
+
+func newEncoder() *encoder {
+	e := &encoder{}
+	e.enc = hpack.NewEncoder(&e.buf)
+	return e
+}
+
+func (e *encoder) encode(fields ...string) []byte {
+	e.buf.Reset()
+	for i := 0; i+1 < len(fields); i += 2 {
+		e.enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return append([]byte(nil), e.buf.Bytes()...)
+}
+
+func rpcHeaders(path string, extra ...string) []string {
+	return append([]string{
+		":method", "POST",
+		":scheme", "http",
+		":path", path,
+		":authority", "etcd:2379",
+		"content-type", "application/grpc",
+		"user-agent", "grpc-go/1.60.0",
+		"te", "trailers",
+	}, extra...)
+}
+
+func genFrame(frameType byte, flags byte, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	return concat([]byte{byte(n >> 16), byte(n >> 8), byte(n), frameType, flags},
+		uint32b(streamID), payload)
+}
+
+// grpcMessage generates a gRPC message of n bytes, with its prefix.
+func grpcMessage(n int) []byte {
+	return concat([]byte{0}, uint32b(uint32(n)), bytes.Repeat([]byte{'x'}, n))
+}
+
+func uint32b(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(50051)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		Options:   Options{Port: 50051},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
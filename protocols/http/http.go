@@ -0,0 +1,562 @@
+// Package http parses HTTP/1.x, as spoken by Elasticsearch, CouchDB,
+// ClickHouse's HTTP interface and other REST datastores and services.
+// Servers respond to requests in order, so responses are matched to
+// requests with a queue, which also handles pipelined requests. Bodies can
+// be much larger than the messages the sniffer hands us, and a response can
+// be split across messages when the client sends its next request, so each
+// direction of the connection keeps its place between messages.
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Port    uint16 `long:"port" description:"HTTP port" default:"80"`
+	Headers string `long:"headers" description:"Comma-separated list of request and response headers to include in events" default:"Host,User-Agent,Content-Type"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if flow.DstPort != pf.Options.Port {
+		flow = flow.Reverse()
+	}
+	headers := make(map[string]bool)
+	for _, h := range strings.Split(pf.Options.Headers, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers[strings.ToLower(h)] = true
+		}
+	}
+	return &Parser{
+		options:   pf.Options,
+		headers:   headers,
+		flow:      flow,
+		logger:    logging.NewLogger(logrus.Fields{"flow": flow, "component": "http"}),
+		publisher: pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	return fmt.Sprintf("tcp port %d", pf.Options.Port)
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	options        Options
+	headers        map[string]bool // Lower-cased names of headers to report
+	flow           sniffer.IPPortTuple
+	client         direction
+	server         direction
+	pending        []*Event // Requests awaiting responses, oldest first
+	desynchronized bool     // Whether we're waiting for the next request
+	// Whether the connection has switched to another protocol, e.g. with
+	// a WebSocket upgrade or a CONNECT tunnel, so we've stopped parsing.
+	switched  bool
+	tls       *tls.Connection
+	logger    *logging.Logger
+	publisher publish.Publisher
+}
+
+// direction holds our place in one direction of the connection.
+type direction struct {
+	state     int
+	line      []byte // The start of a line that's still arriving
+	header    int    // Bytes of the current header block so far
+	remaining int64  // Bytes of the current body or chunk still to come
+	// The request being read, or the one the response being read belongs
+	// to; nil if we don't know.
+	event *Event
+	// For responses, whether the status is informational (1xx), so that
+	// the final response is still to come.
+	interim bool
+	// The values of the headers that determine how the body is framed.
+	contentLength    string
+	transferEncoding string
+}
+
+// Event describes a request and its response.
+type Event struct {
+	EventType   string  `json:"event_type"`
+	ClientIP    string  `json:"client_ip"`
+	ServerIP    string  `json:"server_ip"`
+	DurationMs  float64 `json:"duration_ms"`
+	Method      string  `json:"method"`
+	Path        string  `json:"path"` // Normalized, without the query string
+	HTTPVersion string  `json:"http_version"`
+	Status      int     `json:"status"`
+	// Body sizes, after removing chunked transfer encoding.
+	RequestBodyBytes  int64 `json:"request_body_bytes"`
+	ResponseBodyBytes int64 `json:"response_body_bytes"`
+	// The values of the headers named by the headers option, keyed by
+	// their lower-cased names.
+	RequestHeaders  map[string]string `json:"request_headers,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	// Whether the status was a server error (5xx).
+	Error     bool `json:"error"`
+	timestamp time.Time
+}
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	var last time.Time
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
+			if p.server.state == stateUntilClose && p.server.event != nil {
+				p.requestDone(p.server.event, last)
+			}
+			return
+		}
+		last = m.Timestamp()
+		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		if p.switched {
+			io.Copy(ioutil.Discard, m)
+			continue
+		}
+		d := &p.server
+		if toServer {
+			d = &p.client
+		}
+		if m.Skipped() > 0 {
+			p.desynchronize(d, "skipped bytes")
+		}
+		br := bufio.NewReader(m)
+		var err error
+		if toServer {
+			if p.client.state == stateStartLine && len(p.client.line) == 0 {
+				if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+					p.logger.Debug("Connection uses TLS", logrus.Fields{})
+					p.pending = nil
+					p.tls = tls.NewConnection("http", p.flow, m.Timestamp())
+					p.tls.Observe(br, m.Timestamp(), toServer)
+					continue
+				}
+			}
+			err = p.parseRequestStream(br, m.Timestamp())
+		} else {
+			err = p.parseResponseStream(br, m.Timestamp())
+		}
+		if err != io.EOF {
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("http.parse_errors").Add()
+			p.desynchronize(d, err.Error())
+			io.Copy(ioutil.Discard, br)
+		}
+	}
+}
+
+// desynchronize forgets about outstanding requests once we can no longer
+// tell which responses belong to them, and about our place in direction d;
+// the next message in it should start afresh.
+func (p *Parser) desynchronize(d *direction, reason string) {
+	*d = direction{}
+	if p.desynchronized {
+		return
+	}
+	p.logger.Debug("Stream desynchronized", logrus.Fields{"reason": reason})
+	metrics.Counter("http.desyncs").Add()
+	p.pending = nil
+	p.desynchronized = true
+}
+
+func (p *Parser) parseRequestStream(r *bufio.Reader, timestamp time.Time) error {
+	d := &p.client
+	for first := true; ; first = false {
+		if d.state == stateStartLine || d.state == stateHeaders {
+			line, err := p.readHeaderLine(d, r)
+			if err != nil {
+				return err
+			}
+			if d.state == stateStartLine {
+				if line == "" {
+					// Stray CRLFs between requests are allowed.
+					continue
+				}
+				if err := p.startRequest(line, timestamp, first); err != nil {
+					return err
+				}
+				if p.switched {
+					return io.EOF
+				}
+				continue
+			}
+			if line != "" {
+				if err := p.header(d, line, d.event.RequestHeaders); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := p.endRequestHeaders(); err != nil {
+				return err
+			}
+			continue
+		}
+		n, done, err := p.readBody(d, r)
+		d.event.RequestBodyBytes += n
+		if err != nil {
+			return err
+		}
+		if done {
+			d.event = nil
+			d.state = stateStartLine
+		}
+	}
+}
+
+// startRequest starts a request with the given request line; first is
+// whether the line was at the start of a TCP message.
+func (p *Parser) startRequest(line string, timestamp time.Time, first bool) error {
+	if line == http2Preface {
+		p.logger.Debug("Connection uses HTTP/2", logrus.Fields{})
+		metrics.Counter("http.http2_connections").Add()
+		p.switched = true
+		p.pending = nil
+		return nil
+	}
+	rl, err := parseRequestLine(line)
+	if err != nil {
+		return err
+	}
+	p.logger.Debug("Parsed request line", logrus.Fields{
+		"method": rl.Method,
+		"target": truncate(rl.Target)})
+	if first {
+		// A request line at the start of a new TCP message is likely to be
+		// the start of a request, since clients write each one (or each
+		// batch of pipelined ones) in one go.
+		p.desynchronized = false
+	}
+	p.client.event = &Event{
+		Method:         rl.Method,
+		Path:           normalizePath(rl.Target),
+		HTTPVersion:    rl.Version,
+		RequestHeaders: make(map[string]string),
+		timestamp:      timestamp,
+	}
+	p.client.state = stateHeaders
+	return nil
+}
+
+func (p *Parser) endRequestHeaders() error {
+	d := &p.client
+	e := d.event
+	if len(e.RequestHeaders) == 0 {
+		e.RequestHeaders = nil
+	}
+	switch {
+	case p.desynchronized:
+		// Follow the request's framing, but don't match it with a response
+		// until a TCP message starts with a request again.
+	case len(p.pending) >= maxPendingRequests:
+		p.desynchronize(d, "too many pending requests")
+		return nil
+	default:
+		p.pending = append(p.pending, e)
+	}
+	switch {
+	case d.transferEncoding != "":
+		if !isChunked(d.transferEncoding) {
+			return fmt.Errorf("Unsupported request transfer encoding %q", d.transferEncoding)
+		}
+		d.state = stateChunkSize
+	case d.contentLength != "":
+		if err := startBody(d); err != nil {
+			return err
+		}
+	default:
+		d.event = nil
+		d.state = stateStartLine
+	}
+	d.contentLength = ""
+	d.transferEncoding = ""
+	return nil
+}
+
+func (p *Parser) parseResponseStream(r *bufio.Reader, timestamp time.Time) error {
+	d := &p.server
+	for {
+		if d.state == stateStartLine || d.state == stateHeaders {
+			line, err := p.readHeaderLine(d, r)
+			if err != nil {
+				return err
+			}
+			if d.state == stateStartLine {
+				if err := p.startResponse(line); err != nil {
+					return err
+				}
+				continue
+			}
+			if line != "" {
+				var headers map[string]string
+				if d.event != nil {
+					headers = d.event.ResponseHeaders
+				}
+				if err := p.header(d, line, headers); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := p.endResponseHeaders(timestamp); err != nil {
+				return err
+			}
+			if p.switched {
+				return io.EOF
+			}
+			continue
+		}
+		n, done, err := p.readBody(d, r)
+		if d.event != nil {
+			d.event.ResponseBodyBytes += n
+		}
+		if err != nil {
+			return err
+		}
+		if done {
+			p.responseDone(timestamp)
+		}
+	}
+}
+
+func (p *Parser) startResponse(line string) error {
+	sl, err := parseStatusLine(line)
+	if err != nil {
+		return err
+	}
+	p.logger.Debug("Parsed status line", logrus.Fields{
+		"status":  sl.Status,
+		"pending": len(p.pending)})
+	d := &p.server
+	d.state = stateHeaders
+	// Informational responses, e.g. 100 Continue, come before the final
+	// one; 101 Switching Protocols is final, though.
+	d.interim = sl.Status < 200 && sl.Status != 101
+	if d.interim {
+		return nil
+	}
+	if p.desynchronized || len(p.pending) == 0 {
+		d.event = nil
+		return nil
+	}
+	e := p.pending[0]
+	p.pending[0] = nil
+	p.pending = p.pending[1:]
+	e.Status = sl.Status
+	e.ResponseHeaders = make(map[string]string)
+	d.event = e
+	return nil
+}
+
+func (p *Parser) endResponseHeaders(timestamp time.Time) error {
+	d := &p.server
+	e := d.event
+	defer func() {
+		d.contentLength = ""
+		d.transferEncoding = ""
+	}()
+	if d.interim {
+		d.state = stateStartLine
+		return nil
+	}
+	if e != nil && len(e.ResponseHeaders) == 0 {
+		e.ResponseHeaders = nil
+	}
+	var method string
+	var status int
+	if e != nil {
+		method = e.Method
+		status = e.Status
+	}
+	// See https://tools.ietf.org/html/rfc7230#section-3.3.3
+	switch {
+	case status == 101 || method == "CONNECT" && status >= 200 && status < 300:
+		p.logger.Debug("Connection switched protocols", logrus.Fields{})
+		metrics.Counter("http.protocol_switches").Add()
+		p.responseDone(timestamp)
+		p.switched = true
+		p.pending = nil
+	case method == "HEAD" || status == 204 || status == 304:
+		p.responseDone(timestamp)
+	case d.transferEncoding != "":
+		if isChunked(d.transferEncoding) {
+			d.state = stateChunkSize
+		} else {
+			d.state = stateUntilClose
+		}
+	case d.contentLength != "":
+		return startBody(d)
+	default:
+		d.state = stateUntilClose
+	}
+	return nil
+}
+
+// responseDone publishes the event for the current response, if we know
+// which request it belongs to.
+func (p *Parser) responseDone(timestamp time.Time) {
+	d := &p.server
+	if d.event != nil {
+		p.requestDone(d.event, timestamp)
+	}
+	d.event = nil
+	d.state = stateStartLine
+}
+
+// readHeaderLine reads the next line of a header block, enforcing limits on
+// its length.
+func (p *Parser) readHeaderLine(d *direction, r *bufio.Reader) (string, error) {
+	line, err := readLine(r, &d.line)
+	if err != nil {
+		return "", err
+	}
+	if d.state == stateStartLine {
+		d.header = 0
+	}
+	d.header += len(line)
+	if d.header > maxHeaderBytes {
+		return "", fmt.Errorf("Header block longer than %d bytes", maxHeaderBytes)
+	}
+	return line, nil
+}
+
+// header handles a header field, recording its value in headers if it's
+// one of the ones we report.
+func (p *Parser) header(d *direction, line string, headers map[string]string) error {
+	name, value, err := parseHeader(line)
+	if err != nil {
+		return err
+	}
+	switch name {
+	case "":
+		return nil
+	case "content-length":
+		if d.contentLength != "" && d.contentLength != value {
+			return fmt.Errorf("Conflicting Content-Length headers")
+		}
+		d.contentLength = value
+	case "transfer-encoding":
+		if d.transferEncoding != "" {
+			value = d.transferEncoding + ", " + value
+		}
+		d.transferEncoding = value
+	}
+	if headers != nil && p.headers[name] {
+		if prev, ok := headers[name]; ok {
+			value = prev + ", " + value
+		}
+		headers[name] = value
+	}
+	return nil
+}
+
+// isChunked reports whether a Transfer-Encoding value's final coding is
+// chunked, which is what ends the body.
+func isChunked(te string) bool {
+	codings := strings.Split(te, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+func startBody(d *direction) error {
+	length, err := strconv.ParseInt(d.contentLength, 10, 64)
+	if err != nil || length < 0 {
+		return fmt.Errorf("Bad Content-Length %q", truncate(d.contentLength))
+	}
+	d.remaining = length
+	d.state = stateBody
+	return nil
+}
+
+// readBody reads as much of the current body as has arrived, returning the
+// number of body bytes read and whether the body is complete.
+func (p *Parser) readBody(d *direction, r *bufio.Reader) (int64, bool, error) {
+	switch d.state {
+	case stateBody, stateChunkData:
+		n, err := io.CopyN(ioutil.Discard, r, d.remaining)
+		d.remaining -= n
+		if err != nil {
+			return n, false, err
+		}
+		if d.state == stateBody {
+			return n, true, nil
+		}
+		d.state = stateChunkEnd
+		return n, false, nil
+	case stateChunkSize:
+		line, err := readLine(r, &d.line)
+		if err != nil {
+			return 0, false, err
+		}
+		size, err := parseChunkSize(line)
+		if err != nil {
+			return 0, false, err
+		}
+		d.remaining = size
+		d.state = stateChunkData
+		if size == 0 {
+			d.state = stateTrailers
+		}
+		return 0, false, nil
+	case stateChunkEnd:
+		line, err := readLine(r, &d.line)
+		if err != nil {
+			return 0, false, err
+		}
+		if line != "" {
+			return 0, false, fmt.Errorf("Missing CRLF after chunk")
+		}
+		d.state = stateChunkSize
+		return 0, false, nil
+	case stateTrailers:
+		line, err := readLine(r, &d.line)
+		if err != nil {
+			return 0, false, err
+		}
+		return 0, line == "", nil
+	case stateUntilClose:
+		n, err := io.Copy(ioutil.Discard, r)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, false, err
+	}
+	return 0, false, fmt.Errorf("Unexpected state %d", d.state)
+}
+
+// requestDone publishes an event for a request once its response is
+// complete.
+func (p *Parser) requestDone(e *Event, timestamp time.Time) {
+	e.EventType = "request"
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	e.Error = e.Status >= 500
+	if timestamp.After(e.timestamp) {
+		e.DurationMs = float64(timestamp.Sub(e.timestamp).Nanoseconds()) / 1e6
+	}
+	p.publisher.Publish(e, e.timestamp)
+	metrics.Counter("http.requests_parsed").Add()
+}
@@ -0,0 +1,138 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// See https://tools.ietf.org/html/rfc7230
+
+// What we're waiting for next in one direction of a connection.
+const (
+	stateStartLine = iota
+	stateHeaders
+	stateBody       // Bytes of a body with a known length
+	stateChunkSize  // A chunk-size line
+	stateChunkData  // Bytes of a chunk
+	stateChunkEnd   // The CRLF after a chunk's data
+	stateTrailers   // Trailer fields after the last chunk
+	stateUntilClose // A response body that ends when the connection does
+)
+
+// The preface HTTP/2 clients with prior knowledge start connections with.
+const http2Preface = "PRI * HTTP/2.0"
+
+// Safety constraints:
+// Don't queue more than this many pipelined requests per connection.
+const maxPendingRequests = 256
+
+// Don't accept lines longer than this; servers' own limits on request
+// lines and header fields are typically 8KB.
+const maxLineLength = 65536
+
+// Don't accept header blocks longer than this.
+const maxHeaderBytes = 1 << 20
+
+var errLineTooLong = errors.New("Line too long")
+
+// readLine reads a line from r, appending it to partial, and returns it
+// without its line ending. If r runs out first, it returns io.EOF, and the
+// start of the line is left in partial for next time.
+func readLine(r *bufio.Reader, partial *[]byte) (string, error) {
+	for {
+		b, err := r.ReadSlice('\n')
+		if len(*partial)+len(b) > maxLineLength {
+			return "", errLineTooLong
+		}
+		*partial = append(*partial, b...)
+		if err == nil {
+			line := strings.TrimRight(string(*partial), "\r\n")
+			*partial = (*partial)[:0]
+			return line, nil
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+}
+
+type requestLine struct {
+	Method  string
+	Target  string
+	Version string
+}
+
+func parseRequestLine(line string) (*requestLine, error) {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || !isToken(parts[0]) || parts[1] == "" || !strings.HasPrefix(parts[2], "HTTP/") {
+		return nil, fmt.Errorf("Bad request line %q", truncate(line))
+	}
+	return &requestLine{Method: parts[0], Target: parts[1], Version: parts[2]}, nil
+}
+
+type statusLine struct {
+	Version string
+	Status  int
+}
+
+func parseStatusLine(line string) (*statusLine, error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/") || len(parts[1]) != 3 {
+		return nil, fmt.Errorf("Bad status line %q", truncate(line))
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil || status < 100 {
+		return nil, fmt.Errorf("Bad status line %q", truncate(line))
+	}
+	return &statusLine{Version: parts[0], Status: status}, nil
+}
+
+// parseHeader splits a header field into its name, lower-cased, and value.
+// Obsolete line folding, where a line starting with whitespace continues
+// the previous field's value, is reported with an empty name.
+func parseHeader(line string) (string, string, error) {
+	if line[0] == ' ' || line[0] == '\t' {
+		return "", strings.TrimSpace(line), nil
+	}
+	i := strings.IndexByte(line, ':')
+	if i <= 0 || !isToken(line[:i]) {
+		return "", "", fmt.Errorf("Bad header field %q", truncate(line))
+	}
+	return strings.ToLower(line[:i]), strings.TrimSpace(line[i+1:]), nil
+}
+
+// parseChunkSize parses a chunk-size line, ignoring any chunk extensions.
+func parseChunkSize(line string) (int64, error) {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Bad chunk size %q", truncate(line))
+	}
+	return size, nil
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// truncate shortens s for error messages.
+func truncate(s string) string {
+	if len(s) > 64 {
+		return s[:64] + "..."
+	}
+	return s
+}
@@ -0,0 +1,234 @@
+package http
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequest(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("POST /logs-2017.04.24/_doc/1234?refresh=true HTTP/1.1\r\n"+
+		"Host: es.example.com:9200\r\n"+
+		"Content-Type: application/json\r\n"+
+		"Content-Length: 13\r\n"+
+		"\r\n"+
+		`{"level":"x"}`), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HTTP/1.1 201 Created\r\n"+
+		"content-type: application/json; charset=UTF-8\r\n"+
+		"content-length: 2\r\n"+
+		"\r\n"+
+		"{}"), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "request",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 1,
+			"method": "POST",
+			"path": "/logs-2017.04.24/_doc/?",
+			"http_version": "HTTP/1.1",
+			"status": 201,
+			"request_body_bytes": 13,
+			"response_body_bytes": 2,
+			"request_headers": {
+				"host": "es.example.com:9200",
+				"content-type": "application/json"
+			},
+			"response_headers": {
+				"content-type": "application/json; charset=UTF-8"
+			},
+			"error": false
+		}`, string(tp.Output[0]))
+	}
+}
+
+func TestKeepAliveAndPipelining(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("GET /a HTTP/1.1\r\nHost: x\r\n\r\nHEAD /b HTTP/1.1\r\nHost: x\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\nabc"+
+		// HEAD responses don't have bodies, whatever their headers say.
+		"HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("DELETE /c HTTP/1.1\r\nHost: x\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "/a", events[0]["path"])
+		assert.Equal(t, float64(3), events[0]["response_body_bytes"])
+		assert.Equal(t, "HEAD", events[1]["method"])
+		assert.Equal(t, float64(0), events[1]["response_body_bytes"])
+		assert.Equal(t, "DELETE", events[2]["method"])
+		assert.Equal(t, float64(503), events[2]["status"])
+		assert.Equal(t, true, events[2]["error"])
+	}
+}
+
+func TestChunkedEncoding(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("POST /_bulk HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"5\r\nhello\r\n"+
+		"7;ext=1\r\n, world\r\n"+
+		"0\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: gzip, chunked\r\nX-Trailer: no\r\n\r\n"+
+		"a\r\n0123456789\r\n"+
+		"0\r\nX-Checksum: abc\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, float64(12), events[0]["request_body_bytes"])
+		assert.Equal(t, float64(10), events[0]["response_body_bytes"])
+	}
+}
+
+func TestResponseSplitAcrossMessages(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("GET /a HTTP/1.1\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HTTP/1.1 200 OK\r\nContent-Le"), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	// The client sends its next request while the response is arriving.
+	ms.Append([]byte("GET /b HTTP/1.1\r\n\r\n"), sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow())
+	ms.Append([]byte("ngth: 10\r\n\r\n01234"), sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	ms.Append([]byte("56789HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"),
+		sniffertest.DefaultDate().Add(4*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "/a", events[0]["path"])
+		assert.Equal(t, float64(10), events[0]["response_body_bytes"])
+		assert.Equal(t, float64(4), events[0]["duration_ms"])
+		assert.Equal(t, "/b", events[1]["path"])
+		assert.Equal(t, float64(404), events[1]["status"])
+		assert.Equal(t, false, events[1]["error"])
+	}
+}
+
+func TestResponseUntilClose(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("GET / HTTP/1.0\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HTTP/1.0 200 OK\r\n\r\nsome"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte(" data"), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, float64(9), events[0]["response_body_bytes"])
+		assert.Equal(t, float64(1), events[0]["duration_ms"])
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("PUT /db/doc HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HTTP/1.1 100 Continue\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("data"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HTTP/1.1 201 Created\r\nContent-Length: 0\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, float64(201), events[0]["status"])
+		assert.Equal(t, float64(4), events[0]["request_body_bytes"])
+	}
+}
+
+func TestProtocolSwitch(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("GET /ws HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n\x81\x05hello"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("\x81\x85abcdefghi"), sniffertest.DefaultDate(), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, float64(101), events[0]["status"])
+	}
+}
+
+func TestResyncAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("GET /a HTTP/1.1\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.AppendSkipped([]byte("K\r\nContent-Length: 0\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse(), 14)
+	ms.Append([]byte("GET /b HTTP/1.1\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "/b", events[0]["path"])
+	}
+}
+
+func TestTooManyPendingRequests(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(bytes.Repeat([]byte("GET /a HTTP/1.1\r\n\r\n"), maxPendingRequests+2), sniffertest.DefaultDate(), defaultFlow())
+	// The response to the first request isn't attributed to the last.
+	ms.Append([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("GET /b HTTP/1.1\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "/b", events[0]["path"])
+	}
+}
+
+func TestLongHeaders(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("GET /a HTTP/1.1\r\nCookie: "+strings.Repeat("a", maxLineLength)+"\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HTTP/1.1 431 Request Header Fields Too Large\r\nContent-Length: 0\r\n\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	assert.Equal(t, 0, len(tp.Output))
+}
+
+func TestNormalizePath(t *testing.T) {
+	for target, path := range map[string]string{
+		"/":                           "/",
+		"/users/1234/orders?limit=10": "/users/?/orders",
+		"/_all_dbs":                   "/_all_dbs",
+		"/db/7c9e6679-7425-40de-944b-e07fc1f90ae7": "/db/?",
+		"/objects/507f1f77bcf86cd799439011":        "/objects/?",
+		"/index/_doc/VvUaYHwBZ3mXY8uTVj_6":         "/index/_doc/?",
+		"/logs-2017.04.24/_search":                 "/logs-2017.04.24/_search",
+		"/v1/some_long_lowercase_name":             "/v1/some_long_lowercase_name",
+		"http://proxy.example.com/items/42#top":    "/items/?",
+		"example.com:443":                          "example.com:443",
+		"*":                                        "*",
+	} {
+		assert.Equal(t, path, normalizePath(target), target)
+	}
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(80)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		Options:   Options{Port: 80, Headers: "Host,User-Agent,Content-Type"},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
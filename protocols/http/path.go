@@ -0,0 +1,104 @@
+package http
+
+import (
+	"net/url"
+	"strings"
+)
+
+// normalizePath returns the path of a request target, without its query
+// string, and with segments that look like identifiers replaced by "?", so
+// that requests for different documents or records group together.
+func normalizePath(target string) string {
+	switch {
+	case target == "*":
+		// OPTIONS *
+		return target
+	case strings.HasPrefix(target, "/"):
+		if i := strings.IndexAny(target, "?#"); i >= 0 {
+			target = target[:i]
+		}
+	default:
+		// The absolute form sent to proxies, or the authority form
+		// used by CONNECT.
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return target
+		}
+		target = u.EscapedPath()
+		if target == "" {
+			target = "/"
+		}
+	}
+	segments := strings.Split(target, "/")
+	for i, s := range segments {
+		if isIdentifier(s) {
+			segments[i] = "?"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// isIdentifier reports whether a path segment looks like an ID: a number,
+// a UUID, a long hex string (e.g. a hash, or a MongoDB ObjectId), or a long
+// random-looking string with digits and mixed-case letters (e.g. an
+// Elasticsearch document ID). Names that happen to contain digits, such as
+// "logs-2017.04.24", are left alone.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	var digits, lower, upper, hex int
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+			hex++
+		case c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+			hex++
+			if c >= 'a' {
+				lower++
+			} else {
+				upper++
+			}
+		case c >= 'g' && c <= 'z':
+			lower++
+		case c >= 'G' && c <= 'Z':
+			upper++
+		case c == '-' || c == '_':
+		default:
+			return false
+		}
+	}
+	switch {
+	case digits == len(s):
+		return true
+	case isUUID(s):
+		return true
+	case hex == len(s) && len(s) >= 16:
+		return true
+	case len(s) >= 16 && digits > 0 && lower > 0 && upper > 0:
+		return true
+	}
+	return false
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,468 @@
+// Package kafka parses the Kafka wire protocol. Clients tag each request
+// with a correlation ID, which the broker's response carries, so responses
+// are matched to requests by correlation ID. Responses don't say which API
+// they're for, so only requests whose request we saw can be decoded.
+//
+// Produce and Fetch requests are reported with an event per topic, so that
+// latency, record counts and errors can be broken down by topic.
+package kafka
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Port         uint16 `long:"port" description:"Kafka broker port" default:"9092"`
+	MaxFrameSize int    `long:"max_frame_size" description:"Maximum number of bytes of a single request or response to buffer per connection; topics and records past this aren't reported" default:"1048576"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if flow.DstPort != pf.Options.Port {
+		flow = flow.Reverse()
+	}
+	return &Parser{
+		options:   pf.Options,
+		flow:      flow,
+		pending:   make(map[int32]*request),
+		logger:    logging.NewLogger(logrus.Fields{"flow": flow, "component": "kafka"}),
+		publisher: pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	return fmt.Sprintf("tcp port %d", pf.Options.Port)
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	options   Options
+	flow      sniffer.IPPortTuple
+	client    frameAssembler
+	server    frameAssembler
+	pending   map[int32]*request // Requests awaiting responses, by correlation ID
+	tls       *tls.Connection
+	logger    *logging.Logger
+	publisher publish.Publisher
+}
+
+// request is a request awaiting its response.
+type request struct {
+	event   Event
+	apiKey  int16
+	version int16
+	topics  []*topic // The topics a Produce or Fetch request was for
+}
+
+// topic holds what a Produce or Fetch request did with one topic.
+type topic struct {
+	name        string
+	id          string
+	partitions  int
+	records     int
+	recordBytes int
+	errorCode   int16 // The first error for any of the topic's partitions
+}
+
+// Event describes a request and its response, or, for Produce and Fetch,
+// what they did with one topic.
+type Event struct {
+	EventType  string  `json:"event_type"`
+	ClientIP   string  `json:"client_ip"`
+	ServerIP   string  `json:"server_ip"`
+	DurationMs float64 `json:"duration_ms"`
+	// The API the request was for, e.g. "Produce", "Fetch" or "Metadata".
+	APIKey        string `json:"api_key"`
+	APIVersion    int    `json:"api_version"`
+	CorrelationID int32  `json:"correlation_id"`
+	ClientID      string `json:"client_id,omitempty"`
+	RequestBytes  int    `json:"request_bytes"`
+	ResponseBytes int    `json:"response_bytes"`
+	// For Produce and Fetch. Fetch v13 and later identify topics by ID
+	// instead of by name.
+	Topic   string `json:"topic,omitempty"`
+	TopicID string `json:"topic_id,omitempty"`
+	// The number of topics in the whole request or response.
+	TopicCount  int `json:"topic_count,omitempty"`
+	Partitions  int `json:"partitions,omitempty"`
+	Records     int `json:"records,omitempty"`
+	RecordBytes int `json:"record_bytes,omitempty"`
+	// For Produce: "0", "1" or "all". Requests with acks=0 get no
+	// response.
+	Acks      string `json:"acks,omitempty"`
+	MaxWaitMs int    `json:"max_wait_ms,omitempty"`
+	// Whether the request or response was longer than max_frame_size, so
+	// that topics or records may be missing.
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     bool   `json:"error"`
+	ErrorCode int    `json:"error_code,omitempty"`
+	ErrorName string `json:"error_name,omitempty"`
+	timestamp time.Time
+}
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
+			return
+		}
+		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		a := &p.server
+		if toServer {
+			a = &p.client
+		}
+		if m.Skipped() > 0 {
+			// The message most likely starts partway through a frame;
+			// the next one in this direction should start afresh.
+			p.desynchronize(a, "skipped bytes")
+			io.Copy(ioutil.Discard, m)
+			continue
+		}
+		br := bufio.NewReader(m)
+		if toServer && a.idle() {
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				p.logger.Debug("Connection uses TLS", logrus.Fields{})
+				p.pending = nil
+				p.tls = tls.NewConnection("kafka", p.flow, m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), toServer)
+				continue
+			}
+		}
+		err := p.parseFrames(a, br, m.Timestamp(), toServer)
+		if err != io.EOF {
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("kafka.parse_errors").Add()
+			p.desynchronize(a, err.Error())
+			io.Copy(ioutil.Discard, br)
+		}
+	}
+}
+
+// desynchronize forgets about any partial frame in one direction once we
+// can no longer tell where frames start. Correlation IDs still match
+// responses to requests, so pending requests are kept.
+func (p *Parser) desynchronize(a *frameAssembler, reason string) {
+	p.logger.Debug("Stream desynchronized", logrus.Fields{"reason": reason})
+	metrics.Counter("kafka.desyncs").Add()
+	a.reset()
+}
+
+func (p *Parser) parseFrames(a *frameAssembler, r io.Reader, timestamp time.Time, toServer bool) error {
+	for {
+		f, err := a.next(r, p.options.MaxFrameSize, timestamp)
+		if err != nil {
+			return err
+		}
+		p.logger.Debug("Parsed frame", logrus.Fields{
+			"length":   f.Length,
+			"toServer": toServer})
+		if toServer {
+			err = p.parseRequest(f)
+		} else {
+			err = p.parseResponse(f, timestamp)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (p *Parser) parseRequest(f *frame) error {
+	r := newReader(f.body, f.Truncated)
+	apiKey := r.Int16()
+	version := r.Int16()
+	correlationID := r.Int32()
+	clientID := r.String(false)
+	if r.err != nil {
+		// Either a malformed frame, or max_frame_size is too small to
+		// hold the header.
+		return r.Err()
+	}
+	if apiKey < 0 || version < 0 {
+		return fmt.Errorf("Bad request header: API key %d, version %d", apiKey, version)
+	}
+	req := &request{
+		event: Event{
+			APIKey:        apiName(apiKey),
+			APIVersion:    int(version),
+			CorrelationID: correlationID,
+			ClientID:      clientID,
+			RequestBytes:  f.Length,
+			Truncated:     f.Truncated,
+			timestamp:     f.timestamp,
+		},
+		apiKey:  apiKey,
+		version: version,
+	}
+	switch {
+	case apiKey == API_PRODUCE && version <= maxProduceVersion:
+		readProduceRequest(r, req)
+		if req.event.Acks == "0" {
+			// The broker won't respond.
+			p.requestDone(req, f.timestamp)
+			return r.Err()
+		}
+	case apiKey == API_FETCH && version <= maxFetchVersion:
+		readFetchRequest(r, req)
+	}
+	if old, ok := p.pending[correlationID]; ok {
+		p.logger.Debug("Correlation ID reused before response", logrus.Fields{
+			"correlationID": correlationID,
+			"apiKey":        old.event.APIKey})
+	} else if len(p.pending) >= maxPendingRequests {
+		p.logger.Debug("Too many pending requests", logrus.Fields{})
+		p.pending = make(map[int32]*request)
+	}
+	p.pending[correlationID] = req
+	return r.Err()
+}
+
+func isFlexible(apiKey, version int16) bool {
+	first, ok := flexibleVersions[apiKey]
+	return ok && version >= first
+}
+
+func readProduceRequest(r *reader, req *request) {
+	flexible := isFlexible(API_PRODUCE, req.version)
+	r.TaggedFields(flexible) // the rest of the header
+	if req.version >= 3 {
+		r.String(flexible) // transactional ID
+	}
+	switch acks := r.Int16(); acks {
+	case -1:
+		req.event.Acks = "all"
+	default:
+		req.event.Acks = strconv.Itoa(int(acks))
+	}
+	r.Int32() // timeout
+	n := r.ArrayLength(flexible)
+	req.event.TopicCount = n
+	for i := 0; i < n && r.err == nil; i++ {
+		t := &topic{name: r.String(flexible)}
+		if r.err != nil {
+			break
+		}
+		req.topics = append(req.topics, t)
+		partitions := r.ArrayLength(flexible)
+		for j := 0; j < partitions && r.err == nil; j++ {
+			r.Int32() // partition
+			length, records := r.BytesLength(flexible)
+			t.partitions++
+			t.recordBytes += length
+			t.records += countRecords(records)
+			r.TaggedFields(flexible)
+		}
+		r.TaggedFields(flexible)
+	}
+}
+
+func readFetchRequest(r *reader, req *request) {
+	r.TaggedFields(isFlexible(API_FETCH, req.version))
+	if req.version < 15 {
+		r.Int32() // replica ID
+	}
+	req.event.MaxWaitMs = int(r.Int32())
+}
+
+func (p *Parser) parseResponse(f *frame, timestamp time.Time) error {
+	r := newReader(f.body, f.Truncated)
+	correlationID := r.Int32()
+	if r.err != nil {
+		return r.Err()
+	}
+	req, ok := p.pending[correlationID]
+	if !ok {
+		metrics.Counter("kafka.unmatched_responses").Add()
+		return nil
+	}
+	delete(p.pending, correlationID)
+	e := &req.event
+	e.ResponseBytes = f.Length
+	if f.Truncated {
+		e.Truncated = true
+	}
+	flexible := isFlexible(req.apiKey, req.version)
+	switch {
+	case req.apiKey == API_PRODUCE && req.version <= maxProduceVersion:
+		readProduceResponse(r, req)
+	case req.apiKey == API_FETCH && req.version <= maxFetchVersion:
+		readFetchResponse(r, req)
+	default:
+		if pos, ok := topLevelErrors[req.apiKey]; ok && req.version <= pos.maxVersion {
+			r.TaggedFields(flexible)
+			if pos.throttleFrom >= 0 && req.version >= pos.throttleFrom {
+				r.Int32() // throttle time
+			}
+			if code := r.Int16(); r.err == nil {
+				setError(e, code)
+			}
+		}
+	}
+	p.requestDone(req, timestamp)
+	return r.Err()
+}
+
+func readProduceResponse(r *reader, req *request) {
+	flexible := isFlexible(API_PRODUCE, req.version)
+	r.TaggedFields(flexible)
+	byName := make(map[string]*topic, len(req.topics))
+	for _, t := range req.topics {
+		byName[t.name] = t
+	}
+	n := r.ArrayLength(flexible)
+	for i := 0; i < n && r.err == nil; i++ {
+		t := byName[r.String(flexible)]
+		partitions := r.ArrayLength(flexible)
+		for j := 0; j < partitions && r.err == nil; j++ {
+			r.Int32() // partition
+			code := r.Int16()
+			r.Skip(8) // base offset
+			if req.version >= 2 {
+				r.Skip(8) // log append time
+			}
+			if req.version >= 5 {
+				r.Skip(8) // log start offset
+			}
+			if req.version >= 8 {
+				recordErrors := r.ArrayLength(flexible)
+				for k := 0; k < recordErrors && r.err == nil; k++ {
+					r.Int32() // batch index
+					r.String(flexible)
+					r.TaggedFields(flexible)
+				}
+				r.String(flexible) // error message
+			}
+			r.TaggedFields(flexible)
+			if t != nil && r.err == nil && t.errorCode == 0 {
+				t.errorCode = code
+			}
+		}
+		r.TaggedFields(flexible)
+	}
+}
+
+func readFetchResponse(r *reader, req *request) {
+	flexible := isFlexible(API_FETCH, req.version)
+	r.TaggedFields(flexible)
+	if req.version >= 1 {
+		r.Int32() // throttle time
+	}
+	if req.version >= 7 {
+		if code := r.Int16(); r.err == nil {
+			setError(&req.event, code)
+		}
+		r.Int32() // session ID
+	}
+	n := r.ArrayLength(flexible)
+	req.event.TopicCount = n
+	for i := 0; i < n && r.err == nil; i++ {
+		t := &topic{}
+		if req.version >= firstFetchTopicIDVersion {
+			// Formatted the way Kafka's tools show topic IDs.
+			t.id = base64.RawURLEncoding.EncodeToString(r.take(16))
+		} else {
+			t.name = r.String(flexible)
+		}
+		if r.err != nil {
+			break
+		}
+		req.topics = append(req.topics, t)
+		partitions := r.ArrayLength(flexible)
+		for j := 0; j < partitions && r.err == nil; j++ {
+			r.Int32() // partition
+			code := r.Int16()
+			r.Skip(8) // high watermark
+			if req.version >= 4 {
+				r.Skip(8) // last stable offset
+			}
+			if req.version >= 5 {
+				r.Skip(8) // log start offset
+			}
+			if req.version >= 4 {
+				aborted := r.ArrayLength(flexible)
+				for k := 0; k < aborted && r.err == nil; k++ {
+					r.Skip(16) // producer ID and first offset
+					r.TaggedFields(flexible)
+				}
+			}
+			if req.version >= 11 {
+				r.Int32() // preferred read replica
+			}
+			length, records := r.BytesLength(flexible)
+			t.partitions++
+			t.recordBytes += length
+			t.records += countRecords(records)
+			r.TaggedFields(flexible)
+			if r.err == nil && t.errorCode == 0 {
+				t.errorCode = code
+			}
+		}
+		r.TaggedFields(flexible)
+	}
+}
+
+func setError(e *Event, code int16) {
+	if code == 0 {
+		return
+	}
+	e.Error = true
+	e.ErrorCode = int(code)
+	e.ErrorName = errorNames[code]
+}
+
+// requestDone publishes the events for a request once its response has
+// arrived, or straight away if there won't be one.
+func (p *Parser) requestDone(req *request, timestamp time.Time) {
+	if len(req.topics) == 0 {
+		p.publish(&req.event, timestamp)
+		return
+	}
+	for _, t := range req.topics {
+		e := req.event
+		e.Topic = t.name
+		e.TopicID = t.id
+		e.Partitions = t.partitions
+		e.Records = t.records
+		e.RecordBytes = t.recordBytes
+		setError(&e, t.errorCode)
+		p.publish(&e, timestamp)
+	}
+}
+
+func (p *Parser) publish(e *Event, timestamp time.Time) {
+	e.EventType = "request"
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	if timestamp.After(e.timestamp) {
+		e.DurationMs = float64(timestamp.Sub(e.timestamp).Nanoseconds()) / 1e6
+	}
+	p.publisher.Publish(e, e.timestamp)
+	metrics.Counter("kafka.requests_parsed").Add()
+}
@@ -0,0 +1,520 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// See https://kafka.apache.org/protocol and the message definitions in
+// https://github.com/apache/kafka/tree/trunk/clients/src/main/resources/common/message
+const (
+	API_PRODUCE            int16 = 0
+	API_FETCH              int16 = 1
+	API_METADATA           int16 = 3
+	API_FIND_COORDINATOR   int16 = 10
+	API_JOIN_GROUP         int16 = 11
+	API_HEARTBEAT          int16 = 12
+	API_LEAVE_GROUP        int16 = 13
+	API_SYNC_GROUP         int16 = 14
+	API_LIST_GROUPS        int16 = 16
+	API_SASL_HANDSHAKE     int16 = 17
+	API_API_VERSIONS       int16 = 18
+	API_INIT_PRODUCER_ID   int16 = 22
+	API_ADD_OFFSETS_TO_TXN int16 = 25
+	API_END_TXN            int16 = 26
+	API_SASL_AUTHENTICATE  int16 = 36
+	API_DESCRIBE_CLUSTER   int16 = 60
+)
+
+var apiNames = map[int16]string{
+	0:  "Produce",
+	1:  "Fetch",
+	2:  "ListOffsets",
+	3:  "Metadata",
+	4:  "LeaderAndIsr",
+	5:  "StopReplica",
+	6:  "UpdateMetadata",
+	7:  "ControlledShutdown",
+	8:  "OffsetCommit",
+	9:  "OffsetFetch",
+	10: "FindCoordinator",
+	11: "JoinGroup",
+	12: "Heartbeat",
+	13: "LeaveGroup",
+	14: "SyncGroup",
+	15: "DescribeGroups",
+	16: "ListGroups",
+	17: "SaslHandshake",
+	18: "ApiVersions",
+	19: "CreateTopics",
+	20: "DeleteTopics",
+	21: "DeleteRecords",
+	22: "InitProducerId",
+	23: "OffsetForLeaderEpoch",
+	24: "AddPartitionsToTxn",
+	25: "AddOffsetsToTxn",
+	26: "EndTxn",
+	27: "WriteTxnMarkers",
+	28: "TxnOffsetCommit",
+	29: "DescribeAcls",
+	30: "CreateAcls",
+	31: "DeleteAcls",
+	32: "DescribeConfigs",
+	33: "AlterConfigs",
+	34: "AlterReplicaLogDirs",
+	35: "DescribeLogDirs",
+	36: "SaslAuthenticate",
+	37: "CreatePartitions",
+	38: "CreateDelegationToken",
+	39: "RenewDelegationToken",
+	40: "ExpireDelegationToken",
+	41: "DescribeDelegationToken",
+	42: "DeleteGroups",
+	43: "ElectLeaders",
+	44: "IncrementalAlterConfigs",
+	45: "AlterPartitionReassignments",
+	46: "ListPartitionReassignments",
+	47: "OffsetDelete",
+	48: "DescribeClientQuotas",
+	49: "AlterClientQuotas",
+	50: "DescribeUserScramCredentials",
+	51: "AlterUserScramCredentials",
+	52: "Vote",
+	53: "BeginQuorumEpoch",
+	54: "EndQuorumEpoch",
+	55: "DescribeQuorum",
+	56: "AlterPartition",
+	57: "UpdateFeatures",
+	58: "Envelope",
+	59: "FetchSnapshot",
+	60: "DescribeCluster",
+	61: "DescribeProducers",
+	62: "BrokerRegistration",
+	63: "BrokerHeartbeat",
+	64: "UnregisterBroker",
+	65: "DescribeTransactions",
+	66: "ListTransactions",
+	67: "AllocateProducerIds",
+	68: "ConsumerGroupHeartbeat",
+}
+
+func apiName(key int16) string {
+	if name, ok := apiNames[key]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", key)
+}
+
+// The versions of the Produce and Fetch APIs whose bodies we decode. Later
+// versions are reported with just what's in the request header.
+const (
+	maxProduceVersion = 12
+	maxFetchVersion   = 17
+)
+
+// Versions that identify topics by ID rather than by name.
+const firstFetchTopicIDVersion = 13
+
+// errorPosition describes where the error code is in the responses of APIs
+// whose responses start with one, optionally after the throttle time.
+type errorPosition struct {
+	throttleFrom int16 // First version with a throttle time; -1 if none
+	maxVersion   int16 // Last version with a top-level error code
+}
+
+var topLevelErrors = map[int16]errorPosition{
+	API_FIND_COORDINATOR:   {1, 3},
+	API_JOIN_GROUP:         {2, 32767},
+	API_HEARTBEAT:          {1, 32767},
+	API_LEAVE_GROUP:        {1, 32767},
+	API_SYNC_GROUP:         {1, 32767},
+	API_LIST_GROUPS:        {1, 32767},
+	API_SASL_HANDSHAKE:     {-1, 32767},
+	API_API_VERSIONS:       {-1, 32767},
+	API_INIT_PRODUCER_ID:   {0, 32767},
+	API_ADD_OFFSETS_TO_TXN: {0, 32767},
+	API_END_TXN:            {0, 32767},
+	API_SASL_AUTHENTICATE:  {-1, 32767},
+	API_DESCRIBE_CLUSTER:   {0, 32767},
+}
+
+// The first version of each API whose response is "flexible", with a
+// header that has tagged fields, for the APIs whose responses we decode.
+// ApiVersions responses never have tagged fields in their header, so that
+// clients can read them whatever version they asked for.
+var flexibleVersions = map[int16]int16{
+	API_PRODUCE:            9,
+	API_FETCH:              12,
+	API_FIND_COORDINATOR:   3,
+	API_JOIN_GROUP:         6,
+	API_HEARTBEAT:          4,
+	API_LEAVE_GROUP:        4,
+	API_SYNC_GROUP:         4,
+	API_LIST_GROUPS:        3,
+	API_SASL_HANDSHAKE:     32767,
+	API_API_VERSIONS:       32767,
+	API_INIT_PRODUCER_ID:   2,
+	API_ADD_OFFSETS_TO_TXN: 3,
+	API_END_TXN:            3,
+	API_SASL_AUTHENTICATE:  2,
+	API_DESCRIBE_CLUSTER:   0,
+}
+
+var errorNames = map[int16]string{
+	-1: "UNKNOWN_SERVER_ERROR",
+	1:  "OFFSET_OUT_OF_RANGE",
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	4:  "INVALID_FETCH_SIZE",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	8:  "BROKER_NOT_AVAILABLE",
+	9:  "REPLICA_NOT_AVAILABLE",
+	10: "MESSAGE_TOO_LARGE",
+	11: "STALE_CONTROLLER_EPOCH",
+	12: "OFFSET_METADATA_TOO_LARGE",
+	13: "NETWORK_EXCEPTION",
+	14: "COORDINATOR_LOAD_IN_PROGRESS",
+	15: "COORDINATOR_NOT_AVAILABLE",
+	16: "NOT_COORDINATOR",
+	17: "INVALID_TOPIC_EXCEPTION",
+	18: "RECORD_LIST_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	21: "INVALID_REQUIRED_ACKS",
+	22: "ILLEGAL_GENERATION",
+	23: "INCONSISTENT_GROUP_PROTOCOL",
+	24: "INVALID_GROUP_ID",
+	25: "UNKNOWN_MEMBER_ID",
+	26: "INVALID_SESSION_TIMEOUT",
+	27: "REBALANCE_IN_PROGRESS",
+	28: "INVALID_COMMIT_OFFSET_SIZE",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	30: "GROUP_AUTHORIZATION_FAILED",
+	31: "CLUSTER_AUTHORIZATION_FAILED",
+	32: "INVALID_TIMESTAMP",
+	33: "UNSUPPORTED_SASL_MECHANISM",
+	34: "ILLEGAL_SASL_STATE",
+	35: "UNSUPPORTED_VERSION",
+	36: "TOPIC_ALREADY_EXISTS",
+	37: "INVALID_PARTITIONS",
+	38: "INVALID_REPLICATION_FACTOR",
+	39: "INVALID_REPLICA_ASSIGNMENT",
+	40: "INVALID_CONFIG",
+	41: "NOT_CONTROLLER",
+	42: "INVALID_REQUEST",
+	43: "UNSUPPORTED_FOR_MESSAGE_FORMAT",
+	44: "POLICY_VIOLATION",
+	45: "OUT_OF_ORDER_SEQUENCE_NUMBER",
+	46: "DUPLICATE_SEQUENCE_NUMBER",
+	47: "INVALID_PRODUCER_EPOCH",
+	48: "INVALID_TXN_STATE",
+	49: "INVALID_PRODUCER_ID_MAPPING",
+	50: "INVALID_TRANSACTION_TIMEOUT",
+	51: "CONCURRENT_TRANSACTIONS",
+	52: "TRANSACTION_COORDINATOR_FENCED",
+	53: "TRANSACTIONAL_ID_AUTHORIZATION_FAILED",
+	54: "SECURITY_DISABLED",
+	55: "OPERATION_NOT_ATTEMPTED",
+	56: "KAFKA_STORAGE_ERROR",
+	57: "LOG_DIR_NOT_FOUND",
+	58: "SASL_AUTHENTICATION_FAILED",
+	59: "UNKNOWN_PRODUCER_ID",
+}
+
+// The size of the part of a record batch (magic 2) up to and including its
+// record count, and the offsets of the fields we read.
+const (
+	batchHeaderLength  = 61
+	batchLengthOffset  = 8
+	batchMagicOffset   = 16
+	batchRecordsOffset = 57
+	// Legacy message sets (magic 0 and 1) have an offset and a size
+	// before each message.
+	logOverhead = 12
+)
+
+// Safety constraints:
+// Don't track more than this many outstanding requests per connection;
+// producers default to at most 5 in flight.
+const maxPendingRequests = 1024
+
+// Don't accept frames longer than this, whatever the options say; the
+// broker's own limit (socket.request.max.bytes) defaults to 100MB.
+const maxFrameLength = 1 << 30
+
+// frame is a request or response, without its size.
+type frame struct {
+	Length    int  // Length of the frame
+	Truncated bool // Whether body holds only a prefix of the frame
+	body      []byte
+	timestamp time.Time // When the frame started to arrive
+}
+
+// frameAssembler reads frames from one direction of a connection. Clients
+// can send requests while the broker is still sending a response, which
+// ends the message the response was part of, so the assembler keeps the
+// start of an incomplete frame until the rest arrives.
+type frameAssembler struct {
+	size      [4]byte
+	sizeLen   int    // How much of size has arrived
+	frame     *frame // The frame being read, once its size has arrived
+	body      bytes.Buffer
+	remaining int       // Bytes of the frame still to arrive
+	start     time.Time // When the frame started to arrive
+}
+
+// next reads the rest of the current frame from r, buffering at most
+// maxLength bytes of it. It returns io.EOF if r runs out first.
+func (a *frameAssembler) next(r io.Reader, maxLength int, timestamp time.Time) (*frame, error) {
+	if a.frame == nil {
+		n, err := io.ReadFull(r, a.size[a.sizeLen:])
+		if a.sizeLen == 0 && n > 0 {
+			a.start = timestamp
+		}
+		a.sizeLen += n
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		length := int(int32(binary.BigEndian.Uint32(a.size[:])))
+		if length < 0 || length > maxFrameLength {
+			return nil, fmt.Errorf("Bad frame length %d", length)
+		}
+		a.frame = &frame{Length: length, timestamp: a.start}
+		a.remaining = length
+	}
+	for a.remaining > 0 {
+		toBuffer := maxLength - a.body.Len()
+		if toBuffer > a.remaining {
+			toBuffer = a.remaining
+		}
+		var n int64
+		var err error
+		if toBuffer > 0 {
+			// Copying into a bytes.Buffer grows it as data actually
+			// arrives, rather than allocating based on the declared
+			// length up front.
+			n, err = io.CopyN(&a.body, r, int64(toBuffer))
+		} else {
+			n, err = io.CopyN(ioutil.Discard, r, int64(a.remaining))
+		}
+		a.remaining -= int(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f := a.frame
+	f.body = append([]byte(nil), a.body.Bytes()...)
+	f.Truncated = len(f.body) < f.Length
+	a.reset()
+	return f, nil
+}
+
+// idle reports whether no frame is partway through arriving.
+func (a *frameAssembler) idle() bool {
+	return a.sizeLen == 0
+}
+
+func (a *frameAssembler) reset() {
+	a.sizeLen = 0
+	a.frame = nil
+	a.body.Reset()
+	a.remaining = 0
+}
+
+var errTruncated = errors.New("Truncated frame")
+
+// reader wraps a frame with convenience functions for parsing Kafka's
+// types. Like the Postgres parser's reader, it stores the first error it
+// encounters, and callers must check reader.Err(). Flexible versions of
+// messages use "compact" strings, arrays and bytes, with varint lengths,
+// and have tagged fields; the flexible argument to the methods that read
+// them says which to expect.
+type reader struct {
+	b         []byte
+	truncated bool // Whether the frame is truncated
+	err       error
+}
+
+func newReader(body []byte, truncated bool) *reader {
+	return &reader{b: body, truncated: truncated}
+}
+
+// Err returns the error the reader encountered, if any. Running out of a
+// truncated frame isn't an error; the fields that were cut off are just
+// left empty.
+func (r *reader) Err() error {
+	if r.err == errTruncated {
+		return nil
+	}
+	return r.err
+}
+
+func (r *reader) eof() error {
+	if r.truncated {
+		return errTruncated
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// take returns the next n bytes. If the frame is truncated, it may return
+// fewer.
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 {
+		r.err = fmt.Errorf("Bad length %d", n)
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = r.eof()
+		b := r.b
+		r.b = nil
+		return b
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) Int8() int8 {
+	if b := r.take(1); len(b) == 1 {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *reader) Int16() int16 {
+	if b := r.take(2); len(b) == 2 {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *reader) Int32() int32 {
+	if b := r.take(4); len(b) == 4 {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *reader) Skip(n int) {
+	r.take(n)
+}
+
+func (r *reader) UVarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		if n == 0 {
+			r.err = r.eof()
+		} else {
+			r.err = errors.New("Bad varint")
+		}
+		r.b = nil
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// length reads the length of a string, array or bytes, which is -1 if it's
+// null. Compact lengths are stored plus one, so that null is zero.
+func (r *reader) length(flexible bool, size int) int {
+	switch {
+	case flexible:
+		return int(r.UVarint()) - 1
+	case size == 2:
+		return int(r.Int16())
+	default:
+		return int(r.Int32())
+	}
+}
+
+// String reads a (nullable) string.
+func (r *reader) String(flexible bool) string {
+	n := r.length(flexible, 2)
+	if n < 0 {
+		return ""
+	}
+	return string(r.take(n))
+}
+
+// ArrayLength reads the number of elements of a (nullable) array, which is
+// zero if it's null.
+func (r *reader) ArrayLength(flexible bool) int {
+	if n := r.length(flexible, 4); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// Bytes reads (nullable) bytes.
+func (r *reader) Bytes(flexible bool) []byte {
+	n := r.length(flexible, 4)
+	if n < 0 {
+		return nil
+	}
+	return r.take(n)
+}
+
+// BytesLength reads the length of (nullable) bytes, and as much of them as
+// there are, so that the length of bytes cut off by truncation is known.
+func (r *reader) BytesLength(flexible bool) (int, []byte) {
+	n := r.length(flexible, 4)
+	if n < 0 {
+		return 0, nil
+	}
+	return n, r.take(n)
+}
+
+// TaggedFields skips the tagged fields at the end of a flexible structure.
+func (r *reader) TaggedFields(flexible bool) {
+	if !flexible {
+		return
+	}
+	n := int(r.UVarint())
+	for i := 0; i < n && r.err == nil; i++ {
+		r.UVarint() // tag
+		r.Skip(int(r.UVarint()))
+	}
+}
+
+// countRecords counts the records in a record set, which is a sequence of
+// record batches, or of messages in the legacy format. Fetch responses can
+// end with a partial batch, and the record set may have been truncated;
+// those records aren't counted.
+func countRecords(b []byte) int {
+	count := 0
+	for len(b) >= logOverhead {
+		length := int(int32(binary.BigEndian.Uint32(b[batchLengthOffset:])))
+		if length < 0 || len(b) <= batchMagicOffset {
+			break
+		}
+		if b[batchMagicOffset] < 2 {
+			// A message in the legacy format. Compressed messages wrap
+			// several; we count them as one.
+			count++
+		} else if len(b) >= batchHeaderLength {
+			count += int(int32(binary.BigEndian.Uint32(b[batchRecordsOffset:])))
+		} else {
+			break
+		}
+		if len(b) < logOverhead+length {
+			break
+		}
+		b = b[logOverhead+length:]
+	}
+	return count
+}
@@ -0,0 +1,427 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProduce(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(API_PRODUCE, 7, 1, false, concat(
+		int16b(-1), // transactional ID
+		int16b(-1), // acks
+		int32b(30000),
+		int32b(2),
+		kstring("orders"), int32b(2),
+		int32b(0), kbytes(concat(genBatch(3, 20), genBatch(2, 10))),
+		int32b(1), kbytes(genBatch(1, 10)),
+		kstring("clicks"), int32b(1),
+		int32b(0), kbytes(genBatch(5, 50)))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genResponse(1, false, concat(
+		int32b(2),
+		kstring("orders"), int32b(2),
+		int32b(0), int16b(0), int64b(100), int64b(-1), int64b(0),
+		int32b(1), int16b(6), int64b(-1), int64b(-1), int64b(0),
+		kstring("clicks"), int32b(1),
+		int32b(0), int16b(0), int64b(200), int64b(-1), int64b(0),
+		int32b(0))), sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 2, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "request",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 3,
+			"api_key": "Produce",
+			"api_version": 7,
+			"correlation_id": 1,
+			"client_id": "producer-1",
+			"request_bytes": 414,
+			"response_bytes": 126,
+			"topic": "orders",
+			"topic_count": 2,
+			"partitions": 2,
+			"records": 6,
+			"record_bytes": 223,
+			"acks": "all",
+			"error": true,
+			"error_code": 6,
+			"error_name": "NOT_LEADER_OR_FOLLOWER"
+		}`, string(tp.Output[0]))
+		events := tp.Events()
+		assert.Equal(t, "clicks", events[1]["topic"])
+		assert.Equal(t, float64(1), events[1]["partitions"])
+		assert.Equal(t, float64(5), events[1]["records"])
+		assert.Equal(t, false, events[1]["error"])
+	}
+}
+
+func TestFlexibleProduce(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(API_PRODUCE, 9, 7, true, concat(
+		compactString("txn-1"),
+		int16b(1),
+		int32b(30000),
+		uvarint(2),
+		compactString("orders"), uvarint(2),
+		int32b(0), compactBytes(genBatch(4, 20)), []byte{0},
+		[]byte{0},
+		[]byte{0})), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genResponse(7, true, concat(
+		uvarint(2),
+		compactString("orders"), uvarint(2),
+		int32b(0), int16b(0), int64b(100), int64b(-1), int64b(0),
+		uvarint(0), uvarint(0), // record errors, error message
+		// A tagged field.
+		[]byte{1}, uvarint(0), uvarint(2), []byte{0xab, 0xcd},
+		[]byte{0},
+		int32b(0), []byte{0})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "orders", events[0]["topic"])
+		assert.Equal(t, "1", events[0]["acks"])
+		assert.Equal(t, float64(4), events[0]["records"])
+		assert.Equal(t, false, events[0]["error"])
+	}
+}
+
+func TestProduceWithoutAcks(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(API_PRODUCE, 3, 1, false, concat(
+		int16b(-1), int16b(0), int32b(30000),
+		int32b(1), kstring("logs"), int32b(1), int32b(0), kbytes(genBatch(10, 100)))),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genRequest(API_METADATA, 1, 2, false, int32b(0)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genResponse(2, false, concat(int32b(0), int32b(0), int32b(0), int32b(0))),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "Produce", events[0]["api_key"])
+		assert.Equal(t, "0", events[0]["acks"])
+		assert.Equal(t, float64(10), events[0]["records"])
+		assert.Equal(t, float64(0), events[0]["duration_ms"])
+		assert.Equal(t, "Metadata", events[1]["api_key"])
+		assert.Equal(t, float64(1), events[1]["duration_ms"])
+	}
+}
+
+func TestFetch(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(API_FETCH, 11, 5, false, concat(
+		int32b(-1), int32b(500), int32b(1), int32b(52428800), []byte{0},
+		int32b(0), int32b(-1),
+		int32b(1), kstring("orders"), int32b(1),
+		int32b(0), int32b(-1), int64b(100), int64b(-1), int32b(1048576),
+		int32b(0), kstring(""))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genResponse(5, false, concat(
+		int32b(0), int16b(0), int32b(42),
+		int32b(2),
+		kstring("orders"), int32b(2),
+		int32b(0), int16b(0), int64b(110), int64b(110), int64b(0), int32b(-1), int32b(-1),
+		kbytes(concat(genBatch(7, 30), genBatch(3, 30))),
+		int32b(1), int16b(1), int64b(0), int64b(0), int64b(0), int32b(-1), int32b(-1),
+		kbytes(nil),
+		kstring("clicks"), int32b(1),
+		int32b(0), int16b(0), int64b(50), int64b(50), int64b(0), int32b(0), int32b(-1),
+		// The broker can cut the last batch short.
+		kbytes(concat(genBatch(2, 10), genBatch(9, 10)[:40])))),
+		sniffertest.DefaultDate().Add(500*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "Fetch", events[0]["api_key"])
+		assert.Equal(t, float64(500), events[0]["max_wait_ms"])
+		assert.Equal(t, float64(500), events[0]["duration_ms"])
+		assert.Equal(t, "orders", events[0]["topic"])
+		assert.Equal(t, float64(2), events[0]["topic_count"])
+		assert.Equal(t, float64(2), events[0]["partitions"])
+		assert.Equal(t, float64(10), events[0]["records"])
+		assert.Equal(t, float64(182), events[0]["record_bytes"])
+		assert.Equal(t, "OFFSET_OUT_OF_RANGE", events[0]["error_name"])
+		assert.Equal(t, "clicks", events[1]["topic"])
+		assert.Equal(t, float64(2), events[1]["records"])
+		assert.Equal(t, false, events[1]["error"])
+	}
+}
+
+func TestFetchTopicIDs(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(API_FETCH, 13, 5, true, concat(
+		int32b(-1), int32b(100), int32b(1), int32b(52428800), []byte{0},
+		int32b(0), int32b(-1),
+		uvarint(0), uvarint(0), compactString(""), []byte{0})), sniffertest.DefaultDate(), defaultFlow())
+	id := []byte{0x8d, 0x2c, 0x17, 0xa5, 0x4e, 0x1b, 0x4c, 0x6e, 0x9f, 0x30, 0x2b, 0x77, 0x01, 0x5a, 0xc3, 0xd4}
+	ms.Append(genResponse(5, true, concat(
+		int32b(0), int16b(0), int32b(42),
+		uvarint(2),
+		id, uvarint(2),
+		int32b(0), int16b(0), int64b(10), int64b(10), int64b(0), uvarint(0), int32b(-1),
+		compactBytes(genBatch(3, 10)), []byte{0},
+		[]byte{0},
+		[]byte{0})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Nil(t, events[0]["topic"])
+		assert.Equal(t, "jSwXpU4bTG6fMCt3AVrD1A", events[0]["topic_id"])
+		assert.Equal(t, float64(3), events[0]["records"])
+	}
+}
+
+func TestFetchSessionError(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(API_FETCH, 7, 9, false, concat(int32b(-1), int32b(500))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genResponse(9, false, concat(int32b(0), int16b(70), int32b(0), int32b(0))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Nil(t, events[0]["topic"])
+		assert.Equal(t, true, events[0]["error"])
+		assert.Equal(t, float64(70), events[0]["error_code"])
+	}
+}
+
+func TestTopLevelErrors(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	// ApiVersions responses never have tagged fields in their header.
+	ms.Append(genRequest(API_API_VERSIONS, 3, 1, true, concat(
+		compactString("client"), compactString("1.0"), []byte{0})), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genResponse(1, false, concat(int16b(35), uvarint(0), int32b(0), []byte{0})),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genRequest(API_HEARTBEAT, 4, 2, true, concat(
+		compactString("group"), int32b(3), compactString("member"), []byte{0}, []byte{0})),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genResponse(2, true, concat(int32b(0), int16b(27), []byte{0})),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genRequest(API_FIND_COORDINATOR, 0, 3, false, kstring("group")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genResponse(3, false, concat(int16b(0), int32b(1), kstring("broker-1"), int32b(9092))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "ApiVersions", events[0]["api_key"])
+		assert.Equal(t, "UNSUPPORTED_VERSION", events[0]["error_name"])
+		assert.Equal(t, "Heartbeat", events[1]["api_key"])
+		assert.Equal(t, "REBALANCE_IN_PROGRESS", events[1]["error_name"])
+		assert.Equal(t, "FindCoordinator", events[2]["api_key"])
+		assert.Equal(t, false, events[2]["error"])
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genRequest(API_METADATA, 1, 1, false, int32b(0)),
+		genRequest(100, 0, 2, false, nil)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genResponse(1, false, nil), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	ms.Append(genResponse(2, false, nil), sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow().Reverse())
+	// A response to a request we didn't see.
+	ms.Append(genResponse(3, false, nil), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, float64(1), events[0]["duration_ms"])
+		assert.Equal(t, "100", events[1]["api_key"])
+		assert.Equal(t, float64(2), events[1]["duration_ms"])
+	}
+}
+
+func TestFrameSplitAcrossMessages(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(API_FETCH, 4, 1, false, concat(int32b(-1), int32b(500))), sniffertest.DefaultDate(), defaultFlow())
+	response := genResponse(1, false, concat(
+		int32b(0),
+		int32b(1), kstring("orders"), int32b(1),
+		int32b(0), int16b(0), int64b(10), int64b(10), int32b(-1),
+		kbytes(concat(genBatch(7, 100), genBatch(3, 100)))))
+	ms.Append(response[:2], sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	// The client sends another request while the response is arriving.
+	ms.Append(genRequest(API_METADATA, 1, 2, false, int32b(0)), sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow())
+	ms.Append(response[2:150], sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	ms.Append(concat(response[150:], genResponse(2, false, nil)),
+		sniffertest.DefaultDate().Add(4*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "orders", events[0]["topic"])
+		assert.Equal(t, float64(10), events[0]["records"])
+		assert.Equal(t, float64(4), events[0]["duration_ms"])
+		assert.Equal(t, "Metadata", events[1]["api_key"])
+		assert.Equal(t, float64(2), events[1]["duration_ms"])
+	}
+}
+
+func TestResyncAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genRequest(API_METADATA, 1, 1, false, int32b(0)),
+		genRequest(API_METADATA, 1, 2, false, int32b(0))), sniffertest.DefaultDate(), defaultFlow())
+	response := genResponse(1, false, int32b(0))
+	ms.AppendSkipped(response[3:], sniffertest.DefaultDate(), defaultFlow().Reverse(), 3)
+	ms.Append(genResponse(2, false, int32b(0)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, float64(2), events[0]["correlation_id"])
+	}
+}
+
+func TestTruncatedProduce(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	pf := ParserFactory{
+		Options:   Options{Port: 9092, MaxFrameSize: 200},
+		Publisher: tp,
+	}
+	parser := pf.New(defaultFlow())
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(API_PRODUCE, 3, 1, false, concat(
+		int16b(-1), int16b(1), int32b(30000),
+		int32b(2),
+		kstring("orders"), int32b(1), int32b(0), kbytes(genBatch(3, 1000)),
+		kstring("clicks"), int32b(1), int32b(0), kbytes(genBatch(5, 1000)))),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genResponse(1, false, concat(
+		int32b(1), kstring("orders"), int32b(1), int32b(0), int16b(0), int64b(0), int64b(-1), int32b(0))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "orders", events[0]["topic"])
+		assert.Equal(t, float64(2), events[0]["topic_count"])
+		assert.Equal(t, float64(3), events[0]["records"])
+		assert.Equal(t, float64(1061), events[0]["record_bytes"])
+		assert.Equal(t, true, events[0]["truncated"])
+	}
+}
+
+func TestCountRecords(t *testing.T) {
+	// Legacy message sets count a message at a time.
+	legacy := concat(int64b(0), int32b(10), int32b(0), []byte{1}, make([]byte, 5))
+	assert.Equal(t, 2, countRecords(concat(legacy, legacy)))
+	assert.Equal(t, 4, countRecords(concat(genBatch(4, 0), genBatch(9, 100)[:60])))
+	assert.Equal(t, 0, countRecords(nil))
+}
+
+// genBatch returns a record batch with a dummy payload standing in for its
+// records.
+func genBatch(records int, payloadLength int) []byte {
+	return concat(
+		int64b(0), // base offset
+		int32b(int32(batchHeaderLength-logOverhead+payloadLength)),
+		int32b(0), // partition leader epoch
+		[]byte{2}, // magic
+		make([]byte, 4+2+4+8+8+8+2+4),
+		int32b(int32(records)),
+		make([]byte, payloadLength))
+}
+
+func genRequest(apiKey int16, version int16, correlationID int32, flexible bool, body []byte) []byte {
+	header := concat(int16b(apiKey), int16b(version), int32b(correlationID), kstring("producer-1"))
+	if flexible {
+		header = append(header, 0)
+	}
+	return genFrame(concat(header, body))
+}
+
+func genResponse(correlationID int32, flexible bool, body []byte) []byte {
+	header := int32b(correlationID)
+	if flexible {
+		header = append(header, 0)
+	}
+	return genFrame(concat(header, body))
+}
+
+func genFrame(b []byte) []byte {
+	return concat(int32b(int32(len(b))), b)
+}
+
+func int16b(n int16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(n))
+	return b
+}
+
+func int32b(n int32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+func int64b(n int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return b
+}
+
+func uvarint(n uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, n)]
+}
+
+func kstring(s string) []byte {
+	return concat(int16b(int16(len(s))), []byte(s))
+}
+
+func compactString(s string) []byte {
+	return concat(uvarint(uint64(len(s)+1)), []byte(s))
+}
+
+func kbytes(b []byte) []byte {
+	if b == nil {
+		return int32b(-1)
+	}
+	return concat(int32b(int32(len(b))), b)
+}
+
+func compactBytes(b []byte) []byte {
+	return concat(uvarint(uint64(len(b)+1)), b)
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(9092)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		Options:   Options{Port: 9092, MaxFrameSize: 1048576},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
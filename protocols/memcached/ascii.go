@@ -0,0 +1,269 @@
+package memcached
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Meta commands that the q flag makes quiet, the responses it suppresses,
+// and the result we report when the server doesn't respond.
+var quietMetaCommands = map[string]struct {
+	suppressed []string
+	result     string
+}{
+	"mg": {[]string{"EN"}, "miss"},
+	"ms": {[]string{"HD"}, "stored"},
+	"md": {[]string{"HD", "NF"}, "deleted"},
+	"ma": {[]string{"HD"}, "ok"},
+}
+
+// Responses to meta commands.
+var metaResponses = map[string]bool{
+	"VA": true, "HD": true, "EN": true, "NS": true,
+	"EX": true, "NF": true, "MN": true, "ME": true,
+}
+
+func (p *Parser) parseASCIIRequests(r *bufio.Reader, timestamp time.Time) error {
+	for first := true; ; first = false {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		command := fields[0]
+		p.logger.Debug("Parsed command", logrus.Fields{"command": command})
+		noreply := fields[len(fields)-1] == "noreply"
+		var req *request
+		switch command {
+		case "get", "gets", "gat", "gats":
+			keys := fields[1:]
+			if command == "gat" || command == "gats" {
+				if len(keys) == 0 {
+					return fmt.Errorf("Bad %s command", command)
+				}
+				keys = keys[1:] // exptime
+			}
+			if len(keys) > maxKeysPerCommand {
+				keys = keys[:maxKeysPerCommand]
+			}
+			req = p.newRequest("ascii", command, "", timestamp)
+			req.keys = keys
+			req.values = make(map[string]int)
+		case "set", "add", "replace", "append", "prepend", "cas":
+			if len(fields) < 5 {
+				return fmt.Errorf("Bad %s command", command)
+			}
+			length, err := strconv.Atoi(fields[4])
+			if err != nil {
+				return fmt.Errorf("Bad %s command", command)
+			}
+			if err := skipData(r, length); err != nil {
+				return err
+			}
+			req = p.newRequest("ascii", command, fields[1], timestamp)
+			req.event.ValueBytes = length
+		case "delete", "incr", "decr", "touch":
+			if len(fields) < 2 {
+				return fmt.Errorf("Bad %s command", command)
+			}
+			req = p.newRequest("ascii", command, fields[1], timestamp)
+		case "ms", "mg", "md", "ma", "me":
+			var err error
+			if req, err = p.parseMetaCommand(r, fields, timestamp); err != nil {
+				return err
+			}
+			noreply = false
+		case "quit":
+			// The server just closes the connection.
+			continue
+		case "stats", "version", "flush_all", "verbosity", "mn":
+			req = p.newRequest("ascii", command, "", timestamp)
+		default:
+			// Most likely part of a value, if we've lost our place.
+			return fmt.Errorf("Unknown command %q", command)
+		}
+		if noreply {
+			p.publish(req.event, "noreply", timestamp)
+			continue
+		}
+		p.enqueue(req, first)
+	}
+}
+
+func (p *Parser) parseMetaCommand(r *bufio.Reader, fields []string, timestamp time.Time) (*request, error) {
+	command := fields[0]
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("Bad %s command", command)
+	}
+	key := fields[1]
+	flags := fields[2:]
+	length := 0
+	if command == "ms" {
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Bad %s command", command)
+		}
+		var err error
+		if length, err = strconv.Atoi(fields[2]); err != nil {
+			return nil, fmt.Errorf("Bad %s command", command)
+		}
+		if err := skipData(r, length); err != nil {
+			return nil, err
+		}
+		flags = fields[3:]
+	}
+	quiet := false
+	for _, flag := range flags {
+		switch flag {
+		case "b":
+			// The key is base64-encoded.
+			if decoded, err := base64.StdEncoding.DecodeString(key); err == nil {
+				key = string(decoded)
+			}
+		case "q":
+			quiet = true
+		}
+	}
+	req := p.newRequest("ascii", command, key, timestamp)
+	req.event.ValueBytes = length
+	if quiet {
+		req.quietResult = quietMetaCommands[command].result
+	}
+	return req, nil
+}
+
+func (p *Parser) parseASCIIResponses(r *bufio.Reader, timestamp time.Time) error {
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		word := fields[0]
+		p.logger.Debug("Parsed response", logrus.Fields{
+			"response": word,
+			"pending":  len(p.pending)})
+		switch word {
+		case "VALUE":
+			if len(fields) < 4 {
+				return fmt.Errorf("Bad VALUE line")
+			}
+			length, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return fmt.Errorf("Bad VALUE line")
+			}
+			if err := skipData(r, length); err != nil {
+				return err
+			}
+			if req := p.current(); req != nil && req.values != nil {
+				req.values[fields[1]] = length
+			}
+			continue
+		case "VA":
+			if len(fields) < 2 {
+				return fmt.Errorf("Bad VA line")
+			}
+			length, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return fmt.Errorf("Bad VA line")
+			}
+			if err := skipData(r, length); err != nil {
+				return err
+			}
+			p.skipQuietRequests(word, timestamp)
+			if req := p.current(); req != nil {
+				req.event.ValueBytes = length
+				p.requestDone(metaResult(req, word), timestamp)
+			}
+			continue
+		case "STAT", "ITEM", "CONFIG":
+			// Part of a multi-line response that ends with END.
+			continue
+		}
+
+		// The new value, for incr and decr.
+		_, numberErr := strconv.ParseUint(word, 10, 64)
+		if word != "END" && !metaResponses[word] && asciiResults[word] == "" && numberErr != nil {
+			return fmt.Errorf("Unknown response %q", word)
+		}
+		p.skipQuietRequests(word, timestamp)
+		req := p.current()
+		if req == nil {
+			continue
+		}
+		switch {
+		case word == "END":
+			if req.keys != nil {
+				p.requestDone("", timestamp)
+			} else {
+				p.requestDone("ok", timestamp)
+			}
+		case metaResponses[word]:
+			p.requestDone(metaResult(req, word), timestamp)
+		case asciiResults[word] != "":
+			p.requestDone(asciiResults[word], timestamp)
+		default:
+			p.requestDone("ok", timestamp)
+		}
+	}
+}
+
+// metaResult returns the result of a meta command's response. Gets are hits
+// if the server returns a value, or just says that the key exists.
+func metaResult(req *request, word string) string {
+	switch {
+	case word == "EN":
+		return "miss"
+	case req.event.Command == "mg" && (word == "VA" || word == "HD"):
+		return "hit"
+	case word == "VA":
+		return "ok"
+	}
+	return asciiResults[word]
+}
+
+// current returns the command that the server is responding to.
+func (p *Parser) current() *request {
+	if p.desynchronized || len(p.pending) == 0 {
+		return nil
+	}
+	return p.pending[0]
+}
+
+// skipQuietRequests publishes events for quiet meta commands that the
+// server didn't respond to, because the response it's sending now can't
+// belong to them. Without opaque values, we can't tell whether a response
+// that a quiet command could have received belongs to it, or to a later
+// command; we assume the former.
+func (p *Parser) skipQuietRequests(word string, timestamp time.Time) {
+	for {
+		req := p.current()
+		if req == nil || req.binary || req.quietResult == "" {
+			return
+		}
+		skipped := !metaResponses[word] && !errorResults[asciiResults[word]]
+		if word == "MN" && req.event.Command != "mn" {
+			skipped = true
+		}
+		for _, s := range quietMetaCommands[req.event.Command].suppressed {
+			if word == s {
+				skipped = true
+			}
+		}
+		if !skipped {
+			return
+		}
+		p.requestDone(req.quietResult, timestamp)
+	}
+}
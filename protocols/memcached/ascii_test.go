@@ -0,0 +1,134 @@
+package memcached
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiKeyGet(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("get user:1 user:2 session:9\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("VALUE user:1 0 5\r\nalice\r\nVALUE session:9 0 3\r\nabc\r\nEND\r\n"),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 3, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "command",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 1,
+			"protocol": "ascii",
+			"command": "get",
+			"key_prefix": "user",
+			"result": "hit",
+			"value_bytes": 5,
+			"error": false
+		}`, string(tp.Output[0]))
+		events := tp.Events()
+		assert.Equal(t, "user", events[1]["key_prefix"])
+		assert.Equal(t, "miss", events[1]["result"])
+		assert.Equal(t, float64(0), events[1]["value_bytes"])
+		assert.Equal(t, "session", events[2]["key_prefix"])
+		assert.Equal(t, "hit", events[2]["result"])
+	}
+}
+
+func TestPipelinedStorageCommands(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte(
+		"set user:1 0 0 5\r\nalice\r\n"+
+			"add user:1 0 0 3\r\nbob\r\n"+
+			"cas user:1 0 0 5 1234\r\ncarol\r\n"+
+			"set counter:1 0 0 1 noreply\r\n0\r\n"+
+			"incr counter:1 5\r\n"+
+			"delete user:2\r\n"+
+			"touch user:1 60\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("STORED\r\nNOT_STORED\r\nEXISTS\r\n5\r\nNOT_FOUND\r\nTOUCHED\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 7, len(events)) {
+		// The noreply command is reported straight away.
+		assert.Equal(t, "noreply", events[0]["result"])
+		assert.Equal(t, "counter", events[0]["key_prefix"])
+		var results []string
+		for _, e := range events[1:] {
+			results = append(results, e["command"].(string)+" "+e["result"].(string))
+		}
+		assert.Equal(t, []string{
+			"set stored", "add not_stored", "cas exists", "incr ok",
+			"delete not_found", "touch touched"}, results)
+		assert.Equal(t, float64(5), events[1]["value_bytes"])
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("set user:1 0 0 5\r\nalice\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("SERVER_ERROR out of memory storing object\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("stats\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("STAT pid 1\r\nSTAT uptime 10\r\nEND\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "server_error", events[0]["result"])
+		assert.Equal(t, true, events[0]["error"])
+		assert.Equal(t, "stats", events[1]["command"])
+		assert.Equal(t, "ok", events[1]["result"])
+	}
+}
+
+func TestMetaCommands(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte(
+		"mg user:1 v\r\n"+
+			"mg user:2 v\r\n"+
+			"ms user:3 5 T60\r\nalice\r\n"+
+			"md user:4\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("VA 5 \r\nalice\r\nEN\r\nHD\r\nNF\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 4, len(events)) {
+		assert.Equal(t, "hit", events[0]["result"])
+		assert.Equal(t, float64(5), events[0]["value_bytes"])
+		assert.Equal(t, "miss", events[1]["result"])
+		assert.Equal(t, "ms", events[2]["command"])
+		assert.Equal(t, "ok", events[2]["result"])
+		assert.Equal(t, float64(5), events[2]["value_bytes"])
+		assert.Equal(t, "not_found", events[3]["result"])
+	}
+}
+
+func TestQuietMetaCommands(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	// Clients batch quiet gets, and end the batch with a no-op; the server
+	// only responds to hits.
+	ms.Append([]byte(
+		"mg user:1 v q\r\n"+
+			"mg user:2 v q\r\n"+
+			"mg dXNlcjoz b v q\r\n"+
+			"mn\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("VA 5\r\nalice\r\nMN\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 4, len(events)) {
+		assert.Equal(t, "hit", events[0]["result"])
+		assert.Equal(t, "miss", events[1]["result"])
+		assert.Equal(t, "miss", events[2]["result"])
+		// The key was base64-encoded.
+		assert.Equal(t, "user", events[2]["key_prefix"])
+		assert.Equal(t, "mn", events[3]["command"])
+	}
+}
@@ -0,0 +1,112 @@
+package memcached
+
+import (
+	"bufio"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func (p *Parser) parseBinaryRequests(r *bufio.Reader, timestamp time.Time) error {
+	for first := true; ; first = false {
+		h, key, err := readBinaryMessage(r)
+		if err != nil {
+			return err
+		}
+		if h.Magic != REQUEST_MAGIC {
+			return fmt.Errorf("Expected request magic, got %#x", h.Magic)
+		}
+		op, ok := opcodes[h.Opcode]
+		if !ok {
+			name := fmt.Sprintf("%#02x", h.Opcode)
+			op = opcode{name: name, command: name, success: "ok"}
+		}
+		p.logger.Debug("Parsed binary request", logrus.Fields{
+			"opcode": op.name,
+			"opaque": h.Opaque})
+		req := p.newRequest("binary", op.command, key, timestamp)
+		req.binary = true
+		req.opcode = op
+		req.opaque = h.Opaque
+		if !op.retrieval {
+			req.event.ValueBytes = h.ValueLength()
+		}
+		p.enqueue(req, first)
+	}
+}
+
+func (p *Parser) parseBinaryResponses(r *bufio.Reader, timestamp time.Time) error {
+	for {
+		h, _, err := readBinaryMessage(r)
+		if err != nil {
+			return err
+		}
+		if h.Magic != RESPONSE_MAGIC {
+			return fmt.Errorf("Expected response magic, got %#x", h.Magic)
+		}
+		p.logger.Debug("Parsed binary response", logrus.Fields{
+			"opcode":  h.Opcode,
+			"status":  h.Status,
+			"opaque":  h.Opaque,
+			"pending": len(p.pending)})
+		if !p.skipQuietBinaryRequests(h.Opaque, timestamp) {
+			continue
+		}
+		req := p.pending[0]
+		if req.opcode.command == "stats" && h.KeyLength > 0 {
+			// Each statistic gets its own response, and an empty one ends
+			// the list.
+			continue
+		}
+		var result string
+		switch {
+		case h.Status == 0:
+			result = req.opcode.success
+			if req.opcode.retrieval {
+				req.event.ValueBytes = h.ValueLength()
+			}
+		case h.Status == 0x0001 && req.opcode.retrieval:
+			result = "miss"
+		case statusResults[h.Status] != "":
+			result = statusResults[h.Status]
+		default:
+			result = fmt.Sprintf("status_%#04x", h.Status)
+		}
+		p.requestDone(result, timestamp)
+	}
+}
+
+// skipQuietBinaryRequests publishes events for the quiet commands that the
+// server didn't respond to before the one with the given opaque value, and
+// reports whether that command is now the oldest pending one. Quiet gets
+// only get a response on a hit, and other quiet commands only on an error.
+func (p *Parser) skipQuietBinaryRequests(opaque uint32, timestamp time.Time) bool {
+	if p.desynchronized {
+		return false
+	}
+	found := false
+	for _, req := range p.pending {
+		if req.binary && req.opaque == opaque {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	for p.pending[0].opaque != opaque || !p.pending[0].binary {
+		req := p.pending[0]
+		switch {
+		case req.binary && req.opcode.quiet && req.opcode.retrieval:
+			p.requestDone("miss", timestamp)
+		case req.binary && req.opcode.quiet:
+			p.requestDone(req.opcode.success, timestamp)
+		default:
+			// Responses arrive in order, so this one's was lost.
+			p.pending[0] = nil
+			p.pending = p.pending[1:]
+		}
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinaryGet(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genBinary(REQUEST_MAGIC, OP_GET, 0, 7, nil, "user:1", nil), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genBinary(RESPONSE_MAGIC, OP_GET, 0, 7, make([]byte, 4), "", []byte("alice")),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "command",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 1,
+			"protocol": "binary",
+			"command": "get",
+			"key_prefix": "user",
+			"result": "hit",
+			"value_bytes": 5,
+			"error": false
+		}`, string(tp.Output[0]))
+	}
+}
+
+func TestBinaryQuietCommands(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	// A multi-get: the server only responds to hits, and to the no-op.
+	ms.Append(concat(
+		genBinary(REQUEST_MAGIC, OP_GETKQ, 0, 1, nil, "user:1", nil),
+		genBinary(REQUEST_MAGIC, OP_GETKQ, 0, 2, nil, "user:2", nil),
+		genBinary(REQUEST_MAGIC, OP_SETQ, 0, 3, make([]byte, 8), "user:3", []byte("carol")),
+		genBinary(REQUEST_MAGIC, OP_SETQ, 0, 4, make([]byte, 8), "user:4", []byte("dave")),
+		genBinary(REQUEST_MAGIC, OP_NOOP, 0, 5, nil, "", nil)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genBinary(RESPONSE_MAGIC, OP_GETKQ, 0, 2, make([]byte, 4), "user:2", []byte("bob")),
+		genBinary(RESPONSE_MAGIC, OP_SETQ, 0x0003, 4, nil, "", nil),
+		genBinary(RESPONSE_MAGIC, OP_NOOP, 0, 5, nil, "", nil)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 5, len(events)) {
+		assert.Equal(t, "miss", events[0]["result"])
+		assert.Equal(t, "hit", events[1]["result"])
+		assert.Equal(t, float64(3), events[1]["value_bytes"])
+		assert.Equal(t, "set", events[2]["command"])
+		assert.Equal(t, "stored", events[2]["result"])
+		assert.Equal(t, float64(5), events[2]["value_bytes"])
+		assert.Equal(t, "too_large", events[3]["result"])
+		assert.Equal(t, true, events[3]["error"])
+		assert.Equal(t, "noop", events[4]["command"])
+	}
+}
+
+func TestBinaryMiss(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genBinary(REQUEST_MAGIC, OP_GET, 0, 1, nil, "user:1", nil),
+		genBinary(REQUEST_MAGIC, OP_DELETE, 0, 2, nil, "user:1", nil)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genBinary(RESPONSE_MAGIC, OP_GET, 0x0001, 1, nil, "", []byte("Not found")),
+		genBinary(RESPONSE_MAGIC, OP_DELETE, 0x0001, 2, nil, "", []byte("Not found"))), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "miss", events[0]["result"])
+		assert.Equal(t, float64(0), events[0]["value_bytes"])
+		assert.Equal(t, "not_found", events[1]["result"])
+		assert.Equal(t, false, events[1]["error"])
+	}
+}
+
+func TestBinaryStat(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genBinary(REQUEST_MAGIC, OP_STAT, 0, 1, nil, "", nil), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genBinary(RESPONSE_MAGIC, OP_STAT, 0, 1, nil, "pid", []byte("1")),
+		genBinary(RESPONSE_MAGIC, OP_STAT, 0, 1, nil, "uptime", []byte("10")),
+		genBinary(RESPONSE_MAGIC, OP_STAT, 0, 1, nil, "", nil)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "stats", events[0]["command"])
+	}
+}
+
+func genBinary(magic byte, op byte, status uint16, opaque uint32, extras []byte, key string, value []byte) []byte {
+	b := make([]byte, binaryHeaderLength)
+	b[0] = magic
+	b[1] = op
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(key)))
+	b[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(b[6:8], status)
+	binary.BigEndian.PutUint32(b[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(b[12:16], opaque)
+	return concat(b, extras, []byte(key), value)
+}
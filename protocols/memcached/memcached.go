@@ -0,0 +1,242 @@
+// Package memcached parses the memcached ASCII protocol, including meta
+// commands, and the binary protocol. The server responds to commands in
+// order, so responses are matched to commands with a queue; binary protocol
+// responses also carry the request's opaque value, which tells us when the
+// server has skipped responding to quiet commands.
+package memcached
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Port           uint16 `long:"port" description:"memcached port" default:"11211"`
+	KeyDelimiters  string `long:"key_delimiters" description:"Characters that end the prefix of a key; events report key prefixes rather than whole keys" default:":"`
+	MaxPrefixBytes int    `long:"max_prefix_bytes" description:"Maximum length of key prefixes; keys without a delimiter are truncated to this length" default:"32"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if flow.DstPort != pf.Options.Port {
+		flow = flow.Reverse()
+	}
+	return &Parser{
+		options:   pf.Options,
+		flow:      flow,
+		logger:    logging.NewLogger(logrus.Fields{"flow": flow, "component": "memcached"}),
+		publisher: pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	return fmt.Sprintf("tcp port %d", pf.Options.Port)
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	options        Options
+	flow           sniffer.IPPortTuple
+	pending        []*request      // Commands awaiting responses, oldest first
+	desynchronized bool            // Whether we're waiting for the next command
+	tls            *tls.Connection // Set if the connection uses TLS
+	logger         *logging.Logger
+	publisher      publish.Publisher
+}
+
+// Event describes a command and its response. Multi-key gets are reported
+// with an event per key.
+type Event struct {
+	EventType  string  `json:"event_type"`
+	ClientIP   string  `json:"client_ip"`
+	ServerIP   string  `json:"server_ip"`
+	DurationMs float64 `json:"duration_ms"`
+	Protocol   string  `json:"protocol"` // "ascii" or "binary"
+	// The ASCII protocol command, e.g. "get", "set" or "mg", which binary
+	// protocol commands are reported as too.
+	Command   string `json:"command"`
+	KeyPrefix string `json:"key_prefix,omitempty"`
+	// "hit" or "miss" for gets, or named after the server's response, e.g.
+	// "stored", "not_found" or "client_error"; "noreply" if the client
+	// asked for no response.
+	Result string `json:"result"`
+	// The size of the value sent by the client, or returned by a hit.
+	ValueBytes int  `json:"value_bytes"`
+	Error      bool `json:"error"`
+	timestamp  time.Time
+}
+
+// request tracks a command until its response is complete.
+type request struct {
+	event Event
+	// For ASCII gets, the keys looked up, and the sizes of the values
+	// found so far.
+	keys   []string
+	values map[string]int
+	// For ASCII meta commands with the q flag, the result of the responses
+	// the server suppresses.
+	quietResult string
+	// For the binary protocol.
+	opcode opcode
+	opaque uint32
+	binary bool
+}
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
+			return
+		}
+		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		if m.Skipped() > 0 {
+			p.desynchronize("skipped bytes")
+		}
+		br := bufio.NewReader(m)
+		if toServer {
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				// We can't parse anything on this connection, but can
+				// still report on it.
+				p.logger.Debug("Connection uses TLS", logrus.Fields{})
+				p.tls = tls.NewConnection("memcached", p.flow, m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), toServer)
+				continue
+			}
+		}
+		b, err := br.Peek(1)
+		if err == nil {
+			switch {
+			case toServer && b[0] == REQUEST_MAGIC:
+				err = p.parseBinaryRequests(br, m.Timestamp())
+			case toServer:
+				err = p.parseASCIIRequests(br, m.Timestamp())
+			case b[0] == RESPONSE_MAGIC:
+				err = p.parseBinaryResponses(br, m.Timestamp())
+			default:
+				err = p.parseASCIIResponses(br, m.Timestamp())
+			}
+		}
+		if err != io.EOF {
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("memcached.parse_errors").Add()
+			p.desynchronize(err.Error())
+			io.Copy(ioutil.Discard, br)
+		}
+	}
+}
+
+// desynchronize forgets about outstanding commands once we can no longer
+// tell which responses belong to them.
+func (p *Parser) desynchronize(reason string) {
+	if p.desynchronized {
+		return
+	}
+	p.logger.Debug("Stream desynchronized", logrus.Fields{"reason": reason})
+	metrics.Counter("memcached.desyncs").Add()
+	p.pending = nil
+	p.desynchronized = true
+}
+
+// enqueue adds a command to those awaiting responses; first is whether it
+// was at the start of a TCP message.
+func (p *Parser) enqueue(req *request, first bool) {
+	if first {
+		// A command at the start of a new TCP message is likely to be the
+		// start of a command, since clients write each one (or each batch
+		// of pipelined ones) in one go.
+		p.desynchronized = false
+	}
+	if p.desynchronized {
+		return
+	}
+	if len(p.pending) >= maxPendingCommands {
+		p.desynchronize("too many pending commands")
+		return
+	}
+	p.pending = append(p.pending, req)
+}
+
+func (p *Parser) newRequest(protocol string, command string, key string, timestamp time.Time) *request {
+	return &request{event: Event{
+		Protocol:  protocol,
+		Command:   command,
+		KeyPrefix: p.keyPrefix(key),
+		timestamp: timestamp,
+	}}
+}
+
+// keyPrefix returns the part of key before the first delimiter, if there is
+// one.
+func (p *Parser) keyPrefix(key string) string {
+	if i := strings.IndexAny(key, p.options.KeyDelimiters); i >= 0 {
+		key = key[:i]
+	}
+	if len(key) > p.options.MaxPrefixBytes {
+		key = key[:p.options.MaxPrefixBytes]
+	}
+	return key
+}
+
+// requestDone removes the oldest pending command from the queue and
+// publishes events for it. For gets, an empty result means that the
+// response ended normally, and each key was a hit or a miss.
+func (p *Parser) requestDone(result string, timestamp time.Time) {
+	req := p.pending[0]
+	p.pending[0] = nil
+	p.pending = p.pending[1:]
+	if req.keys == nil {
+		p.publish(req.event, result, timestamp)
+		return
+	}
+	for _, key := range req.keys {
+		e := req.event
+		e.KeyPrefix = p.keyPrefix(key)
+		keyResult := result
+		if keyResult == "" {
+			keyResult = "miss"
+			if size, ok := req.values[key]; ok {
+				keyResult = "hit"
+				e.ValueBytes = size
+			}
+		}
+		p.publish(e, keyResult, timestamp)
+	}
+}
+
+func (p *Parser) publish(e Event, result string, timestamp time.Time) {
+	e.EventType = "command"
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	e.Result = result
+	e.Error = errorResults[result]
+	if timestamp.After(e.timestamp) {
+		e.DurationMs = float64(timestamp.Sub(e.timestamp).Nanoseconds()) / 1e6
+	}
+	p.publisher.Publish(&e, e.timestamp)
+	metrics.Counter("memcached.commands_parsed").Add()
+}
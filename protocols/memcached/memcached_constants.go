@@ -0,0 +1,271 @@
+package memcached
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// See https://github.com/memcached/memcached/blob/master/doc/protocol.txt
+// and https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped
+
+// Binary protocol magic bytes, which start every request and response.
+const (
+	REQUEST_MAGIC  byte = 0x80
+	RESPONSE_MAGIC byte = 0x81
+)
+
+const binaryHeaderLength = 24
+
+// Binary protocol opcodes.
+const (
+	OP_GET        byte = 0x00
+	OP_SET        byte = 0x01
+	OP_ADD        byte = 0x02
+	OP_REPLACE    byte = 0x03
+	OP_DELETE     byte = 0x04
+	OP_INCREMENT  byte = 0x05
+	OP_DECREMENT  byte = 0x06
+	OP_QUIT       byte = 0x07
+	OP_FLUSH      byte = 0x08
+	OP_GETQ       byte = 0x09
+	OP_NOOP       byte = 0x0a
+	OP_VERSION    byte = 0x0b
+	OP_GETK       byte = 0x0c
+	OP_GETKQ      byte = 0x0d
+	OP_APPEND     byte = 0x0e
+	OP_PREPEND    byte = 0x0f
+	OP_STAT       byte = 0x10
+	OP_SETQ       byte = 0x11
+	OP_ADDQ       byte = 0x12
+	OP_REPLACEQ   byte = 0x13
+	OP_DELETEQ    byte = 0x14
+	OP_INCREMENTQ byte = 0x15
+	OP_DECREMENTQ byte = 0x16
+	OP_QUITQ      byte = 0x17
+	OP_FLUSHQ     byte = 0x18
+	OP_APPENDQ    byte = 0x19
+	OP_PREPENDQ   byte = 0x1a
+	OP_VERBOSITY  byte = 0x1b
+	OP_TOUCH      byte = 0x1c
+	OP_GAT        byte = 0x1d
+	OP_GATQ       byte = 0x1e
+	OP_SASL_LIST  byte = 0x20
+	OP_SASL_AUTH  byte = 0x21
+	OP_SASL_STEP  byte = 0x22
+	OP_GATK       byte = 0x23
+	OP_GATKQ      byte = 0x24
+)
+
+type opcode struct {
+	name string
+	// The command's name in the ASCII protocol, which events report for
+	// both, and the result it has when it succeeds.
+	command   string
+	success   string
+	retrieval bool // Whether it looks a key up
+	quiet     bool // Whether the server only responds on a miss or error
+}
+
+var opcodes = map[byte]opcode{
+	OP_GET:        {"get", "get", "hit", true, false},
+	OP_GETQ:       {"getq", "get", "hit", true, true},
+	OP_GETK:       {"getk", "get", "hit", true, false},
+	OP_GETKQ:      {"getkq", "get", "hit", true, true},
+	OP_GAT:        {"gat", "gat", "hit", true, false},
+	OP_GATQ:       {"gatq", "gat", "hit", true, true},
+	OP_GATK:       {"gatk", "gat", "hit", true, false},
+	OP_GATKQ:      {"gatkq", "gat", "hit", true, true},
+	OP_SET:        {"set", "set", "stored", false, false},
+	OP_SETQ:       {"setq", "set", "stored", false, true},
+	OP_ADD:        {"add", "add", "stored", false, false},
+	OP_ADDQ:       {"addq", "add", "stored", false, true},
+	OP_REPLACE:    {"replace", "replace", "stored", false, false},
+	OP_REPLACEQ:   {"replaceq", "replace", "stored", false, true},
+	OP_APPEND:     {"append", "append", "stored", false, false},
+	OP_APPENDQ:    {"appendq", "append", "stored", false, true},
+	OP_PREPEND:    {"prepend", "prepend", "stored", false, false},
+	OP_PREPENDQ:   {"prependq", "prepend", "stored", false, true},
+	OP_DELETE:     {"delete", "delete", "deleted", false, false},
+	OP_DELETEQ:    {"deleteq", "delete", "deleted", false, true},
+	OP_INCREMENT:  {"increment", "incr", "ok", false, false},
+	OP_INCREMENTQ: {"incrementq", "incr", "ok", false, true},
+	OP_DECREMENT:  {"decrement", "decr", "ok", false, false},
+	OP_DECREMENTQ: {"decrementq", "decr", "ok", false, true},
+	OP_TOUCH:      {"touch", "touch", "touched", false, false},
+	OP_FLUSH:      {"flush", "flush_all", "ok", false, false},
+	OP_FLUSHQ:     {"flushq", "flush_all", "ok", false, true},
+	OP_NOOP:       {"noop", "noop", "ok", false, false},
+	OP_VERSION:    {"version", "version", "ok", false, false},
+	OP_STAT:       {"stat", "stats", "ok", false, false},
+	OP_VERBOSITY:  {"verbosity", "verbosity", "ok", false, false},
+	OP_SASL_LIST:  {"sasl_list_mechs", "sasl_list_mechs", "ok", false, false},
+	OP_SASL_AUTH:  {"sasl_auth", "sasl_auth", "ok", false, false},
+	OP_SASL_STEP:  {"sasl_step", "sasl_step", "ok", false, false},
+}
+
+// Binary protocol response statuses, named like the equivalent ASCII
+// responses where there are any.
+var statusResults = map[uint16]string{
+	0x0001: "not_found",
+	0x0002: "exists",
+	0x0003: "too_large",
+	0x0004: "invalid_arguments",
+	0x0005: "not_stored",
+	0x0006: "non_numeric",
+	0x0008: "auth_error",
+	0x0009: "auth_continue",
+	0x0081: "unknown_command",
+	0x0082: "out_of_memory",
+}
+
+// ASCII responses that end a command, other than values.
+var asciiResults = map[string]string{
+	"STORED":       "stored",
+	"NOT_STORED":   "not_stored",
+	"EXISTS":       "exists",
+	"NOT_FOUND":    "not_found",
+	"DELETED":      "deleted",
+	"TOUCHED":      "touched",
+	"OK":           "ok",
+	"ERROR":        "error",
+	"CLIENT_ERROR": "client_error",
+	"SERVER_ERROR": "server_error",
+	"VERSION":      "version",
+	"RESET":        "reset",
+	// Meta command responses
+	"HD": "ok",
+	"NS": "not_stored",
+	"EX": "exists",
+	"NF": "not_found",
+	"MN": "ok",
+	"ME": "ok",
+}
+
+var errorResults = map[string]bool{
+	"error":             true,
+	"client_error":      true,
+	"server_error":      true,
+	"too_large":         true,
+	"invalid_arguments": true,
+	"non_numeric":       true,
+	"auth_error":        true,
+	"unknown_command":   true,
+	"out_of_memory":     true,
+}
+
+// Safety constraints:
+// Don't queue more than this many pipelined commands per connection.
+const maxPendingCommands = 1024
+
+// Don't accept ASCII lines longer than this. The server's own limit is
+// 2048 bytes for most commands, but multi-key gets can be longer.
+const maxLineLength = 65536
+
+// Don't report on more than this many keys of a multi-key get.
+const maxKeysPerCommand = 1024
+
+// Don't accept values larger than this; the server's own limit (-I) is at
+// most 1GB.
+const maxValueLength = 1 << 30
+
+var errLineTooLong = errors.New("Line too long")
+
+type binaryHeader struct {
+	Magic        byte
+	Opcode       byte
+	KeyLength    int
+	ExtrasLength int
+	Status       uint16 // For responses; for requests, the vbucket ID
+	BodyLength   int
+	Opaque       uint32
+}
+
+// ValueLength returns the length of the value that follows the extras and
+// key in the body.
+func (h *binaryHeader) ValueLength() int {
+	return h.BodyLength - h.ExtrasLength - h.KeyLength
+}
+
+// readBinaryMessage reads a request or response, returning its header and
+// key. The extras and value are read and discarded.
+func readBinaryMessage(r io.Reader) (*binaryHeader, string, error) {
+	var b [binaryHeaderLength]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, "", err
+	}
+	h := binaryHeader{
+		Magic:        b[0],
+		Opcode:       b[1],
+		KeyLength:    int(binary.BigEndian.Uint16(b[2:4])),
+		ExtrasLength: int(b[4]),
+		Status:       binary.BigEndian.Uint16(b[6:8]),
+		BodyLength:   int(binary.BigEndian.Uint32(b[8:12])),
+		Opaque:       binary.BigEndian.Uint32(b[12:16]),
+	}
+	if h.Magic != REQUEST_MAGIC && h.Magic != RESPONSE_MAGIC {
+		return nil, "", fmt.Errorf("Bad binary protocol magic %#x", h.Magic)
+	}
+	if h.ValueLength() < 0 || h.BodyLength > maxValueLength {
+		return nil, "", fmt.Errorf("Bad binary protocol body length %d", h.BodyLength)
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(h.ExtrasLength)); err != nil {
+		return nil, "", unexpectedEOF(err)
+	}
+	key := make([]byte, h.KeyLength)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, "", unexpectedEOF(err)
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(h.ValueLength())); err != nil {
+		return nil, "", unexpectedEOF(err)
+	}
+	return &h, string(key), nil
+}
+
+// readLine reads an ASCII protocol line, without its CRLF.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		line = append(line, b...)
+		if len(line) > maxLineLength {
+			return "", errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if len(line) > 0 {
+				return "", unexpectedEOF(err)
+			}
+			return "", err
+		}
+		break
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return string(line), nil
+}
+
+// skipData discards a data block of the given length and its CRLF.
+func skipData(r io.Reader, length int) error {
+	if length < 0 || length > maxValueLength {
+		return fmt.Errorf("Bad data block length %d", length)
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(length)+2); err != nil {
+		return unexpectedEOF(err)
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package memcached
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	p := newParser(&sniffertest.Publisher{}).(*Parser)
+	assert.Equal(t, "user", p.keyPrefix("user:1234"))
+	assert.Equal(t, "", p.keyPrefix(":1234"))
+	assert.Equal(t, "session", p.keyPrefix("session"))
+	assert.Equal(t, "abcdefghijklmnopqrstuvwxyzabcdef", p.keyPrefix("abcdefghijklmnopqrstuvwxyzabcdefghij"))
+}
+
+func TestResyncAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("get user:1\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.AppendSkipped([]byte("lue\r\nEND\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse(), 100)
+	ms.Append([]byte("delete session:1\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("DELETED\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "delete", events[0]["command"])
+		assert.Equal(t, "deleted", events[0]["result"])
+	}
+}
+
+func TestTooManyPendingCommands(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(bytes.Repeat([]byte("delete user:1\r\n"), maxPendingCommands+2), sniffertest.DefaultDate(), defaultFlow())
+	// The response to the first command isn't attributed to the last.
+	ms.Append([]byte("NOT_FOUND\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("delete session:1\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("DELETED\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "deleted", events[0]["result"])
+	}
+}
+
+func TestValueBytesAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.AppendSkipped([]byte("part of a value\r\nmore value bytes\r\n"), sniffertest.DefaultDate(), defaultFlow(), 100)
+	ms.Append([]byte("STORED\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("incr hits 1\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("more value bytes\r\n2\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("version\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("VERSION 1.6.21\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	// Neither the value bytes nor the response that was ignored after them
+	// are taken for a command.
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "version", events[0]["command"])
+		assert.Equal(t, "version", events[0]["result"])
+	}
+}
+
+func TestTLSConnection(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	clientHello := []byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00}
+	ms.Append(clientHello, sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte{0x17, 0x03, 0x03, 0x00, 0x01, 0xaa}, sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "tls_connection", events[0]["event_type"])
+		assert.Equal(t, "memcached", events[0]["protocol"])
+		assert.Equal(t, float64(9), events[0]["bytes_to_server"])
+		assert.Equal(t, float64(6), events[0]["bytes_from_server"])
+	}
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(11211)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		Options:   Options{Port: 11211, KeyDelimiters: ":", MaxPrefixBytes: 32},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
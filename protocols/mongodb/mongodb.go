@@ -1,6 +1,7 @@
 package mongodb
 
 import (
+	"bufio"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
@@ -16,6 +17,7 @@ import (
 	"github.com/codahale/metrics"
 	"github.com/honeycombio/honeycomb-tcpagent/logging"
 	"github.com/honeycombio/honeycomb-tcpagent/protocols/mongodb/queryshape"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
 	"github.com/honeycombio/honeycomb-tcpagent/publish"
 	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
 )
@@ -105,6 +107,7 @@ type Parser struct {
 	qcache    *QCache
 	logger    *logging.Logger
 	publisher publish.Publisher
+	tls       *tls.Connection // Set if the connection uses TLS
 }
 
 func (p *Parser) On(ms sniffer.MessageStream) {
@@ -112,16 +115,36 @@ func (p *Parser) On(ms sniffer.MessageStream) {
 		m, ok := ms.Next()
 		if !ok {
 			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
 			return
 		}
 		isRequest := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), isRequest)
+			continue
+		}
+		var r io.Reader = m
+		if isRequest {
+			br := bufio.NewReader(m)
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				// We can't parse anything on this connection, but can
+				// still report on it.
+				p.logger.Debug("Connection uses TLS", logrus.Fields{})
+				p.tls = tls.NewConnection("mongodb", p.flow, m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), isRequest)
+				continue
+			}
+			r = br
+		}
 		var err error
 		p.logger.Debug("Parsing MongoDB message",
 			logrus.Fields{"isRequest": isRequest})
 		if isRequest {
-			err = p.parseRequest(m, m.Timestamp())
+			err = p.parseRequest(r, m.Timestamp())
 		} else {
-			err = p.parseResponse(m, m.Timestamp())
+			err = p.parseResponse(r, m.Timestamp())
 		}
 		if err != io.EOF {
 			p.logger.Debug("Error parsing request",
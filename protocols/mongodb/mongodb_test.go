@@ -236,6 +236,24 @@ func TestRemainingBytesDiscardedOnError(t *testing.T) {
 	}
 }
 
+func TestTLSConnection(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	clientHello := []byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00}
+	ms.Append(clientHello, defaultDate(), defaultFlow())
+	ms.Append([]byte{0x17, 0x03, 0x03, 0x00, 0x01, 0xaa}, defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.output)) {
+		var ret map[string]interface{}
+		json.Unmarshal(tp.output[0], &ret)
+		assert.Equal(t, "tls_connection", ret["event_type"])
+		assert.Equal(t, "mongodb", ret["protocol"])
+		assert.Equal(t, float64(9), ret["bytes_to_server"])
+		assert.Equal(t, float64(6), ret["bytes_from_server"])
+	}
+}
+
 func TestReadRawMsg(t *testing.T) {
 	q, err := genQuery("collection", request{0, `{"isMaster" :1}`})
 	assert.Nil(t, err)
@@ -344,13 +362,15 @@ func genOldStyleInsert(collectionName string, documents ...interface{}) []byte {
 
 // Implements sniffer.Message
 type message struct {
-	flow sniffer.IPPortTuple
-	ts   time.Time
-	r    io.Reader
+	flow    sniffer.IPPortTuple
+	ts      time.Time
+	skipped int
+	r       io.Reader
 }
 
 func (m *message) Flow() sniffer.IPPortTuple { return m.flow }
 func (m *message) Timestamp() time.Time      { return m.ts }
+func (m *message) Skipped() int              { return m.skipped }
 func (m *message) Read(p []byte) (int, error) {
 	return m.r.Read(p)
 }
@@ -0,0 +1,191 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/klauspost/compress/zstd"
+)
+
+// When the compressed protocol is in use, each direction of the stream is a
+// sequence of compressed packets, whose payloads concatenate to the
+// sequence of regular packets. A compressed packet has a seven-byte header:
+// a three-byte compressed payload length, a sequence ID, and a three-byte
+// uncompressed payload length, which is zero if the payload was sent as-is.
+// https://dev.mysql.com/doc/internals/en/compressed-packet-header.html
+const compressedHeaderLength = 7
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Safety constraints:
+// A compressed packet decompresses to at most a packet's worth of payload, so
+// don't let a zstd frame make the decoder buffer more than that, whatever
+// window size it claims to need.
+const maxZstdWindow = maxPacketLength + 1
+
+// decompressor holds the decoders for a connection, so that they can be
+// reused across compressed packets.
+type decompressor struct {
+	zlib io.ReadCloser
+	zstd *zstd.Decoder
+}
+
+func (d *decompressor) zlibReader(r io.Reader) (io.Reader, error) {
+	if d.zlib == nil {
+		var err error
+		d.zlib, err = zlib.NewReader(r)
+		return d.zlib, err
+	}
+	return d.zlib, d.zlib.(zlib.Resetter).Reset(r, nil)
+}
+
+func (d *decompressor) zstdReader(r io.Reader) (io.Reader, error) {
+	if d.zstd == nil {
+		var err error
+		// With a concurrency of 1, the decoder doesn't start any
+		// goroutines of its own.
+		d.zstd, err = zstd.NewReader(r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(maxZstdWindow),
+			zstd.WithDecoderMaxMemory(maxZstdWindow))
+		return d.zstd, err
+	}
+	return d.zstd, d.zstd.Reset(r)
+}
+
+func (d *decompressor) Close() {
+	if d.zstd != nil {
+		d.zstd.Close()
+	}
+}
+
+// compressedReader reads the concatenated, decompressed payloads of the
+// compressed packets in r.
+type compressedReader struct {
+	r       io.Reader
+	d       *decompressor
+	raw     *io.LimitedReader // Remaining bytes of the current compressed packet
+	current io.Reader         // Decompressed payload of the current compressed packet
+}
+
+func newCompressedReader(r io.Reader, d *decompressor) *compressedReader {
+	return &compressedReader{r: r, d: d}
+}
+
+func (c *compressedReader) Read(p []byte) (int, error) {
+	for {
+		if c.current != nil {
+			n, err := c.current.Read(p)
+			if n > 0 {
+				return n, nil
+			}
+			if err == io.EOF {
+				// Skip anything the decompressor didn't consume.
+				if _, err := io.Copy(ioutil.Discard, c.raw); err != nil {
+					return 0, err
+				}
+				c.current = nil
+			} else if err != nil {
+				// Whatever we were decompressing wasn't what the header
+				// said it was, so the caller should desynchronize.
+				metrics.Counter("mysql.decompression_errors").Add()
+				return 0, fmt.Errorf("Error decompressing packet: %v", err)
+			}
+			continue
+		}
+		if err := c.nextPacket(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *compressedReader) nextPacket() error {
+	var header [compressedHeaderLength]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+	compressedLength := readUint24(header[0:3])
+	uncompressedLength := readUint24(header[4:7])
+	c.raw = &io.LimitedReader{R: c.r, N: int64(compressedLength)}
+	if uncompressedLength == 0 {
+		c.current = c.raw
+		return nil
+	}
+
+	// The handshake tells us which algorithm the client asked for, but we
+	// may not have seen it, so go by the payload's magic number instead.
+	br := bufio.NewReaderSize(c.raw, len(zstdMagic))
+	magic, _ := br.Peek(len(zstdMagic))
+	var decompressed io.Reader
+	var err error
+	if bytes.Equal(magic, zstdMagic) {
+		decompressed, err = c.d.zstdReader(br)
+	} else {
+		decompressed, err = c.d.zlibReader(br)
+	}
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	c.current = io.LimitReader(decompressed, int64(uncompressedLength))
+	return nil
+}
+
+// detectCompression guesses whether a connection whose handshake we didn't
+// see uses the compressed protocol, by peeking at the start of a request
+// message.
+func (p *Parser) detectCompression(br *bufio.Reader) {
+	b, err := br.Peek(compressedHeaderLength + 5)
+	if err != nil {
+		// Too short to tell.
+		return
+	}
+	compressed, known := guessCompression(b)
+	if !known {
+		return
+	}
+	p.compressionKnown = true
+	if compressed {
+		p.logger.Debug("Detected compressed protocol", logrus.Fields{})
+		metrics.Counter("mysql.compressed_streams_detected").Add()
+		p.compressed = true
+	}
+}
+
+// guessCompression looks at the first bytes of a request message, and
+// reports whether they're the start of a compressed packet, and whether it
+// could tell at all.
+func guessCompression(b []byte) (compressed bool, known bool) {
+	compressedLength := readUint24(b[0:3])
+	uncompressedLength := readUint24(b[4:7])
+	// The compressed sequence ID is reset for each command.
+	if b[3] == 0 {
+		if uncompressedLength == 0 {
+			// Read as a regular packet, this would be a COM_SLEEP command,
+			// which clients never send. Check that the payload looks like
+			// a command packet as well.
+			innerLength := readUint24(b[7:10])
+			if innerLength > 0 && innerLength+4 <= compressedLength &&
+				b[10] == 0 && b[11] <= COM_RESET_CONNECTION {
+				return true, true
+			}
+		} else if bytes.Equal(b[7:11], zstdMagic) ||
+			(b[7] == 0x78 && (uint16(b[7])<<8|uint16(b[8]))%31 == 0) {
+			// zlib streams start with 0x78 and a checksummed flag byte.
+			return true, true
+		}
+	}
+	if b[3] == 0 && b[4] > COM_SLEEP && b[4] <= COM_RESET_CONNECTION {
+		return false, true
+	}
+	return false, false
+}
+
+func readUint24(b []byte) int {
+	return int(b[0]) + int(b[1])<<8 + int(b[2])<<16
+}
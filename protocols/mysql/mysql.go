@@ -1,27 +1,39 @@
 package mysql
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
 	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
 )
 
 type Options struct {
-	Port uint16 `long:"port" description:"MySQL port" default:"3306"`
+	Port           uint16 `long:"port" description:"MySQL port" default:"3306"`
+	MaxPayloadSize int    `long:"max_payload_size" description:"Maximum number of bytes of a single MySQL payload to buffer per connection; longer payloads are truncated" default:"1048576"`
+	ColumnNames    bool   `long:"column_names" description:"Include the tables and columns that each query's results came from"`
+
+	Replication         bool `long:"replication" description:"Report on replication streams from this server to its replicas"`
+	ReplicationInterval int  `long:"replication_interval" description:"How often to report on each replication stream, in seconds" default:"10"`
 }
 
 // ParserFactory implements sniffer.ConsumerFactory
 // TODO: this way of setting things up is kind of confusing
 type ParserFactory struct {
-	Options Options
+	Options   Options
+	Publisher publish.Publisher
 }
 
 func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
@@ -29,8 +41,12 @@ func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
 		flow = flow.Reverse()
 	}
 	return &Parser{
-		options: pf.Options,
-		flow:    flow,
+		options:   pf.Options,
+		flow:      flow,
+		state:     parseStateIdle,
+		logger:    logging.NewLogger(logrus.Fields{"flow": flow, "component": "mysql"}),
+		publisher: pf.Publisher,
+		output:    os.Stdout,
 	}
 }
 
@@ -44,25 +60,97 @@ type Parser struct {
 	flow              sniffer.IPPortTuple
 	currentQueryEvent QueryEvent
 	state             parseState
+	nextSequenceID    byte // Expected sequence ID of the next response packet
+	columnsRemaining  int  // Column definitions left in the current result set
+	expectEOF         bool // Whether an EOF packet may follow the column definitions
+	infileContinued   bool // Whether the last LOCAL INFILE packet was maximum-length
+	logger            *logging.Logger
+	publisher         publish.Publisher
+	output            io.Writer // Where query events are written
+
+	serverCapabilities uint32 // From the initial handshake, if we saw it
+	capabilities       uint32 // Negotiated in the handshake, if we saw it
+	compressAfterAuth  bool   // Whether the client negotiated compression
+	compressed         bool   // Whether the compressed protocol is in use
+	compressionKnown   bool   // Whether we can trust the compressed field
+	decompressor       decompressor
+
+	transaction      *TransactionEvent // The open transaction, if any
+	transactionCount int
+
+	user           string           // The session's user, if we know it
+	schema         string           // The session's default schema, if we know it
+	currentCommand CommandEvent     // The non-query command in flight, if any
+	pending        []pendingCommand // Commands queued behind the one in flight
+
+	replication *replicationStream // The replication stream, if this is one
+	tls         *tls.Connection    // Set once the connection switches to TLS
 }
 
 func (p *Parser) On(ms sniffer.MessageStream) {
 	for {
 		m, ok := ms.Next()
 		if !ok {
-			logrus.WithFields(logrus.Fields{"flow": p.flow}).Debug("Messages closed")
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			p.decompressor.Close()
+			if p.transaction != nil {
+				p.endTransaction("connection_closed")
+			}
+			if p.replication != nil {
+				p.endReplication(p.replication.last)
+			}
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
 			return
 		}
+		if m.Skipped() > 0 {
+			p.desynchronize("skipped bytes")
+		}
 		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		var r io.Reader = m
+		if toServer && !p.compressed {
+			br := bufio.NewReader(m)
+			// We may have missed the SSLRequest packet, or the client may
+			// not have sent one (e.g., if it's talking to a proxy).
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				p.startTLS(m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), toServer)
+				continue
+			}
+			if !p.compressionKnown {
+				p.detectCompression(br)
+			}
+			r = br
+		}
+		if p.compressed {
+			r = newCompressedReader(r, &p.decompressor)
+		}
+		var err error
 		if toServer {
-			p.parseRequestStream(m, m.Timestamp())
+			err = p.parseRequestStream(r, m.Timestamp())
 		} else {
-			p.parseResponseStream(m, m.Timestamp())
+			err = p.parseResponseStream(r, m.Timestamp())
+		}
+		if err != io.EOF {
+			// We no longer know where packet boundaries are, or which
+			// command the server is responding to, so throw away the rest
+			// of the message and wait for the next command.
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("mysql.parse_errors").Add()
+			p.desynchronize(err.Error())
+			io.Copy(ioutil.Discard, m)
 		}
 	}
 }
 
 type QueryEvent struct {
+	EventType   string `json:"event_type"`
 	Timestamp   time.Time
 	ClientIP    string
 	ServerIP    string
@@ -73,12 +161,64 @@ type QueryEvent struct {
 	ColumnsSent int
 	Error       bool
 	ErrorCode   int
+	// Number of result sets returned. Multi-statement queries and stored
+	// procedure calls can return several, in which case RowsSent,
+	// BytesSent and ColumnsSent are totals across all of them.
+	ResultSetCount int `json:"result_set_count"`
+	// Rows inserted, updated or deleted, from the OK packets in the
+	// response.
+	RowsAffected uint64 `json:"rows_affected"`
+	// For LOAD DATA LOCAL INFILE, the file that the server asked the
+	// client to send, and the number of bytes the client sent.
+	LocalInfile   string `json:"local_infile,omitempty"`
+	BytesUploaded int    `json:"bytes_uploaded,omitempty"`
+	// The session's user and default schema when the query was sent, if
+	// we saw the handshake or a command that set them.
+	User   string `json:"user,omitempty"`
+	Schema string `json:"schema,omitempty"`
+	// With the column_names option, the tables ("schema.table") and
+	// columns that result sets were drawn from. Computed columns have no
+	// table.
+	Tables  []string `json:"tables,omitempty"`
+	Columns []string `json:"columns,omitempty"`
+	// The transaction the query ran in, if any. See TransactionEvent.
+	TransactionID    string `json:"transaction_id,omitempty"`
+	statusFlags      uint16 // From the packet that ended the response
+	statusFlagsKnown bool   // False if the response ended with an error
+}
+
+// Safety constraints:
+// Don't record more column names than this per query
+const maxColumnNames = 256
+
+// Don't queue more than this many pipelined commands per connection
+const maxPendingCommands = 32
+
+// A pendingCommand is a command that the client sent while waiting for the
+// response to an earlier one.
+type pendingCommand struct {
+	packet    *mySQLPacket
+	timestamp time.Time
 }
 
+// errDesynchronized is returned when a packet doesn't fit in the sequence we
+// expect, which means that we've lost track of the command/response cycle.
+var errDesynchronized = errors.New("MySQL stream desynchronized")
+
+// maxPacketLength is the largest payload length that fits in a single MySQL
+// packet header. Payloads of this length or longer are split into a sequence
+// of packets, terminated by one that is shorter than maxPacketLength
+// (possibly empty).
+const maxPacketLength = 0xFFFFFF
+
+// A mySQLPacket is a single logical payload, which may have been reassembled
+// from several physical packets.
 type mySQLPacket struct {
-	PayloadLength int
-	SequenceID    byte
-	payload       []byte
+	PayloadLength  int  // Total length of the logical payload
+	SequenceID     byte // Sequence ID of the first physical packet
+	LastSequenceID byte // Sequence ID of the last physical packet
+	Truncated      bool // Whether payload holds only a prefix of the payload
+	payload        []byte
 }
 
 func (mp *mySQLPacket) FirstPayloadByte() byte { return mp.payload[0] }
@@ -89,177 +229,601 @@ const (
 	parseStateChompFirstPacket parseState = iota
 	parseStateChompColumnDefs
 	parseStateChompRows
+	// No command we're tracking is in flight.
+	parseStateIdle
+	// We've lost track of the command/response cycle, and are waiting for
+	// the next plausible command packet.
+	parseStateDesynchronized
+	// The server has sent its initial handshake, and we're waiting for the
+	// client's response.
+	parseStateHandshake
+	// The client has responded to the handshake, and we're waiting for the
+	// server to accept or reject it.
+	parseStateAuthenticating
+	// We're waiting for the response to a non-query command.
+	parseStateCommandResponse
+	// The server is streaming binlog events to a replica.
+	parseStateBinlogStream
+	// The client is sending a file for LOAD DATA LOCAL INFILE.
+	parseStateLocalInfile
 )
 
 var stateMap = map[parseState]string{
 	0: "parseStateChompFirstPacket",
 	1: "parseStateChompColumnDefs",
 	2: "parseStateChompRows",
+	3: "parseStateIdle",
+	4: "parseStateDesynchronized",
+	5: "parseStateHandshake",
+	6: "parseStateAuthenticating",
+	7: "parseStateCommandResponse",
+	8: "parseStateBinlogStream",
+	9: "parseStateLocalInfile",
 }
 
 func (p *Parser) parseRequestStream(r io.Reader, timestamp time.Time) error {
-	logrus.Debug("Parsing request stream")
+	p.logger.Debug("Parsing request stream", logrus.Fields{})
 	for {
-		packet, err := readPacket(r)
+		if p.state == parseStateLocalInfile {
+			// File contents can be arbitrarily long, and we don't need
+			// them, so don't buffer them.
+			if err := p.readInfilePacket(r); err != nil {
+				return err
+			}
+			continue
+		}
+		packet, err := readPacket(r, p.options.MaxPayloadSize)
 		if err != nil {
 			return err
 		}
-		if packet.FirstPayloadByte() == COM_QUERY {
-			p.currentQueryEvent.Query = string(packet.payload[1:])
-			p.currentQueryEvent.Timestamp = timestamp
-			logrus.WithFields(logrus.Fields{"query": p.currentQueryEvent.Query}).Debug("Parsed query")
-		} else {
-			logrus.WithFields(logrus.Fields{"command": packet.payload[0]}).Debug("Skipping non-QUERY command")
-			// TODO: usefully handle some non-query packets
+		if p.state == parseStateBinlogStream {
+			// Replicas only send acknowledgements for semi-synchronous
+			// replication once the stream has started.
+			continue
+		}
+		if packet.SequenceID != 0 {
+			// Commands always start a new sequence. Outside of the connection
+			// phase, the client only sends other packets in the middle of an
+			// exchange.
+			if p.state == parseStateHandshake && packet.SequenceID == 1 {
+				p.parseHandshakeResponse(packet, timestamp)
+				if p.tls != nil {
+					// The TLS handshake may follow in the same message.
+					p.tls.Observe(r, timestamp, true)
+					return io.EOF
+				}
+				continue
+			}
+			if p.state == parseStateCommandResponse &&
+				p.currentCommand.command == COM_CHANGE_USER &&
+				packet.SequenceID == p.nextSequenceID {
+				// Changing user can take more than one round trip to
+				// authenticate.
+				p.nextSequenceID = packet.LastSequenceID + 1
+				continue
+			}
+			if p.state == parseStateIdle || p.state == parseStateDesynchronized ||
+				p.state == parseStateAuthenticating {
+				p.logger.Debug("Skipping non-command packet",
+					logrus.Fields{"sequenceID": packet.SequenceID})
+				continue
+			}
+			return errDesynchronized
 		}
+		if p.state == parseStateDesynchronized {
+			if !isPlausibleCommand(packet) {
+				continue
+			}
+			p.logger.Debug("Resynchronized stream", logrus.Fields{})
+			metrics.Counter("mysql.resyncs").Add()
+		} else if p.commandInFlight() {
+			// The client is pipelining commands: the server will respond to
+			// this one once it's done with the ones before it.
+			if len(p.pending) >= maxPendingCommands {
+				// More likely, we've missed some responses.
+				p.desynchronize("too many pending commands")
+				continue
+			}
+			p.logger.Debug("Command sent before previous response completed",
+				logrus.Fields{"parserState": stateMap[p.state], "pending": len(p.pending)})
+			metrics.Counter("mysql.pipelined_commands").Add()
+			p.pending = append(p.pending, pendingCommand{packet, timestamp})
+			continue
+		}
+		p.startCommandPacket(packet, timestamp)
 	}
 }
 
-func readPacket(r io.Reader) (*mySQLPacket, error) {
-	buf := make([]byte, 4)
-	_, err := r.Read(buf)
-	if err == io.EOF {
-		return nil, err
-	} else if err != nil {
-		logrus.WithFields(logrus.Fields{"header": buf, "err": err}).Debug("Bad MySQL packet header")
-		return nil, err
+// startCommandPacket starts tracking the response to a command that the
+// client sent at timestamp.
+func (p *Parser) startCommandPacket(packet *mySQLPacket, timestamp time.Time) {
+	p.currentQueryEvent = QueryEvent{}
+	p.currentCommand = CommandEvent{}
+	p.nextSequenceID = packet.LastSequenceID + 1
+	switch packet.FirstPayloadByte() {
+	case COM_QUERY:
+		p.currentQueryEvent.Query = string(packet.payload[1:])
+		p.currentQueryEvent.User = p.user
+		p.currentQueryEvent.Schema = p.schema
+		p.currentQueryEvent.Timestamp = timestamp
+		p.state = parseStateChompFirstPacket
+		p.logger.Debug("Parsed query", logrus.Fields{"query": p.currentQueryEvent.Query})
+	case COM_INIT_DB, COM_CHANGE_USER, COM_RESET_CONNECTION, COM_PING, COM_QUIT:
+		p.logger.Debug("Parsed command",
+			logrus.Fields{"command": packet.FirstPayloadByte()})
+		p.startCommand(packet, timestamp)
+	case COM_BINLOG_DUMP, COM_BINLOG_DUMP_GTID:
+		if !p.options.Replication {
+			p.state = parseStateIdle
+			break
+		}
+		p.startReplication(packet, timestamp)
+	default:
+		p.logger.Debug("Skipping unsupported command",
+			logrus.Fields{"command": packet.FirstPayloadByte()})
+		p.state = parseStateIdle
+		if len(p.pending) > 0 && hasResponse(packet.FirstPayloadByte()) {
+			// We don't know where its response ends, so we can't tell
+			// which responses belong to the commands after it.
+			p.logger.Debug("Dropping pipelined commands",
+				logrus.Fields{"count": len(p.pending)})
+			metrics.Counter("mysql.pipelined_commands_dropped").Add()
+			p.pending = nil
+		}
 	}
-	p := mySQLPacket{}
-	p.PayloadLength = int(buf[0]) + int(buf[1])<<8 + int(buf[2])<<16
-	p.SequenceID = buf[3]
-	// TODO: we need to guard against unsafe values of p.PayloadLength here
-	// (as in the MongoDB parser's use of newSafeBuffer)
-	p.payload = make([]byte, p.PayloadLength)
+}
 
-	if p.PayloadLength == 0 {
-		return nil, errors.New("Bad MySQL packet header")
+// startNextCommand starts tracking the oldest pipelined command, once the
+// response to the previous one is complete.
+func (p *Parser) startNextCommand() {
+	for len(p.pending) > 0 && p.state == parseStateIdle {
+		c := p.pending[0]
+		p.pending[0] = pendingCommand{}
+		p.pending = p.pending[1:]
+		p.startCommandPacket(c.packet, c.timestamp)
 	}
+}
 
-	bytesRead := 0
-	for {
-		n, err := r.Read(p.payload[bytesRead:])
-		bytesRead += n
-		if bytesRead == p.PayloadLength {
-			break
-		}
+// hasResponse reports whether the server responds to command.
+func hasResponse(command byte) bool {
+	return command != COM_STMT_CLOSE && command != COM_STMT_SEND_LONG_DATA &&
+		command != COM_QUIT
+}
+
+// commandInFlight reports whether we're waiting for the response to a
+// command.
+func (p *Parser) commandInFlight() bool {
+	return p.state == parseStateChompFirstPacket ||
+		p.state == parseStateChompColumnDefs ||
+		p.state == parseStateChompRows ||
+		p.state == parseStateCommandResponse ||
+		p.state == parseStateLocalInfile
+}
+
+// isPlausibleCommand reports whether packet looks enough like a command to
+// resynchronize on. It's only a heuristic: after a gap in the stream, we may
+// be reading from the middle of a packet.
+func isPlausibleCommand(packet *mySQLPacket) bool {
+	if packet.SequenceID != 0 || packet.FirstPayloadByte() > COM_RESET_CONNECTION {
+		return false
+	}
+	if packet.FirstPayloadByte() == COM_QUERY {
+		return packet.PayloadLength > 1 && (packet.Truncated || utf8.Valid(packet.payload[1:]))
+	}
+	return true
+}
+
+// desynchronize discards any in-flight query, so that we don't emit events
+// built from mismatched requests and responses.
+func (p *Parser) desynchronize(reason string) {
+	if p.state == parseStateDesynchronized {
+		return
+	}
+	p.logger.Debug("Stream desynchronized",
+		logrus.Fields{"reason": reason, "parserState": stateMap[p.state]})
+	metrics.Counter("mysql.desyncs").Add()
+	if p.replication != nil {
+		// We can't find the next binlog event, so stop here.
+		p.endReplication(p.replication.last)
+	}
+	p.currentQueryEvent = QueryEvent{}
+	p.currentCommand = CommandEvent{}
+	p.pending = nil
+	p.state = parseStateDesynchronized
+}
+
+// readPacket reads the next logical payload from r, stitching together
+// consecutive maximum-length packets. At most maxLength bytes of the payload
+// are buffered; the remainder is read and discarded, so that a corrupt header
+// can't make us allocate huge amounts of memory.
+func readPacket(r io.Reader, maxLength int) (*mySQLPacket, error) {
+	// Always keep enough of the payload to identify what kind of packet it
+	// is.
+	if maxLength < 1 {
+		maxLength = 1
+	}
+	p := mySQLPacket{}
+	var buf bytes.Buffer
+	for first := true; ; first = false {
+		length, sequenceID, err := readPacketHeader(r)
 		if err != nil {
+			if !first && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
 			return nil, err
 		}
+		if first {
+			if length == 0 {
+				return nil, errors.New("Bad MySQL packet header")
+			}
+			p.SequenceID = sequenceID
+		}
+		p.LastSequenceID = sequenceID
+		p.PayloadLength += length
+
+		toBuffer := length
+		if room := maxLength - buf.Len(); toBuffer > room {
+			toBuffer = room
+			p.Truncated = true
+		}
+		// Copying into a bytes.Buffer grows it as data actually arrives,
+		// rather than allocating based on the declared length up front.
+		if _, err := io.CopyN(&buf, r, int64(toBuffer)); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, int64(length-toBuffer)); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if length < maxPacketLength {
+			break
+		}
+	}
+	if p.Truncated {
+		logrus.WithFields(logrus.Fields{
+			"payloadLength": p.PayloadLength,
+			"maxLength":     maxLength}).Debug("Truncating MySQL payload")
+		metrics.Counter("mysql.payloads_truncated").Add()
 	}
+	p.payload = buf.Bytes()
 	return &p, nil
 }
 
+// readPacketHeader reads a four-byte packet header: a three-byte little-endian
+// payload length followed by the sequence ID.
+func readPacketHeader(r io.Reader) (length int, sequenceID byte, err error) {
+	var buf [4]byte
+	_, err = io.ReadFull(r, buf[:])
+	if err == io.EOF {
+		return 0, 0, err
+	} else if err != nil {
+		logrus.WithFields(logrus.Fields{"header": buf, "err": err}).Debug("Bad MySQL packet header")
+		return 0, 0, err
+	}
+	length = int(buf[0]) + int(buf[1])<<8 + int(buf[2])<<16
+	return length, buf[3], nil
+}
+
+// unexpectedEOF converts io.EOF into io.ErrUnexpectedEOF, for reads that end
+// in the middle of a packet.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 func (p *Parser) parseResponseStream(r io.Reader, timestamp time.Time) error {
-	logrus.Debug("Parsing response stream")
+	p.logger.Debug("Parsing response stream", logrus.Fields{})
 	for {
-		packet, err := readPacket(r)
+		packet, err := readPacket(r, p.options.MaxPayloadSize)
 		if err != nil {
-			if err != io.EOF {
-				logrus.WithFields(logrus.Fields{
-					"err":   err,
-					"state": p.state}).Error("Error parsing packet")
-			}
 			return err
 		}
-		logrus.WithFields(logrus.Fields{
-			"flow":             p.flow,
+		p.logger.Debug("Parsed response packet", logrus.Fields{
 			"firstPayloadByte": packet.FirstPayloadByte(),
 			"sequenceID":       packet.SequenceID,
 			"payloadLength":    packet.PayloadLength,
-			"parserState":      stateMap[p.state]}).Debug("Parsed response packet")
+			"parserState":      stateMap[p.state]})
 		switch p.state {
+		case parseStateIdle, parseStateDesynchronized:
+			// Not a response to anything we're tracking, unless it's the
+			// start of a new connection.
+			if packet.SequenceID == 0 && packet.FirstPayloadByte() == HANDSHAKE_V10 {
+				p.parseHandshake(packet)
+			}
+			continue
+		case parseStateHandshake:
+			continue
+		case parseStateAuthenticating:
+			p.parseAuthResponse(packet)
+			continue
+		}
+		if packet.SequenceID != p.nextSequenceID {
+			p.logger.Debug("Unexpected sequence ID", logrus.Fields{
+				"expected": p.nextSequenceID,
+				"actual":   packet.SequenceID})
+			return errDesynchronized
+		}
+		p.nextSequenceID = packet.LastSequenceID + 1
+		switch p.state {
+		case parseStateBinlogStream:
+			if err := p.parseBinlogPacket(packet, timestamp); err != nil {
+				return err
+			}
+		case parseStateCommandResponse:
+			switch packet.FirstPayloadByte() {
+			case OK:
+				p.commandDone(timestamp)
+			case ERR:
+				p.currentCommand.Error = true
+				p.currentCommand.ErrorCode = readErrorCode(packet.payload)
+				p.commandDone(timestamp)
+			}
+			// Anything else is part of authenticating a COM_CHANGE_USER.
+		case parseStateLocalInfile:
+			// The server only responds before the client has sent the
+			// whole file if something goes wrong.
+			if packet.FirstPayloadByte() != ERR {
+				return errDesynchronized
+			}
+			p.currentQueryEvent.Error = true
+			p.currentQueryEvent.ErrorCode = readErrorCode(packet.payload)
+			p.QueryEventDone(timestamp)
 		case parseStateChompFirstPacket:
 			if packet.FirstPayloadByte() == OK {
-				// TODO: parse OK packet contents
-				p.QueryEventDone()
+				m, err := readOKPacket(packet.payload)
+				if err != nil {
+					return err
+				}
+				p.currentQueryEvent.RowsAffected += m.AffectedRows
+				p.resultDone(m.StatusFlags, timestamp)
+			} else if packet.FirstPayloadByte() == LOCAL_INFILE {
+				// The server wants the client to send it a file.
+				p.currentQueryEvent.LocalInfile = string(packet.payload[1:])
+				p.infileContinued = false
+				p.state = parseStateLocalInfile
+				p.logger.Debug("Server requested local file",
+					logrus.Fields{"filename": p.currentQueryEvent.LocalInfile})
 			} else if packet.FirstPayloadByte() == EOF && packet.PayloadLength < 9 {
 				// TODO: parse EOF packet contents
 			} else if packet.FirstPayloadByte() == ERR {
+				// An error ends the whole response, even if earlier results
+				// said that more would follow.
 				p.currentQueryEvent.Error = true
-				p.QueryEventDone()
-				p.state = parseStateChompFirstPacket
-				// TODO: parse error packet contents
+				p.currentQueryEvent.ErrorCode = readErrorCode(packet.payload)
+				p.QueryEventDone(timestamp)
 			} else {
-				columnCount, err := readLengthEncodedInteger(packet.FirstPayloadByte(), packet.payload[1:])
-				if err != nil {
-					logrus.WithError(err).Error("Error parsing column count")
-					return err
+				r := newErrReader(packet.payload)
+				columnCount := r.LengthEncodedInteger()
+				metadataFollows := true
+				if p.capabilities&CLIENT_OPTIONAL_RESULTSET_METADATA != 0 {
+					metadataFollows = r.Byte() != RESULTSET_METADATA_NONE
+				}
+				if r.err != nil {
+					return r.err
+				}
+				p.currentQueryEvent.ColumnsSent += int(columnCount)
+				p.currentQueryEvent.ResultSetCount++
+				p.columnsRemaining = int(columnCount)
+				if metadataFollows && columnCount > 0 {
+					p.state = parseStateChompColumnDefs
+				} else {
+					p.state = parseStateChompRows
+					p.expectEOF = true
 				}
-				p.currentQueryEvent.ColumnsSent = int(columnCount)
-				p.state = parseStateChompColumnDefs
 			}
 		case parseStateChompColumnDefs:
-			if packet.FirstPayloadByte() == COL_DEF_FIRST_PAYLOAD_BYTE {
-				// This is subtle. A column definition packet always starts with the length-encoded string "def",
-				// i.e., the byte sequence 03 64 65 66.
-				//                         |   |  |  |
-				//                     length  d  e  f
-
-				// TODO: we can't reliably distinguish this from the case that (1) there's no EOF packet
-				// between the column defs and the rows, and (2) the first row result starts with 0x03.
-				// So when CLIENT_DEPRECATE_EOF is set, we actually need to count column definition packets
-				// that we've seen in order to reliably know when to transition to reading row packets.
-			} else if packet.FirstPayloadByte() == OK {
-				// TODO: parse OK packet contents
-			} else if packet.FirstPayloadByte() == EOF && packet.PayloadLength < 9 {
-				p.state = parseStateChompRows
-				// TODO: parse EOF packet contents
-			} else {
-				// Switch to parsing row packets
+			// We count column definitions instead of looking for the EOF
+			// packet that follows them, because there isn't one when
+			// CLIENT_DEPRECATE_EOF is set.
+			column, err := readColumnDefinition41(packet.payload)
+			if err != nil {
+				return err
+			}
+			p.logger.Debug("Parsed column definition", logrus.Fields{
+				"schema": column.Schema,
+				"table":  column.OrgTable,
+				"name":   column.Name,
+				"type":   column.ColumnType})
+			if p.options.ColumnNames {
+				p.addColumn(column)
+			}
+			p.columnsRemaining--
+			if p.columnsRemaining == 0 {
 				p.state = parseStateChompRows
-				p.currentQueryEvent.RowsSent++
+				p.expectEOF = true
 			}
 		case parseStateChompRows:
-			if packet.FirstPayloadByte() == OK || packet.FirstPayloadByte() == EOF {
-				// TODO: parse OK packet contents
-				p.currentQueryEvent.QueryTime = timestamp.Sub(p.currentQueryEvent.Timestamp).Seconds()
-				p.QueryEventDone()
-				p.state = parseStateChompFirstPacket
+			if p.expectEOF {
+				p.expectEOF = false
+				// Unless CLIENT_DEPRECATE_EOF is set, an EOF packet separates
+				// the column definitions from the rows. The packet that ends
+				// the result set is longer when CLIENT_DEPRECATE_EOF is set,
+				// so this is unambiguous.
+				if packet.FirstPayloadByte() == EOF && packet.PayloadLength == eofPacketLength {
+					continue
+				}
+			}
+			if packet.FirstPayloadByte() == EOF && packet.PayloadLength < maxPacketLength {
+				// The result set ends with an EOF packet, or an OK packet
+				// with an EOF header if CLIENT_DEPRECATE_EOF is set. A row
+				// can only start with 0xFE if its first value is at least
+				// 2^24 bytes long.
+				statusFlags, err := readStatusFlags(packet.payload)
+				if err != nil {
+					return err
+				}
+				p.resultDone(statusFlags, timestamp)
+			} else if packet.FirstPayloadByte() == ERR {
+				p.currentQueryEvent.Error = true
+				p.currentQueryEvent.ErrorCode = readErrorCode(packet.payload)
+				p.QueryEventDone(timestamp)
 			} else {
 				p.currentQueryEvent.RowsSent++
-				// TODO: parse row packet contents
+				p.currentQueryEvent.BytesSent += packet.PayloadLength
 			}
 		}
-		if err != nil {
-			logrus.WithError(err).Error("Error parsing response stream")
+	}
+}
+
+// readInfilePacket reads a packet of the file that the client sends in
+// response to a LOCAL INFILE request, which ends with an empty packet.
+func (p *Parser) readInfilePacket(r io.Reader) error {
+	length, sequenceID, err := readPacketHeader(r)
+	if err != nil {
+		return err
+	}
+	if sequenceID != p.nextSequenceID {
+		return errDesynchronized
+	}
+	p.nextSequenceID++
+	if _, err := io.CopyN(ioutil.Discard, r, int64(length)); err != nil {
+		return unexpectedEOF(err)
+	}
+	p.currentQueryEvent.BytesUploaded += length
+	if length == 0 && !p.infileContinued {
+		// The server responds with the result of the LOAD DATA statement.
+		p.state = parseStateChompFirstPacket
+	}
+	// An empty packet after a maximum-length one just ends that payload.
+	p.infileContinued = length == maxPacketLength
+	return nil
+}
+
+// addColumn records where a result set column came from.
+func (p *Parser) addColumn(column *columnDefinition41) {
+	q := &p.currentQueryEvent
+	if len(q.Columns) >= maxColumnNames {
+		return
+	}
+	name := column.OrgName
+	if name == "" {
+		// Computed columns only have an alias.
+		name = column.Name
+	}
+	q.Columns = append(q.Columns, name)
+	if column.OrgTable == "" {
+		return
+	}
+	table := column.OrgTable
+	if column.Schema != "" {
+		table = column.Schema + "." + table
+	}
+	for _, t := range q.Tables {
+		if t == table {
+			return
 		}
 	}
+	q.Tables = append(q.Tables, table)
 }
 
-// https://dev.mysql.com/doc/internals/en/integer.html#packet-Protocol::LengthEncodedInteger
-func readLengthEncodedInteger(firstByte byte, nextBytes []byte) (n uint64, err error) {
-	r := bytes.NewReader(nextBytes)
-	if firstByte <= 0xFB {
-		return uint64(firstByte), nil
-	} else if firstByte == 0xFC {
-		var v uint16
-		err = binary.Read(r, binary.LittleEndian, &v)
-		return uint64(v), err
-	} else if firstByte == 0xFD {
-		// Hack to properly parse a three-byte integer
-		var v struct {
-			a uint8
-			b uint16
+// parseHandshake handles the initial handshake packet that the server sends
+// when a client connects.
+func (p *Parser) parseHandshake(packet *mySQLPacket) {
+	m, err := readHandshakeV10(packet.payload)
+	if err != nil {
+		p.logger.Debug("Error parsing initial handshake", logrus.Fields{"error": err})
+		return
+	}
+	p.logger.Debug("Parsed initial handshake", logrus.Fields{
+		"serverVersion": m.ServerVersion,
+		"connectionID":  m.ConnectionID})
+	p.serverCapabilities = m.CapabilityFlags
+	// The handshake response will tell us whether compression is in use.
+	p.compressionKnown = true
+	p.state = parseStateHandshake
+}
+
+func (p *Parser) parseHandshakeResponse(packet *mySQLPacket, timestamp time.Time) {
+	m, err := readHandshakeResponse41(packet.payload)
+	if err != nil {
+		p.logger.Debug("Error parsing handshake response", logrus.Fields{"error": err})
+		p.state = parseStateIdle
+		return
+	}
+	if m.CapabilityFlags&CLIENT_SSL != 0 {
+		// An SSLRequest: the rest of the connection is encrypted.
+		p.startTLS(timestamp)
+		return
+	}
+	p.capabilities = m.CapabilityFlags & p.serverCapabilities
+	p.user = m.Username
+	if p.capabilities&CLIENT_CONNECT_WITH_DB != 0 {
+		p.schema = m.Database
+	}
+	p.compressAfterAuth = p.capabilities&(CLIENT_COMPRESS|CLIENT_ZSTD_COMPRESSION_ALGORITHM) != 0
+	p.state = parseStateAuthenticating
+}
+
+// startTLS stops parsing the connection once it switches to TLS. From then
+// on, we only count the bytes sent in each direction.
+func (p *Parser) startTLS(timestamp time.Time) {
+	p.logger.Debug("Connection switched to TLS", logrus.Fields{})
+	p.tls = tls.NewConnection("mysql", p.flow, timestamp)
+	p.currentQueryEvent = QueryEvent{}
+	p.currentCommand = CommandEvent{}
+	p.state = parseStateIdle
+}
+
+// parseAuthResponse handles packets that the server sends while
+// authenticating the client. Authentication can take several round trips,
+// but always ends with an OK or ERR packet.
+func (p *Parser) parseAuthResponse(packet *mySQLPacket) {
+	switch packet.FirstPayloadByte() {
+	case OK:
+		// Compression starts with the packets following the OK packet.
+		if p.compressAfterAuth {
+			p.logger.Debug("Compression negotiated", logrus.Fields{})
+			p.compressed = true
 		}
-		err = binary.Read(r, binary.LittleEndian, &v)
-		return uint64(v.a) + uint64(v.b)<<8, err
-	} else if firstByte == 0xFE {
-		var v uint64
-		err = binary.Read(r, binary.LittleEndian, &v)
-		return v, err
-	}
-	return 0, errors.New("Invalid length-encoded integer")
+		p.state = parseStateIdle
+	case ERR:
+		p.state = parseStateIdle
+	}
 }
 
-func (p *Parser) QueryEventDone() {
-	p.currentQueryEvent.ClientIP = p.flow.SrcIP.String()
-	p.currentQueryEvent.ServerIP = p.flow.DstIP.String()
-	s, err := json.Marshal(&p.currentQueryEvent)
+// resultDone is called at the end of each result in a response: either a
+// single OK packet or a complete result set. The query is only done once the
+// server stops setting SERVER_MORE_RESULTS_EXISTS.
+func (p *Parser) resultDone(statusFlags uint16, timestamp time.Time) {
+	if statusFlags&SERVER_MORE_RESULTS_EXISTS != 0 {
+		p.state = parseStateChompFirstPacket
+		return
+	}
+	p.currentQueryEvent.statusFlags = statusFlags
+	p.currentQueryEvent.statusFlagsKnown = true
+	p.QueryEventDone(timestamp)
+}
+
+func (p *Parser) QueryEventDone(timestamp time.Time) {
+	q := p.currentQueryEvent
+	q.EventType = "query"
+	q.ClientIP = p.flow.SrcIP.String()
+	q.ServerIP = p.flow.DstIP.String()
+	if timestamp.After(q.Timestamp) {
+		q.QueryTime = timestamp.Sub(q.Timestamp).Seconds()
+	}
+	if schema, ok := parseUseStatement(q.Query); ok && !q.Error {
+		p.schema = schema
+	}
+	p.trackTransaction(&q, timestamp)
+	s, err := json.Marshal(&q)
 	if err != nil {
 		logrus.Error("Error marshaling query event", err)
 	}
-	io.WriteString(os.Stdout, string(s))
-	io.WriteString(os.Stdout, "\n")
+	p.output.Write(append(s, '\n'))
+	metrics.Counter("mysql.queries_parsed").Add()
 	p.currentQueryEvent = QueryEvent{}
-	p.state = parseStateChompFirstPacket
+	p.state = parseStateIdle
+	p.startNextCommand()
+}
+
+// readErrorCode returns the error code from an ERR packet, or 0 if it's
+// malformed.
+func readErrorCode(payload []byte) int {
+	m, err := readErrPacket(payload)
+	if err != nil {
+		return 0
+	}
+	return int(m.ErrorCode)
 }
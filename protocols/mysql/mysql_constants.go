@@ -1,5 +1,13 @@
 package mysql
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
 // https://dev.mysql.com/doc/internals/en/text-protocol.html
 const (
 	COM_SLEEP byte = iota
@@ -35,7 +43,542 @@ const (
 	COM_RESET_CONNECTION
 )
 
+// Capability flags, exchanged in the connection handshake.
+// https://dev.mysql.com/doc/internals/en/capability-flags.html
+const (
+	CLIENT_LONG_PASSWORD                  uint32 = 0x00000001
+	CLIENT_FOUND_ROWS                     uint32 = 0x00000002
+	CLIENT_LONG_FLAG                      uint32 = 0x00000004
+	CLIENT_CONNECT_WITH_DB                uint32 = 0x00000008
+	CLIENT_NO_SCHEMA                      uint32 = 0x00000010
+	CLIENT_COMPRESS                       uint32 = 0x00000020
+	CLIENT_ODBC                           uint32 = 0x00000040
+	CLIENT_LOCAL_FILES                    uint32 = 0x00000080
+	CLIENT_IGNORE_SPACE                   uint32 = 0x00000100
+	CLIENT_PROTOCOL_41                    uint32 = 0x00000200
+	CLIENT_INTERACTIVE                    uint32 = 0x00000400
+	CLIENT_SSL                            uint32 = 0x00000800
+	CLIENT_IGNORE_SIGPIPE                 uint32 = 0x00001000
+	CLIENT_TRANSACTIONS                   uint32 = 0x00002000
+	CLIENT_RESERVED                       uint32 = 0x00004000
+	CLIENT_SECURE_CONNECTION              uint32 = 0x00008000
+	CLIENT_MULTI_STATEMENTS               uint32 = 0x00010000
+	CLIENT_MULTI_RESULTS                  uint32 = 0x00020000
+	CLIENT_PS_MULTI_RESULTS               uint32 = 0x00040000
+	CLIENT_PLUGIN_AUTH                    uint32 = 0x00080000
+	CLIENT_CONNECT_ATTRS                  uint32 = 0x00100000
+	CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA uint32 = 0x00200000
+	CLIENT_CAN_HANDLE_EXPIRED_PASSWORDS   uint32 = 0x00400000
+	CLIENT_SESSION_TRACK                  uint32 = 0x00800000
+	CLIENT_DEPRECATE_EOF                  uint32 = 0x01000000
+	CLIENT_OPTIONAL_RESULTSET_METADATA    uint32 = 0x02000000
+	CLIENT_ZSTD_COMPRESSION_ALGORITHM     uint32 = 0x04000000
+	CLIENT_QUERY_ATTRIBUTES               uint32 = 0x08000000
+)
+
+// The protocol version sent at the start of the initial handshake packet.
+const HANDSHAKE_V10 uint8 = 0x0a
+
+// Sent after the column count when CLIENT_OPTIONAL_RESULTSET_METADATA is set.
+const (
+	RESULTSET_METADATA_NONE uint8 = 0x00
+	RESULTSET_METADATA_FULL uint8 = 0x01
+)
+
 const OK uint8 = 0x00
 const ERR uint8 = 0xFF
 const EOF uint8 = 0xFE
 const COL_DEF_FIRST_PAYLOAD_BYTE uint8 = 0x03
+
+// Sent instead of a result set when the server wants the client to send a
+// file for LOAD DATA LOCAL INFILE.
+const LOCAL_INFILE uint8 = 0xFB
+
+// Server status flags, sent in OK and EOF packets.
+// https://dev.mysql.com/doc/internals/en/status-flags.html
+const (
+	SERVER_STATUS_IN_TRANS             uint16 = 0x0001
+	SERVER_STATUS_AUTOCOMMIT           uint16 = 0x0002
+	SERVER_MORE_RESULTS_EXISTS         uint16 = 0x0008
+	SERVER_STATUS_NO_GOOD_INDEX_USED   uint16 = 0x0010
+	SERVER_STATUS_NO_INDEX_USED        uint16 = 0x0020
+	SERVER_STATUS_CURSOR_EXISTS        uint16 = 0x0040
+	SERVER_STATUS_LAST_ROW_SENT        uint16 = 0x0080
+	SERVER_STATUS_DB_DROPPED           uint16 = 0x0100
+	SERVER_STATUS_NO_BACKSLASH_ESCAPES uint16 = 0x0200
+	SERVER_STATUS_METADATA_CHANGED     uint16 = 0x0400
+	SERVER_QUERY_WAS_SLOW              uint16 = 0x0800
+	SERVER_PS_OUT_PARAMS               uint16 = 0x1000
+	SERVER_STATUS_IN_TRANS_READONLY    uint16 = 0x2000
+	SERVER_SESSION_STATE_CHANGED       uint16 = 0x4000
+)
+
+// Binlog event types that we look inside, or that don't describe a change
+// made on the primary.
+// https://dev.mysql.com/doc/internals/en/binlog-event-type.html
+const (
+	ROTATE_EVENT              byte = 0x04
+	FORMAT_DESCRIPTION_EVENT  byte = 0x0f
+	HEARTBEAT_EVENT           byte = 0x1b
+	GTID_EVENT                byte = 0x21
+	PREVIOUS_GTIDS_EVENT      byte = 0x23
+	HEARTBEAT_EVENT_V2        byte = 0x29
+	MARIADB_BINLOG_CHECKPOINT byte = 0xa1
+	MARIADB_GTID_EVENT        byte = 0xa2
+	MARIADB_GTID_LIST_EVENT   byte = 0xa3
+)
+
+// With semi-synchronous replication, each binlog event packet has a two-byte
+// header between the OK byte and the event, starting with this byte.
+const SEMI_SYNC_INDICATOR uint8 = 0xef
+
+// binlogEventHeaderLength is the length of a version 4 binlog event header.
+const binlogEventHeaderLength = 19
+
+// binlogChecksumLength is the length of the CRC32 checksum that follows
+// each event when binlog_checksum is enabled.
+const binlogChecksumLength = 4
+
+// eofPacketLength is the payload length of an EOF packet. When
+// CLIENT_DEPRECATE_EOF is set, the server instead sends OK packets with an
+// EOF header byte, which are always longer.
+const eofPacketLength = 5
+
+// https://dev.mysql.com/doc/internals/en/packet-OK_Packet.html
+type okPacket struct {
+	Header       byte   // OK, or EOF when CLIENT_DEPRECATE_EOF is set
+	AffectedRows uint64 // number of affected rows
+	LastInsertID uint64 // last insert ID
+	StatusFlags  uint16 // server status flags
+	Warnings     uint16 // number of warnings
+	// Human-readable status information and session state info are not
+	// parsed.
+}
+
+func readOKPacket(payload []byte) (*okPacket, error) {
+	r := newErrReader(payload)
+	m := okPacket{}
+	m.Header = r.Byte()
+	m.AffectedRows = r.LengthEncodedInteger()
+	m.LastInsertID = r.LengthEncodedInteger()
+	m.StatusFlags = r.Uint16()
+	m.Warnings = r.Uint16()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &m, nil
+}
+
+// https://dev.mysql.com/doc/internals/en/packet-EOF_Packet.html
+type eofPacket struct {
+	Header      byte   // always EOF
+	Warnings    uint16 // number of warnings
+	StatusFlags uint16 // server status flags
+}
+
+func readEOFPacket(payload []byte) (*eofPacket, error) {
+	r := newErrReader(payload)
+	m := eofPacket{}
+	m.Header = r.Byte()
+	m.Warnings = r.Uint16()
+	m.StatusFlags = r.Uint16()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &m, nil
+}
+
+// readStatusFlags returns the server status flags from a packet that ends a
+// result or result set: either an OK packet or an EOF packet.
+func readStatusFlags(payload []byte) (uint16, error) {
+	if len(payload) == eofPacketLength && payload[0] == EOF {
+		m, err := readEOFPacket(payload)
+		if err != nil {
+			return 0, err
+		}
+		return m.StatusFlags, nil
+	}
+	m, err := readOKPacket(payload)
+	if err != nil {
+		return 0, err
+	}
+	return m.StatusFlags, nil
+}
+
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::HandshakeV10
+type handshakeV10 struct {
+	ProtocolVersion byte   // always HANDSHAKE_V10
+	ServerVersion   string // human-readable server version
+	ConnectionID    uint32 // connection ID
+	CapabilityFlags uint32 // server capabilities
+	// Auth plugin data, character set and status flags are not parsed.
+}
+
+func readHandshakeV10(payload []byte) (*handshakeV10, error) {
+	r := newErrReader(payload)
+	m := handshakeV10{}
+	m.ProtocolVersion = r.Byte()
+	m.ServerVersion = r.NullTerminatedString()
+	m.ConnectionID = r.Uint32()
+	r.Bytes(8) // auth-plugin-data-part-1
+	r.Byte()   // filler
+	m.CapabilityFlags = uint32(r.Uint16())
+	if r.err == nil && r.Len() > 0 {
+		r.Byte()   // character set
+		r.Uint16() // status flags
+		m.CapabilityFlags |= uint32(r.Uint16()) << 16
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &m, nil
+}
+
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::HandshakeResponse41
+type handshakeResponse41 struct {
+	CapabilityFlags uint32 // client capabilities
+	MaxPacketSize   uint32 // maximum packet size the client will send
+	CharacterSet    byte   // connection's default character set
+	Username        string // user the client is logging in as
+	Database        string // initial schema, if CLIENT_CONNECT_WITH_DB is set
+	// The auth plugin name and connection attributes are not parsed.
+}
+
+func readHandshakeResponse41(payload []byte) (*handshakeResponse41, error) {
+	r := newErrReader(payload)
+	m := handshakeResponse41{}
+	m.CapabilityFlags = r.Uint32()
+	m.MaxPacketSize = r.Uint32()
+	m.CharacterSet = r.Byte()
+	r.Bytes(23) // reserved
+	if r.err != nil {
+		return nil, r.err
+	}
+	if m.CapabilityFlags&CLIENT_PROTOCOL_41 == 0 {
+		return nil, errors.New("Unsupported handshake response version")
+	}
+	if m.CapabilityFlags&CLIENT_SSL != 0 && r.Len() == 0 {
+		// An SSLRequest packet, which is a truncated handshake response.
+		// The client sends the full one once TLS is set up.
+		return &m, nil
+	}
+	m.Username = r.NullTerminatedString()
+	r.AuthResponse(m.CapabilityFlags)
+	if m.CapabilityFlags&CLIENT_CONNECT_WITH_DB != 0 {
+		m.Database = r.NullTerminatedString()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &m, nil
+}
+
+// https://dev.mysql.com/doc/internals/en/com-binlog-dump.html and
+// https://dev.mysql.com/doc/internals/en/com-binlog-dump-gtid.html
+type binlogDumpPacket struct {
+	Command        byte   // COM_BINLOG_DUMP or COM_BINLOG_DUMP_GTID
+	BinlogPosition uint64 // position to start streaming from
+	Flags          uint16 // dump flags
+	ServerID       uint32 // replica's server ID
+	BinlogFilename string // file to start streaming from
+	// The GTID set sent with COM_BINLOG_DUMP_GTID is not parsed.
+}
+
+func readBinlogDumpPacket(payload []byte) (*binlogDumpPacket, error) {
+	r := newErrReader(payload)
+	m := binlogDumpPacket{}
+	m.Command = r.Byte()
+	switch m.Command {
+	case COM_BINLOG_DUMP:
+		m.BinlogPosition = uint64(r.Uint32())
+		m.Flags = r.Uint16()
+		m.ServerID = r.Uint32()
+		m.BinlogFilename = string(r.Bytes(r.Len()))
+	case COM_BINLOG_DUMP_GTID:
+		m.Flags = r.Uint16()
+		m.ServerID = r.Uint32()
+		m.BinlogFilename = string(r.Bytes(int(r.Uint32())))
+		m.BinlogPosition = r.Uint64()
+	default:
+		return nil, fmt.Errorf("Not a binlog dump command: %#x", m.Command)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &m, nil
+}
+
+// https://dev.mysql.com/doc/internals/en/binlog-event-header.html
+type binlogEventHeader struct {
+	Timestamp   uint32 // seconds since the epoch when the event was created
+	EventType   byte   // type of the event
+	ServerID    uint32 // server where the event originated
+	EventSize   uint32 // size of the event, including this header
+	LogPosition uint32 // position of the next event in the binlog
+	Flags       uint16 // event flags
+}
+
+func readBinlogEventHeader(r *errReader) *binlogEventHeader {
+	m := binlogEventHeader{}
+	m.Timestamp = r.Uint32()
+	m.EventType = r.Byte()
+	m.ServerID = r.Uint32()
+	m.EventSize = r.Uint32()
+	m.LogPosition = r.Uint32()
+	m.Flags = r.Uint16()
+	return &m
+}
+
+// readGTIDEvent returns the GTID from the body of a GTID_EVENT, formatted
+// as "source_uuid:transaction_id".
+func readGTIDEvent(body []byte) (string, error) {
+	r := newErrReader(body)
+	r.Byte() // flags
+	sid := r.Bytes(16)
+	gno := r.Uint64()
+	if r.err != nil {
+		return "", r.err
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x:%d",
+		sid[0:4], sid[4:6], sid[6:8], sid[8:10], sid[10:16], gno), nil
+}
+
+// readMariaDBGTIDEvent returns the GTID from the body of a
+// MARIADB_GTID_EVENT, formatted as "domain_id-server_id-sequence_number".
+func readMariaDBGTIDEvent(body []byte, serverID uint32) (string, error) {
+	r := newErrReader(body)
+	sequenceNumber := r.Uint64()
+	domainID := r.Uint32()
+	if r.err != nil {
+		return "", r.err
+	}
+	return fmt.Sprintf("%d-%d-%d", domainID, serverID, sequenceNumber), nil
+}
+
+// https://dev.mysql.com/doc/internals/en/com-change-user.html
+type changeUserPacket struct {
+	Command byte   // always COM_CHANGE_USER
+	User    string // user to change to
+	Schema  string // schema to change to
+	// The character set, auth plugin name and connection attributes are
+	// not parsed.
+}
+
+// readChangeUserPacket parses a COM_CHANGE_USER payload. How the auth
+// response is encoded depends on the capabilities negotiated for the
+// connection; if we didn't see the handshake, we assume that
+// CLIENT_SECURE_CONNECTION is set, as it is for every modern client.
+func readChangeUserPacket(payload []byte, capabilities uint32) (*changeUserPacket, error) {
+	if capabilities == 0 {
+		capabilities = CLIENT_SECURE_CONNECTION
+	}
+	r := newErrReader(payload)
+	m := changeUserPacket{}
+	m.Command = r.Byte()
+	m.User = r.NullTerminatedString()
+	// COM_CHANGE_USER never uses a length-encoded auth response.
+	r.AuthResponse(capabilities &^ CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA)
+	m.Schema = r.NullTerminatedString()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &m, nil
+}
+
+// https://dev.mysql.com/doc/internals/en/packet-ERR_Packet.html
+type errPacket struct {
+	Header       byte   // always ERR
+	ErrorCode    uint16 // error code
+	SQLState     string // SQL state, if present
+	ErrorMessage string // human-readable error message
+}
+
+func readErrPacket(payload []byte) (*errPacket, error) {
+	r := newErrReader(payload)
+	m := errPacket{}
+	m.Header = r.Byte()
+	m.ErrorCode = r.Uint16()
+	if r.err == nil && r.Len() > 0 && payload[3] == '#' {
+		r.Byte() // SQL state marker
+		m.SQLState = string(r.Bytes(5))
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	m.ErrorMessage = string(r.Bytes(r.Len()))
+	return &m, r.err
+}
+
+// https://dev.mysql.com/doc/internals/en/com-query-response.html#packet-Protocol::ColumnDefinition41
+type columnDefinition41 struct {
+	Catalog      string // always "def"
+	Schema       string // schema name
+	Table        string // virtual table name
+	OrgTable     string // physical table name
+	Name         string // virtual column name
+	OrgName      string // physical column name
+	CharacterSet uint16 // column character set
+	ColumnLength uint32 // maximum length of the field
+	ColumnType   byte   // type of the column
+	Flags        uint16 // column flags
+	Decimals     byte   // max shown decimal digits
+}
+
+func readColumnDefinition41(payload []byte) (*columnDefinition41, error) {
+	r := newErrReader(payload)
+	m := columnDefinition41{}
+	m.Catalog = r.LengthEncodedString()
+	m.Schema = r.LengthEncodedString()
+	m.Table = r.LengthEncodedString()
+	m.OrgTable = r.LengthEncodedString()
+	m.Name = r.LengthEncodedString()
+	m.OrgName = r.LengthEncodedString()
+	r.LengthEncodedInteger() // length of fixed-length fields, always 0x0c
+	m.CharacterSet = r.Uint16()
+	m.ColumnLength = r.Uint32()
+	m.ColumnType = r.Byte()
+	m.Flags = r.Uint16()
+	m.Decimals = r.Byte()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if m.Catalog != "def" {
+		return nil, fmt.Errorf("Invalid column definition catalog %q", m.Catalog)
+	}
+	return &m, nil
+}
+
+// errReader wraps a packet payload with convenience functions for parsing
+// MySQL datatypes. Instead of returning error values, errReader methods check
+// errReader.err, and store any errors they encounter. But callers *must*
+// check errReader.err before returning.
+type errReader struct {
+	err error
+	b   *bytes.Reader
+}
+
+func newErrReader(payload []byte) *errReader {
+	return &errReader{b: bytes.NewReader(payload)}
+}
+
+func (e *errReader) Byte() byte {
+	if e.err != nil {
+		return 0
+	}
+	var v byte
+	v, e.err = e.b.ReadByte()
+	return v
+}
+
+func (e *errReader) Uint16() uint16 {
+	if e.err != nil {
+		return 0
+	}
+	var v uint16
+	e.err = binary.Read(e.b, binary.LittleEndian, &v)
+	return v
+}
+
+func (e *errReader) Uint32() uint32 {
+	if e.err != nil {
+		return 0
+	}
+	var v uint32
+	e.err = binary.Read(e.b, binary.LittleEndian, &v)
+	return v
+}
+
+func (e *errReader) Uint64() uint64 {
+	if e.err != nil {
+		return 0
+	}
+	var v uint64
+	e.err = binary.Read(e.b, binary.LittleEndian, &v)
+	return v
+}
+
+// https://dev.mysql.com/doc/internals/en/integer.html#packet-Protocol::LengthEncodedInteger
+func (e *errReader) LengthEncodedInteger() uint64 {
+	firstByte := e.Byte()
+	if e.err != nil {
+		return 0
+	}
+	switch {
+	case firstByte < 0xFB:
+		return uint64(firstByte)
+	case firstByte == 0xFC:
+		return uint64(e.Uint16())
+	case firstByte == 0xFD:
+		lo := e.Uint16()
+		hi := e.Byte()
+		return uint64(lo) + uint64(hi)<<16
+	case firstByte == 0xFE:
+		return e.Uint64()
+	}
+	e.err = fmt.Errorf("Invalid length-encoded integer prefix %#x", firstByte)
+	return 0
+}
+
+// Bytes returns the next n bytes of the payload.
+func (e *errReader) Bytes(n int) []byte {
+	if e.err != nil {
+		return nil
+	}
+	if n < 0 || n > e.b.Len() {
+		e.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	buf := make([]byte, n)
+	_, e.err = io.ReadFull(e.b, buf)
+	return buf
+}
+
+// https://dev.mysql.com/doc/internals/en/string.html#packet-Protocol::LengthEncodedString
+func (e *errReader) LengthEncodedString() string {
+	length := e.LengthEncodedInteger()
+	if e.err != nil {
+		return ""
+	}
+	if length > uint64(e.b.Len()) {
+		e.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	return string(e.Bytes(int(length)))
+}
+
+// https://dev.mysql.com/doc/internals/en/string.html#packet-Protocol::NulTerminatedString
+func (e *errReader) NullTerminatedString() string {
+	if e.err != nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	for {
+		c, err := e.b.ReadByte()
+		if err != nil {
+			e.err = io.ErrUnexpectedEOF
+			return ""
+		}
+		if c == 0x00 {
+			return buf.String()
+		}
+		buf.WriteByte(c)
+	}
+}
+
+// Len returns the number of unread bytes.
+func (e *errReader) Len() int {
+	return e.b.Len()
+}
+
+// AuthResponse skips over the auth response in a handshake response or
+// COM_CHANGE_USER packet, whose encoding depends on capabilities.
+func (e *errReader) AuthResponse(capabilities uint32) {
+	switch {
+	case capabilities&CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA != 0:
+		e.LengthEncodedString()
+	case capabilities&CLIENT_SECURE_CONNECTION != 0:
+		e.Bytes(int(e.Byte()))
+	default:
+		e.NullTerminatedString()
+	}
+}
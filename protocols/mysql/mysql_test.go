@@ -0,0 +1,812 @@
+package mysql
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQueries(t *testing.T) {
+	var queryTests = []struct {
+		response [][]byte
+		output   string
+	}{
+		{ // Query with OK response
+			[][]byte{okPayload(1, 0)},
+			`{
+				"event_type": "query",
+				"Timestamp": "2006-01-02T15:04:05Z",
+				"ClientIP": "10.0.0.22",
+				"ServerIP": "10.0.0.23",
+				"QueryTime": 0.002,
+				"Query": "SELECT 1",
+				"RowsSent": 0,
+				"BytesSent": 0,
+				"ColumnsSent": 0,
+				"Error": false,
+				"ErrorCode": 0,
+				"result_set_count": 0,
+				"rows_affected": 1
+			}`,
+		},
+		{ // Query with result set
+			resultSet([]string{"a", "b"}, [][]string{{"1", "2"}, {"3", "4"}}),
+			`{
+				"event_type": "query",
+				"Timestamp": "2006-01-02T15:04:05Z",
+				"ClientIP": "10.0.0.22",
+				"ServerIP": "10.0.0.23",
+				"QueryTime": 0.002,
+				"Query": "SELECT 1",
+				"RowsSent": 2,
+				"BytesSent": 8,
+				"ColumnsSent": 2,
+				"Error": false,
+				"ErrorCode": 0,
+				"result_set_count": 1,
+				"rows_affected": 0
+			}`,
+		},
+		{ // Query with error response
+			[][]byte{{ERR, 0x28, 0x04, '#', '4', '2', '0', '0', '0'}},
+			`{
+				"event_type": "query",
+				"Timestamp": "2006-01-02T15:04:05Z",
+				"ClientIP": "10.0.0.22",
+				"ServerIP": "10.0.0.23",
+				"QueryTime": 0.002,
+				"Query": "SELECT 1",
+				"RowsSent": 0,
+				"BytesSent": 0,
+				"ColumnsSent": 0,
+				"Error": true,
+				"ErrorCode": 1064,
+				"result_set_count": 0,
+				"rows_affected": 0
+			}`,
+		},
+	}
+	for _, testcase := range queryTests {
+		tp := &testPublisher{}
+		parser := newParser(tp)
+		ms := &messageStream{}
+		ms.Append(genQuery("SELECT 1"), defaultDate(), defaultFlow())
+		ms.Append(genResponse(testcase.response), defaultDate().Add(2*time.Millisecond), defaultFlow().Reverse())
+		parser.On(ms)
+		if assert.Equal(t, 1, len(tp.output)) {
+			assert.JSONEq(t, testcase.output, string(tp.output[0]))
+		}
+	}
+}
+
+func TestParseMultipleResults(t *testing.T) {
+	var resultTests = []struct {
+		response       [][]byte
+		rowsSent       int
+		columnsSent    int
+		resultSetCount int
+		isError        bool
+	}{
+		{ // CALL returning two result sets, followed by the final OK
+			concat(
+				withStatus(resultSet([]string{"a"}, [][]string{{"1"}, {"2"}}), SERVER_MORE_RESULTS_EXISTS),
+				withStatus(resultSet([]string{"a", "b"}, [][]string{{"", "x"}}), SERVER_MORE_RESULTS_EXISTS),
+				[][]byte{okPayload(0, 0)}),
+			3, 3, 2, false,
+		},
+		{ // Multi-statement query: UPDATE then SELECT
+			concat(
+				[][]byte{okPayload(1, SERVER_MORE_RESULTS_EXISTS)},
+				resultSet([]string{"a"}, [][]string{{"1"}})),
+			1, 1, 1, false,
+		},
+		{ // Error in the second statement
+			concat(
+				withStatus(resultSet([]string{"a"}, [][]string{{"1"}}), SERVER_MORE_RESULTS_EXISTS),
+				[][]byte{{ERR, 0x28, 0x04}}),
+			1, 1, 1, true,
+		},
+		{ // CLIENT_DEPRECATE_EOF: result sets end with OK packets with an EOF header
+			concat(
+				[][]byte{{0x01}, columnDefinition("a"), lengthEncodedString("1"),
+					{EOF, 0x00, 0x00, byte(SERVER_MORE_RESULTS_EXISTS), 0x00, 0x00, 0x00}},
+				[][]byte{okPayload(0, 0)}),
+			1, 1, 1, false,
+		},
+	}
+	for _, testcase := range resultTests {
+		tp := &testPublisher{}
+		parser := newParser(tp)
+		ms := &messageStream{}
+		ms.Append(genQuery("CALL p()"), defaultDate(), defaultFlow())
+		// The final packet arrives later than the rest.
+		response := genResponse(testcase.response)
+		last := len(response) - len(testcase.response[len(testcase.response)-1]) - 4
+		ms.Append(response[:last], defaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+		ms.Append(response[last:], defaultDate().Add(5*time.Millisecond), defaultFlow().Reverse())
+		parser.On(ms)
+		if !assert.Equal(t, 1, len(tp.output)) {
+			continue
+		}
+		var ret map[string]interface{}
+		json.Unmarshal(tp.output[0], &ret)
+		assert.Equal(t, float64(testcase.rowsSent), ret["RowsSent"])
+		assert.Equal(t, float64(testcase.columnsSent), ret["ColumnsSent"])
+		assert.Equal(t, float64(testcase.resultSetCount), ret["result_set_count"])
+		assert.Equal(t, testcase.isError, ret["Error"])
+		assert.Equal(t, 0.005, ret["QueryTime"])
+	}
+}
+
+func TestColumnDefinitions(t *testing.T) {
+	deprecateEOFTests := []struct {
+		response [][]byte
+		rowsSent int
+	}{
+		{ // Empty result set
+			[][]byte{{0x01}, columnDefinition("a"), okEOFPayload(0)},
+			0,
+		},
+		{ // First value in the row has three bytes, like a column definition
+			[][]byte{{0x01}, columnDefinition("a"), lengthEncodedString("abc"), okEOFPayload(0)},
+			1,
+		},
+	}
+	for _, testcase := range deprecateEOFTests {
+		tp := &testPublisher{}
+		parser := newParser(tp)
+		ms := &messageStream{}
+		ms.Append(genQuery("SELECT a FROM t"), defaultDate(), defaultFlow())
+		ms.Append(genResponse(testcase.response), defaultDate(), defaultFlow().Reverse())
+		ms.Append(genQuery("SELECT 2"), defaultDate(), defaultFlow())
+		ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+		parser.On(ms)
+		if assert.Equal(t, 2, len(tp.output)) {
+			var ret map[string]interface{}
+			json.Unmarshal(tp.output[0], &ret)
+			assert.Equal(t, float64(testcase.rowsSent), ret["RowsSent"])
+		}
+	}
+}
+
+func TestColumnNames(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParserWithOptions(tp, Options{Port: 3306, MaxPayloadSize: 1024 * 1024, ColumnNames: true})
+	computed := []byte{0x03, 'd', 'e', 'f', 0x00, 0x00, 0x00, 0x01, 'c', 0x00,
+		0x0c, 0x3f, 0x00, 0x01, 0x00, 0x00, 0x00, 0x08, 0x81, 0x00, 0x00}
+	response := concat(
+		[][]byte{{0x03}, columnDefinition("a"), columnDefinition("b"), computed, eofPayload(0)},
+		[][]byte{{0x01, 'x', 0x01, 'y', 0x01, '1'}, eofPayload(0)})
+	ms := &messageStream{}
+	ms.Append(genQuery("SELECT *, 1 AS c FROM table"), defaultDate(), defaultFlow())
+	ms.Append(genResponse(response), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.output)) {
+		var ret map[string]interface{}
+		json.Unmarshal(tp.output[0], &ret)
+		assert.Equal(t, []interface{}{"db.table"}, ret["tables"])
+		assert.Equal(t, []interface{}{"a", "b", "c"}, ret["columns"])
+		assert.Equal(t, float64(3), ret["ColumnsSent"])
+		assert.Equal(t, float64(6), ret["BytesSent"])
+	}
+}
+
+func TestPipelinedQueries(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	// A batch of queries sent without waiting for responses.
+	ms.Append(concat2(genQuery("USE app"), genQuery("SELECT 1")), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate().Add(1*time.Millisecond), defaultFlow().Reverse())
+	// Another query sent while the previous response is still arriving.
+	response := genResponse(resultSet([]string{"a"}, [][]string{{"1"}}))
+	ms.Append(response[:5], defaultDate().Add(2*time.Millisecond), defaultFlow().Reverse())
+	ms.Append(genQuery("SELECT 2"), defaultDate().Add(3*time.Millisecond), defaultFlow())
+	ms.Append(append(response[5:], genResponse([][]byte{okPayload(0, 0)})...),
+		defaultDate().Add(4*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+
+	events := decodeEvents(tp)
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "USE app", events[0]["Query"])
+		assert.Equal(t, 0.001, events[0]["QueryTime"])
+		assert.Equal(t, "SELECT 1", events[1]["Query"])
+		assert.Equal(t, 0.004, events[1]["QueryTime"])
+		assert.Equal(t, float64(1), events[1]["RowsSent"])
+		assert.Equal(t, "app", events[1]["schema"])
+		assert.Equal(t, "SELECT 2", events[2]["Query"])
+		assert.Equal(t, 0.001, events[2]["QueryTime"])
+		assert.Equal(t, float64(0), events[2]["RowsSent"])
+	}
+}
+
+func TestPipelinedAfterUnsupportedCommand(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	// We can't tell where the COM_STATISTICS response ends, so we can't
+	// match up the response to the query after it.
+	batch := concat2(genQuery("SELECT 1"), genPacket(0, []byte{COM_STATISTICS}), genQuery("SELECT 2"))
+	ms.Append(batch, defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genPacket(1, []byte("Uptime: 5")), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.output)) {
+		var ret map[string]interface{}
+		json.Unmarshal(tp.output[0], &ret)
+		assert.Equal(t, "SELECT 1", ret["Query"])
+	}
+}
+
+func TestTooManyPipelinedCommands(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	var batch []byte
+	for i := 0; i <= maxPendingCommands+1; i++ {
+		batch = append(batch, genQuery("SELECT 1")...)
+	}
+	ms.Append(batch, defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	assert.Equal(t, 0, len(tp.output))
+}
+
+func TestLoadDataLocalInfile(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append(genQuery("LOAD DATA LOCAL INFILE 'data.csv' INTO TABLE t"), defaultDate(), defaultFlow())
+	ms.Append(genPacket(1, append([]byte{LOCAL_INFILE}, "data.csv"...)), defaultDate(), defaultFlow().Reverse())
+	// The file is sent in chunks, and ends with an empty packet.
+	ms.Append(concat2(genPacket(2, []byte("1,a\n2,b\n")), genPacket(3, []byte("3,c\n"))),
+		defaultDate().Add(time.Millisecond), defaultFlow())
+	ms.Append(genPacket(4, nil), defaultDate().Add(2*time.Millisecond), defaultFlow())
+	ms.Append(genPacket(5, okPayload(3, 0)), defaultDate().Add(5*time.Millisecond), defaultFlow().Reverse())
+	ms.Append(genQuery("SELECT 1"), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := decodeEvents(tp)
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "data.csv", events[0]["local_infile"])
+		assert.Equal(t, float64(12), events[0]["bytes_uploaded"])
+		assert.Equal(t, float64(3), events[0]["rows_affected"])
+		assert.Equal(t, 0.005, events[0]["QueryTime"])
+		assert.Equal(t, float64(0), events[0]["RowsSent"])
+		assert.Equal(t, "SELECT 1", events[1]["Query"])
+		assert.Nil(t, events[1]["local_infile"])
+	}
+}
+
+func TestLoadDataLocalInfileRejected(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append(genQuery("LOAD DATA LOCAL INFILE '/etc/passwd' INTO TABLE t"), defaultDate(), defaultFlow())
+	ms.Append(genPacket(1, append([]byte{LOCAL_INFILE}, "/etc/passwd"...)), defaultDate(), defaultFlow().Reverse())
+	// The client refuses to send the file.
+	ms.Append(genPacket(2, nil), defaultDate(), defaultFlow())
+	ms.Append(genPacket(3, []byte{ERR, 0xe0, 0x07, '#', '4', '2', '0', '0', '0'}), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := decodeEvents(tp)
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "/etc/passwd", events[0]["local_infile"])
+		assert.Nil(t, events[0]["bytes_uploaded"])
+		assert.Equal(t, true, events[0]["Error"])
+		assert.Equal(t, float64(2016), events[0]["ErrorCode"])
+	}
+}
+
+func TestReadInfilePacketsAcrossMaxLength(t *testing.T) {
+	p := newParser(&testPublisher{}).(*Parser)
+	p.state = parseStateLocalInfile
+	p.nextSequenceID = 2
+	var b []byte
+	b = append(b, genPacket(2, make([]byte, maxPacketLength))...)
+	b = append(b, genPacket(3, nil)...) // Ends the maximum-length payload
+	b = append(b, genPacket(4, nil)...) // Ends the file
+	r := bytes.NewReader(b)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, p.readInfilePacket(r))
+		assert.Equal(t, parseStateLocalInfile, p.state)
+	}
+	assert.NoError(t, p.readInfilePacket(r))
+	assert.Equal(t, parseStateChompFirstPacket, p.state)
+	assert.Equal(t, maxPacketLength, p.currentQueryEvent.BytesUploaded)
+}
+
+func TestResponseWithoutQuery(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append(genPacket(2, okPayload(0, 0)), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	assert.Equal(t, 0, len(tp.output))
+}
+
+func TestResyncAfterSkippedBytes(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append(genQuery("SELECT 1"), defaultDate(), defaultFlow())
+	// The first part of the response is lost; what's left looks like the
+	// tail end of a result set.
+	rest := genResponse(resultSet([]string{"a"}, [][]string{{"1"}, {"2"}}))[14:]
+	ms.AppendSkipped(rest, defaultDate(), defaultFlow().Reverse(), 100)
+	ms.Append(genQuery("SELECT 2"), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.output)) {
+		var ret map[string]interface{}
+		json.Unmarshal(tp.output[0], &ret)
+		assert.Equal(t, "SELECT 2", ret["Query"])
+	}
+}
+
+func TestResyncAfterSequenceMismatch(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append(genQuery("SELECT 1"), defaultDate(), defaultFlow())
+	// Sequence IDs should start at 1.
+	ms.Append(genPacket(3, okPayload(0, 0)), defaultDate(), defaultFlow().Reverse())
+	// Non-command packets and garbage are ignored until the next command.
+	ms.Append(genPacket(1, []byte{0x01, 0x02, 0x03}), defaultDate(), defaultFlow())
+	ms.Append(genPacket(0, []byte{0xee, 0x02, 0x03}), defaultDate(), defaultFlow())
+	ms.Append(genPacket(1, okPayload(0, 0)), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genQuery("SELECT 2"), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.output)) {
+		var ret map[string]interface{}
+		json.Unmarshal(tp.output[0], &ret)
+		assert.Equal(t, "SELECT 2", ret["Query"])
+	}
+}
+
+func TestRemainingBytesDiscardedOnError(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append(append(genPacket(1, []byte{0x01}), 0x00, 0x00), defaultDate(), defaultFlow())
+	parser.On(ms)
+	n, err := ms.messages[0].Read(make([]byte, 1))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestNegotiatedCompression(t *testing.T) {
+	for _, capabilities := range []uint32{CLIENT_COMPRESS, CLIENT_ZSTD_COMPRESSION_ALGORITHM} {
+		tp := &testPublisher{}
+		parser := newParser(tp)
+		ms := &messageStream{}
+		ms.Append(genPacket(0, handshakePayload(capabilities)), defaultDate(), defaultFlow().Reverse())
+		ms.Append(genPacket(1, handshakeResponsePayload(capabilities)), defaultDate(), defaultFlow())
+		ms.Append(genPacket(2, okPayload(0, 0)), defaultDate(), defaultFlow().Reverse())
+		// Short payloads are sent uncompressed, inside compressed packets.
+		ms.Append(genCompressed(genQuery("SELECT 1"), ""), defaultDate(), defaultFlow())
+		response := genResponse(resultSet([]string{"a"}, [][]string{{"1"}, {"2"}}))
+		algorithm := "zlib"
+		if capabilities == CLIENT_ZSTD_COMPRESSION_ALGORITHM {
+			algorithm = "zstd"
+		}
+		ms.Append(genCompressed(response, algorithm), defaultDate(), defaultFlow().Reverse())
+		parser.On(ms)
+		if assert.Equal(t, 1, len(tp.output)) {
+			var ret map[string]interface{}
+			json.Unmarshal(tp.output[0], &ret)
+			assert.Equal(t, "SELECT 1", ret["Query"])
+			assert.Equal(t, float64(2), ret["RowsSent"])
+		}
+	}
+}
+
+func TestHandshakeWithoutCompression(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	// The client doesn't ask for compression, even though the server
+	// supports it.
+	ms.Append(genPacket(0, handshakePayload(CLIENT_COMPRESS)), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genPacket(1, handshakeResponsePayload(0)), defaultDate(), defaultFlow())
+	ms.Append(genPacket(2, okPayload(0, 0)), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genQuery("SELECT 1"), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	assert.Equal(t, 1, len(tp.output))
+}
+
+func TestSSLRequest(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	clientHello := []byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00}
+	ms.Append(genPacket(0, handshakePayload(CLIENT_SSL)), defaultDate(), defaultFlow().Reverse())
+	// The client sends the ClientHello right after the SSLRequest.
+	sslRequest := handshakeResponsePayload(CLIENT_SSL)[:32]
+	ms.Append(append(genPacket(1, sslRequest), clientHello...), defaultDate(), defaultFlow())
+	// Application data that would otherwise look like a query and response.
+	ms.Append(genQuery("SELECT 1"), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := decodeEvents(tp)
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "tls_connection", events[0]["event_type"])
+		assert.Equal(t, "mysql", events[0]["protocol"])
+		assert.Equal(t, float64(len(clientHello)+len(genQuery("SELECT 1"))), events[0]["bytes_to_server"])
+		assert.Equal(t, float64(1), events[0]["duration_ms"])
+	}
+}
+
+func TestClientHelloWithoutSSLRequest(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append([]byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00}, defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := decodeEvents(tp)
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "tls_connection", events[0]["event_type"])
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	longQuery := "SELECT * FROM t WHERE " + strings.Repeat("a = 1 AND ", 20) + "b = 2"
+	for _, algorithm := range []string{"", "zlib", "zstd"} {
+		tp := &testPublisher{}
+		parser := newParser(tp)
+		ms := &messageStream{}
+		ms.Append(genCompressed(genQuery(longQuery), algorithm), defaultDate(), defaultFlow())
+		// Two compressed packets, with a packet split across them.
+		response := genResponse(resultSet([]string{"a"}, [][]string{{"1"}, {"2"}}))
+		ms.Append(append(genCompressed(response[:20], algorithm), genCompressed(response[20:], algorithm)...),
+			defaultDate(), defaultFlow().Reverse())
+		parser.On(ms)
+		if assert.Equal(t, 1, len(tp.output), algorithm) {
+			var ret map[string]interface{}
+			json.Unmarshal(tp.output[0], &ret)
+			assert.Equal(t, longQuery, ret["Query"])
+			assert.Equal(t, float64(2), ret["RowsSent"])
+		}
+	}
+}
+
+func TestGuessCompression(t *testing.T) {
+	compressed, known := guessCompression(genCompressed(genQuery("SELECT 1"), ""))
+	assert.True(t, known)
+	assert.True(t, compressed)
+	compressed, known = guessCompression(genQuery("SELECT 1"))
+	assert.True(t, known)
+	assert.False(t, compressed)
+	compressed, known = guessCompression(genPacket(3, []byte("garbage data")))
+	assert.False(t, known)
+}
+
+func TestReadPacket(t *testing.T) {
+	payload := append([]byte{COM_QUERY}, "SELECT 1"...)
+	r := iotest.OneByteReader(bytes.NewReader(genPacket(0, payload)))
+	packet, err := readPacket(r, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, packet.payload)
+	assert.Equal(t, len(payload), packet.PayloadLength)
+	assert.False(t, packet.Truncated)
+
+	_, err = readPacket(r, 1024)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadMultiPacketPayload(t *testing.T) {
+	for _, length := range []int{maxPacketLength, maxPacketLength + 10, 2*maxPacketLength + 1} {
+		payload := bytes.Repeat([]byte{'x'}, length)
+		r := bytes.NewReader(genPayload(0, payload))
+		packet, err := readPacket(r, 3*maxPacketLength)
+		assert.Nil(t, err)
+		assert.Equal(t, length, packet.PayloadLength)
+		assert.Equal(t, payload, packet.payload)
+		assert.Equal(t, 0, r.Len())
+	}
+}
+
+func TestReadTruncatedPayload(t *testing.T) {
+	payload := bytes.Repeat([]byte{'x'}, maxPacketLength+10)
+	next := genPacket(0, []byte{COM_PING})
+	r := bytes.NewReader(append(genPayload(0, payload), next...))
+	packet, err := readPacket(r, 16)
+	assert.Nil(t, err)
+	assert.True(t, packet.Truncated)
+	assert.Equal(t, maxPacketLength+10, packet.PayloadLength)
+	assert.Equal(t, payload[:16], packet.payload)
+
+	// The rest of the payload was discarded, and the next packet is intact.
+	packet, err = readPacket(r, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{COM_PING}, packet.payload)
+}
+
+func TestReadBadPackets(t *testing.T) {
+	for _, b := range [][]byte{
+		{0x00, 0x00, 0x00, 0x00},             // Zero-length payload
+		{0x05, 0x00},                         // Short header
+		{0x05, 0x00, 0x00, 0x00, 0x03, 'S'},  // Short payload
+		{0xff, 0xff, 0xff, 0x00, 0x03, 0x03}, // Corrupt length
+	} {
+		_, err := readPacket(bytes.NewReader(b), 1024)
+		assert.NotNil(t, err)
+		assert.NotEqual(t, io.EOF, err)
+	}
+}
+
+// genPacket returns a single physical packet containing payload.
+func genPacket(sequenceID byte, payload []byte) []byte {
+	l := len(payload)
+	b := []byte{byte(l), byte(l >> 8), byte(l >> 16), sequenceID}
+	return append(b, payload...)
+}
+
+// genPayload splits payload into as many physical packets as necessary.
+func genPayload(sequenceID byte, payload []byte) []byte {
+	var b []byte
+	for {
+		n := len(payload)
+		if n > maxPacketLength {
+			n = maxPacketLength
+		}
+		b = append(b, genPacket(sequenceID, payload[:n])...)
+		sequenceID++
+		payload = payload[n:]
+		if n < maxPacketLength {
+			return b
+		}
+	}
+}
+
+func genQuery(query string) []byte {
+	return genPacket(0, append([]byte{COM_QUERY}, query...))
+}
+
+// genResponse serializes response payloads with consecutive sequence IDs,
+// starting at 1.
+func genResponse(payloads [][]byte) []byte {
+	var b []byte
+	for i, payload := range payloads {
+		b = append(b, genPacket(byte(i+1), payload)...)
+	}
+	return b
+}
+
+func okPayload(affectedRows byte, statusFlags uint16) []byte {
+	return []byte{OK, affectedRows, 0x00, byte(statusFlags), byte(statusFlags >> 8), 0x00, 0x00}
+}
+
+func eofPayload(statusFlags uint16) []byte {
+	return []byte{EOF, 0x00, 0x00, byte(statusFlags), byte(statusFlags >> 8)}
+}
+
+// okEOFPayload returns an OK packet with an EOF header, which ends result sets
+// when CLIENT_DEPRECATE_EOF is set.
+func okEOFPayload(statusFlags uint16) []byte {
+	b := okPayload(0, statusFlags)
+	b[0] = EOF
+	return b
+}
+
+func lengthEncodedString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func columnDefinition(name string) []byte {
+	var b []byte
+	for _, s := range []string{"def", "db", "table", "table", name, name} {
+		b = append(b, lengthEncodedString(s)...)
+	}
+	b = append(b, 0x0c, 0x21, 0x00, 0x0b, 0x00, 0x00, 0x00, 0xfd, 0x00, 0x00, 0x00, 0x00, 0x00)
+	return b
+}
+
+// resultSet returns the payloads making up a text protocol result set.
+func resultSet(columns []string, rows [][]string) [][]byte {
+	payloads := [][]byte{{byte(len(columns))}}
+	for _, c := range columns {
+		payloads = append(payloads, columnDefinition(c))
+	}
+	payloads = append(payloads, eofPayload(0))
+	for _, row := range rows {
+		var b []byte
+		for _, v := range row {
+			b = append(b, lengthEncodedString(v)...)
+		}
+		payloads = append(payloads, b)
+	}
+	return append(payloads, eofPayload(0))
+}
+
+func handshakePayload(capabilities uint32) []byte {
+	capabilities |= CLIENT_PROTOCOL_41 | CLIENT_SECURE_CONNECTION
+	b := []byte{HANDSHAKE_V10}
+	b = append(b, "5.7.18\x00"...)
+	b = append(b, 0x01, 0x00, 0x00, 0x00)          // connection ID
+	b = append(b, bytes.Repeat([]byte{'a'}, 8)...) // auth-plugin-data-part-1
+	b = append(b, 0x00)                            // filler
+	b = append(b, byte(capabilities), byte(capabilities>>8))
+	b = append(b, 0x21, 0x02, 0x00) // character set, status flags
+	b = append(b, byte(capabilities>>16), byte(capabilities>>24))
+	b = append(b, 0x15)                              // auth-plugin-data length
+	b = append(b, bytes.Repeat([]byte{0x00}, 10)...) // reserved
+	b = append(b, bytes.Repeat([]byte{'a'}, 13)...)  // auth-plugin-data-part-2
+	return b
+}
+
+func handshakeResponsePayload(capabilities uint32) []byte {
+	capabilities |= CLIENT_PROTOCOL_41 | CLIENT_SECURE_CONNECTION
+	b := make([]byte, 32)
+	binary.LittleEndian.PutUint32(b, capabilities)
+	binary.LittleEndian.PutUint32(b[4:], 1<<24)
+	b[8] = 0x21
+	b = append(b, "user\x00"...)
+	return append(b, 0x00) // empty auth response
+}
+
+func TestZstdWindowLimit(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	// A zstd frame holding a query in a raw block, which claims to need a
+	// 256MB window.
+	query := genQuery("SELECT 1")
+	n := len(query)
+	frame := append([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 18 << 3, byte(1 | n<<3), byte(n >> 5), byte(n >> 13)}, query...)
+	l := len(frame)
+	ms.Append(append([]byte{byte(l), byte(l >> 8), byte(l >> 16), 0x00, byte(n), byte(n >> 8), byte(n >> 16)}, frame...),
+		defaultDate(), defaultFlow())
+	ms.Append(genCompressed(genResponse([][]byte{okPayload(0, 0)}), "zstd"), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genCompressed(genQuery("SELECT 2"), "zstd"), defaultDate(), defaultFlow())
+	ms.Append(genCompressed(genResponse([][]byte{okPayload(0, 0)}), "zstd"), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.output)) {
+		var ret map[string]interface{}
+		json.Unmarshal(tp.output[0], &ret)
+		assert.Equal(t, "SELECT 2", ret["Query"])
+	}
+}
+
+// genCompressed wraps b in a compressed packet, compressing it with the given
+// algorithm (or sending it as-is, if algorithm is empty).
+func genCompressed(b []byte, algorithm string) []byte {
+	var payload bytes.Buffer
+	uncompressedLength := len(b)
+	switch algorithm {
+	case "zlib":
+		w := zlib.NewWriter(&payload)
+		w.Write(b)
+		w.Close()
+	case "zstd":
+		w, _ := zstd.NewWriter(&payload)
+		w.Write(b)
+		w.Close()
+	default:
+		payload.Write(b)
+		uncompressedLength = 0
+	}
+	l := payload.Len()
+	header := []byte{byte(l), byte(l >> 8), byte(l >> 16), 0x00,
+		byte(uncompressedLength), byte(uncompressedLength >> 8), byte(uncompressedLength >> 16)}
+	return append(header, payload.Bytes()...)
+}
+
+// withStatus sets the status flags in the EOF packet that ends a result set.
+func withStatus(payloads [][]byte, statusFlags uint16) [][]byte {
+	payloads[len(payloads)-1] = eofPayload(statusFlags)
+	return payloads
+}
+
+func concat2(packets ...[]byte) []byte {
+	var b []byte
+	for _, p := range packets {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func concat(results ...[][]byte) [][]byte {
+	var payloads [][]byte
+	for _, r := range results {
+		payloads = append(payloads, r...)
+	}
+	return payloads
+}
+
+// Implements sniffer.Message
+type message struct {
+	flow    sniffer.IPPortTuple
+	ts      time.Time
+	skipped int
+	r       io.Reader
+}
+
+func (m *message) Flow() sniffer.IPPortTuple { return m.flow }
+func (m *message) Timestamp() time.Time      { return m.ts }
+func (m *message) Skipped() int              { return m.skipped }
+func (m *message) Read(p []byte) (int, error) {
+	return m.r.Read(p)
+}
+
+type messageStream struct {
+	messages []sniffer.Message
+	index    int
+}
+
+func (ms *messageStream) Append(b []byte, ts time.Time, flow sniffer.IPPortTuple) {
+	ms.AppendSkipped(b, ts, flow, 0)
+}
+
+func (ms *messageStream) AppendSkipped(b []byte, ts time.Time, flow sniffer.IPPortTuple, skipped int) {
+	ms.messages = append(ms.messages, &message{
+		r:       bytes.NewReader(b),
+		flow:    flow,
+		ts:      ts,
+		skipped: skipped,
+	})
+}
+
+func (ms *messageStream) Next() (sniffer.Message, bool) {
+	if ms.index < len(ms.messages) {
+		m := ms.messages[ms.index]
+		ms.index++
+		return m, true
+	} else {
+		return nil, false
+	}
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffer.IPPortTuple{
+		SrcIP:   net.IPv4(10, 0, 0, 22),
+		DstIP:   net.IPv4(10, 0, 0, 23),
+		SrcPort: 44444,
+		DstPort: 3306,
+	}
+}
+
+func defaultDate() time.Time {
+	return time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+}
+
+type testPublisher struct {
+	output [][]byte
+}
+
+func (tp *testPublisher) Publish(data interface{}, timestamp time.Time) {
+	m, _ := json.Marshal(data)
+	tp.output = append(tp.output, m)
+}
+
+// Write collects the query events that the parser writes out, in order with
+// the events it publishes.
+func (tp *testPublisher) Write(b []byte) (int, error) {
+	tp.output = append(tp.output, bytes.TrimSuffix(append([]byte(nil), b...), []byte("\n")))
+	return len(b), nil
+}
+
+func newParser(tp *testPublisher) sniffer.Consumer {
+	return newParserWithOptions(tp, Options{Port: 3306, MaxPayloadSize: 1024 * 1024})
+}
+
+func newParserWithOptions(tp *testPublisher, options Options) sniffer.Consumer {
+	pf := ParserFactory{Options: options, Publisher: tp}
+	parser := pf.New(defaultFlow()).(*Parser)
+	parser.output = tp
+	return parser
+}
@@ -0,0 +1,278 @@
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+)
+
+// ReplicationEvent summarizes a replication stream over one reporting
+// interval. A replica connects to the primary and sends COM_BINLOG_DUMP or
+// COM_BINLOG_DUMP_GTID, after which the primary streams binlog events to it
+// for the rest of the connection.
+//
+// Intervals are measured with capture timestamps, so an event is only
+// published once a packet arrives after its interval has ended (or the
+// stream ends). The primary sends heartbeats to idle replicas, so this
+// shouldn't take much longer than the heartbeat period.
+type ReplicationEvent struct {
+	EventType       string `json:"event_type"`
+	ClientIP        string `json:"client_ip"`
+	ServerIP        string `json:"server_ip"`
+	Command         string `json:"command"` // "binlog_dump" or "binlog_dump_gtid"
+	ReplicaServerID uint32 `json:"replica_server_id"`
+	// Where the replica has got to in the primary's binlog, as of the end
+	// of the interval. GTID is the last GTID sent, if any.
+	BinlogFile     string  `json:"binlog_file"`
+	BinlogPosition uint64  `json:"binlog_position"`
+	GTID           string  `json:"gtid,omitempty"`
+	IntervalMs     float64 `json:"interval_ms"`
+	Events         int     `json:"events"` // Not including heartbeats
+	EventsPerSec   float64 `json:"events_per_sec"`
+	Heartbeats     int     `json:"heartbeats"`
+	Bytes          int     `json:"bytes"`
+	BytesPerSec    float64 `json:"bytes_per_sec"`
+	// How far behind the primary the replication stream was: the
+	// difference between the capture timestamp and the timestamp in the
+	// binlog event header, for the last event and the worst one in the
+	// interval. Binlog timestamps only have a resolution of a second. These
+	// are omitted if no events in the interval carried a usable timestamp.
+	LagMs    float64 `json:"lag_ms,omitempty"`
+	MaxLagMs float64 `json:"max_lag_ms,omitempty"`
+	// Set on the final event for a stream, which may cover a partial
+	// interval. If the primary ended the stream with an error (e.g.
+	// because the requested binlog was purged), Error and ErrorCode say so.
+	StreamEnded bool `json:"stream_ended"`
+	Error       bool `json:"error"`
+	ErrorCode   int  `json:"error_code"`
+	timestamp   time.Time
+}
+
+// replicationStream tracks a replication stream between reports.
+type replicationStream struct {
+	event          ReplicationEvent
+	lagKnown       bool
+	checksums      bool // Whether binlog events end with a checksum
+	checksumsKnown bool
+	last           time.Time // Capture timestamp of the latest packet
+}
+
+var binlogDumpCommandNames = map[byte]string{
+	COM_BINLOG_DUMP:      "binlog_dump",
+	COM_BINLOG_DUMP_GTID: "binlog_dump_gtid",
+}
+
+// startReplication handles a replica's request for a binlog stream.
+func (p *Parser) startReplication(packet *mySQLPacket, timestamp time.Time) {
+	m, err := readBinlogDumpPacket(packet.payload)
+	if err != nil {
+		p.logger.Debug("Error parsing binlog dump command", logrus.Fields{"error": err})
+		p.state = parseStateIdle
+		return
+	}
+	p.logger.Debug("Replication stream started", logrus.Fields{
+		"serverID":       m.ServerID,
+		"binlogFile":     m.BinlogFilename,
+		"binlogPosition": m.BinlogPosition})
+	p.replication = &replicationStream{
+		event: ReplicationEvent{
+			Command:         binlogDumpCommandNames[m.Command],
+			ReplicaServerID: m.ServerID,
+			BinlogFile:      m.BinlogFilename,
+			BinlogPosition:  m.BinlogPosition,
+			timestamp:       timestamp,
+		},
+		last: timestamp,
+	}
+	p.state = parseStateBinlogStream
+	metrics.Counter("mysql.replication_streams").Add()
+}
+
+// parseBinlogPacket handles a packet in a replication stream: a binlog event
+// prefixed with an OK byte, or the EOF or ERR packet that ends the stream.
+func (p *Parser) parseBinlogPacket(packet *mySQLPacket, timestamp time.Time) error {
+	rs := p.replication
+	p.advanceReplication(timestamp)
+	switch {
+	case packet.FirstPayloadByte() == ERR:
+		rs.event.Error = true
+		rs.event.ErrorCode = readErrorCode(packet.payload)
+		p.endReplication(timestamp)
+		return nil
+	case packet.FirstPayloadByte() == EOF && packet.PayloadLength < 9:
+		// The replica asked the primary not to block at the end of the
+		// binlog.
+		p.endReplication(timestamp)
+		return nil
+	case packet.FirstPayloadByte() != OK:
+		return errDesynchronized
+	}
+
+	// The event fills the rest of the payload, possibly after a
+	// semi-synchronous replication header. The event size in the header
+	// tells us which.
+	payload := packet.payload[1:]
+	payloadLength := packet.PayloadLength - 1
+	eventSize := func(offset int) int {
+		if len(payload) < offset+13 {
+			return -1
+		}
+		return int(binary.LittleEndian.Uint32(payload[offset+9:]))
+	}
+	if eventSize(0) != payloadLength && len(payload) > 0 &&
+		payload[0] == SEMI_SYNC_INDICATOR && eventSize(2) == payloadLength-2 {
+		payload = payload[2:]
+	}
+	r := newErrReader(payload)
+	header := readBinlogEventHeader(r)
+	if r.err != nil {
+		return r.err
+	}
+	body := payload[binlogEventHeaderLength:]
+	if header.EventSize >= binlogEventHeaderLength && int(header.EventSize) <= len(payload) {
+		body = payload[binlogEventHeaderLength:header.EventSize]
+	}
+	p.logger.Debug("Parsed binlog event", logrus.Fields{
+		"type":        header.EventType,
+		"serverID":    header.ServerID,
+		"logPosition": header.LogPosition})
+
+	e := &rs.event
+	e.Bytes += packet.PayloadLength
+	if header.EventType == HEARTBEAT_EVENT || header.EventType == HEARTBEAT_EVENT_V2 {
+		e.Heartbeats++
+	} else {
+		e.Events++
+	}
+	// Artificial events, which the primary generates rather than reading
+	// from the binlog, have a position of 0.
+	if header.LogPosition != 0 {
+		e.BinlogPosition = uint64(header.LogPosition)
+	}
+
+	switch header.EventType {
+	case ROTATE_EVENT:
+		r := newErrReader(body)
+		position := r.Uint64()
+		filename := r.Bytes(r.Len())
+		if r.err != nil {
+			return r.err
+		}
+		if len(filename) > binlogChecksumLength &&
+			(rs.checksums || (!rs.checksumsKnown && hasChecksum(filename))) {
+			filename = filename[:len(filename)-binlogChecksumLength]
+		}
+		e.BinlogFile = string(filename)
+		e.BinlogPosition = position
+	case FORMAT_DESCRIPTION_EVENT:
+		// The checksum algorithm is the last byte before the checksum.
+		if int(header.EventSize) <= len(payload) && len(body) > binlogChecksumLength {
+			rs.checksums = body[len(body)-binlogChecksumLength-1] != 0
+			rs.checksumsKnown = true
+		}
+	case GTID_EVENT:
+		if gtid, err := readGTIDEvent(body); err == nil {
+			e.GTID = gtid
+		}
+	case MARIADB_GTID_EVENT:
+		if gtid, err := readMariaDBGTIDEvent(body, header.ServerID); err == nil {
+			e.GTID = gtid
+		}
+	}
+
+	if hasLag(header) {
+		lag := timestamp.Sub(time.Unix(int64(header.Timestamp), 0))
+		e.LagMs = float64(lag.Nanoseconds()) / 1e6
+		if e.LagMs < 0 {
+			e.LagMs = 0
+		}
+		if !rs.lagKnown || e.LagMs > e.MaxLagMs {
+			e.MaxLagMs = e.LagMs
+		}
+		rs.lagKnown = true
+	}
+	return nil
+}
+
+// hasLag reports whether an event's timestamp says when the change it
+// describes was made on the primary. Other events are generated when the
+// binlog is created or when a replica connects.
+func hasLag(header *binlogEventHeader) bool {
+	if header.Timestamp == 0 || header.LogPosition == 0 {
+		return false
+	}
+	switch header.EventType {
+	case ROTATE_EVENT, FORMAT_DESCRIPTION_EVENT, HEARTBEAT_EVENT,
+		HEARTBEAT_EVENT_V2, PREVIOUS_GTIDS_EVENT, MARIADB_BINLOG_CHECKPOINT,
+		MARIADB_GTID_LIST_EVENT:
+		return false
+	}
+	return true
+}
+
+// hasChecksum guesses whether a rotate event's filename is followed by a
+// checksum, for rotate events that arrive before the format description
+// event. Binlog filenames are printable, but checksums are unlikely to be.
+func hasChecksum(filename []byte) bool {
+	tail := filename[len(filename)-binlogChecksumLength:]
+	return bytes.IndexFunc(tail, func(c rune) bool { return c < 0x20 || c > 0x7e }) >= 0
+}
+
+// advanceReplication publishes a report for the current interval if
+// timestamp is past its end. Intervals in which nothing arrived at all are
+// skipped.
+func (p *Parser) advanceReplication(timestamp time.Time) {
+	rs := p.replication
+	rs.last = timestamp
+	interval := time.Duration(p.options.ReplicationInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+	elapsed := timestamp.Sub(rs.event.timestamp)
+	if elapsed < interval {
+		return
+	}
+	p.publishReplication(interval)
+	rs.event.timestamp = rs.event.timestamp.Add(elapsed - elapsed%interval)
+}
+
+// endReplication publishes a final report for the replication stream.
+func (p *Parser) endReplication(timestamp time.Time) {
+	rs := p.replication
+	rs.event.StreamEnded = true
+	elapsed := timestamp.Sub(rs.event.timestamp)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	p.publishReplication(elapsed)
+	p.logger.Debug("Replication stream ended", logrus.Fields{})
+	p.replication = nil
+	p.state = parseStateIdle
+}
+
+// publishReplication publishes a report covering the given length of time,
+// and resets the per-interval counters.
+func (p *Parser) publishReplication(interval time.Duration) {
+	rs := p.replication
+	e := rs.event
+	e.EventType = "replication"
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	e.IntervalMs = float64(interval.Nanoseconds()) / 1e6
+	if seconds := interval.Seconds(); seconds > 0 {
+		e.EventsPerSec = float64(e.Events) / seconds
+		e.BytesPerSec = float64(e.Bytes) / seconds
+	}
+	p.publisher.Publish(&e, e.timestamp)
+	metrics.Counter("mysql.replication_events_parsed").Add()
+
+	rs.event.Events = 0
+	rs.event.Heartbeats = 0
+	rs.event.Bytes = 0
+	rs.event.LagMs = 0
+	rs.event.MaxLagMs = 0
+	rs.lagKnown = false
+}
@@ -0,0 +1,122 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicationStream(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParserWithOptions(tp, Options{Port: 3306, MaxPayloadSize: 1024 * 1024,
+		Replication: true, ReplicationInterval: 10})
+	ms := &messageStream{}
+	start := defaultDate()
+	ms.Append(genPacket(0, binlogDumpGTIDPayload("mysql-bin.000001", 4, 7)), start, defaultFlow())
+
+	var stream []byte
+	sequenceID := byte(1)
+	appendEvent := func(event []byte, semiSync bool) {
+		payload := []byte{OK}
+		if semiSync {
+			payload = append(payload, SEMI_SYNC_INDICATOR, 0x00)
+		}
+		stream = append(stream, genPacket(sequenceID, append(payload, event...))...)
+		sequenceID++
+	}
+	sid := []byte("0123456789abcdef")
+	// The fake rotate event announces the file, with a checksum.
+	appendEvent(binlogEvent(0, ROTATE_EVENT, 0, append(append(make([]byte, 8), "mysql-bin.000002"...), 0x01, 0x02, 0x03, 0x04)), false)
+	gtid := append([]byte{0x01}, sid...)
+	gtid = append(gtid, 42, 0, 0, 0, 0, 0, 0, 0)
+	eventTime := uint32(start.Add(-5 * time.Second).Unix())
+	appendEvent(binlogEvent(eventTime, GTID_EVENT, 200, gtid), true)
+	appendEvent(binlogEvent(eventTime, 0x02, 300, []byte("query")), false)
+	ms.Append(stream, start.Add(time.Second), defaultFlow().Reverse())
+
+	// A heartbeat in the next interval, then an error.
+	stream = nil
+	appendEvent(binlogEvent(0, HEARTBEAT_EVENT, 0, []byte("mysql-bin.000002")), false)
+	ms.Append(stream, start.Add(12*time.Second), defaultFlow().Reverse())
+	ms.Append(genPacket(sequenceID, []byte{ERR, 0xd4, 0x04, '#', 'H', 'Y', '0', '0', '0'}),
+		start.Add(14*time.Second), defaultFlow().Reverse())
+	parser.On(ms)
+
+	events := decodeEvents(tp)
+	if assert.Equal(t, 2, len(events)) {
+		e := events[0]
+		assert.Equal(t, "replication", e["event_type"])
+		assert.Equal(t, "binlog_dump_gtid", e["command"])
+		assert.Equal(t, float64(7), e["replica_server_id"])
+		assert.Equal(t, "mysql-bin.000002", e["binlog_file"])
+		assert.Equal(t, float64(300), e["binlog_position"])
+		assert.Equal(t, "30313233-3435-3637-3839-616263646566:42", e["gtid"])
+		assert.Equal(t, float64(3), e["events"])
+		assert.Equal(t, float64(0.3), e["events_per_sec"])
+		assert.Equal(t, float64(6000), e["lag_ms"])
+		assert.Equal(t, float64(6000), e["max_lag_ms"])
+		assert.Equal(t, false, e["stream_ended"])
+
+		e = events[1]
+		assert.Equal(t, float64(0), e["events"])
+		assert.Equal(t, float64(1), e["heartbeats"])
+		assert.Equal(t, float64(4000), e["interval_ms"])
+		assert.Nil(t, e["lag_ms"])
+		assert.Equal(t, true, e["stream_ended"])
+		assert.Equal(t, true, e["error"])
+		assert.Equal(t, float64(1236), e["error_code"])
+	}
+}
+
+func TestReplicationDisabled(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append(genPacket(0, binlogDumpGTIDPayload("mysql-bin.000001", 4, 7)), defaultDate(), defaultFlow())
+	ms.Append(genPacket(1, append([]byte{OK}, binlogEvent(1, 0x02, 100, nil)...)), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	assert.Equal(t, 0, len(tp.output))
+}
+
+func TestReadBinlogDumpPacket(t *testing.T) {
+	payload := []byte{COM_BINLOG_DUMP, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, 0x00, 0x00, 0x00}
+	payload = append(payload, "mysql-bin.000001"...)
+	m, err := readBinlogDumpPacket(payload)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(4), m.BinlogPosition)
+		assert.Equal(t, uint32(7), m.ServerID)
+		assert.Equal(t, "mysql-bin.000001", m.BinlogFilename)
+	}
+	m, err = readBinlogDumpPacket(binlogDumpGTIDPayload("mysql-bin.000003", 1234, 8))
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(1234), m.BinlogPosition)
+		assert.Equal(t, uint32(8), m.ServerID)
+		assert.Equal(t, "mysql-bin.000003", m.BinlogFilename)
+	}
+	_, err = readBinlogDumpPacket([]byte{COM_BINLOG_DUMP, 0x04})
+	assert.Error(t, err)
+}
+
+func binlogDumpGTIDPayload(filename string, position uint64, serverID uint32) []byte {
+	b := make([]byte, 11)
+	b[0] = COM_BINLOG_DUMP_GTID
+	binary.LittleEndian.PutUint32(b[3:], serverID)
+	binary.LittleEndian.PutUint32(b[7:], uint32(len(filename)))
+	b = append(b, filename...)
+	pos := make([]byte, 8)
+	binary.LittleEndian.PutUint64(pos, position)
+	b = append(b, pos...)
+	return append(b, 0x00, 0x00, 0x00, 0x00) // empty GTID set
+}
+
+func binlogEvent(timestamp uint32, eventType byte, logPosition uint32, body []byte) []byte {
+	b := make([]byte, binlogEventHeaderLength)
+	binary.LittleEndian.PutUint32(b, timestamp)
+	b[4] = eventType
+	binary.LittleEndian.PutUint32(b[5:], 1)
+	binary.LittleEndian.PutUint32(b[9:], uint32(binlogEventHeaderLength+len(body)))
+	binary.LittleEndian.PutUint32(b[13:], logPosition)
+	return append(b, body...)
+}
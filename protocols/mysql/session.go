@@ -0,0 +1,116 @@
+package mysql
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+)
+
+// CommandEvent describes a command other than a query that we publish
+// events for: COM_PING, COM_QUIT or COM_CHANGE_USER.
+type CommandEvent struct {
+	EventType  string  `json:"event_type"`
+	Command    string  `json:"command"`
+	ClientIP   string  `json:"client_ip"`
+	ServerIP   string  `json:"server_ip"`
+	DurationMs float64 `json:"duration_ms"`
+	// For COM_CHANGE_USER, the user and schema the client asked for;
+	// otherwise, the current session's.
+	User      string `json:"user,omitempty"`
+	Schema    string `json:"schema,omitempty"`
+	Error     bool   `json:"error"`
+	ErrorCode int    `json:"error_code"`
+	command   byte
+	timestamp time.Time
+}
+
+var commandNames = map[byte]string{
+	COM_QUIT:        "quit",
+	COM_PING:        "ping",
+	COM_CHANGE_USER: "change_user",
+}
+
+// startCommand handles commands that change (or check on) the session,
+// whose responses we need to track.
+func (p *Parser) startCommand(packet *mySQLPacket, timestamp time.Time) {
+	c := CommandEvent{
+		command:   packet.FirstPayloadByte(),
+		User:      p.user,
+		Schema:    p.schema,
+		timestamp: timestamp,
+	}
+	switch c.command {
+	case COM_INIT_DB:
+		c.Schema = string(packet.payload[1:])
+	case COM_CHANGE_USER:
+		m, err := readChangeUserPacket(packet.payload, p.capabilities)
+		if err != nil {
+			p.logger.Debug("Error parsing COM_CHANGE_USER", logrus.Fields{"error": err})
+			p.state = parseStateIdle
+			return
+		}
+		c.User = m.User
+		c.Schema = m.Schema
+	case COM_QUIT:
+		// The server just closes the connection.
+		p.currentCommand = c
+		p.commandDone(timestamp)
+		return
+	}
+	p.currentCommand = c
+	p.state = parseStateCommandResponse
+}
+
+// commandDone updates the session once the server has responded to the
+// current command, and publishes an event for it if it's one we report on.
+func (p *Parser) commandDone(timestamp time.Time) {
+	c := p.currentCommand
+	p.currentCommand = CommandEvent{}
+	p.state = parseStateIdle
+	if !c.Error {
+		switch c.command {
+		case COM_INIT_DB:
+			p.schema = c.Schema
+		case COM_CHANGE_USER, COM_RESET_CONNECTION:
+			// Both reset the session, rolling back any open transaction.
+			p.user = c.User
+			p.schema = c.Schema
+			if p.transaction != nil {
+				p.endTransaction("session_reset")
+			}
+		case COM_QUIT:
+			if p.transaction != nil {
+				p.endTransaction("connection_closed")
+			}
+		}
+	}
+
+	if name, ok := commandNames[c.command]; ok {
+		c.EventType = "command"
+		c.Command = name
+		c.ClientIP = p.flow.SrcIP.String()
+		c.ServerIP = p.flow.DstIP.String()
+		if timestamp.After(c.timestamp) {
+			c.DurationMs = float64(timestamp.Sub(c.timestamp).Nanoseconds()) / 1e6
+		}
+		p.publisher.Publish(&c, c.timestamp)
+		metrics.Counter("mysql.commands_parsed").Add()
+	}
+	p.startNextCommand()
+}
+
+// parseUseStatement returns the schema named in a USE statement, and whether
+// query is one.
+func parseUseStatement(query string) (string, bool) {
+	words := strings.Fields(stripLeadingComments(query))
+	if len(words) != 2 || strings.ToUpper(words[0]) != "USE" {
+		return "", false
+	}
+	schema := strings.TrimRight(words[1], ";")
+	if len(schema) > 1 && schema[0] == '`' && schema[len(schema)-1] == '`' {
+		schema = strings.Replace(schema[1:len(schema)-1], "``", "`", -1)
+	}
+	return schema, true
+}
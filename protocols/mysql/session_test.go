@@ -0,0 +1,155 @@
+package mysql
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPing(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append(genPacket(0, []byte{COM_PING}), defaultDate(), defaultFlow())
+	ms.Append(genPacket(1, okPayload(0, 0)), defaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.output)) {
+		assert.JSONEq(t, `{
+			"event_type": "command",
+			"command": "ping",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 3,
+			"error": false,
+			"error_code": 0
+		}`, string(tp.output[0]))
+	}
+}
+
+func TestQuit(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append(genQuery("BEGIN"), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, SERVER_STATUS_IN_TRANS)}), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genPacket(0, []byte{COM_QUIT}), defaultDate(), defaultFlow())
+	parser.On(ms)
+	events := decodeEvents(tp)
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "transaction", events[1]["event_type"])
+		assert.Equal(t, "connection_closed", events[1]["outcome"])
+		assert.Equal(t, "command", events[2]["event_type"])
+		assert.Equal(t, "quit", events[2]["command"])
+	}
+}
+
+func TestChangeUser(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append(genPacket(0, handshakePayload(CLIENT_CONNECT_WITH_DB)), defaultDate(), defaultFlow().Reverse())
+	response := append(handshakeResponsePayload(CLIENT_CONNECT_WITH_DB), "app\x00"...)
+	ms.Append(genPacket(1, response), defaultDate(), defaultFlow())
+	ms.Append(genPacket(2, okPayload(0, 0)), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genQuery("SELECT 1"), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+
+	changeUser := []byte{COM_CHANGE_USER}
+	changeUser = append(changeUser, "admin\x00"...)
+	changeUser = append(changeUser, 0x02, 'x', 'x') // auth response
+	changeUser = append(changeUser, "reports\x00"...)
+	ms.Append(genPacket(0, changeUser), defaultDate(), defaultFlow())
+	// The server asks the client to switch auth methods before accepting.
+	ms.Append(genPacket(1, []byte{EOF, 'p', 0x00}), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genPacket(2, []byte{'x', 'x'}), defaultDate(), defaultFlow())
+	ms.Append(genPacket(3, okPayload(0, 0)), defaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	ms.Append(genQuery("SELECT 2"), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+
+	events := decodeEvents(tp)
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "SELECT 1", events[0]["Query"])
+		assert.Equal(t, "user", events[0]["user"])
+		assert.Equal(t, "app", events[0]["schema"])
+		assert.Equal(t, "change_user", events[1]["command"])
+		assert.Equal(t, "admin", events[1]["user"])
+		assert.Equal(t, "reports", events[1]["schema"])
+		assert.Equal(t, float64(1), events[1]["duration_ms"])
+		assert.Equal(t, "SELECT 2", events[2]["Query"])
+		assert.Equal(t, "admin", events[2]["user"])
+		assert.Equal(t, "reports", events[2]["schema"])
+	}
+}
+
+func TestChangeSchema(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append(genPacket(0, append([]byte{COM_INIT_DB}, "app"...)), defaultDate(), defaultFlow())
+	ms.Append(genPacket(1, okPayload(0, 0)), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genQuery("SELECT 1"), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genQuery("USE `reports`;"), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+	// A failed COM_INIT_DB leaves the schema unchanged.
+	ms.Append(genPacket(0, append([]byte{COM_INIT_DB}, "nope"...)), defaultDate(), defaultFlow())
+	ms.Append(genPacket(1, []byte{ERR, 0x19, 0x04, '#', '4', '2', '0', '0', '0'}), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genQuery("SELECT 2"), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, 0)}), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+
+	events := decodeEvents(tp)
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "app", events[0]["schema"])
+		assert.Equal(t, "app", events[1]["schema"])
+		assert.Equal(t, "reports", events[2]["schema"])
+	}
+}
+
+func TestResetConnection(t *testing.T) {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	ms.Append(genQuery("BEGIN"), defaultDate(), defaultFlow())
+	ms.Append(genResponse([][]byte{okPayload(0, SERVER_STATUS_IN_TRANS)}), defaultDate(), defaultFlow().Reverse())
+	ms.Append(genPacket(0, []byte{COM_RESET_CONNECTION}), defaultDate(), defaultFlow())
+	ms.Append(genPacket(1, okPayload(0, 0)), defaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := decodeEvents(tp)
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "transaction", events[1]["event_type"])
+		assert.Equal(t, "session_reset", events[1]["outcome"])
+	}
+}
+
+func TestParseUseStatement(t *testing.T) {
+	var useTests = []struct {
+		query  string
+		schema string
+		ok     bool
+	}{
+		{"USE app", "app", true},
+		{"use `my``db`;", "my`db", true},
+		{"/* comment */ USE app", "app", true},
+		{"SELECT 1", "", false},
+		{"USE", "", false},
+	}
+	for _, testcase := range useTests {
+		schema, ok := parseUseStatement(testcase.query)
+		assert.Equal(t, testcase.schema, schema, testcase.query)
+		assert.Equal(t, testcase.ok, ok, testcase.query)
+	}
+}
+
+func decodeEvents(tp *testPublisher) []map[string]interface{} {
+	var events []map[string]interface{}
+	for _, b := range tp.output {
+		var ret map[string]interface{}
+		json.Unmarshal(b, &ret)
+		events = append(events, ret)
+	}
+	return events
+}
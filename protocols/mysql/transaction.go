@@ -0,0 +1,190 @@
+package mysql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+)
+
+// TransactionEvent summarizes a transaction once it ends. IdleTimeMs is the
+// part of the transaction's duration that the server spent waiting for the
+// client to send its next statement, e.g. because the application was
+// making other network calls while holding the transaction open.
+type TransactionEvent struct {
+	EventType     string  `json:"event_type"`
+	ClientIP      string  `json:"client_ip"`
+	ServerIP      string  `json:"server_ip"`
+	TransactionID string  `json:"transaction_id"`
+	Statements    int     `json:"statements"`
+	Errors        int     `json:"errors"`
+	DurationMs    float64 `json:"duration_ms"`
+	QueryTimeMs   float64 `json:"query_time_ms"`
+	IdleTimeMs    float64 `json:"idle_time_ms"`
+	// One of "commit", "rollback", "implicit_commit" (e.g., a DDL statement
+	// or a new BEGIN ended the transaction), "session_reset" (by
+	// COM_CHANGE_USER or COM_RESET_CONNECTION, which roll it back), or
+	// "connection_closed".
+	Outcome   string `json:"outcome"`
+	xa        bool   // Whether this is an XA transaction
+	timestamp time.Time
+	end       time.Time
+}
+
+type transactionStatementKind int
+
+const (
+	transactionStatementNone transactionStatementKind = iota
+	transactionStatementBegin
+	transactionStatementCommit
+	transactionStatementRollback
+)
+
+// classifyTransactionStatement reports whether query starts or ends a
+// transaction, whether it's an XA statement, and whether it chains a new
+// transaction onto the one it ends (COMMIT AND CHAIN).
+func classifyTransactionStatement(query string) (kind transactionStatementKind, xa bool, chain bool) {
+	// Transaction statements are short, so there's no need to look at all
+	// of a long query.
+	if len(query) > 128 {
+		query = query[:128]
+	}
+	words := strings.Fields(strings.ToUpper(strings.TrimRight(stripLeadingComments(query), "; \t\r\n")))
+	if len(words) == 0 {
+		return transactionStatementNone, false, false
+	}
+	if words[0] == "XA" && len(words) > 1 {
+		xa = true
+		words = words[1:]
+	}
+	switch words[0] {
+	case "BEGIN", "START":
+		if words[0] == "START" && !xa && (len(words) < 2 || words[1] != "TRANSACTION") {
+			// e.g. START SLAVE
+			return transactionStatementNone, false, false
+		}
+		return transactionStatementBegin, xa, false
+	case "COMMIT":
+		kind = transactionStatementCommit
+	case "ROLLBACK":
+		for _, w := range words[1:] {
+			if w == "TO" {
+				// ROLLBACK TO SAVEPOINT leaves the transaction open.
+				return transactionStatementNone, false, false
+			}
+		}
+		kind = transactionStatementRollback
+	default:
+		return transactionStatementNone, false, false
+	}
+	for i, w := range words {
+		if w == "CHAIN" && i > 0 && words[i-1] != "NO" {
+			chain = true
+		}
+	}
+	return kind, xa, chain
+}
+
+// stripLeadingComments removes whitespace and C-style comments from the
+// start of query.
+func stripLeadingComments(query string) string {
+	for {
+		query = strings.TrimLeft(query, " \t\r\n")
+		if !strings.HasPrefix(query, "/*") {
+			return query
+		}
+		end := strings.Index(query, "*/")
+		if end < 0 {
+			return ""
+		}
+		query = query[end+2:]
+	}
+}
+
+// trackTransaction updates the connection's transaction state once q is
+// complete, and tags q with the ID of the transaction it ran in. Besides
+// BEGIN/COMMIT/ROLLBACK statements, we use the SERVER_STATUS_IN_TRANS flag
+// to notice transactions that start implicitly (when autocommit is off) or
+// end implicitly (e.g., with a DDL statement).
+func (p *Parser) trackTransaction(q *QueryEvent, end time.Time) {
+	kind, xa, chain := classifyTransactionStatement(q.Query)
+	inTransaction := q.statusFlags&SERVER_STATUS_IN_TRANS != 0
+
+	if kind == transactionStatementBegin && p.transaction != nil && !q.Error {
+		// Starting a transaction implicitly commits the current one.
+		p.endTransaction("implicit_commit")
+	}
+	if p.transaction == nil && !q.Error &&
+		(kind == transactionStatementBegin || (q.statusFlagsKnown && inTransaction)) {
+		p.startTransaction(q.Timestamp, xa)
+	}
+	t := p.transaction
+	if t == nil {
+		return
+	}
+
+	q.TransactionID = t.TransactionID
+	t.Statements++
+	if q.Error {
+		t.Errors++
+	}
+	if end.After(q.Timestamp) {
+		t.QueryTimeMs += float64(end.Sub(q.Timestamp).Nanoseconds()) / 1e6
+	}
+	if end.After(t.end) {
+		t.end = end
+	}
+
+	if kind == transactionStatementCommit || kind == transactionStatementRollback {
+		if q.Error {
+			return
+		}
+		if kind == transactionStatementCommit {
+			p.endTransaction("commit")
+		} else {
+			p.endTransaction("rollback")
+		}
+		if chain {
+			p.startTransaction(end, xa)
+		}
+	} else if q.statusFlagsKnown && !inTransaction && !t.xa {
+		// XA transactions are detached from the session once they're
+		// prepared, so only explicit statements end them.
+		p.endTransaction("implicit_commit")
+	}
+}
+
+func (p *Parser) startTransaction(start time.Time, xa bool) {
+	p.transactionCount++
+	p.transaction = &TransactionEvent{
+		EventType: "transaction",
+		TransactionID: fmt.Sprintf("%s:%d:%d",
+			p.flow.SrcIP, p.flow.SrcPort, p.transactionCount),
+		xa:        xa,
+		timestamp: start,
+		end:       start,
+	}
+	p.logger.Debug("Transaction started",
+		logrus.Fields{"transactionID": p.transaction.TransactionID})
+}
+
+// endTransaction publishes a summary of the current transaction.
+func (p *Parser) endTransaction(outcome string) {
+	t := p.transaction
+	p.transaction = nil
+	t.Outcome = outcome
+	t.ClientIP = p.flow.SrcIP.String()
+	t.ServerIP = p.flow.DstIP.String()
+	t.DurationMs = float64(t.end.Sub(t.timestamp).Nanoseconds()) / 1e6
+	t.IdleTimeMs = t.DurationMs - t.QueryTimeMs
+	if t.IdleTimeMs < 0 {
+		t.IdleTimeMs = 0
+	}
+	p.logger.Debug("Transaction ended", logrus.Fields{
+		"transactionID": t.TransactionID,
+		"outcome":       outcome})
+	p.publisher.Publish(t, t.timestamp)
+	metrics.Counter("mysql.transactions_parsed").Add()
+}
@@ -0,0 +1,151 @@
+package mysql
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyTransactionStatement(t *testing.T) {
+	testCases := []struct {
+		query string
+		kind  transactionStatementKind
+		xa    bool
+		chain bool
+	}{
+		{"BEGIN", transactionStatementBegin, false, false},
+		{"begin work;", transactionStatementBegin, false, false},
+		{"/* app:checkout */ START TRANSACTION READ ONLY", transactionStatementBegin, false, false},
+		{"START SLAVE", transactionStatementNone, false, false},
+		{"COMMIT", transactionStatementCommit, false, false},
+		{"COMMIT AND CHAIN", transactionStatementCommit, false, true},
+		{"COMMIT AND NO CHAIN", transactionStatementCommit, false, false},
+		{"ROLLBACK WORK", transactionStatementRollback, false, false},
+		{"ROLLBACK TO SAVEPOINT s1", transactionStatementNone, false, false},
+		{"XA START 'xid'", transactionStatementBegin, true, false},
+		{"XA COMMIT 'xid'", transactionStatementCommit, true, false},
+		{"XA ROLLBACK 'xid'", transactionStatementRollback, true, false},
+		{"XA END 'xid'", transactionStatementNone, false, false},
+		{"SELECT * FROM begin", transactionStatementNone, false, false},
+		{"", transactionStatementNone, false, false},
+	}
+	for _, tc := range testCases {
+		kind, xa, chain := classifyTransactionStatement(tc.query)
+		assert.Equal(t, tc.kind, kind, tc.query)
+		assert.Equal(t, tc.xa, xa, tc.query)
+		assert.Equal(t, tc.chain, chain, tc.query)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	testCases := []struct {
+		exchanges  []exchange
+		statements int
+		outcome    string
+		durationMs float64
+		idleTimeMs float64
+	}{
+		{ // Explicit transaction
+			[]exchange{
+				{"BEGIN", SERVER_STATUS_IN_TRANS | SERVER_STATUS_AUTOCOMMIT, 0, 1},
+				{"UPDATE t SET a = 1", SERVER_STATUS_IN_TRANS | SERVER_STATUS_AUTOCOMMIT, 10, 15},
+				{"COMMIT", SERVER_STATUS_AUTOCOMMIT, 40, 50},
+			},
+			3, "commit", 50, 34,
+		},
+		{ // Implicitly started with autocommit off
+			[]exchange{
+				{"UPDATE t SET a = 1", SERVER_STATUS_IN_TRANS, 0, 5},
+				{"ROLLBACK", 0, 5, 10},
+			},
+			2, "rollback", 10, 0,
+		},
+		{ // Implicitly committed by DDL
+			[]exchange{
+				{"BEGIN", SERVER_STATUS_IN_TRANS, 0, 1},
+				{"CREATE TABLE t (a INT)", 0, 2, 10},
+			},
+			2, "implicit_commit", 10, 1,
+		},
+		{ // Connection closes with the transaction open
+			[]exchange{
+				{"BEGIN", SERVER_STATUS_IN_TRANS, 0, 1},
+				{"SELECT 1", SERVER_STATUS_IN_TRANS, 1, 2},
+			},
+			2, "connection_closed", 2, 0,
+		},
+	}
+	for _, tc := range testCases {
+		output := runExchanges(tc.exchanges)
+		if !assert.Equal(t, len(tc.exchanges)+1, len(output), tc.outcome) {
+			continue
+		}
+		var transaction map[string]interface{}
+		for _, ev := range output {
+			if ev["event_type"] == "transaction" {
+				transaction = ev
+			}
+		}
+		if !assert.NotNil(t, transaction, tc.outcome) {
+			continue
+		}
+		assert.Equal(t, "10.0.0.22:44444:1", transaction["transaction_id"])
+		assert.Equal(t, float64(tc.statements), transaction["statements"])
+		assert.Equal(t, tc.outcome, transaction["outcome"])
+		assert.Equal(t, tc.durationMs, transaction["duration_ms"])
+		assert.Equal(t, tc.idleTimeMs, transaction["idle_time_ms"])
+		for _, ev := range output {
+			if ev["event_type"] == "query" {
+				assert.Equal(t, "10.0.0.22:44444:1", ev["transaction_id"])
+			}
+		}
+	}
+}
+
+func TestQueriesOutsideTransactions(t *testing.T) {
+	output := runExchanges([]exchange{
+		{"SELECT 1", SERVER_STATUS_AUTOCOMMIT, 0, 1},
+		{"BEGIN", SERVER_STATUS_IN_TRANS | SERVER_STATUS_AUTOCOMMIT, 1, 2},
+		{"COMMIT AND CHAIN", SERVER_STATUS_IN_TRANS | SERVER_STATUS_AUTOCOMMIT, 2, 3},
+		{"COMMIT", SERVER_STATUS_AUTOCOMMIT, 3, 4},
+		{"SELECT 2", SERVER_STATUS_AUTOCOMMIT, 4, 5},
+	})
+	var transactionIDs []interface{}
+	for _, ev := range output {
+		if ev["event_type"] == "query" {
+			transactionIDs = append(transactionIDs, ev["transaction_id"])
+		}
+	}
+	assert.Equal(t, []interface{}{nil, "10.0.0.22:44444:1", "10.0.0.22:44444:1", "10.0.0.22:44444:2", nil},
+		transactionIDs)
+}
+
+// An exchange is a query, and the status flags in its OK response. Start and
+// end are offsets from defaultDate(), in milliseconds.
+type exchange struct {
+	query       string
+	statusFlags uint16
+	start       int
+	end         int
+}
+
+func runExchanges(exchanges []exchange) []map[string]interface{} {
+	tp := &testPublisher{}
+	parser := newParser(tp)
+	ms := &messageStream{}
+	for _, e := range exchanges {
+		ms.Append(genQuery(e.query), defaultDate().Add(time.Duration(e.start)*time.Millisecond), defaultFlow())
+		ms.Append(genResponse([][]byte{okPayload(0, e.statusFlags)}),
+			defaultDate().Add(time.Duration(e.end)*time.Millisecond), defaultFlow().Reverse())
+	}
+	parser.On(ms)
+	var output []map[string]interface{}
+	for _, b := range tp.output {
+		var ev map[string]interface{}
+		json.Unmarshal(b, &ev)
+		output = append(output, ev)
+	}
+	return output
+}
@@ -0,0 +1,285 @@
+// Package mysqlx parses the MySQL X Protocol, which MySQL Shell and the
+// document store connectors use instead of the classic protocol. Messages
+// are protobuf-encoded, and the server responds to requests in order, so
+// responses are matched to requests with a queue.
+package mysqlx
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Port           uint16 `long:"port" description:"MySQL X Protocol port" default:"33060"`
+	MaxMessageSize int    `long:"max_message_size" description:"Maximum number of bytes of a single X Protocol message to buffer per connection; longer messages are truncated" default:"1048576"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if flow.DstPort != pf.Options.Port {
+		flow = flow.Reverse()
+	}
+	return &Parser{
+		options:   pf.Options,
+		flow:      flow,
+		logger:    logging.NewLogger(logrus.Fields{"flow": flow, "component": "mysqlx"}),
+		publisher: pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	return fmt.Sprintf("tcp port %d", pf.Options.Port)
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	options        Options
+	flow           sniffer.IPPortTuple
+	pending        []*Event // Requests awaiting responses, oldest first
+	desynchronized bool     // Whether we're waiting for the next request
+	compressed     bool     // Whether the connection uses compression
+	tls            *tls.Connection
+	logger         *logging.Logger
+	publisher      publish.Publisher
+}
+
+// Event describes a statement or CRUD operation and its response.
+type Event struct {
+	EventType  string  `json:"event_type"`
+	ClientIP   string  `json:"client_ip"`
+	ServerIP   string  `json:"server_ip"`
+	DurationMs float64 `json:"duration_ms"`
+	// One of "sql", "find", "insert", "update" or "delete".
+	Operation string `json:"operation"`
+	// For "sql" operations, the statement and its namespace ("sql", or
+	// "mysqlx" for admin commands).
+	Statement string `json:"statement,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	// For CRUD operations, the collection or table operated on, and
+	// whether it's a "document" collection or a "table".
+	Schema       string `json:"schema,omitempty"`
+	Collection   string `json:"collection,omitempty"`
+	DataModel    string `json:"data_model,omitempty"`
+	RowsAffected uint64 `json:"rows_affected"`
+	RowsSent     int    `json:"rows_sent"`
+	Error        bool   `json:"error"`
+	ErrorCode    int    `json:"error_code"`
+	timestamp    time.Time
+}
+
+var errCompressed = errors.New("Compressed X Protocol messages are not supported")
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
+			return
+		}
+		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		if p.compressed {
+			io.Copy(ioutil.Discard, m)
+			continue
+		}
+		if m.Skipped() > 0 {
+			p.desynchronize("skipped bytes")
+		}
+		var r io.Reader = m
+		if toServer {
+			// Clients switch to TLS after asking for it with
+			// CapabilitiesSet.
+			br := bufio.NewReader(m)
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				p.logger.Debug("Connection switched to TLS", logrus.Fields{})
+				p.pending = nil
+				p.tls = tls.NewConnection("mysqlx", p.flow, m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), toServer)
+				continue
+			}
+			r = br
+		}
+		var err error
+		if toServer {
+			err = p.parseRequestStream(r, m.Timestamp())
+		} else {
+			err = p.parseResponseStream(r, m.Timestamp())
+		}
+		if err == errCompressed {
+			p.logger.Debug("Connection uses compression", logrus.Fields{})
+			metrics.Counter("mysqlx.compressed_connections").Add()
+			p.compressed = true
+			p.pending = nil
+			io.Copy(ioutil.Discard, m)
+		} else if err != io.EOF {
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("mysqlx.parse_errors").Add()
+			p.desynchronize(err.Error())
+			io.Copy(ioutil.Discard, m)
+		}
+	}
+}
+
+// desynchronize forgets about outstanding requests once we can no longer
+// tell which responses belong to them.
+func (p *Parser) desynchronize(reason string) {
+	if p.desynchronized {
+		return
+	}
+	p.logger.Debug("Stream desynchronized", logrus.Fields{"reason": reason})
+	metrics.Counter("mysqlx.desyncs").Add()
+	p.pending = nil
+	p.desynchronized = true
+}
+
+func (p *Parser) parseRequestStream(r io.Reader, timestamp time.Time) error {
+	for first := true; ; first = false {
+		f, err := readFrame(r, p.options.MaxMessageSize)
+		if err != nil {
+			return err
+		}
+		p.logger.Debug("Parsed request", logrus.Fields{
+			"messageType": f.MessageType,
+			"length":      f.Length})
+		if f.MessageType == CLIENT_COMPRESSION {
+			return errCompressed
+		}
+		if first {
+			// A message at the start of a new TCP message is likely to be
+			// the start of a request, since clients write each request in
+			// one go. The responses to any lost requests will still be
+			// attributed to later ones, though.
+			p.desynchronized = false
+		}
+		if p.desynchronized {
+			continue
+		}
+		if len(p.pending) >= maxPendingRequests {
+			p.desynchronize("too many pending requests")
+			continue
+		}
+		// Every request gets a response, so requests that we don't report
+		// on still need a place in the queue.
+		p.pending = append(p.pending, p.newEvent(f, timestamp))
+	}
+}
+
+// newEvent starts an event for a request, or returns nil if it's not one we
+// report on.
+func (p *Parser) newEvent(f *frame, timestamp time.Time) *Event {
+	operation, ok := operationNames[f.MessageType]
+	if !ok {
+		return nil
+	}
+	e := &Event{Operation: operation, timestamp: timestamp}
+	if f.MessageType == SQL_STMT_EXECUTE {
+		m, err := readStmtExecute(f.payload)
+		if err != nil {
+			p.logger.Debug("Error parsing StmtExecute", logrus.Fields{"error": err})
+			return nil
+		}
+		e.Statement = m.Stmt
+		e.Namespace = m.Namespace
+		return e
+	}
+	m, err := readCrudMessage(f.MessageType, f.payload)
+	if err != nil {
+		p.logger.Debug("Error parsing CRUD message", logrus.Fields{"error": err})
+		return nil
+	}
+	e.Schema = m.Schema
+	e.Collection = m.Name
+	e.DataModel = dataModelNames[m.DataModel]
+	return e
+}
+
+func (p *Parser) parseResponseStream(r io.Reader, timestamp time.Time) error {
+	for {
+		f, err := readFrame(r, p.options.MaxMessageSize)
+		if err != nil {
+			return err
+		}
+		p.logger.Debug("Parsed response", logrus.Fields{
+			"messageType": f.MessageType,
+			"length":      f.Length,
+			"pending":     len(p.pending)})
+		if f.MessageType == SERVER_COMPRESSION {
+			return errCompressed
+		}
+		if p.desynchronized || len(p.pending) == 0 {
+			// Global notices, and responses we can't match up.
+			continue
+		}
+		e := p.pending[0]
+		switch f.MessageType {
+		case NOTICE:
+			if e == nil {
+				continue
+			}
+			rows, ok, err := readRowsAffected(f.payload)
+			if err != nil {
+				p.logger.Debug("Error parsing notice", logrus.Fields{"error": err})
+			} else if ok {
+				e.RowsAffected = rows
+			}
+		case RESULTSET_ROW:
+			if e != nil {
+				e.RowsSent++
+			}
+		case ERROR:
+			if e != nil {
+				e.Error = true
+				if m, err := readError(f.payload); err == nil {
+					e.ErrorCode = int(m.Code)
+				}
+			}
+			p.requestDone(timestamp)
+		case OK, CONN_CAPABILITIES, SERVER_SESS_AUTHENTICATE_CONTINUE,
+			SESS_AUTHENTICATE_OK, SQL_STMT_EXECUTE_OK:
+			// Each of these ends the response to a request.
+			p.requestDone(timestamp)
+		}
+	}
+}
+
+// requestDone publishes an event for the oldest pending request, if it's
+// one we report on.
+func (p *Parser) requestDone(timestamp time.Time) {
+	e := p.pending[0]
+	p.pending[0] = nil
+	p.pending = p.pending[1:]
+	if e == nil {
+		return
+	}
+	e.EventType = "query"
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	if timestamp.After(e.timestamp) {
+		e.DurationMs = float64(timestamp.Sub(e.timestamp).Nanoseconds()) / 1e6
+	}
+	p.publisher.Publish(e, e.timestamp)
+	metrics.Counter("mysqlx.queries_parsed").Add()
+}
@@ -0,0 +1,417 @@
+package mysqlx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// See https://dev.mysql.com/doc/dev/mysql-server/latest/mysqlx_protocol_messages.html
+// Each message is framed by a four-byte little-endian length, which counts
+// the one-byte message type and the protobuf-encoded payload that follow.
+const frameHeaderLength = 5
+
+// Mysqlx.ClientMessages.Type
+const (
+	CON_CAPABILITIES_GET       = 1
+	CON_CAPABILITIES_SET       = 2
+	CON_CLOSE                  = 3
+	SESS_AUTHENTICATE_START    = 4
+	SESS_AUTHENTICATE_CONTINUE = 5
+	SESS_RESET                 = 6
+	SESS_CLOSE                 = 7
+	SQL_STMT_EXECUTE           = 12
+	CRUD_FIND                  = 17
+	CRUD_INSERT                = 18
+	CRUD_UPDATE                = 19
+	CRUD_DELETE                = 20
+	EXPECT_OPEN                = 24
+	EXPECT_CLOSE               = 25
+	CLIENT_COMPRESSION         = 46
+)
+
+// Mysqlx.ServerMessages.Type
+const (
+	OK                                  = 0
+	ERROR                               = 1
+	CONN_CAPABILITIES                   = 2
+	SERVER_SESS_AUTHENTICATE_CONTINUE   = 3
+	SESS_AUTHENTICATE_OK                = 4
+	NOTICE                              = 11
+	RESULTSET_COLUMN_META_DATA          = 12
+	RESULTSET_ROW                       = 13
+	RESULTSET_FETCH_DONE                = 14
+	RESULTSET_FETCH_SUSPENDED           = 15
+	RESULTSET_FETCH_DONE_MORE_RESULTSET = 16
+	SQL_STMT_EXECUTE_OK                 = 17
+	RESULTSET_FETCH_DONE_MORE_OUT       = 18
+	SERVER_COMPRESSION                  = 19
+)
+
+// Mysqlx.Notice.Frame.Type, and the Mysqlx.Notice.SessionStateChanged
+// parameter we use.
+const (
+	NOTICE_SESSION_STATE_CHANGED = 3
+	SESSION_STATE_ROWS_AFFECTED  = 4
+)
+
+// Mysqlx.Datatypes.Scalar.Type values for integers.
+const (
+	SCALAR_V_SINT = 1
+	SCALAR_V_UINT = 2
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var operationNames = map[byte]string{
+	SQL_STMT_EXECUTE: "sql",
+	CRUD_FIND:        "find",
+	CRUD_INSERT:      "insert",
+	CRUD_UPDATE:      "update",
+	CRUD_DELETE:      "delete",
+}
+
+var dataModelNames = map[uint64]string{
+	1: "document",
+	2: "table",
+}
+
+// Safety constraints:
+// Don't queue more than this many pipelined requests per connection
+const maxPendingRequests = 32
+
+// Don't accept frames longer than this, whatever the options say; the
+// server's own limit (mysqlx_max_allowed_packet) is at most 1GB.
+const maxFrameLength = 1 << 30
+
+type frame struct {
+	Length      int  // Length of the type and payload
+	MessageType byte // Client or server message type
+	Truncated   bool // Whether payload holds only a prefix of the message
+	payload     []byte
+}
+
+// readFrame reads the next message from r. At most maxLength bytes of the
+// payload are buffered; the rest is read and discarded.
+func readFrame(r io.Reader, maxLength int) (*frame, error) {
+	var header [frameHeaderLength]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	f := frame{
+		Length:      int(binary.LittleEndian.Uint32(header[0:4])),
+		MessageType: header[4],
+	}
+	if f.Length < 1 || f.Length > maxFrameLength {
+		return nil, fmt.Errorf("Bad X Protocol frame length %d", f.Length)
+	}
+	payloadLength := f.Length - 1
+	toBuffer := payloadLength
+	if toBuffer > maxLength {
+		toBuffer = maxLength
+		f.Truncated = true
+	}
+	// Copying into a bytes.Buffer grows it as data actually arrives,
+	// rather than allocating based on the declared length up front.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(toBuffer)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, int64(payloadLength-toBuffer)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	f.payload = buf.Bytes()
+	return &f, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Mysqlx.Sql.StmtExecute
+type stmtExecute struct {
+	Stmt      string // the statement
+	Namespace string // "sql", or "mysqlx" for admin commands
+	// Arguments are not parsed.
+}
+
+func readStmtExecute(payload []byte) (*stmtExecute, error) {
+	m := stmtExecute{Namespace: "sql"}
+	err := readFields(payload, func(field int, r *protoReader) {
+		switch field {
+		case 1:
+			m.Stmt = string(r.Bytes())
+		case 3:
+			m.Namespace = string(r.Bytes())
+		default:
+			r.Skip()
+		}
+	})
+	return &m, err
+}
+
+// Mysqlx.Crud.Find, Insert, Update and Delete, which share the fields we
+// care about, at different field numbers.
+type crudMessage struct {
+	Name      string // collection or table name
+	Schema    string // schema name
+	DataModel uint64 // 1 for documents, 2 for tables
+	Rows      int    // rows to insert, for Insert
+	// Criteria, projections and so on are not parsed.
+}
+
+func readCrudMessage(messageType byte, payload []byte) (*crudMessage, error) {
+	collectionField, dataModelField := 1, 2
+	if messageType == CRUD_FIND || messageType == CRUD_UPDATE {
+		collectionField, dataModelField = 2, 3
+	}
+	m := crudMessage{}
+	err := readFields(payload, func(field int, r *protoReader) {
+		switch {
+		case field == collectionField:
+			r.err = readFields(r.Bytes(), func(field int, r *protoReader) {
+				switch field {
+				case 1:
+					m.Name = string(r.Bytes())
+				case 2:
+					m.Schema = string(r.Bytes())
+				default:
+					r.Skip()
+				}
+			})
+		case field == dataModelField:
+			m.DataModel = r.Varint()
+		case field == 4 && messageType == CRUD_INSERT:
+			m.Rows++
+			r.Skip()
+		default:
+			r.Skip()
+		}
+	})
+	return &m, err
+}
+
+// Mysqlx.Error
+type errorMessage struct {
+	Severity uint64 // 0 for errors, 1 for fatal errors
+	Code     uint64 // MySQL error code
+	SQLState string // SQL state
+	Msg      string // human-readable error message
+}
+
+func readError(payload []byte) (*errorMessage, error) {
+	m := errorMessage{}
+	err := readFields(payload, func(field int, r *protoReader) {
+		switch field {
+		case 1:
+			m.Severity = r.Varint()
+		case 2:
+			m.Code = r.Varint()
+		case 3:
+			m.Msg = string(r.Bytes())
+		case 4:
+			m.SQLState = string(r.Bytes())
+		default:
+			r.Skip()
+		}
+	})
+	return &m, err
+}
+
+// readRowsAffected returns the number of rows affected, if payload is a
+// Mysqlx.Notice.Frame carrying a SessionStateChanged notice that says.
+func readRowsAffected(payload []byte) (uint64, bool, error) {
+	var noticeType uint64
+	var notice []byte
+	err := readFields(payload, func(field int, r *protoReader) {
+		switch field {
+		case 1:
+			noticeType = r.Varint()
+		case 3:
+			notice = r.Bytes()
+		default:
+			r.Skip()
+		}
+	})
+	if err != nil || noticeType != NOTICE_SESSION_STATE_CHANGED {
+		return 0, false, err
+	}
+
+	var param uint64
+	var rows uint64
+	var found bool
+	err = readFields(notice, func(field int, r *protoReader) {
+		switch field {
+		case 1:
+			param = r.Varint()
+		case 2:
+			rows, found, r.err = readScalarInteger(r.Bytes())
+		default:
+			r.Skip()
+		}
+	})
+	if err != nil || param != SESSION_STATE_ROWS_AFFECTED {
+		return 0, false, err
+	}
+	return rows, found, nil
+}
+
+// readScalarInteger returns the value of a Mysqlx.Datatypes.Scalar, if it's
+// an integer.
+func readScalarInteger(payload []byte) (uint64, bool, error) {
+	var scalarType, signed, unsigned uint64
+	err := readFields(payload, func(field int, r *protoReader) {
+		switch field {
+		case 1:
+			scalarType = r.Varint()
+		case 2:
+			signed = r.Varint()
+		case 3:
+			unsigned = r.Varint()
+		default:
+			r.Skip()
+		}
+	})
+	switch {
+	case err != nil:
+		return 0, false, err
+	case scalarType == SCALAR_V_UINT:
+		return unsigned, true, nil
+	case scalarType == SCALAR_V_SINT:
+		// Zigzag-encoded
+		v := int64(signed>>1) ^ -int64(signed&1)
+		if v < 0 {
+			return 0, false, nil
+		}
+		return uint64(v), true, nil
+	}
+	return 0, false, nil
+}
+
+var errTruncated = errors.New("Truncated protobuf message")
+
+// protoReader decodes protobuf-encoded messages, one field at a time. Like
+// errReader in the mysql parser, it stores the first error it encounters,
+// and callers must check protoReader.err.
+type protoReader struct {
+	b        []byte
+	wireType int
+	err      error
+}
+
+// readFields calls f with the number of each field in payload, and a
+// reader positioned at its value. f must consume the value, by reading or
+// skipping it. If payload is truncated, f is called for the fields before
+// the truncation point, and for a length-delimited field that it cuts off,
+// whose value is truncated too.
+func readFields(payload []byte, f func(field int, r *protoReader)) error {
+	r := &protoReader{b: payload}
+	for len(r.b) > 0 && r.err == nil {
+		key := r.varint()
+		if r.err != nil {
+			break
+		}
+		r.wireType = int(key & 0x7)
+		f(int(key>>3), r)
+	}
+	if r.err == errTruncated {
+		return nil
+	}
+	return r.err
+}
+
+func (r *protoReader) varint() uint64 {
+	var v uint64
+	for i := uint(0); i < 64; i += 7 {
+		if len(r.b) == 0 {
+			r.err = errTruncated
+			return 0
+		}
+		c := r.b[0]
+		r.b = r.b[1:]
+		v |= uint64(c&0x7f) << i
+		if c < 0x80 {
+			return v
+		}
+	}
+	r.err = errors.New("Invalid protobuf varint")
+	return 0
+}
+
+// Varint returns the value of a varint field.
+func (r *protoReader) Varint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if r.wireType != wireVarint {
+		r.err = fmt.Errorf("Expected varint, got wire type %d", r.wireType)
+		return 0
+	}
+	return r.varint()
+}
+
+// Bytes returns the value of a length-delimited field, or as much of it as
+// there is.
+func (r *protoReader) Bytes() []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.wireType != wireBytes {
+		r.err = fmt.Errorf("Expected length-delimited field, got wire type %d", r.wireType)
+		return nil
+	}
+	length := r.varint()
+	if r.err != nil {
+		return nil
+	}
+	if length > uint64(len(r.b)) {
+		v := r.b
+		r.b = nil
+		r.err = errTruncated
+		return v
+	}
+	v := r.b[:length]
+	r.b = r.b[length:]
+	return v
+}
+
+// Skip skips over the value of a field.
+func (r *protoReader) Skip() {
+	if r.err != nil {
+		return
+	}
+	n := 0
+	switch r.wireType {
+	case wireVarint:
+		r.varint()
+		return
+	case wireBytes:
+		r.Bytes()
+		return
+	case wireFixed64:
+		n = 8
+	case wireFixed32:
+		n = 4
+	default:
+		r.err = fmt.Errorf("Unsupported protobuf wire type %d", r.wireType)
+		return
+	}
+	if n > len(r.b) {
+		r.b = nil
+		r.err = errTruncated
+		return
+	}
+	r.b = r.b[n:]
+}
@@ -0,0 +1,278 @@
+package mysqlx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStmtExecute(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(SQL_STMT_EXECUTE, stmtExecutePayload("SELECT 1")), sniffertest.DefaultDate(), defaultFlow())
+	response := concat(
+		genFrame(RESULTSET_COLUMN_META_DATA, nil),
+		genFrame(RESULTSET_ROW, nil),
+		genFrame(RESULTSET_ROW, nil),
+		genFrame(RESULTSET_FETCH_DONE, nil),
+		genFrame(NOTICE, rowsAffectedNotice(0)),
+		genFrame(SQL_STMT_EXECUTE_OK, nil))
+	ms.Append(response, sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "query",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 2,
+			"operation": "sql",
+			"statement": "SELECT 1",
+			"namespace": "sql",
+			"rows_affected": 0,
+			"rows_sent": 2,
+			"error": false,
+			"error_code": 0
+		}`, string(tp.Output[0]))
+	}
+}
+
+func TestParseCrud(t *testing.T) {
+	var crudTests = []struct {
+		messageType byte
+		payload     []byte
+		operation   string
+	}{
+		{CRUD_FIND, concat(field(2, collection("app", "people")), varintField(3, 1)), "find"},
+		{CRUD_INSERT, concat(field(1, collection("app", "people")), varintField(2, 1),
+			field(4, nil), field(4, nil)), "insert"},
+		{CRUD_UPDATE, concat(field(2, collection("app", "people")), varintField(3, 1)), "update"},
+		{CRUD_DELETE, concat(field(1, collection("app", "people")), varintField(2, 1)), "delete"},
+	}
+	for _, testcase := range crudTests {
+		tp := &sniffertest.Publisher{}
+		parser := newParser(tp)
+		ms := &sniffertest.MessageStream{}
+		ms.Append(genFrame(testcase.messageType, testcase.payload), sniffertest.DefaultDate(), defaultFlow())
+		response := concat(
+			genFrame(NOTICE, rowsAffectedNotice(2)),
+			genFrame(SQL_STMT_EXECUTE_OK, nil))
+		ms.Append(response, sniffertest.DefaultDate(), defaultFlow().Reverse())
+		parser.On(ms)
+		if assert.Equal(t, 1, len(tp.Output)) {
+			var ret map[string]interface{}
+			json.Unmarshal(tp.Output[0], &ret)
+			assert.Equal(t, testcase.operation, ret["operation"])
+			assert.Equal(t, "app", ret["schema"])
+			assert.Equal(t, "people", ret["collection"])
+			assert.Equal(t, "document", ret["data_model"])
+			assert.Equal(t, float64(2), ret["rows_affected"])
+			assert.Nil(t, ret["statement"])
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(SQL_STMT_EXECUTE, stmtExecutePayload("SELEC 1")), sniffertest.DefaultDate(), defaultFlow())
+	errorPayload := concat(varintField(2, 1064), field(3, []byte("syntax error")), field(4, []byte("42000")))
+	ms.Append(genFrame(ERROR, errorPayload), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		var ret map[string]interface{}
+		json.Unmarshal(tp.Output[0], &ret)
+		assert.Equal(t, true, ret["error"])
+		assert.Equal(t, float64(1064), ret["error_code"])
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	// Authentication and other requests we don't report on still take up
+	// a place in the queue.
+	ms.Append(concat(
+		genFrame(SESS_AUTHENTICATE_START, nil),
+		genFrame(SQL_STMT_EXECUTE, stmtExecutePayload("SELECT 1")),
+		genFrame(EXPECT_OPEN, nil),
+		genFrame(SQL_STMT_EXECUTE, stmtExecutePayload("SELECT 2"))), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genFrame(NOTICE, rowsAffectedNotice(5)),
+		genFrame(SESS_AUTHENTICATE_OK, nil),
+		genFrame(SQL_STMT_EXECUTE_OK, nil)), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	ms.Append(concat(
+		genFrame(OK, nil),
+		genFrame(SQL_STMT_EXECUTE_OK, nil)), sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 2, len(tp.Output)) {
+		var ret map[string]interface{}
+		json.Unmarshal(tp.Output[0], &ret)
+		assert.Equal(t, "SELECT 1", ret["statement"])
+		assert.Equal(t, float64(1), ret["duration_ms"])
+		assert.Equal(t, float64(0), ret["rows_affected"])
+		json.Unmarshal(tp.Output[1], &ret)
+		assert.Equal(t, "SELECT 2", ret["statement"])
+		assert.Equal(t, float64(3), ret["duration_ms"])
+	}
+}
+
+func TestResyncAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(SQL_STMT_EXECUTE, stmtExecutePayload("SELECT 1")), sniffertest.DefaultDate(), defaultFlow())
+	ms.AppendSkipped([]byte{0x01, 0x02, 0x03}, sniffertest.DefaultDate(), defaultFlow().Reverse(), 100)
+	ms.Append(genFrame(SQL_STMT_EXECUTE, stmtExecutePayload("SELECT 2")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(SQL_STMT_EXECUTE_OK, nil), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		var ret map[string]interface{}
+		json.Unmarshal(tp.Output[0], &ret)
+		assert.Equal(t, "SELECT 2", ret["statement"])
+	}
+}
+
+func TestTooManyPendingRequests(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	var requests []byte
+	for i := 0; i < maxPendingRequests+2; i++ {
+		requests = append(requests, genFrame(SQL_STMT_EXECUTE, stmtExecutePayload("SELECT 1"))...)
+	}
+	ms.Append(requests, sniffertest.DefaultDate(), defaultFlow())
+	// The response to the first request isn't attributed to the last.
+	ms.Append(genFrame(SQL_STMT_EXECUTE_OK, nil), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genFrame(SQL_STMT_EXECUTE, stmtExecutePayload("SELECT 2")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(SQL_STMT_EXECUTE_OK, nil), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		var ret map[string]interface{}
+		json.Unmarshal(tp.Output[0], &ret)
+		assert.Equal(t, "SELECT 2", ret["statement"])
+	}
+}
+
+func TestCompressionUnsupported(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(CLIENT_COMPRESSION, []byte{0x01, 0x02}), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(SQL_STMT_EXECUTE, stmtExecutePayload("SELECT 1")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(SQL_STMT_EXECUTE_OK, nil), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	assert.Equal(t, 0, len(tp.Output))
+}
+
+func TestTLS(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genFrame(CON_CAPABILITIES_SET, nil), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(OK, nil), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00}, sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genFrame(SQL_STMT_EXECUTE_OK, nil), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		var ret map[string]interface{}
+		json.Unmarshal(tp.Output[0], &ret)
+		assert.Equal(t, "tls_connection", ret["event_type"])
+		assert.Equal(t, "mysqlx", ret["protocol"])
+	}
+}
+
+func TestReadTruncatedFrame(t *testing.T) {
+	b := genFrame(SQL_STMT_EXECUTE, stmtExecutePayload("SELECT 123456789"))
+	f, err := readFrame(bytes.NewReader(b), 8)
+	if assert.NoError(t, err) {
+		assert.True(t, f.Truncated)
+		m, err := readStmtExecute(f.payload)
+		assert.NoError(t, err)
+		assert.Equal(t, "SELECT", m.Stmt)
+	}
+	_, err = readFrame(bytes.NewReader(b[:10]), 1024)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	_, err = readFrame(bytes.NewReader([]byte{0x00, 0x00, 0x00, 0x00, 0x01}), 1024)
+	assert.Error(t, err)
+}
+
+func TestReadScalarInteger(t *testing.T) {
+	v, ok, err := readScalarInteger(concat(varintField(1, SCALAR_V_SINT), varintField(2, 6)))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), v)
+	_, ok, err = readScalarInteger(concat(varintField(1, 8), field(8, []byte("x"))))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func genFrame(messageType byte, payload []byte) []byte {
+	b := make([]byte, frameHeaderLength)
+	binary.LittleEndian.PutUint32(b, uint32(len(payload)+1))
+	b[4] = messageType
+	return append(b, payload...)
+}
+
+func varint(v uint64) []byte {
+	var b []byte
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func varintField(number int, v uint64) []byte {
+	return append(varint(uint64(number)<<3|wireVarint), varint(v)...)
+}
+
+func field(number int, value []byte) []byte {
+	b := varint(uint64(number)<<3 | wireBytes)
+	b = append(b, varint(uint64(len(value)))...)
+	return append(b, value...)
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func stmtExecutePayload(stmt string) []byte {
+	return concat(field(1, []byte(stmt)), field(3, []byte("sql")))
+}
+
+func collection(schema string, name string) []byte {
+	return concat(field(1, []byte(name)), field(2, []byte(schema)))
+}
+
+func rowsAffectedNotice(rows uint64) []byte {
+	scalar := concat(varintField(1, SCALAR_V_UINT), varintField(3, rows))
+	notice := concat(varintField(1, SESSION_STATE_ROWS_AFFECTED), field(2, scalar))
+	return concat(varintField(1, NOTICE_SESSION_STATE_CHANGED), varintField(2, 2), field(3, notice))
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(33060)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		Options:   Options{Port: 33060, MaxMessageSize: 1024 * 1024},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
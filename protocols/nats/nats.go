@@ -0,0 +1,422 @@
+// Package nats parses the NATS client protocol. Clients publish messages to
+// subjects with PUB (or HPUB, with headers), and the server delivers them to
+// subscriptions, identified by the subscription ID (SID) the client chose in
+// SUB, with MSG (or HMSG).
+//
+// A message can name a subject to reply to, typically a unique "inbox"
+// subject. When a client publishes a request with a reply subject, its
+// event is held until the server delivers the reply, so that it reports the
+// request's latency; likewise, when a client is delivered a request, its
+// event is held until the client publishes the reply. Replies that are
+// matched up this way aren't reported separately.
+package nats
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Port uint16 `long:"port" description:"NATS client port" default:"4222"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if flow.DstPort != pf.Options.Port {
+		flow = flow.Reverse()
+	}
+	return &Parser{
+		options:       pf.Options,
+		flow:          flow,
+		subscriptions: make(map[string]*subscription),
+		awaitingMsg:   make(map[string]*pendingReply),
+		awaitingPub:   make(map[string]*pendingReply),
+		logger:        logging.NewLogger(logrus.Fields{"flow": flow, "component": "nats"}),
+		publisher:     pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	return fmt.Sprintf("tcp port %d", pf.Options.Port)
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	options       Options
+	flow          sniffer.IPPortTuple
+	client        opAssembler
+	server        opAssembler
+	subscriptions map[string]*subscription // By SID
+	// Messages awaiting replies, by reply subject: requests the client
+	// published, awaiting the server's MSG, and requests delivered to the
+	// client, awaiting its PUB. replies holds both, oldest first.
+	awaitingMsg map[string]*pendingReply
+	awaitingPub map[string]*pendingReply
+	replies     []*pendingReply
+	// From CONNECT.
+	clientName    string
+	clientLang    string
+	clientVersion string
+	tls           *tls.Connection
+	logger        *logging.Logger
+	publisher     publish.Publisher
+}
+
+type subscription struct {
+	subject    string
+	queueGroup string
+	// How many more messages until the subscription is automatically
+	// unsubscribed, if UNSUB gave a maximum; otherwise 0.
+	remaining int
+}
+
+// pendingReply is a publish or delivery awaiting its reply.
+type pendingReply struct {
+	event *Event
+	done  bool
+}
+
+// Event describes a publish or delivery of a message, or an error from the
+// server.
+type Event struct {
+	// "publish", "deliver" or "error".
+	EventType     string  `json:"event_type"`
+	ClientIP      string  `json:"client_ip"`
+	ServerIP      string  `json:"server_ip"`
+	DurationMs    float64 `json:"duration_ms"`
+	ClientName    string  `json:"client_name,omitempty"`
+	ClientLang    string  `json:"client_lang,omitempty"`
+	ClientVersion string  `json:"client_version,omitempty"`
+	Subject       string  `json:"subject,omitempty"`
+	ReplyTo       string  `json:"reply_to,omitempty"`
+	// For deliveries, the subscription's ID, the subject it subscribed
+	// to, which may have wildcards, and its queue group.
+	SID          string `json:"sid,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	QueueGroup   string `json:"queue_group,omitempty"`
+	// The size of the message's payload, not counting headers.
+	PayloadBytes int `json:"payload_bytes"`
+	HeaderBytes  int `json:"header_bytes,omitempty"`
+	// The status in the message's headers, e.g. 503 for no responders.
+	Status int `json:"status,omitempty"`
+	// For messages with a reply subject: the size of the reply's payload,
+	// and its status, or whether no reply was seen.
+	ReplyBytes  int  `json:"reply_bytes,omitempty"`
+	ReplyStatus int  `json:"reply_status,omitempty"`
+	NoReply     bool `json:"no_reply,omitempty"`
+	// For -ERR, e.g. "Permissions Violation for Publish to foo".
+	ErrorMessage string `json:"error_message,omitempty"`
+	Error        bool   `json:"error"`
+	timestamp    time.Time
+}
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
+			p.expireReplies(time.Time{})
+			return
+		}
+		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		a := &p.server
+		if toServer {
+			a = &p.client
+		}
+		if m.Skipped() > 0 {
+			// The message most likely starts partway through an
+			// operation; the next one in this direction should start
+			// afresh.
+			p.desynchronize(a, "skipped bytes")
+			io.Copy(ioutil.Discard, m)
+			continue
+		}
+		br := bufio.NewReader(m)
+		if toServer && a.idle() {
+			// The client upgrades to TLS after the server's INFO, or
+			// straight away if the server expects TLS first.
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				p.logger.Debug("Connection uses TLS", logrus.Fields{})
+				p.tls = tls.NewConnection("nats", p.flow, m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), toServer)
+				continue
+			}
+		}
+		err := p.parseOps(a, br, m.Timestamp(), toServer)
+		if err != io.EOF {
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("nats.parse_errors").Add()
+			p.desynchronize(a, err.Error())
+			io.Copy(ioutil.Discard, br)
+		}
+	}
+}
+
+// desynchronize forgets about any partial operation in one direction once
+// we can no longer tell where operations start. Subscriptions and reply
+// subjects still identify messages, so they're kept.
+func (p *Parser) desynchronize(a *opAssembler, reason string) {
+	p.logger.Debug("Stream desynchronized", logrus.Fields{"reason": reason})
+	metrics.Counter("nats.desyncs").Add()
+	a.reset()
+}
+
+func (p *Parser) parseOps(a *opAssembler, r *bufio.Reader, timestamp time.Time, toServer bool) error {
+	for {
+		op, err := a.next(r, timestamp)
+		if err != nil {
+			return err
+		}
+		p.logger.Debug("Parsed operation", logrus.Fields{
+			"op":       op.Name,
+			"toServer": toServer})
+		p.expireReplies(op.timestamp)
+		if toServer {
+			err = p.parseClientOp(op, timestamp)
+		} else {
+			err = p.parseServerOp(op, timestamp)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (p *Parser) parseClientOp(op *operation, timestamp time.Time) error {
+	switch op.Name {
+	case "CONNECT":
+		var options struct {
+			Name    string `json:"name"`
+			Lang    string `json:"lang"`
+			Version string `json:"version"`
+		}
+		if err := json.Unmarshal([]byte(op.Args[0]), &options); err != nil {
+			return fmt.Errorf("Bad CONNECT: %v", err)
+		}
+		p.clientName = options.Name
+		p.clientLang = options.Lang
+		p.clientVersion = options.Version
+	case "PUB", "HPUB":
+		// PUB <subject> [reply-to]
+		if len(op.Args) < 1 || len(op.Args) > 2 {
+			return fmt.Errorf("Bad %s line", op.Name)
+		}
+		subject := op.Args[0]
+		if pending, ok := p.awaitingPub[subject]; ok {
+			// A reply to a request delivered to the client.
+			delete(p.awaitingPub, subject)
+			p.replied(pending, op, timestamp)
+			return nil
+		}
+		e := p.newEvent("publish", op)
+		if len(op.Args) == 2 {
+			e.ReplyTo = op.Args[1]
+			p.awaitReply(p.awaitingMsg, e)
+			return nil
+		}
+		p.publish(e, timestamp)
+	case "SUB":
+		// SUB <subject> [queue group] <sid>
+		if len(op.Args) < 2 || len(op.Args) > 3 {
+			return fmt.Errorf("Bad SUB line")
+		}
+		sid := op.Args[len(op.Args)-1]
+		if _, ok := p.subscriptions[sid]; !ok && len(p.subscriptions) >= maxSubscriptions {
+			p.logger.Debug("Too many subscriptions", logrus.Fields{})
+			metrics.Counter("nats.subscriptions_dropped").Add()
+			return nil
+		}
+		sub := &subscription{subject: op.Args[0]}
+		if len(op.Args) == 3 {
+			sub.queueGroup = op.Args[1]
+		}
+		p.subscriptions[sid] = sub
+	case "UNSUB":
+		// UNSUB <sid> [max_msgs]
+		if len(op.Args) < 1 {
+			return fmt.Errorf("Bad UNSUB line")
+		}
+		sub, ok := p.subscriptions[op.Args[0]]
+		if !ok {
+			return nil
+		}
+		max := 0
+		if len(op.Args) == 2 {
+			fmt.Sscan(op.Args[1], &max)
+		}
+		if max > 0 {
+			sub.remaining = max
+		} else {
+			delete(p.subscriptions, op.Args[0])
+		}
+	case "PING", "PONG":
+		// Nothing to do.
+	default:
+		// Most likely part of a payload, if we've lost our place.
+		return fmt.Errorf("Unknown operation %q", op.Name)
+	}
+	return nil
+}
+
+func (p *Parser) parseServerOp(op *operation, timestamp time.Time) error {
+	switch op.Name {
+	case "MSG", "HMSG":
+		// MSG <subject> <sid> [reply-to]
+		if len(op.Args) < 2 || len(op.Args) > 3 {
+			return fmt.Errorf("Bad %s line", op.Name)
+		}
+		subject, sid := op.Args[0], op.Args[1]
+		sub := p.delivered(sid)
+		if pending, ok := p.awaitingMsg[subject]; ok {
+			// A reply to a request the client published.
+			delete(p.awaitingMsg, subject)
+			p.replied(pending, op, timestamp)
+			return nil
+		}
+		e := p.newEvent("deliver", op)
+		e.SID = sid
+		if sub != nil {
+			e.Subscription = sub.subject
+			e.QueueGroup = sub.queueGroup
+		}
+		if len(op.Args) == 3 {
+			e.ReplyTo = op.Args[2]
+			p.awaitReply(p.awaitingPub, e)
+			return nil
+		}
+		p.publish(e, timestamp)
+	case "-ERR":
+		e := p.newEvent("error", op)
+		e.ErrorMessage = strings.Trim(op.Args[0], "'")
+		e.Error = true
+		p.publish(e, timestamp)
+	case "INFO", "+OK", "PING", "PONG":
+		// Nothing to do.
+	default:
+		return fmt.Errorf("Unknown operation %q", op.Name)
+	}
+	return nil
+}
+
+func (p *Parser) newEvent(eventType string, op *operation) *Event {
+	e := &Event{
+		EventType:     eventType,
+		ClientName:    p.clientName,
+		ClientLang:    p.clientLang,
+		ClientVersion: p.clientVersion,
+		PayloadBytes:  op.TotalLength - op.HeaderLength,
+		HeaderBytes:   op.HeaderLength,
+		Status:        op.status(),
+		timestamp:     op.timestamp,
+	}
+	if len(op.Args) > 0 && op.Name != "-ERR" {
+		e.Subject = op.Args[0]
+	}
+	return e
+}
+
+// delivered counts a message delivered to a subscription, which ends it if
+// it has reached the maximum UNSUB gave. It returns the subscription, or nil
+// if it's unknown.
+func (p *Parser) delivered(sid string) *subscription {
+	sub, ok := p.subscriptions[sid]
+	if !ok || sub.remaining == 0 {
+		return sub
+	}
+	sub.remaining--
+	if sub.remaining == 0 {
+		delete(p.subscriptions, sid)
+	}
+	return sub
+}
+
+// awaitReply holds an event until a reply to it arrives.
+func (p *Parser) awaitReply(awaiting map[string]*pendingReply, e *Event) {
+	if old, ok := awaiting[e.ReplyTo]; ok {
+		// The same reply subject again; JetStream consumers do this for
+		// redeliveries, for example.
+		old.done = true
+		old.event.NoReply = true
+		p.publish(old.event, time.Time{})
+	} else if len(awaiting) >= maxPendingReplies {
+		p.logger.Debug("Too many messages awaiting replies", logrus.Fields{})
+		metrics.Counter("nats.replies_dropped").Add()
+		e.NoReply = true
+		p.publish(e, time.Time{})
+		return
+	}
+	pending := &pendingReply{event: e}
+	awaiting[e.ReplyTo] = pending
+	p.replies = append(p.replies, pending)
+}
+
+// replied publishes an event whose reply has arrived.
+func (p *Parser) replied(pending *pendingReply, reply *operation, timestamp time.Time) {
+	pending.done = true
+	e := pending.event
+	e.ReplyBytes = reply.TotalLength - reply.HeaderLength
+	e.ReplyStatus = reply.status()
+	if e.ReplyStatus == statusNoResponders {
+		e.Error = true
+	}
+	p.publish(e, timestamp)
+}
+
+// expireReplies gives up on replies that have taken too long, or all of
+// them if now is zero.
+func (p *Parser) expireReplies(now time.Time) {
+	for len(p.replies) > 0 {
+		pending := p.replies[0]
+		if !pending.done && !now.IsZero() && now.Sub(pending.event.timestamp) < maxReplyWait {
+			break
+		}
+		p.replies[0] = nil
+		p.replies = p.replies[1:]
+		if pending.done {
+			continue
+		}
+		e := pending.event
+		if p.awaitingMsg[e.ReplyTo] == pending {
+			delete(p.awaitingMsg, e.ReplyTo)
+		} else {
+			delete(p.awaitingPub, e.ReplyTo)
+		}
+		e.NoReply = true
+		p.publish(e, time.Time{})
+	}
+}
+
+func (p *Parser) publish(e *Event, timestamp time.Time) {
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	if timestamp.After(e.timestamp) {
+		e.DurationMs = float64(timestamp.Sub(e.timestamp).Nanoseconds()) / 1e6
+	}
+	p.publisher.Publish(e, e.timestamp)
+	metrics.Counter("nats.events_parsed").Add()
+}
@@ -0,0 +1,220 @@
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// See https://docs.nats.io/reference/reference-protocols/nats-protocol
+// Operations that carry a payload after their control line.
+var payloadOps = map[string]bool{
+	"PUB":  true,
+	"HPUB": true,
+	"MSG":  true,
+	"HMSG": true,
+}
+
+// The version line that starts message headers, which may be followed by a
+// status code, e.g. "NATS/1.0 503".
+const headerVersion = "NATS/1.0"
+
+// The status of a reply saying that nothing was subscribed to the request's
+// subject.
+const statusNoResponders = 503
+
+// Safety constraints:
+// Don't accept control lines longer than this. The server's own limit
+// (max_control_line) defaults to 4KB, but doesn't apply to CONNECT, which
+// can carry a JWT.
+const maxLineLength = 65536
+
+// Don't accept payloads longer than this; the server's own limit
+// (max_payload) defaults to 1MB, and can be at most 64MB.
+const maxPayloadLength = 64 << 20
+
+// Don't buffer more than this much of a message's headers; we only need
+// the status line.
+const maxHeaderLength = 4096
+
+// Don't track more than this many subscriptions, or messages awaiting
+// replies, per connection.
+const (
+	maxSubscriptions  = 16384
+	maxPendingReplies = 4096
+)
+
+// Give up on a reply after this long; requesters time out well before.
+const maxReplyWait = time.Minute
+
+var errLineTooLong = errors.New("Line too long")
+
+// operation is a protocol operation: a control line, and for messages, a
+// payload.
+type operation struct {
+	Name string   // Upper-cased, e.g. "PUB"
+	Args []string // The rest of the control line, split on whitespace
+	// For messages, the lengths of the headers and the whole payload, and
+	// the headers, or as much of them as we buffered.
+	HeaderLength int
+	TotalLength  int
+	header       []byte
+	timestamp    time.Time // When the operation started to arrive
+}
+
+// opAssembler reads operations from one direction of a connection, keeping
+// an incomplete control line or payload until the rest arrives. Clients
+// publish while the server is delivering messages, so a message can be
+// split across several of the sniffer's.
+type opAssembler struct {
+	line      bytes.Buffer
+	op        *operation // An operation whose payload is arriving
+	header    bytes.Buffer
+	remaining int // Bytes of the payload, and its CRLF, still to arrive
+	start     time.Time
+}
+
+// next reads the rest of the current operation from r. It returns io.EOF
+// if r runs out first.
+func (a *opAssembler) next(r *bufio.Reader, timestamp time.Time) (*operation, error) {
+	if a.op == nil {
+		line, err := a.readLine(r, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		op, err := parseControlLine(line)
+		if err != nil {
+			return nil, err
+		}
+		op.timestamp = a.start
+		if !payloadOps[op.Name] {
+			return op, nil
+		}
+		a.op = op
+		a.remaining = op.TotalLength + 2
+	}
+	for a.remaining > 0 {
+		toBuffer := a.op.HeaderLength - a.header.Len()
+		if toBuffer > maxHeaderLength-a.header.Len() {
+			toBuffer = maxHeaderLength - a.header.Len()
+		}
+		var n int64
+		var err error
+		if toBuffer > 0 {
+			n, err = io.CopyN(&a.header, r, int64(toBuffer))
+		} else {
+			n, err = io.CopyN(ioutil.Discard, r, int64(a.remaining))
+		}
+		a.remaining -= int(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	op := a.op
+	op.header = append([]byte(nil), a.header.Bytes()...)
+	a.reset()
+	return op, nil
+}
+
+// readLine reads a control line, without its CRLF.
+func (a *opAssembler) readLine(r *bufio.Reader, timestamp time.Time) (string, error) {
+	for {
+		b, err := r.ReadSlice('\n')
+		if a.line.Len() == 0 && len(b) > 0 {
+			a.start = timestamp
+		}
+		a.line.Write(b)
+		if a.line.Len() > maxLineLength {
+			return "", errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	line := strings.TrimRight(a.line.String(), "\r\n")
+	a.line.Reset()
+	return line, nil
+}
+
+// idle reports whether no operation is partway through arriving.
+func (a *opAssembler) idle() bool {
+	return a.line.Len() == 0 && a.op == nil
+}
+
+func (a *opAssembler) reset() {
+	a.line.Reset()
+	a.op = nil
+	a.header.Reset()
+	a.remaining = 0
+}
+
+func parseControlLine(line string) (*operation, error) {
+	// CONNECT and INFO take a JSON object, and -ERR a quoted message,
+	// which may contain spaces.
+	name := line
+	rest := ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name = line[:i]
+		rest = strings.TrimSpace(line[i+1:])
+	}
+	op := &operation{Name: strings.ToUpper(name)}
+	switch op.Name {
+	case "CONNECT", "INFO", "-ERR":
+		op.Args = []string{rest}
+		return op, nil
+	}
+	op.Args = strings.Fields(rest)
+	if !payloadOps[op.Name] {
+		return op, nil
+	}
+	// The last one or two arguments are lengths.
+	lengths := 1
+	if op.Name == "HPUB" || op.Name == "HMSG" {
+		lengths = 2
+	}
+	if len(op.Args) < lengths+1 {
+		return nil, fmt.Errorf("Bad %s line", op.Name)
+	}
+	total, err := strconv.Atoi(op.Args[len(op.Args)-1])
+	if err != nil || total < 0 || total > maxPayloadLength {
+		return nil, fmt.Errorf("Bad %s payload length", op.Name)
+	}
+	op.TotalLength = total
+	if lengths == 2 {
+		header, err := strconv.Atoi(op.Args[len(op.Args)-2])
+		if err != nil || header < 0 || header > total {
+			return nil, fmt.Errorf("Bad %s header length", op.Name)
+		}
+		op.HeaderLength = header
+	}
+	op.Args = op.Args[:len(op.Args)-lengths]
+	return op, nil
+}
+
+// status returns the status code in a message's headers, or 0 if there
+// isn't one.
+func (op *operation) status() int {
+	line := string(op.header)
+	if i := strings.IndexByte(line, '\r'); i >= 0 {
+		line = line[:i]
+	}
+	if !strings.HasPrefix(line, headerVersion) {
+		return 0
+	}
+	fields := strings.Fields(line[len(headerVersion):])
+	if len(fields) == 0 {
+		return 0
+	}
+	code, _ := strconv.Atoi(fields[0])
+	return code
+}
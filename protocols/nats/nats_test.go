@@ -0,0 +1,278 @@
+package nats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublish(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("INFO {\"server_id\":\"abc\",\"max_payload\":1048576}\r\n"),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("CONNECT {\"verbose\":false,\"name\":\"orders\",\"lang\":\"go\",\"version\":\"1.31.0\"}\r\n"+
+		"PING\r\nPUB orders.created 11\r\nhello world\r\n"),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow())
+	ms.Append([]byte("PONG\r\n"), sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "publish",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 0,
+			"client_name": "orders",
+			"client_lang": "go",
+			"client_version": "1.31.0",
+			"subject": "orders.created",
+			"payload_bytes": 11,
+			"error": false
+		}`, string(tp.Output[0]))
+	}
+}
+
+func TestSubscribeAndDeliver(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("SUB orders.* workers 1\r\nSUB audit.> 2\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("MSG orders.created 1 5\r\nhello\r\nMSG audit.login.ok 2 0\r\n\r\n"),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "deliver", events[0]["event_type"])
+		assert.Equal(t, "orders.created", events[0]["subject"])
+		assert.Equal(t, "1", events[0]["sid"])
+		assert.Equal(t, "orders.*", events[0]["subscription"])
+		assert.Equal(t, "workers", events[0]["queue_group"])
+		assert.Equal(t, 5., events[0]["payload_bytes"])
+		assert.Equal(t, "audit.>", events[1]["subscription"])
+		assert.Nil(t, events[1]["queue_group"])
+		assert.Equal(t, 0., events[1]["payload_bytes"])
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("SUB a 1\r\nSUB b 2\r\nUNSUB 1 1\r\nUNSUB 2\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("MSG a 1 1\r\nx\r\nMSG a 1 1\r\ny\r\nMSG b 2 1\r\nz\r\n"),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "a", events[0]["subscription"])
+		// The subscription ended after one more message.
+		assert.Nil(t, events[1]["subscription"])
+		assert.Nil(t, events[2]["subscription"])
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("SUB _INBOX.abc.* 1\r\nPUB time.now _INBOX.abc.1 0\r\n\r\n"),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("MSG _INBOX.abc.1 1 20\r\n2006-01-02T15:04:05Z\r\n"),
+		sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	// The reply isn't reported separately.
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "publish", events[0]["event_type"])
+		assert.Equal(t, "time.now", events[0]["subject"])
+		assert.Equal(t, "_INBOX.abc.1", events[0]["reply_to"])
+		assert.Equal(t, 3., events[0]["duration_ms"])
+		assert.Equal(t, 20., events[0]["reply_bytes"])
+		assert.Equal(t, false, events[0]["error"])
+		assert.Nil(t, events[0]["no_reply"])
+	}
+}
+
+func TestNoResponders(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("HPUB time.now _INBOX.abc.1 12 14\r\nNATS/1.0\r\n\r\nhi\r\n"),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("HMSG _INBOX.abc.1 1 16 16\r\nNATS/1.0 503\r\n\r\n\r\n"),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, 2., events[0]["payload_bytes"])
+		assert.Equal(t, 12., events[0]["header_bytes"])
+		assert.Equal(t, 503., events[0]["reply_status"])
+		assert.Equal(t, true, events[0]["error"])
+	}
+}
+
+func TestServedRequest(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("SUB time.now svc 7\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("MSG time.now 7 _INBOX.xyz.9 2\r\nhi\r\n"),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	ms.Append([]byte("PUB _INBOX.xyz.9 20\r\n2006-01-02T15:04:05Z\r\n"),
+		sniffertest.DefaultDate().Add(5*time.Millisecond), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "deliver", events[0]["event_type"])
+		assert.Equal(t, "time.now", events[0]["subject"])
+		assert.Equal(t, "svc", events[0]["queue_group"])
+		assert.Equal(t, "_INBOX.xyz.9", events[0]["reply_to"])
+		assert.Equal(t, 4., events[0]["duration_ms"])
+		assert.Equal(t, 20., events[0]["reply_bytes"])
+	}
+}
+
+func TestNoReply(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("PUB a _INBOX.1 1\r\nx\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	// Long after the first request should have been answered.
+	ms.Append([]byte("PUB b _INBOX.2 1\r\ny\r\n"), sniffertest.DefaultDate().Add(2*time.Minute), defaultFlow())
+	ms.Append([]byte("MSG _INBOX.1 1 1\r\nz\r\n"),
+		sniffertest.DefaultDate().Add(2*time.Minute+time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "a", events[0]["subject"])
+		assert.Equal(t, true, events[0]["no_reply"])
+		assert.Equal(t, 0., events[0]["duration_ms"])
+		// The late reply is just a delivery.
+		assert.Equal(t, "deliver", events[1]["event_type"])
+		assert.Equal(t, "_INBOX.1", events[1]["subject"])
+		// Still awaiting a reply when the stream ended.
+		assert.Equal(t, "b", events[2]["subject"])
+		assert.Equal(t, true, events[2]["no_reply"])
+	}
+}
+
+func TestServerError(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("PUB secret 1\r\nx\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("-ERR 'Permissions Violation for Publish to \"secret\"'\r\n"),
+		sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "error", events[1]["event_type"])
+		assert.Equal(t, `Permissions Violation for Publish to "secret"`, events[1]["error_message"])
+		assert.Equal(t, true, events[1]["error"])
+	}
+}
+
+func TestLowerCaseOperations(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("sub foo 1\r\npub foo 3\r\nabc\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("+OK\r\n+OK\r\nmsg foo 1 3\r\nabc\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "publish", events[0]["event_type"])
+		assert.Equal(t, "deliver", events[1]["event_type"])
+		assert.Equal(t, "foo", events[1]["subscription"])
+	}
+}
+
+func TestSplitAcrossMessages(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	// The server delivers messages while the client publishes, so each
+	// direction's operations arrive in pieces.
+	ms.Append([]byte("PUB req _INBOX.1 1"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("MSG foo 1 "), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	ms.Append([]byte("0\r\n0123456789\r\n"), sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow())
+	ms.Append([]byte("5\r\nhel"), sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	ms.Append([]byte("PUB b 0\r\n\r"), sniffertest.DefaultDate().Add(4*time.Millisecond), defaultFlow())
+	ms.Append([]byte("lo\r\nMSG _INBOX.1 2 1\r\ny\r\n"), sniffertest.DefaultDate().Add(5*time.Millisecond), defaultFlow().Reverse())
+	ms.Append([]byte("\n"), sniffertest.DefaultDate().Add(6*time.Millisecond), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, "deliver", events[0]["event_type"])
+		assert.Equal(t, 5., events[0]["payload_bytes"])
+		assert.Equal(t, "req", events[1]["subject"])
+		assert.Equal(t, 10., events[1]["payload_bytes"])
+		assert.Equal(t, 5., events[1]["duration_ms"])
+		assert.Equal(t, "b", events[2]["subject"])
+	}
+}
+
+func TestResyncAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("PUB a 100\r\nstart"), sniffertest.DefaultDate(), defaultFlow())
+	ms.AppendSkipped([]byte("end\r\n"), sniffertest.DefaultDate(), defaultFlow(), 100)
+	ms.Append([]byte("UB b 1\r\nx\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("PUB c 1\r\nx\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "c", events[0]["subject"])
+	}
+}
+
+func TestPayloadAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.AppendSkipped([]byte("the middle of a payload\r\n"), sniffertest.DefaultDate(), defaultFlow(), 100)
+	// The payload continues in the next message, which we can't make sense
+	// of, so we wait for the one after.
+	ms.Append([]byte("end of the payload\r\nPUB c 1\r\nx\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("+OK\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte("PUB d 1\r\nx\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "d", events[0]["subject"])
+	}
+}
+
+func TestParseControlLine(t *testing.T) {
+	op, err := parseControlLine("HMSG foo.bar 9 _INBOX.1 12 30")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "HMSG", op.Name)
+		assert.Equal(t, []string{"foo.bar", "9", "_INBOX.1"}, op.Args)
+		assert.Equal(t, 12, op.HeaderLength)
+		assert.Equal(t, 30, op.TotalLength)
+	}
+	_, err = parseControlLine("HPUB foo 31 30")
+	assert.Error(t, err)
+	_, err = parseControlLine("PUB foo -1")
+	assert.Error(t, err)
+	_, err = parseControlLine("PUB 3")
+	assert.Error(t, err)
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(4222)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		Options:   Options{Port: 4222},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
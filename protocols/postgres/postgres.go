@@ -0,0 +1,520 @@
+// Package postgres parses the PostgreSQL frontend/backend protocol (version
+// 3). The server responds to messages in order, so responses are matched to
+// queries with a queue; with the extended query protocol, a client can send
+// several queries before it reads any responses.
+package postgres
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Port           uint16 `long:"port" description:"PostgreSQL port" default:"5432"`
+	MaxMessageSize int    `long:"max_message_size" description:"Maximum number of bytes of a single protocol message to buffer per connection; longer queries are truncated" default:"1048576"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if flow.DstPort != pf.Options.Port {
+		flow = flow.Reverse()
+	}
+	return &Parser{
+		options:      pf.Options,
+		flow:         flow,
+		awaitStartup: true,
+		statements:   make(map[string]string),
+		portals:      make(map[string]portal),
+		logger:       logging.NewLogger(logrus.Fields{"flow": flow, "component": "postgres"}),
+		publisher:    pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	return fmt.Sprintf("tcp port %d", pf.Options.Port)
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	options Options
+	flow    sniffer.IPPortTuple
+	// Whether the client may still send an untyped startup message.
+	awaitStartup bool
+	// The request code, if the client asked to encrypt the connection and
+	// we haven't seen the server's answer yet.
+	encryptionRequest uint32
+	gssEncrypted      bool // Whether the connection uses GSSAPI encryption
+	tls               *tls.Connection
+	// From the startup message.
+	user            string
+	database        string
+	applicationName string
+	statements      map[string]string // Prepared statement queries, by name
+	portals         map[string]portal // Bound portals, by name
+	// Queries awaiting responses, and Syncs and function calls, which also
+	// get responses, oldest first.
+	pending        []*Event
+	desynchronized bool // Whether we're waiting for the next request
+	logger         *logging.Logger
+	publisher      publish.Publisher
+}
+
+type portal struct {
+	statement string
+	query     string
+}
+
+// Event describes a query and its response. A simple query may contain
+// several statements, which are reported on together.
+type Event struct {
+	EventType       string  `json:"event_type"`
+	ClientIP        string  `json:"client_ip"`
+	ServerIP        string  `json:"server_ip"`
+	DurationMs      float64 `json:"duration_ms"`
+	User            string  `json:"user,omitempty"`
+	Database        string  `json:"database,omitempty"`
+	ApplicationName string  `json:"application_name,omitempty"`
+	Query           string  `json:"query"`
+	// "simple" for Query messages, or "extended" for Parse/Bind/Execute.
+	QueryProtocol string `json:"query_protocol"`
+	// For the extended protocol, the prepared statement and portal, if
+	// they're named.
+	StatementName string `json:"statement_name,omitempty"`
+	Portal        string `json:"portal,omitempty"`
+	// From the CommandComplete tag (of the last statement, for simple
+	// queries); e.g. "SELECT" or "CREATE TABLE".
+	Command      string `json:"command,omitempty"`
+	RowsAffected uint64 `json:"rows_affected"`
+	RowsSent     int    `json:"rows_sent"`
+	// Whether an Execute stopped early because it reached its row limit.
+	PortalSuspended bool `json:"portal_suspended,omitempty"`
+	// For COPY, "in" (from the client), "out" or "both", and the number
+	// of bytes of data copied.
+	CopyDirection string `json:"copy_direction,omitempty"`
+	CopyBytes     int64  `json:"copy_bytes,omitempty"`
+	Error         bool   `json:"error"`
+	SQLState      string `json:"sqlstate,omitempty"`
+	ErrorMessage  string `json:"error_message,omitempty"`
+	messageType   byte
+	timestamp     time.Time
+}
+
+var errGSSEncrypted = errors.New("GSSAPI-encrypted connections are not supported")
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
+			return
+		}
+		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		if p.gssEncrypted {
+			io.Copy(ioutil.Discard, m)
+			continue
+		}
+		if m.Skipped() > 0 {
+			p.desynchronize("skipped bytes")
+		}
+		br := bufio.NewReader(m)
+		if toServer {
+			// Clients send a ClientHello once the server accepts an
+			// SSLRequest, or straight away with direct SSL negotiation.
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				p.logger.Debug("Connection switched to TLS", logrus.Fields{})
+				p.pending = nil
+				p.tls = tls.NewConnection("postgres", p.flow, m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), toServer)
+				continue
+			}
+		}
+		var err error
+		if toServer {
+			err = p.parseRequestStream(br, m.Timestamp())
+		} else {
+			err = p.parseResponseStream(br, m.Timestamp())
+		}
+		if err == errGSSEncrypted {
+			p.logger.Debug("Connection uses GSSAPI encryption", logrus.Fields{})
+			metrics.Counter("postgres.gssapi_connections").Add()
+			p.gssEncrypted = true
+			p.pending = nil
+			io.Copy(ioutil.Discard, m)
+		} else if err != io.EOF {
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("postgres.parse_errors").Add()
+			p.desynchronize(err.Error())
+			io.Copy(ioutil.Discard, m)
+		}
+	}
+}
+
+// desynchronize forgets about outstanding requests once we can no longer
+// tell which responses belong to them.
+func (p *Parser) desynchronize(reason string) {
+	if p.desynchronized {
+		return
+	}
+	p.logger.Debug("Stream desynchronized", logrus.Fields{"reason": reason})
+	metrics.Counter("postgres.desyncs").Add()
+	p.pending = nil
+	p.encryptionRequest = 0
+	p.desynchronized = true
+}
+
+func (p *Parser) parseRequestStream(r *bufio.Reader, timestamp time.Time) error {
+	for first := true; ; first = false {
+		if p.awaitStartup {
+			b, err := r.Peek(startupMessageHeaderLength)
+			if err == nil && isStartupMessage(b) {
+				if err := p.parseStartupMessage(r); err != nil {
+					return err
+				}
+				continue
+			}
+			if len(b) == 0 {
+				return io.EOF
+			}
+			// We must have missed the start of the connection.
+			p.awaitStartup = false
+		}
+
+		m, err := readHeader(r)
+		if err != nil {
+			return err
+		}
+		p.logger.Debug("Parsed request", logrus.Fields{
+			"messageType": string(m.MessageType),
+			"length":      m.Length})
+		if first {
+			// A message at the start of a new TCP message is likely to be
+			// the start of a request, since clients write each batch of
+			// messages in one go.
+			p.desynchronized = false
+		}
+
+		switch m.MessageType {
+		case QUERY, PARSE, BIND, EXECUTE, CLOSE:
+			if err := m.readPayload(r, p.options.MaxMessageSize); err != nil {
+				return err
+			}
+			if err := p.parseRequest(m, timestamp); err != nil {
+				return err
+			}
+		case COPY_DATA:
+			if e := p.current(); e != nil {
+				e.CopyBytes += int64(m.Length)
+			}
+			if err := m.skipPayload(r, m.Length); err != nil {
+				return err
+			}
+		case SYNC, FUNCTION_CALL:
+			// Both get a ReadyForQuery in response, so still need a place
+			// in the queue.
+			p.enqueue(&Event{messageType: m.MessageType})
+			if err := m.skipPayload(r, m.Length); err != nil {
+				return err
+			}
+		default:
+			if err := m.skipPayload(r, m.Length); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *Parser) parseStartupMessage(r io.Reader) error {
+	m, err := readStartupMessage(r)
+	if err != nil {
+		return err
+	}
+	p.logger.Debug("Parsed startup message", logrus.Fields{"code": m.Code})
+	switch m.Code {
+	case SSL_REQUEST_CODE, GSSENC_REQUEST_CODE:
+		// The client sends a startup message (or a TLS handshake) once the
+		// server responds.
+		p.encryptionRequest = m.Code
+	case CANCEL_REQUEST_CODE:
+		// The server just closes the connection.
+	default:
+		p.awaitStartup = false
+		p.user = m.Parameters["user"]
+		p.database = m.Parameters["database"]
+		if p.database == "" {
+			p.database = p.user
+		}
+		p.applicationName = m.Parameters["application_name"]
+	}
+	return nil
+}
+
+func (p *Parser) parseRequest(m *pgMessage, timestamp time.Time) error {
+	switch m.MessageType {
+	case QUERY:
+		r := newReader(m.payload, m.Truncated)
+		query := r.CString()
+		if err := r.Err(); err != nil {
+			return err
+		}
+		e := p.newEvent(QUERY, timestamp)
+		e.Query = query
+		e.QueryProtocol = "simple"
+		p.enqueue(e)
+	case PARSE:
+		pm, err := readParseMessage(m)
+		if err != nil {
+			return err
+		}
+		if _, ok := p.statements[pm.Name]; ok || len(p.statements) < maxStatements {
+			p.statements[pm.Name] = pm.Query
+		}
+	case BIND:
+		bm, err := readBindMessage(m)
+		if err != nil {
+			return err
+		}
+		if _, ok := p.portals[bm.Portal]; ok || len(p.portals) < maxStatements {
+			p.portals[bm.Portal] = portal{statement: bm.Statement, query: p.statements[bm.Statement]}
+		}
+	case EXECUTE:
+		em, err := readExecuteMessage(m)
+		if err != nil {
+			return err
+		}
+		e := p.newEvent(EXECUTE, timestamp)
+		pt := p.portals[em.Portal]
+		e.Query = pt.query
+		e.QueryProtocol = "extended"
+		e.StatementName = pt.statement
+		e.Portal = em.Portal
+		p.enqueue(e)
+	case CLOSE:
+		cm, err := readCloseMessage(m)
+		if err != nil {
+			return err
+		}
+		if cm.Type == closeTypeStatement {
+			delete(p.statements, cm.Name)
+		} else if cm.Type == closeTypePortal {
+			delete(p.portals, cm.Name)
+		}
+	}
+	return nil
+}
+
+func (p *Parser) newEvent(messageType byte, timestamp time.Time) *Event {
+	return &Event{
+		User:            p.user,
+		Database:        p.database,
+		ApplicationName: p.applicationName,
+		messageType:     messageType,
+		timestamp:       timestamp,
+	}
+}
+
+func (p *Parser) enqueue(e *Event) {
+	if p.desynchronized {
+		// Wait for the next TCP message to start with a request.
+		return
+	}
+	if len(p.pending) >= maxPendingRequests {
+		p.desynchronize("too many pending requests")
+		return
+	}
+	p.pending = append(p.pending, e)
+}
+
+// current returns the query that the server is responding to, if it's one
+// we report on.
+func (p *Parser) current() *Event {
+	if p.desynchronized || len(p.pending) == 0 {
+		return nil
+	}
+	e := p.pending[0]
+	if e.messageType != QUERY && e.messageType != EXECUTE {
+		return nil
+	}
+	return e
+}
+
+func (p *Parser) parseResponseStream(r *bufio.Reader, timestamp time.Time) error {
+	for {
+		if p.encryptionRequest != 0 {
+			if err := p.parseEncryptionResponse(r); err != nil {
+				return err
+			}
+		}
+
+		m, err := readHeader(r)
+		if err != nil {
+			return err
+		}
+		p.logger.Debug("Parsed response", logrus.Fields{
+			"messageType": string(m.MessageType),
+			"length":      m.Length,
+			"pending":     len(p.pending)})
+		e := p.current()
+		switch m.MessageType {
+		case DATA_ROW, COPY_DATA:
+			if e != nil {
+				if m.MessageType == DATA_ROW {
+					e.RowsSent++
+				} else {
+					e.CopyBytes += int64(m.Length)
+				}
+			}
+			if err := m.skipPayload(r, m.Length); err != nil {
+				return err
+			}
+			continue
+		case COMMAND_COMPLETE, ERROR_RESPONSE:
+			if err := m.readPayload(r, p.options.MaxMessageSize); err != nil {
+				return err
+			}
+		default:
+			if err := m.skipPayload(r, m.Length); err != nil {
+				return err
+			}
+		}
+
+		switch m.MessageType {
+		case COMMAND_COMPLETE:
+			if e == nil {
+				continue
+			}
+			tag := newReader(m.payload, m.Truncated).CString()
+			command, rows := parseCommandTag(tag)
+			e.Command = command
+			e.RowsAffected += rows
+			if e.messageType == EXECUTE {
+				p.queryDone(timestamp)
+			}
+		case EMPTY_QUERY_RESPONSE:
+			if e != nil && e.messageType == EXECUTE {
+				p.queryDone(timestamp)
+			}
+		case PORTAL_SUSPENDED:
+			if e != nil {
+				e.PortalSuspended = true
+				p.queryDone(timestamp)
+			}
+		case ERROR_RESPONSE:
+			if e == nil || e.Error {
+				// Errors in response to a Parse or Bind without an Execute
+				// in the same batch aren't reported on.
+				continue
+			}
+			em, err := readErrorResponse(m)
+			if err != nil {
+				return err
+			}
+			e.Error = true
+			e.SQLState = em.SQLState
+			e.ErrorMessage = em.Message
+			// With the extended protocol, an error ends the Execute, or
+			// means that it was never run: the server skips everything up
+			// to the next Sync.
+			if e.messageType == EXECUTE {
+				p.queryDone(timestamp)
+			}
+		case COPY_IN_RESPONSE:
+			if e != nil {
+				e.CopyDirection = "in"
+			}
+		case COPY_OUT_RESPONSE:
+			if e != nil {
+				e.CopyDirection = "out"
+			}
+		case COPY_BOTH_RESPONSE:
+			if e != nil {
+				e.CopyDirection = "both"
+			}
+		case READY_FOR_QUERY:
+			p.readyForQuery(timestamp)
+		}
+	}
+}
+
+// parseEncryptionResponse reads the server's one-byte response to an
+// SSLRequest or GSSENCRequest.
+func (p *Parser) parseEncryptionResponse(r *bufio.Reader) error {
+	b, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+	request := p.encryptionRequest
+	p.encryptionRequest = 0
+	switch {
+	case b[0] == ENCRYPTION_ACCEPTED_GSS && request == GSSENC_REQUEST_CODE:
+		return errGSSEncrypted
+	case b[0] == ENCRYPTION_ACCEPTED_SSL && request == SSL_REQUEST_CODE:
+		// The client sends a ClientHello next.
+		r.ReadByte()
+	case b[0] == ENCRYPTION_REFUSED:
+		// The client carries on unencrypted, or gives up.
+		r.ReadByte()
+	}
+	// Otherwise, it's an ErrorResponse from a server too old to
+	// understand the request.
+	return nil
+}
+
+// readyForQuery handles the end of the response to a simple query, a
+// function call, or everything up to and including a Sync.
+func (p *Parser) readyForQuery(timestamp time.Time) {
+	for !p.desynchronized && len(p.pending) > 0 {
+		e := p.pending[0]
+		switch e.messageType {
+		case QUERY:
+			p.queryDone(timestamp)
+			return
+		case EXECUTE:
+			// Skipped by the server after an earlier error in the batch.
+			p.pending[0] = nil
+			p.pending = p.pending[1:]
+		default:
+			p.pending[0] = nil
+			p.pending = p.pending[1:]
+			return
+		}
+	}
+}
+
+// queryDone publishes an event for the oldest pending query.
+func (p *Parser) queryDone(timestamp time.Time) {
+	e := p.pending[0]
+	p.pending[0] = nil
+	p.pending = p.pending[1:]
+	e.EventType = "query"
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	if timestamp.After(e.timestamp) {
+		e.DurationMs = float64(timestamp.Sub(e.timestamp).Nanoseconds()) / 1e6
+	}
+	p.publisher.Publish(e, e.timestamp)
+	metrics.Counter("postgres.queries_parsed").Add()
+}
@@ -0,0 +1,411 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// See https://www.postgresql.org/docs/current/protocol-message-formats.html
+// After the startup message, each message starts with a one-byte type and a
+// four-byte big-endian length, which counts itself but not the type.
+const messageHeaderLength = 5
+
+// Frontend (client) message types.
+const (
+	BIND             byte = 'B'
+	CLOSE            byte = 'C'
+	DESCRIBE         byte = 'D'
+	EXECUTE          byte = 'E'
+	FUNCTION_CALL    byte = 'F'
+	FLUSH            byte = 'H'
+	PARSE            byte = 'P'
+	QUERY            byte = 'Q'
+	SYNC             byte = 'S'
+	TERMINATE        byte = 'X'
+	PASSWORD_MESSAGE byte = 'p'
+	COPY_FAIL        byte = 'f'
+)
+
+// Sent in both directions during COPY.
+const (
+	COPY_DATA byte = 'd'
+	COPY_DONE byte = 'c'
+)
+
+// Backend (server) message types.
+const (
+	PARSE_COMPLETE         byte = '1'
+	BIND_COMPLETE          byte = '2'
+	CLOSE_COMPLETE         byte = '3'
+	NOTIFICATION_RESPONSE  byte = 'A'
+	COMMAND_COMPLETE       byte = 'C'
+	DATA_ROW               byte = 'D'
+	ERROR_RESPONSE         byte = 'E'
+	COPY_IN_RESPONSE       byte = 'G'
+	COPY_OUT_RESPONSE      byte = 'H'
+	EMPTY_QUERY_RESPONSE   byte = 'I'
+	BACKEND_KEY_DATA       byte = 'K'
+	NOTICE_RESPONSE        byte = 'N'
+	AUTHENTICATION         byte = 'R'
+	PARAMETER_STATUS       byte = 'S'
+	ROW_DESCRIPTION        byte = 'T'
+	FUNCTION_CALL_RESPONSE byte = 'V'
+	COPY_BOTH_RESPONSE     byte = 'W'
+	READY_FOR_QUERY        byte = 'Z'
+	NO_DATA                byte = 'n'
+	PORTAL_SUSPENDED       byte = 's'
+	PARAMETER_DESCRIPTION  byte = 't'
+)
+
+// Codes that follow the length in the untyped messages a client can start
+// a connection with.
+const (
+	PROTOCOL_VERSION_3  uint32 = 3 << 16
+	CANCEL_REQUEST_CODE uint32 = 80877102
+	SSL_REQUEST_CODE    uint32 = 80877103
+	GSSENC_REQUEST_CODE uint32 = 80877104
+)
+
+// The single-byte responses to an SSLRequest or GSSENCRequest.
+const (
+	ENCRYPTION_ACCEPTED_SSL byte = 'S'
+	ENCRYPTION_ACCEPTED_GSS byte = 'G'
+	ENCRYPTION_REFUSED      byte = 'N'
+)
+
+// ErrorResponse and NoticeResponse field types.
+const (
+	FIELD_SEVERITY              byte = 'S'
+	FIELD_SEVERITY_NONLOCALIZED byte = 'V'
+	FIELD_SQLSTATE              byte = 'C'
+	FIELD_MESSAGE               byte = 'M'
+)
+
+// What a Close message closes.
+const (
+	closeTypeStatement byte = 'S'
+	closeTypePortal    byte = 'P'
+)
+
+// Untyped messages start with a four-byte length and a four-byte code.
+const startupMessageHeaderLength = 8
+
+// Safety constraints:
+// Don't queue more than this many pipelined queries per connection. Clients
+// sending batches with the extended protocol may send many Executes before
+// a Sync.
+const maxPendingRequests = 256
+
+// Don't remember more than this many named prepared statements or portals
+// per connection.
+const maxStatements = 1024
+
+// Don't accept startup messages longer than this; the server's own limit is
+// 10000 bytes.
+const maxStartupMessageLength = 10000
+
+// Don't accept messages longer than this, whatever the options say; the
+// server won't accept anything longer than 1GB either.
+const maxMessageLength = 1 << 30
+
+type pgMessage struct {
+	MessageType byte
+	Length      int  // Length of the payload
+	Truncated   bool // Whether payload holds only a prefix of the message
+	payload     []byte
+}
+
+// readHeader reads the type and length of the next message from r.
+func readHeader(r io.Reader) (*pgMessage, error) {
+	var header [messageHeaderLength]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header[1:5]))
+	if length < 4 || length > maxMessageLength {
+		return nil, fmt.Errorf("Bad message length %d for message type %q", length, header[0])
+	}
+	return &pgMessage{MessageType: header[0], Length: length - 4}, nil
+}
+
+// readPayload reads the message's payload from r. At most maxLength bytes
+// are buffered; the rest is read and discarded.
+func (m *pgMessage) readPayload(r io.Reader, maxLength int) error {
+	toBuffer := m.Length
+	if toBuffer > maxLength {
+		toBuffer = maxLength
+		m.Truncated = true
+	}
+	// Copying into a bytes.Buffer grows it as data actually arrives,
+	// rather than allocating based on the declared length up front.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(toBuffer)); err != nil {
+		return unexpectedEOF(err)
+	}
+	m.payload = buf.Bytes()
+	return m.skipPayload(r, m.Length-toBuffer)
+}
+
+// skipPayload discards the n remaining bytes of the message's payload.
+func (m *pgMessage) skipPayload(r io.Reader, n int) error {
+	if _, err := io.CopyN(ioutil.Discard, r, int64(n)); err != nil {
+		return unexpectedEOF(err)
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// isStartupMessage reports whether b, the first eight bytes of a message
+// from the client, look like the start of one of the untyped messages
+// clients begin connections with.
+func isStartupMessage(b []byte) bool {
+	length := binary.BigEndian.Uint32(b[0:4])
+	code := binary.BigEndian.Uint32(b[4:8])
+	if length < startupMessageHeaderLength || length > maxStartupMessageLength {
+		return false
+	}
+	return code>>16 == 3 || code == CANCEL_REQUEST_CODE ||
+		code == SSL_REQUEST_CODE || code == GSSENC_REQUEST_CODE
+}
+
+// StartupMessage, SSLRequest, GSSENCRequest or CancelRequest
+type startupMessage struct {
+	Code       uint32            // Protocol version, or request code
+	Parameters map[string]string // For StartupMessage, the parameters
+}
+
+func readStartupMessage(r io.Reader) (*startupMessage, error) {
+	var header [startupMessageHeaderLength]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header[0:4]))
+	m := startupMessage{Code: binary.BigEndian.Uint32(header[4:8])}
+	body := make([]byte, length-startupMessageHeaderLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if m.Code>>16 != 3 {
+		return &m, nil
+	}
+	m.Parameters = make(map[string]string)
+	c := newReader(body, false)
+	for c.err == nil {
+		name := c.CString()
+		if name == "" {
+			break
+		}
+		m.Parameters[name] = c.CString()
+	}
+	return &m, c.Err()
+}
+
+// Parse
+type parseMessage struct {
+	Name  string // Prepared statement name; empty for the unnamed statement
+	Query string
+	// Parameter types are not parsed.
+}
+
+func readParseMessage(m *pgMessage) (*parseMessage, error) {
+	r := newReader(m.payload, m.Truncated)
+	p := parseMessage{}
+	p.Name = r.CString()
+	p.Query = r.CString()
+	return &p, r.Err()
+}
+
+// Bind
+type bindMessage struct {
+	Portal    string // Portal name; empty for the unnamed portal
+	Statement string // Prepared statement name
+	// Parameter values and formats are not parsed.
+}
+
+func readBindMessage(m *pgMessage) (*bindMessage, error) {
+	r := newReader(m.payload, m.Truncated)
+	b := bindMessage{}
+	b.Portal = r.CString()
+	b.Statement = r.CString()
+	return &b, r.Err()
+}
+
+// Execute
+type executeMessage struct {
+	Portal  string
+	MaxRows uint32 // Zero for no limit
+}
+
+func readExecuteMessage(m *pgMessage) (*executeMessage, error) {
+	r := newReader(m.payload, m.Truncated)
+	e := executeMessage{}
+	e.Portal = r.CString()
+	e.MaxRows = r.Uint32()
+	return &e, r.Err()
+}
+
+// Close
+type closeMessage struct {
+	Type byte // closeTypeStatement or closeTypePortal
+	Name string
+}
+
+func readCloseMessage(m *pgMessage) (*closeMessage, error) {
+	r := newReader(m.payload, m.Truncated)
+	c := closeMessage{}
+	c.Type = r.Byte()
+	c.Name = r.CString()
+	return &c, r.Err()
+}
+
+// ErrorResponse
+type errorResponse struct {
+	Severity string // Not localized, if the server sends that
+	SQLState string
+	Message  string
+	// Other fields are not parsed.
+}
+
+func readErrorResponse(m *pgMessage) (*errorResponse, error) {
+	r := newReader(m.payload, m.Truncated)
+	e := errorResponse{}
+	for r.err == nil {
+		fieldType := r.Byte()
+		if fieldType == 0 {
+			break
+		}
+		value := r.CString()
+		switch fieldType {
+		case FIELD_SEVERITY:
+			if e.Severity == "" {
+				e.Severity = value
+			}
+		case FIELD_SEVERITY_NONLOCALIZED:
+			e.Severity = value
+		case FIELD_SQLSTATE:
+			e.SQLState = value
+		case FIELD_MESSAGE:
+			e.Message = value
+		}
+	}
+	return &e, r.Err()
+}
+
+// Commands whose CommandComplete tags end with a row count.
+var taggedRowCounts = map[string]bool{
+	"INSERT": true,
+	"DELETE": true,
+	"UPDATE": true,
+	"MERGE":  true,
+	"SELECT": true,
+	"MOVE":   true,
+	"FETCH":  true,
+	"COPY":   true,
+}
+
+// parseCommandTag splits a CommandComplete tag such as "INSERT 0 5" or
+// "CREATE TABLE" into the command and the number of rows it affected.
+func parseCommandTag(tag string) (string, uint64) {
+	words := strings.Fields(tag)
+	if len(words) < 2 || !taggedRowCounts[words[0]] {
+		return tag, 0
+	}
+	rows, err := strconv.ParseUint(words[len(words)-1], 10, 64)
+	if err != nil {
+		return tag, 0
+	}
+	return words[0], rows
+}
+
+var errNoTerminator = errors.New("Missing string terminator")
+var errTruncated = errors.New("Truncated message")
+
+// reader wraps a message payload with convenience functions for parsing
+// Postgres datatypes. Like the MySQL parser's errReader, it stores the first
+// error it encounters, and callers must check reader.err.
+type reader struct {
+	b         []byte
+	truncated bool // Whether the payload is truncated
+	err       error
+}
+
+func newReader(payload []byte, truncated bool) *reader {
+	return &reader{b: payload, truncated: truncated}
+}
+
+// Err returns the error the reader encountered, if any. Running out of a
+// truncated payload isn't an error; the fields that were cut off are just
+// left empty.
+func (r *reader) Err() error {
+	if r.err == errTruncated {
+		return nil
+	}
+	return r.err
+}
+
+// CString reads a null-terminated string. If the payload is truncated, the
+// last string may be missing its terminator, and is returned as is.
+func (r *reader) CString() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.b, 0)
+	if i < 0 {
+		if !r.truncated {
+			r.err = errNoTerminator
+			return ""
+		}
+		r.err = errTruncated
+		s := string(r.b)
+		r.b = nil
+		return s
+	}
+	s := string(r.b[:i])
+	r.b = r.b[i+1:]
+	return s
+}
+
+func (r *reader) Byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) < 1 {
+		r.err = r.eof()
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) Uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) < 4 {
+		r.err = r.eof()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *reader) eof() error {
+	if r.truncated {
+		return errTruncated
+	}
+	return io.ErrUnexpectedEOF
+}
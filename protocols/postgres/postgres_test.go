@@ -0,0 +1,484 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimpleQuery(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genStartup("user", "app", "database", "appdb", "application_name", "psql"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(AUTHENTICATION, []byte{0, 0, 0, 0}),
+		genMessage(PARAMETER_STATUS, cstrings("server_version", "16.1")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genMessage(QUERY, cstrings("SELECT 1")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(ROW_DESCRIPTION, nil),
+		genMessage(DATA_ROW, []byte{0, 1, 0, 0, 0, 1, '1'}),
+		genMessage(DATA_ROW, []byte{0, 1, 0, 0, 0, 1, '1'}),
+		genMessage(COMMAND_COMPLETE, cstrings("SELECT 2")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "query",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 2,
+			"user": "app",
+			"database": "appdb",
+			"application_name": "psql",
+			"query": "SELECT 1",
+			"query_protocol": "simple",
+			"command": "SELECT",
+			"rows_affected": 2,
+			"rows_sent": 2,
+			"error": false
+		}`, string(tp.Output[0]))
+	}
+}
+
+func TestMultiStatementQuery(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genMessage(QUERY, cstrings("INSERT INTO t VALUES (1); UPDATE t SET x = 2")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(COMMAND_COMPLETE, cstrings("INSERT 0 1")),
+		genMessage(COMMAND_COMPLETE, cstrings("UPDATE 3")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "UPDATE", events[0]["command"])
+		assert.Equal(t, float64(4), events[0]["rows_affected"])
+		// Without a startup message, we don't know the user.
+		assert.Nil(t, events[0]["user"])
+	}
+}
+
+func TestSimpleQueryError(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genMessage(QUERY, cstrings("SELECT * FROM missing")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(ERROR_RESPONSE, genErrorFields("ERROR", "42P01", `relation "missing" does not exist`)),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, true, events[0]["error"])
+		assert.Equal(t, "42P01", events[0]["sqlstate"])
+		assert.Equal(t, `relation "missing" does not exist`, events[0]["error_message"])
+	}
+}
+
+func TestExtendedQuery(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genMessage(PARSE, concat(cstrings("find_user", "SELECT * FROM users WHERE id = $1"), []byte{0, 0})),
+		genBind("", "find_user"),
+		genMessage(DESCRIBE, append([]byte{'P'}, cstrings("")...)),
+		genExecute("", 0),
+		genMessage(SYNC, nil)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(PARSE_COMPLETE, nil),
+		genMessage(BIND_COMPLETE, nil),
+		genMessage(ROW_DESCRIPTION, nil),
+		genMessage(DATA_ROW, nil),
+		genMessage(COMMAND_COMPLETE, cstrings("SELECT 1")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	// The named statement can be reused, with a named portal.
+	ms.Append(concat(
+		genBind("cursor", "find_user"),
+		genExecute("cursor", 0),
+		genMessage(SYNC, nil)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(BIND_COMPLETE, nil),
+		genMessage(COMMAND_COMPLETE, cstrings("SELECT 0")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 2, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "query",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 1,
+			"query": "SELECT * FROM users WHERE id = $1",
+			"query_protocol": "extended",
+			"statement_name": "find_user",
+			"command": "SELECT",
+			"rows_affected": 1,
+			"rows_sent": 1,
+			"error": false
+		}`, string(tp.Output[0]))
+		events := tp.Events()
+		assert.Equal(t, "SELECT * FROM users WHERE id = $1", events[1]["query"])
+		assert.Equal(t, "cursor", events[1]["portal"])
+		assert.Equal(t, float64(3), events[1]["duration_ms"])
+	}
+}
+
+func TestExtendedQueryBatchWithError(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	var batch []byte
+	for _, query := range []string{"INSERT INTO t VALUES (1)", "INSERT INTO t VALUES (1)", "INSERT INTO t VALUES (2)"} {
+		batch = concat(batch,
+			genMessage(PARSE, concat(cstrings("", query), []byte{0, 0})),
+			genBind("", ""),
+			genExecute("", 0))
+	}
+	batch = concat(batch, genMessage(SYNC, nil))
+	ms.Append(batch, sniffertest.DefaultDate(), defaultFlow())
+	// The second insert fails, so the server skips the third.
+	ms.Append(concat(
+		genMessage(PARSE_COMPLETE, nil),
+		genMessage(BIND_COMPLETE, nil),
+		genMessage(COMMAND_COMPLETE, cstrings("INSERT 0 1")),
+		genMessage(PARSE_COMPLETE, nil),
+		genMessage(BIND_COMPLETE, nil),
+		genMessage(ERROR_RESPONSE, genErrorFields("ERROR", "23505", "duplicate key value violates unique constraint")),
+		genMessage(READY_FOR_QUERY, []byte{'E'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genMessage(QUERY, cstrings("ROLLBACK")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(COMMAND_COMPLETE, cstrings("ROLLBACK")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 3, len(events)) {
+		assert.Equal(t, false, events[0]["error"])
+		assert.Equal(t, float64(1), events[0]["rows_affected"])
+		assert.Equal(t, true, events[1]["error"])
+		assert.Equal(t, "23505", events[1]["sqlstate"])
+		assert.Equal(t, "ROLLBACK", events[2]["query"])
+		assert.Equal(t, "ROLLBACK", events[2]["command"])
+	}
+}
+
+func TestParseErrorWithoutExecute(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genMessage(PARSE, concat(cstrings("bad", "SELEC 1"), []byte{0, 0})),
+		genMessage(SYNC, nil)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(ERROR_RESPONSE, genErrorFields("ERROR", "42601", "syntax error")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genMessage(QUERY, cstrings("SELECT 1")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(COMMAND_COMPLETE, cstrings("SELECT 1")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "SELECT 1", events[0]["query"])
+		assert.Equal(t, false, events[0]["error"])
+	}
+}
+
+func TestPortalSuspended(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genMessage(PARSE, concat(cstrings("", "SELECT * FROM t"), []byte{0, 0})),
+		genBind("", ""),
+		genExecute("", 1),
+		genMessage(SYNC, nil)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(PARSE_COMPLETE, nil),
+		genMessage(BIND_COMPLETE, nil),
+		genMessage(DATA_ROW, nil),
+		genMessage(PORTAL_SUSPENDED, nil),
+		genMessage(READY_FOR_QUERY, []byte{'T'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, true, events[0]["portal_suspended"])
+		assert.Equal(t, float64(1), events[0]["rows_sent"])
+	}
+}
+
+func TestCloseStatement(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genMessage(PARSE, concat(cstrings("s1", "SELECT 1"), []byte{0, 0})),
+		genMessage(CLOSE, append([]byte{closeTypeStatement}, cstrings("s1")...)),
+		genBind("", "s1"),
+		genExecute("", 0),
+		genMessage(SYNC, nil)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(PARSE_COMPLETE, nil),
+		genMessage(CLOSE_COMPLETE, nil),
+		genMessage(ERROR_RESPONSE, genErrorFields("ERROR", "26000", `prepared statement "s1" does not exist`)),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "", events[0]["query"])
+		assert.Equal(t, "26000", events[0]["sqlstate"])
+	}
+}
+
+func TestCopyIn(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genMessage(QUERY, cstrings("COPY t FROM STDIN")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genMessage(COPY_IN_RESPONSE, []byte{0, 0, 1, 0, 0}), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(concat(
+		genMessage(COPY_DATA, []byte("1\tone\n")),
+		genMessage(COPY_DATA, []byte("2\ttwo\n")),
+		genMessage(COPY_DONE, nil)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(COMMAND_COMPLETE, cstrings("COPY 2")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate().Add(4*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "in", events[0]["copy_direction"])
+		assert.Equal(t, float64(12), events[0]["copy_bytes"])
+		assert.Equal(t, float64(2), events[0]["rows_affected"])
+		assert.Equal(t, "COPY", events[0]["command"])
+		assert.Equal(t, float64(4), events[0]["duration_ms"])
+	}
+}
+
+func TestCopyOut(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genMessage(QUERY, cstrings("COPY t TO STDOUT")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(COPY_OUT_RESPONSE, []byte{0, 0, 1, 0, 0}),
+		genMessage(COPY_DATA, []byte("1\tone\n")),
+		genMessage(COPY_DONE, nil),
+		genMessage(COMMAND_COMPLETE, cstrings("COPY 1")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "out", events[0]["copy_direction"])
+		assert.Equal(t, float64(6), events[0]["copy_bytes"])
+	}
+}
+
+func TestSSLRequest(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(SSL_REQUEST_CODE), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte{ENCRYPTION_ACCEPTED_SSL}, sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append([]byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0x00, 0x00, 0x00}, sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte{0x16, 0x03, 0x03, 0x00, 0x01, 0x02}, sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "tls_connection", events[0]["event_type"])
+		assert.Equal(t, "postgres", events[0]["protocol"])
+	}
+}
+
+func TestSSLRequestRefused(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(SSL_REQUEST_CODE), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte{ENCRYPTION_REFUSED}, sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genStartup("user", "app"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(AUTHENTICATION, []byte{0, 0, 0, 0}),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genMessage(QUERY, cstrings("SELECT 1")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(COMMAND_COMPLETE, cstrings("SELECT 1")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "app", events[0]["user"])
+		// The database defaults to the user name.
+		assert.Equal(t, "app", events[0]["database"])
+	}
+}
+
+func TestGSSEncryption(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(GSSENC_REQUEST_CODE), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte{ENCRYPTION_ACCEPTED_GSS}, sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genMessage(QUERY, cstrings("SELECT 1")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(COMMAND_COMPLETE, cstrings("SELECT 1")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	assert.Equal(t, 0, len(tp.Output))
+}
+
+func TestResyncAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genMessage(QUERY, cstrings("SELECT 1")), sniffertest.DefaultDate(), defaultFlow())
+	ms.AppendSkipped([]byte{0x01, 0x02, 0x03}, sniffertest.DefaultDate(), defaultFlow().Reverse(), 100)
+	ms.Append(genMessage(QUERY, cstrings("SELECT 2")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(COMMAND_COMPLETE, cstrings("SELECT 1")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "SELECT 2", events[0]["query"])
+	}
+}
+
+func TestTooManyPendingRequests(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	var requests []byte
+	for i := 0; i < maxPendingRequests+2; i++ {
+		requests = append(requests, genMessage(QUERY, cstrings("SELECT 1"))...)
+	}
+	ms.Append(requests, sniffertest.DefaultDate(), defaultFlow())
+	// The response to the first query isn't attributed to the last.
+	ms.Append(concat(
+		genMessage(COMMAND_COMPLETE, cstrings("SELECT 1")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genMessage(QUERY, cstrings("SELECT 2")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(COMMAND_COMPLETE, cstrings("SELECT 1")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "SELECT 2", events[0]["query"])
+	}
+}
+
+func TestTruncatedQuery(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	pf := ParserFactory{
+		Options:   Options{Port: 5432, MaxMessageSize: 8},
+		Publisher: tp,
+	}
+	parser := pf.New(defaultFlow())
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genMessage(QUERY, cstrings("SELECT 123456789")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genMessage(COMMAND_COMPLETE, cstrings("SELECT 1")),
+		genMessage(READY_FOR_QUERY, []byte{'I'})), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "SELECT 1", events[0]["query"])
+	}
+}
+
+func TestParseCommandTag(t *testing.T) {
+	var tagTests = []struct {
+		tag     string
+		command string
+		rows    uint64
+	}{
+		{"INSERT 0 5", "INSERT", 5},
+		{"UPDATE 3", "UPDATE", 3},
+		{"SELECT 0", "SELECT", 0},
+		{"CREATE TABLE", "CREATE TABLE", 0},
+		{"BEGIN", "BEGIN", 0},
+	}
+	for _, testcase := range tagTests {
+		command, rows := parseCommandTag(testcase.tag)
+		assert.Equal(t, testcase.command, command)
+		assert.Equal(t, testcase.rows, rows)
+	}
+}
+
+func genMessage(messageType byte, payload []byte) []byte {
+	b := make([]byte, messageHeaderLength)
+	b[0] = messageType
+	binary.BigEndian.PutUint32(b[1:], uint32(len(payload)+4))
+	return append(b, payload...)
+}
+
+func genRequest(code uint32) []byte {
+	b := make([]byte, startupMessageHeaderLength)
+	binary.BigEndian.PutUint32(b, startupMessageHeaderLength)
+	binary.BigEndian.PutUint32(b[4:], code)
+	return b
+}
+
+func genStartup(parameters ...string) []byte {
+	body := append(cstrings(parameters...), 0)
+	b := make([]byte, startupMessageHeaderLength)
+	binary.BigEndian.PutUint32(b, uint32(len(body)+startupMessageHeaderLength))
+	binary.BigEndian.PutUint32(b[4:], PROTOCOL_VERSION_3)
+	return append(b, body...)
+}
+
+func genBind(portal string, statement string) []byte {
+	// No parameter formats, parameters or result formats.
+	return genMessage(BIND, concat(cstrings(portal, statement), []byte{0, 0, 0, 0, 0, 0}))
+}
+
+func genExecute(portal string, maxRows uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, maxRows)
+	return genMessage(EXECUTE, concat(cstrings(portal), b))
+}
+
+func genErrorFields(severity string, sqlstate string, message string) []byte {
+	return concat(
+		[]byte{FIELD_SEVERITY}, cstrings(severity),
+		[]byte{FIELD_SEVERITY_NONLOCALIZED}, cstrings(severity),
+		[]byte{FIELD_SQLSTATE}, cstrings(sqlstate),
+		[]byte{FIELD_MESSAGE}, cstrings(message),
+		[]byte{0})
+}
+
+func cstrings(s ...string) []byte {
+	var b []byte
+	for _, v := range s {
+		b = append(b, v...)
+		b = append(b, 0)
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(5432)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		Options:   Options{Port: 5432, MaxMessageSize: 1024 * 1024},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
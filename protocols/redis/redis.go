@@ -0,0 +1,353 @@
+// Package redis parses the Redis serialization protocol (RESP2 and RESP3).
+// The server replies to commands in order, so replies are matched to
+// commands with a queue, which also handles pipelined commands. Pub/sub
+// messages and RESP3 pushes arrive out of band, and aren't matched to
+// commands, except for the confirmations that SUBSCRIBE and friends get in
+// place of a reply.
+package redis
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Port     uint16 `long:"port" description:"Redis port" default:"6379"`
+	HashKeys bool   `long:"hash_keys" description:"Apply a one-way hash to keys"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if flow.DstPort != pf.Options.Port {
+		flow = flow.Reverse()
+	}
+	return &Parser{
+		options:   pf.Options,
+		flow:      flow,
+		logger:    logging.NewLogger(logrus.Fields{"flow": flow, "component": "redis"}),
+		publisher: pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	return fmt.Sprintf("tcp port %d", pf.Options.Port)
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	options        Options
+	flow           sniffer.IPPortTuple
+	pending        []*Event // Commands awaiting replies, oldest first
+	desynchronized bool     // Whether we're waiting for the next command
+	inTransaction  bool     // Whether the client has sent MULTI
+	subscribed     bool     // Whether the connection has any subscriptions
+	monitoring     bool     // Whether the connection is running MONITOR
+	tls            *tls.Connection
+	logger         *logging.Logger
+	publisher      publish.Publisher
+}
+
+// Event describes a command and its reply.
+type Event struct {
+	EventType  string  `json:"event_type"`
+	ClientIP   string  `json:"client_ip"`
+	ServerIP   string  `json:"server_ip"`
+	DurationMs float64 `json:"duration_ms"`
+	// The command name, upper-cased, and for commands with subcommands,
+	// the subcommand, as in "CONFIG GET".
+	Command string `json:"command"`
+	// The first argument, for commands where that's a key.
+	Key      string `json:"key,omitempty"`
+	ArgCount int    `json:"arg_count"`
+	// Whether the command was sent between MULTI and EXEC, so that its
+	// reply just says whether it was queued.
+	InTransaction bool `json:"in_transaction,omitempty"`
+	RequestBytes  int  `json:"request_bytes"`
+	// e.g. "simple_string", "bulk_string" or "array"; "null" for RESP2
+	// null bulk strings and arrays as well as RESP3 nulls.
+	ReplyType string `json:"reply_type"`
+	// For aggregate replies, the number of elements; for SUBSCRIBE and
+	// friends, the number of confirmations.
+	ReplyElements int  `json:"reply_elements,omitempty"`
+	ReplyBytes    int  `json:"reply_bytes"`
+	Error         bool `json:"error"`
+	// The first word of an error reply, e.g. "ERR", "WRONGTYPE" or "MOVED".
+	ErrorPrefix string `json:"error_prefix,omitempty"`
+	// For SUBSCRIBE and friends, the number of confirmations expected (one
+	// per channel), or -1 for unsubscribing from everything.
+	confirmations int
+	timestamp     time.Time
+}
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
+			return
+		}
+		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		if m.Skipped() > 0 {
+			p.desynchronize("skipped bytes")
+		}
+		br := bufio.NewReader(m)
+		if toServer {
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				p.logger.Debug("Connection uses TLS", logrus.Fields{})
+				p.pending = nil
+				p.tls = tls.NewConnection("redis", p.flow, m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), toServer)
+				continue
+			}
+		}
+		var err error
+		if toServer {
+			err = p.parseRequestStream(br, m.Timestamp())
+		} else {
+			err = p.parseResponseStream(br, m.Timestamp())
+		}
+		if err != io.EOF {
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("redis.parse_errors").Add()
+			p.desynchronize(err.Error())
+			io.Copy(ioutil.Discard, br)
+		}
+	}
+}
+
+// desynchronize forgets about outstanding commands once we can no longer
+// tell which replies belong to them.
+func (p *Parser) desynchronize(reason string) {
+	if p.desynchronized {
+		return
+	}
+	p.logger.Debug("Stream desynchronized", logrus.Fields{"reason": reason})
+	metrics.Counter("redis.desyncs").Add()
+	p.pending = nil
+	p.desynchronized = true
+}
+
+func (p *Parser) parseRequestStream(r *bufio.Reader, timestamp time.Time) error {
+	rr := newRESPReader(r)
+	for first := true; ; first = false {
+		b, err := r.Peek(1)
+		if err != nil {
+			return err
+		}
+		var v *value
+		if b[0] == ARRAY {
+			v, err = rr.readValue(0)
+		} else {
+			v, err = rr.readInlineCommand()
+		}
+		if err != nil {
+			return err
+		}
+		if len(v.elements) == 0 {
+			// Inline commands can be empty lines, which get no reply.
+			continue
+		}
+		if first {
+			// A command at the start of a new TCP message is likely to be
+			// the start of a command, since clients write each one (or
+			// each batch of pipelined ones) in one go.
+			p.desynchronized = false
+		}
+		if p.desynchronized {
+			continue
+		}
+		e := p.newEvent(v, timestamp)
+		p.logger.Debug("Parsed command", logrus.Fields{
+			"command": e.Command,
+			"args":    e.ArgCount})
+		if len(p.pending) >= maxPendingCommands {
+			p.desynchronize("too many pending commands")
+			continue
+		}
+		p.pending = append(p.pending, e)
+	}
+}
+
+func (p *Parser) newEvent(v *value, timestamp time.Time) *Event {
+	e := &Event{
+		Command:      strings.ToUpper(v.elements[0].str),
+		ArgCount:     v.Elements - 1,
+		RequestBytes: v.Length,
+		timestamp:    timestamp,
+	}
+	switch {
+	case containerCommands[e.Command]:
+		if len(v.elements) > 1 {
+			e.Command += " " + strings.ToUpper(v.elements[1].str)
+		}
+	case !keylessCommands[e.Command] && len(v.elements) > 1:
+		e.Key = v.elements[1].str
+		if p.options.HashKeys {
+			e.Key = fmt.Sprintf("%x", sha256.Sum256([]byte(e.Key)))
+		}
+	}
+
+	switch e.Command {
+	case "MULTI":
+		p.inTransaction = true
+	case "EXEC", "DISCARD", "RESET":
+		p.inTransaction = false
+	default:
+		e.InTransaction = p.inTransaction
+	}
+	if subscriptionKinds[strings.ToLower(e.Command)] {
+		e.confirmations = e.ArgCount
+		if e.confirmations == 0 {
+			e.confirmations = -1
+		}
+	}
+	return e
+}
+
+func (p *Parser) parseResponseStream(r *bufio.Reader, timestamp time.Time) error {
+	rr := newRESPReader(r)
+	for {
+		v, err := rr.readValue(0)
+		if err != nil {
+			return err
+		}
+		p.logger.Debug("Parsed reply", logrus.Fields{
+			"type":    string(v.Type),
+			"length":  v.Length,
+			"pending": len(p.pending)})
+		if p.monitoring {
+			// Everything after MONITOR's reply is a log of other
+			// connections' commands.
+			continue
+		}
+		if kind, ok := p.pubsubKind(v); ok {
+			if subscriptionKinds[kind] {
+				p.confirmSubscription(kind, v, timestamp)
+			} else {
+				metrics.Counter("redis.pushed_messages").Add()
+			}
+			continue
+		}
+		p.endUnsubscribeAll(timestamp)
+		if p.desynchronized || len(p.pending) == 0 {
+			continue
+		}
+		e := p.pending[0]
+		e.ReplyType = typeNames[v.Type]
+		if v.Null {
+			e.ReplyType = "null"
+		}
+		e.ReplyElements = v.Elements
+		e.ReplyBytes = v.Length
+		if v.Type == SIMPLE_ERROR || v.Type == BULK_ERROR {
+			e.Error = true
+			e.ErrorPrefix = strings.SplitN(v.str, " ", 2)[0]
+		}
+		switch e.Command {
+		case "MONITOR":
+			p.monitoring = !e.Error
+		case "RESET":
+			p.subscribed = false
+		}
+		p.commandDone(timestamp)
+	}
+}
+
+// pubsubKind returns the kind of a pub/sub message, if v is one. In RESP2,
+// these are arrays that only appear once a connection has subscribed to
+// something; "pong" replies to PING in that mode are ordinary replies.
+func (p *Parser) pubsubKind(v *value) (string, bool) {
+	if v.Type != PUSH && v.Type != ARRAY || len(v.elements) == 0 {
+		return "", false
+	}
+	kind := strings.ToLower(v.elements[0].str)
+	if v.Type == PUSH {
+		return kind, true
+	}
+	if !p.subscribed && p.confirming() == nil {
+		return "", false
+	}
+	return kind, subscriptionKinds[kind] || messageKinds[kind]
+}
+
+// confirming returns the oldest pending command, if it's waiting for
+// subscription change confirmations.
+func (p *Parser) confirming() *Event {
+	if p.desynchronized || len(p.pending) == 0 || p.pending[0].confirmations == 0 {
+		return nil
+	}
+	return p.pending[0]
+}
+
+// confirmSubscription attributes a subscription change to the oldest pending
+// command, if it's the one that asked for it.
+func (p *Parser) confirmSubscription(kind string, v *value, timestamp time.Time) {
+	count := int64(0)
+	if len(v.elements) >= 3 {
+		count = v.elements[2].integer
+	}
+	p.subscribed = count > 0
+	if e := p.confirming(); e != nil && strings.ToLower(e.Command) != kind {
+		p.endUnsubscribeAll(timestamp)
+	}
+	e := p.confirming()
+	if e == nil || strings.ToLower(e.Command) != kind {
+		return
+	}
+	e.ReplyType = typeNames[v.Type]
+	e.ReplyElements++
+	e.ReplyBytes += v.Length
+	if e.ReplyElements == e.confirmations || e.confirmations < 0 && count == 0 {
+		p.commandDone(timestamp)
+	}
+}
+
+// endUnsubscribeAll ends an UNSUBSCRIBE (or PUNSUBSCRIBE or SUNSUBSCRIBE)
+// without arguments once the next reply shows that it's had all its
+// confirmations. We can't tell how many to expect, since other kinds of
+// subscription count towards the number left.
+func (p *Parser) endUnsubscribeAll(timestamp time.Time) {
+	if e := p.confirming(); e != nil && e.confirmations < 0 && e.ReplyElements > 0 {
+		p.commandDone(timestamp)
+	}
+}
+
+// commandDone publishes an event for the oldest pending command.
+func (p *Parser) commandDone(timestamp time.Time) {
+	e := p.pending[0]
+	p.pending[0] = nil
+	p.pending = p.pending[1:]
+	e.EventType = "command"
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	if timestamp.After(e.timestamp) {
+		e.DurationMs = float64(timestamp.Sub(e.timestamp).Nanoseconds()) / 1e6
+	}
+	p.publisher.Publish(e, e.timestamp)
+	metrics.Counter("redis.commands_parsed").Add()
+}
@@ -0,0 +1,311 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// See https://redis.io/docs/latest/develop/reference/protocol-spec/
+// RESP2 types, which RESP3 also uses.
+const (
+	SIMPLE_STRING byte = '+'
+	SIMPLE_ERROR  byte = '-'
+	INTEGER       byte = ':'
+	BULK_STRING   byte = '$'
+	ARRAY         byte = '*'
+)
+
+// Types added in RESP3, which clients opt into with HELLO 3.
+const (
+	NULL            byte = '_'
+	DOUBLE          byte = ','
+	BOOLEAN         byte = '#'
+	BULK_ERROR      byte = '!'
+	VERBATIM_STRING byte = '='
+	BIG_NUMBER      byte = '('
+	MAP             byte = '%'
+	SET             byte = '~'
+	ATTRIBUTE       byte = '|'
+	PUSH            byte = '>'
+)
+
+var typeNames = map[byte]string{
+	SIMPLE_STRING:   "simple_string",
+	SIMPLE_ERROR:    "error",
+	INTEGER:         "integer",
+	BULK_STRING:     "bulk_string",
+	ARRAY:           "array",
+	NULL:            "null",
+	DOUBLE:          "double",
+	BOOLEAN:         "boolean",
+	BULK_ERROR:      "bulk_error",
+	VERBATIM_STRING: "verbatim_string",
+	BIG_NUMBER:      "big_number",
+	MAP:             "map",
+	SET:             "set",
+	PUSH:            "push",
+}
+
+// Safety constraints:
+// Don't queue more than this many pipelined commands per connection.
+const maxPendingCommands = 1024
+
+// Don't buffer more than this much of any string. Longer command names and
+// keys are truncated.
+const maxStringLength = 1024
+
+// Don't accept strings longer than this, or aggregates with more elements;
+// the server's own limit on bulk strings (proto-max-bulk-len) defaults to
+// 512MB.
+const maxLength = 1 << 30
+
+// Don't follow aggregates nested more deeply than this.
+const maxDepth = 32
+
+// Only keep summaries of this many elements of an aggregate; enough for
+// the command name and key of a request, and the kind, channel and count of
+// a pub/sub message.
+const maxElements = 3
+
+var errUnsupportedStream = errors.New("Streamed RESP3 strings and aggregates are not supported")
+
+// value summarizes a RESP value.
+type value struct {
+	Type     byte
+	Length   int     // Bytes on the wire
+	Elements int     // For aggregates, the number of elements (pairs, for maps)
+	Null     bool    // For RESP2 null bulk strings and arrays
+	str      string  // For strings and errors, up to maxStringLength bytes of the value
+	integer  int64   // For integers
+	elements []value // Up to maxElements elements of an aggregate
+}
+
+// respReader reads RESP values from a stream, counting the bytes it reads.
+type respReader struct {
+	r *bufio.Reader
+	n int
+}
+
+func newRESPReader(r *bufio.Reader) *respReader {
+	return &respReader{r: r}
+}
+
+// readValue reads the next value. Attributes are read and skipped, and
+// counted in the length of the value they precede.
+func (rr *respReader) readValue(depth int) (*value, error) {
+	if depth > maxDepth {
+		return nil, errors.New("RESP value nested too deeply")
+	}
+	start := rr.n
+	t, err := rr.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	rr.n++
+	v := value{Type: t}
+	switch t {
+	case SIMPLE_STRING, SIMPLE_ERROR, DOUBLE, BOOLEAN, BIG_NUMBER, NULL:
+		if v.str, err = rr.line(); err != nil {
+			return nil, err
+		}
+	case INTEGER:
+		line, err := rr.line()
+		if err != nil {
+			return nil, err
+		}
+		if v.integer, err = strconv.ParseInt(line, 10, 64); err != nil {
+			return nil, fmt.Errorf("Bad RESP integer %q", line)
+		}
+	case BULK_STRING, BULK_ERROR, VERBATIM_STRING:
+		length, err := rr.length()
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			v.Null = true
+			break
+		}
+		if v.str, err = rr.bulk(length); err != nil {
+			return nil, err
+		}
+	case ARRAY, MAP, SET, PUSH, ATTRIBUTE:
+		length, err := rr.length()
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			v.Null = true
+			break
+		}
+		v.Elements = length
+		n := length
+		if t == MAP || t == ATTRIBUTE {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			e, err := rr.readValue(depth + 1)
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			if len(v.elements) < maxElements {
+				v.elements = append(v.elements, *e)
+			}
+		}
+		if t == ATTRIBUTE {
+			// Attributes annotate the value that follows them.
+			next, err := rr.readValue(depth)
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			v = *next
+		}
+	default:
+		return nil, fmt.Errorf("Unknown RESP type %q", t)
+	}
+	v.Length = rr.n - start
+	return &v, nil
+}
+
+// readInlineCommand reads a command sent as a line of space-separated
+// words, as from telnet, and summarizes it as an array.
+func (rr *respReader) readInlineCommand() (*value, error) {
+	start := rr.n
+	line, err := rr.line()
+	if err != nil {
+		return nil, err
+	}
+	words := strings.Fields(line)
+	v := value{Type: ARRAY, Elements: len(words)}
+	for i, w := range words {
+		if i == maxElements {
+			break
+		}
+		v.elements = append(v.elements, value{Type: BULK_STRING, str: w})
+	}
+	v.Length = rr.n - start
+	return &v, nil
+}
+
+// line reads up to the next CRLF, returning at most maxStringLength bytes
+// of the line.
+func (rr *respReader) line() (string, error) {
+	var s []byte
+	for {
+		b, err := rr.r.ReadSlice('\n')
+		rr.n += len(b)
+		if len(s) < maxStringLength {
+			s = append(s, b...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", unexpectedEOF(err)
+		}
+		break
+	}
+	s = trimCRLF(s)
+	if len(s) > maxStringLength {
+		s = s[:maxStringLength]
+	}
+	return string(s), nil
+}
+
+// length reads the length that follows a bulk string or aggregate type.
+func (rr *respReader) length() (int, error) {
+	line, err := rr.line()
+	if err != nil {
+		return 0, err
+	}
+	if line == "?" {
+		return 0, errUnsupportedStream
+	}
+	length, err := strconv.Atoi(line)
+	if err != nil || length < -1 || length > maxLength {
+		return 0, fmt.Errorf("Bad RESP length %q", line)
+	}
+	return length, nil
+}
+
+// bulk reads a string of the given length and its trailing CRLF, returning
+// at most maxStringLength bytes of it.
+func (rr *respReader) bulk(length int) (string, error) {
+	toBuffer := length
+	if toBuffer > maxStringLength {
+		toBuffer = maxStringLength
+	}
+	b := make([]byte, toBuffer)
+	if _, err := io.ReadFull(rr.r, b); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if _, err := io.CopyN(ioutil.Discard, rr.r, int64(length-toBuffer+2)); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	rr.n += length + 2
+	return string(b), nil
+}
+
+func trimCRLF(b []byte) []byte {
+	if len(b) > 0 && b[len(b)-1] == '\n' {
+		b = b[:len(b)-1]
+	}
+	if len(b) > 0 && b[len(b)-1] == '\r' {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Commands whose first argument isn't a key, and shouldn't be reported
+// (for AUTH, HELLO and MIGRATE, because it may be a password).
+var keylessCommands = map[string]bool{
+	"AUTH": true, "HELLO": true, "PING": true, "ECHO": true, "SELECT": true,
+	"INFO": true, "MULTI": true, "EXEC": true, "DISCARD": true, "UNWATCH": true,
+	"QUIT": true, "RESET": true, "MONITOR": true, "SCAN": true, "KEYS": true,
+	"EVAL": true, "EVALSHA": true, "EVAL_RO": true, "EVALSHA_RO": true,
+	"FCALL": true, "FCALL_RO": true, "PUBLISH": true, "SPUBLISH": true,
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true,
+	"FLUSHDB": true, "FLUSHALL": true, "DBSIZE": true, "TIME": true,
+	"LASTSAVE": true, "SAVE": true, "BGSAVE": true, "BGREWRITEAOF": true,
+	"SHUTDOWN": true, "SWAPDB": true, "WAIT": true, "WAITAOF": true,
+	"REPLICAOF": true, "SLAVEOF": true, "ROLE": true, "SYNC": true,
+	"PSYNC": true, "READONLY": true, "READWRITE": true, "MIGRATE": true,
+	"BITOP": true, "XREAD": true, "XREADGROUP": true, "ZUNION": true,
+	"ZINTER": true, "ZDIFF": true, "ZINTERCARD": true, "SINTERCARD": true,
+	"LMPOP": true, "BLMPOP": true, "ZMPOP": true, "BZMPOP": true,
+	"RANDOMKEY": true, "FAILOVER": true, "LOLWUT": true,
+}
+
+// Commands with subcommands, which are reported together, as in
+// "CONFIG GET". Their arguments aren't reported as keys either.
+var containerCommands = map[string]bool{
+	"ACL": true, "CLIENT": true, "CLUSTER": true, "COMMAND": true,
+	"CONFIG": true, "DEBUG": true, "FUNCTION": true, "LATENCY": true,
+	"MEMORY": true, "MODULE": true, "OBJECT": true, "PUBSUB": true,
+	"SCRIPT": true, "SLOWLOG": true, "XGROUP": true, "XINFO": true,
+}
+
+// Pub/sub message kinds, sent as the first element of RESP2 arrays (once a
+// connection has subscribed to something) or RESP3 pushes. Confirmations of
+// subscription changes respond to SUBSCRIBE and friends, one per channel,
+// and end with the number of subscriptions the connection has left.
+var subscriptionKinds = map[string]bool{
+	"subscribe": true, "psubscribe": true, "ssubscribe": true,
+	"unsubscribe": true, "punsubscribe": true, "sunsubscribe": true,
+}
+
+var messageKinds = map[string]bool{
+	"message": true, "pmessage": true, "smessage": true,
+}
@@ -0,0 +1,353 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCommand(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genCommand("get", "user:1"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("$5\r\nalice\r\n"), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "command",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 1,
+			"command": "GET",
+			"key": "user:1",
+			"arg_count": 1,
+			"request_bytes": 25,
+			"reply_type": "bulk_string",
+			"reply_bytes": 11,
+			"error": false
+		}`, string(tp.Output[0]))
+	}
+}
+
+func TestPipelinedCommands(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genCommand("SET", "a", "1"),
+		genCommand("INCR", "a"),
+		genCommand("LRANGE", "list", "0", "-1"),
+		genCommand("GET", "missing")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("+OK\r\n:2\r\n"), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	ms.Append([]byte("*2\r\n$1\r\nx\r\n$1\r\ny\r\n$-1\r\n"), sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 4, len(events)) {
+		assert.Equal(t, "simple_string", events[0]["reply_type"])
+		assert.Equal(t, "integer", events[1]["reply_type"])
+		assert.Equal(t, float64(1), events[1]["duration_ms"])
+		assert.Equal(t, "array", events[2]["reply_type"])
+		assert.Equal(t, float64(2), events[2]["reply_elements"])
+		assert.Equal(t, float64(3), events[2]["arg_count"])
+		assert.Equal(t, "null", events[3]["reply_type"])
+		assert.Equal(t, float64(2), events[3]["duration_ms"])
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genCommand("INCR", "name"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, true, events[0]["error"])
+		assert.Equal(t, "WRONGTYPE", events[0]["error_prefix"])
+	}
+}
+
+func TestKeylessCommands(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genCommand("AUTH", "secret"),
+		genCommand("CONFIG", "get", "maxmemory")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("+OK\r\n*2\r\n$9\r\nmaxmemory\r\n$1\r\n0\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "AUTH", events[0]["command"])
+		assert.Nil(t, events[0]["key"])
+		assert.Equal(t, "CONFIG GET", events[1]["command"])
+		assert.Nil(t, events[1]["key"])
+	}
+}
+
+func TestHashKeys(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	pf := ParserFactory{
+		Options:   Options{Port: 6379, HashKeys: true},
+		Publisher: tp,
+	}
+	parser := pf.New(defaultFlow())
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genCommand("GET", "user:1"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("$-1\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "abc3a47b8ad18b855c687d9ca2c6091ee7312db5563021942a57ada889c87b34", events[0]["key"])
+	}
+}
+
+func TestInlineCommand(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append([]byte("PING\r\n"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("+PONG\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "PING", events[0]["command"])
+		assert.Equal(t, float64(0), events[0]["arg_count"])
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genCommand("MULTI"),
+		genCommand("INCR", "a"),
+		genCommand("INCR", "b"),
+		genCommand("EXEC"),
+		genCommand("GET", "a")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n:1\r\n:1\r\n$1\r\n1\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 5, len(events)) {
+		assert.Nil(t, events[0]["in_transaction"])
+		assert.Equal(t, true, events[1]["in_transaction"])
+		assert.Equal(t, true, events[2]["in_transaction"])
+		assert.Equal(t, "EXEC", events[3]["command"])
+		assert.Nil(t, events[3]["in_transaction"])
+		assert.Equal(t, float64(2), events[3]["reply_elements"])
+		assert.Nil(t, events[4]["in_transaction"])
+		assert.Equal(t, "bulk_string", events[4]["reply_type"])
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genCommand("SUBSCRIBE", "news", "weather"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genArray("subscribe", "news", 1),
+		genArray("subscribe", "weather", 2)), sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	// Messages can arrive at any time, and aren't replies to anything.
+	ms.Append(genArray("message", "news", "hello"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(concat(
+		genCommand("PING"),
+		genCommand("UNSUBSCRIBE")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genArray("message", "weather", "rain"),
+		genArray("pong", ""),
+		genArray("unsubscribe", "news", 1),
+		genArray("unsubscribe", "weather", 0)), sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	// Back to normal.
+	ms.Append(genCommand("LRANGE", "l", "0", "-1"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genArray("message", "news", "hello"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 4, len(events)) {
+		assert.Equal(t, "SUBSCRIBE", events[0]["command"])
+		assert.Equal(t, float64(2), events[0]["reply_elements"])
+		assert.Equal(t, float64(1), events[0]["duration_ms"])
+		assert.Equal(t, "PING", events[1]["command"])
+		assert.Equal(t, "array", events[1]["reply_type"])
+		assert.Equal(t, "UNSUBSCRIBE", events[2]["command"])
+		assert.Equal(t, float64(2), events[2]["reply_elements"])
+		assert.Equal(t, "LRANGE", events[3]["command"])
+		assert.Equal(t, float64(3), events[3]["reply_elements"])
+	}
+}
+
+func TestUnsubscribeAllFollowedByCommand(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genCommand("SUBSCRIBE", "news"),
+		genCommand("PSUBSCRIBE", "w*")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genArray("subscribe", "news", 1),
+		genArray("psubscribe", "w*", 2)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	// Unsubscribing from all channels leaves a pattern subscription.
+	ms.Append(concat(
+		genCommand("UNSUBSCRIBE"),
+		genCommand("PING")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genArray("unsubscribe", "news", 1),
+		genArray("pong", "")), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 4, len(events)) {
+		assert.Equal(t, "UNSUBSCRIBE", events[2]["command"])
+		assert.Equal(t, float64(1), events[2]["reply_elements"])
+		assert.Equal(t, "PING", events[3]["command"])
+	}
+}
+
+func TestRESP3(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genCommand("HELLO", "3"),
+		genCommand("HGETALL", "h"),
+		genCommand("SUBSCRIBE", "news"),
+		genCommand("GET", "missing")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte(
+		"%1\r\n+server\r\n+redis\r\n"+
+			"|1\r\n+ttl\r\n:3600\r\n%1\r\n$1\r\nf\r\n,1.5\r\n"+
+			">3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n"+
+			">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n"+
+			"_\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 4, len(events)) {
+		assert.Equal(t, "map", events[0]["reply_type"])
+		assert.Equal(t, "map", events[1]["reply_type"])
+		assert.Equal(t, float64(1), events[1]["reply_elements"])
+		assert.Equal(t, "push", events[2]["reply_type"])
+		assert.Equal(t, "null", events[3]["reply_type"])
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genCommand("MONITOR"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("+OK\r\n+1339518083.107412 [0 127.0.0.1:60866] \"keys\" \"*\"\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	assert.Equal(t, 1, len(tp.Output))
+}
+
+func TestResyncAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genCommand("GET", "a"), sniffertest.DefaultDate(), defaultFlow())
+	ms.AppendSkipped([]byte("lo\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse(), 100)
+	ms.Append(genCommand("GET", "b"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("$1\r\nb\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "b", events[0]["key"])
+	}
+}
+
+func TestTooManyPendingCommands(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	var commands []byte
+	for i := 0; i < maxPendingCommands+2; i++ {
+		commands = append(commands, genCommand("GET", "a")...)
+	}
+	ms.Append(commands, sniffertest.DefaultDate(), defaultFlow())
+	// The reply to the first command isn't attributed to the last.
+	ms.Append([]byte("$1\r\na\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genCommand("GET", "b"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append([]byte("$1\r\nb\r\n"), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "b", events[0]["key"])
+	}
+}
+
+func TestReadLongValues(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	b := concat(
+		[]byte("$10000\r\n"+long+"\r\n"),
+		[]byte("+"+long+"\r\n"))
+	rr := newRESPReader(bufio.NewReader(bytes.NewReader(b)))
+	v, err := rr.readValue(0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, maxStringLength, len(v.str))
+		assert.Equal(t, 10010, v.Length)
+	}
+	v, err = rr.readValue(0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, maxStringLength, len(v.str))
+		assert.Equal(t, 10003, v.Length)
+	}
+	_, err = rr.readValue(0)
+	assert.Equal(t, io.EOF, err)
+
+	nested := strings.Repeat("*1\r\n", maxDepth+2) + ":1\r\n"
+	rr = newRESPReader(bufio.NewReader(strings.NewReader(nested)))
+	_, err = rr.readValue(0)
+	assert.Error(t, err)
+}
+
+func genCommand(args ...string) []byte {
+	b := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, a := range args {
+		b = append(b, fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)...)
+	}
+	return b
+}
+
+// genArray encodes a RESP2 array of bulk strings and integers.
+func genArray(elements ...interface{}) []byte {
+	b := []byte(fmt.Sprintf("*%d\r\n", len(elements)))
+	for _, e := range elements {
+		switch v := e.(type) {
+		case string:
+			b = append(b, fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)...)
+		case int:
+			b = append(b, fmt.Sprintf(":%d\r\n", v)...)
+		}
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(6379)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		Options:   Options{Port: 6379},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
@@ -0,0 +1,585 @@
+// Package tds parses TDS (Tabular Data Stream), the protocol Microsoft SQL
+// Server speaks. Messages are split into packets, which are reassembled
+// before parsing. A connection has at most one request outstanding (we
+// don't support MARS, which multiplexes several), so each response belongs
+// to the last request.
+//
+// Unless a connection is fully encrypted, TLS is often used just for the
+// login, with the handshake carried in PRELOGIN packets. We then don't know
+// the user or application name, and only learn the database from the
+// server's notifications.
+package tds
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Port           uint16 `long:"port" description:"SQL Server port" default:"1433"`
+	MaxMessageSize int    `long:"max_message_size" description:"Maximum number of bytes of a single TDS message to buffer per connection; longer queries are truncated" default:"1048576"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if flow.DstPort != pf.Options.Port {
+		flow = flow.Reverse()
+	}
+	return &Parser{
+		options:    pf.Options,
+		flow:       flow,
+		statements: make(map[int32]string),
+		logger:     logging.NewLogger(logrus.Fields{"flow": flow, "component": "tds"}),
+		publisher:  pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	return fmt.Sprintf("tcp port %d", pf.Options.Port)
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	options Options
+	flow    sniffer.IPPortTuple
+	client  messageAssembler
+	server  messageAssembler
+	pending *Event // The request awaiting a response
+	// The major and minor TDS version (e.g. 0x74 for 7.4), once we've seen
+	// the login.
+	version byte
+	// Whether the login is encrypted, or the whole connection, in which
+	// case we give up.
+	loginEncrypted bool
+	encrypted      bool
+	mars           bool // Whether we've given up because of MARS
+	// From the login, or for the database, the server's notifications.
+	user            string
+	database        string
+	applicationName string
+	hostName        string
+	statements      map[int32]string // Prepared statement queries, by handle
+	tls             *tls.Connection
+	logger          *logging.Logger
+	publisher       publish.Publisher
+}
+
+// Event describes a SQL batch or RPC call and its response.
+type Event struct {
+	EventType       string  `json:"event_type"`
+	ClientIP        string  `json:"client_ip"`
+	ServerIP        string  `json:"server_ip"`
+	DurationMs      float64 `json:"duration_ms"`
+	User            string  `json:"user,omitempty"`
+	Database        string  `json:"database,omitempty"`
+	ApplicationName string  `json:"application_name,omitempty"`
+	HostName        string  `json:"host_name,omitempty"`
+	// "sql_batch", "rpc", "bulk_load" or "transaction_manager".
+	RequestType string `json:"request_type"`
+	// The stored procedure an RPC request calls, e.g. "sp_executesql".
+	Procedure string `json:"procedure,omitempty"`
+	// The text of a SQL batch, or the statement passed to sp_executesql,
+	// sp_prepexec and the like, or run by sp_execute, if it was prepared on
+	// the same connection.
+	Query string `json:"query"`
+	// The sum of the row counts of the response's statements.
+	RowsAffected uint64 `json:"rows_affected"`
+	RowsSent     int    `json:"rows_sent"`
+	// Whether the client cancelled the request.
+	Cancelled bool `json:"cancelled,omitempty"`
+	// Whether the request or response was longer than max_message_size,
+	// so that the query or the number of rows sent may be incomplete.
+	Truncated     bool   `json:"truncated,omitempty"`
+	Error         bool   `json:"error"`
+	ErrorNumber   int    `json:"error_number,omitempty"`
+	ErrorSeverity int    `json:"error_severity,omitempty"`
+	ErrorMessage  string `json:"error_message,omitempty"`
+	// The prepared statement handle a prepare returned.
+	preparedHandle    int32
+	hasPreparedHandle bool
+	final             bool // Whether we've seen the final DONE token
+	internal          bool // Whether the request is part of the login
+	timestamp         time.Time
+}
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
+			return
+		}
+		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		if p.encrypted || p.mars {
+			io.Copy(ioutil.Discard, m)
+			continue
+		}
+		a := &p.server
+		if toServer {
+			a = &p.client
+		}
+		if m.Skipped() > 0 {
+			// The message most likely starts partway through a packet;
+			// the next one in this direction should start afresh.
+			p.desynchronize(a, "skipped bytes")
+			io.Copy(ioutil.Discard, m)
+			continue
+		}
+		br := bufio.NewReader(m)
+		if toServer && a.idle() {
+			// TDS 8.0 connections start with a TLS handshake, outside
+			// of TDS packets.
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				p.logger.Debug("Connection uses TLS", logrus.Fields{})
+				p.pending = nil
+				p.tls = tls.NewConnection("tds", p.flow, m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), toServer)
+				continue
+			}
+		}
+		err := p.parseMessages(a, br, m.Timestamp(), toServer)
+		if err == errMARS {
+			p.logger.Debug("Connection uses MARS", logrus.Fields{})
+			metrics.Counter("tds.mars_connections").Add()
+			p.mars = true
+			p.pending = nil
+			io.Copy(ioutil.Discard, br)
+		} else if err != io.EOF {
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("tds.parse_errors").Add()
+			p.desynchronize(a, err.Error())
+			io.Copy(ioutil.Discard, br)
+		}
+	}
+}
+
+// desynchronize forgets about any partial message in one direction once we
+// can no longer tell where packets start.
+func (p *Parser) desynchronize(a *messageAssembler, reason string) {
+	p.logger.Debug("Stream desynchronized", logrus.Fields{"reason": reason})
+	metrics.Counter("tds.desyncs").Add()
+	a.reset()
+}
+
+func (p *Parser) parseMessages(a *messageAssembler, r io.Reader, timestamp time.Time, toServer bool) error {
+	for {
+		m, err := a.next(r, p.options.MaxMessageSize, timestamp)
+		if err != nil {
+			return err
+		}
+		p.logger.Debug("Parsed message", logrus.Fields{
+			"type":     m.Type,
+			"length":   m.Length,
+			"toServer": toServer})
+		if toServer {
+			p.parseRequest(m)
+		} else {
+			p.parseResponse(m, timestamp)
+		}
+		if p.encrypted {
+			return io.EOF
+		}
+	}
+}
+
+// wide reports whether the connection uses TDS 7.2 or later. We assume so
+// if we missed the login.
+func (p *Parser) wide() bool {
+	return p.version == 0 || p.version >= tdsVersion72
+}
+
+func (p *Parser) newEvent(m *message) *Event {
+	return &Event{
+		User:            p.user,
+		Database:        p.database,
+		ApplicationName: p.applicationName,
+		HostName:        p.hostName,
+		RequestType:     requestTypes[m.Type],
+		Truncated:       m.Truncated,
+		timestamp:       m.timestamp,
+	}
+}
+
+func (p *Parser) parseRequest(m *message) {
+	var e *Event
+	var err error
+	switch m.Type {
+	case PACKET_PRELOGIN:
+		if len(m.body) > 0 && m.body[0] == tlsHandshake {
+			// The client's side of a TLS handshake, so the login that
+			// follows is encrypted.
+			p.loginEncrypted = true
+			return
+		}
+		e = &Event{RequestType: "prelogin", internal: true}
+	case packetTLSRecord:
+		if !p.loginEncrypted {
+			return
+		}
+		e = &Event{RequestType: "login", internal: true}
+	case PACKET_LOGIN7:
+		p.parseLogin(m)
+		e = &Event{RequestType: "login", internal: true}
+	case PACKET_SQL_BATCH:
+		e = p.newEvent(m)
+		e.Query = ucs2(skipAllHeaders(m.body))
+	case PACKET_RPC:
+		e = p.newEvent(m)
+		err = p.parseRPC(m, e)
+	case PACKET_BULK_LOAD, PACKET_TRANSACTION_MANAGER:
+		e = p.newEvent(m)
+	case PACKET_ATTENTION:
+		if p.pending != nil {
+			p.pending.Cancelled = true
+		}
+		return
+	default:
+		return
+	}
+	if err != nil {
+		p.logger.Debug("Error parsing request", logrus.Fields{"error": err})
+		metrics.Counter("tds.parse_errors").Add()
+	}
+	if p.pending != nil && !p.pending.internal {
+		p.logger.Debug("Request without response", logrus.Fields{
+			"requestType": p.pending.RequestType})
+	}
+	p.pending = e
+}
+
+// parseLogin reads the names in a LOGIN7 message.
+func (p *Parser) parseLogin(m *message) {
+	b := m.body
+	if len(b) < login7MinFixedLength {
+		return
+	}
+	// The version is little-endian, with the major and minor version in
+	// the last byte.
+	p.version = b[login7TDSVersion+3]
+	field := func(offset int) string {
+		start := int(binary.LittleEndian.Uint16(b[offset:]))
+		end := start + 2*int(binary.LittleEndian.Uint16(b[offset+2:]))
+		if end > len(b) {
+			return ""
+		}
+		return ucs2(b[start:end])
+	}
+	p.hostName = field(login7HostName)
+	p.user = field(login7UserName)
+	p.applicationName = field(login7AppName)
+	p.database = field(login7Database)
+}
+
+// parseRPC reads the procedure an RPC request calls, and the statement it
+// runs, for procedures that take one. A request can call several
+// procedures; we only read the first.
+func (p *Parser) parseRPC(m *message, e *Event) error {
+	r := newReader(skipAllHeaders(m.body), m.Truncated, p.wide())
+	if n := r.Uint16(); n == 0xFFFF {
+		id := r.Uint16()
+		e.Procedure = procNames[id]
+		if e.Procedure == "" {
+			e.Procedure = fmt.Sprintf("%d", id)
+		}
+	} else {
+		e.Procedure = ucs2(r.take(2 * int(n)))
+	}
+	r.Uint16() // option flags
+	procedure := strings.ToLower(e.Procedure)
+	if procedure == "sp_execute" || procedure == "sp_cursorexecute" {
+		// The first parameter is the prepared statement's handle.
+		v := readParameter(r, true)
+		if r.err == nil && len(v) == 4 {
+			e.Query = p.statements[int32(binary.LittleEndian.Uint32(v))]
+		}
+		return r.Err()
+	}
+	index, ok := statementParams[procedure]
+	if !ok {
+		return r.Err()
+	}
+	for i := 0; i < index && r.err == nil; i++ {
+		readParameter(r, false)
+	}
+	r.BVarchar() // name
+	r.Byte()     // status flags
+	if t := r.TypeInfo(); t.isText() {
+		e.Query = r.Text(t)
+	}
+	return r.Err()
+}
+
+// readParameter reads an RPC parameter, returning its value if keep is
+// true.
+func readParameter(r *reader, keep bool) []byte {
+	r.BVarchar() // name
+	r.Byte()     // status flags
+	return r.Value(r.TypeInfo(), false, keep)
+}
+
+func (p *Parser) parseResponse(m *message, timestamp time.Time) {
+	if m.Type != PACKET_TABULAR_RESULT {
+		// Probably the server's side of a TLS handshake.
+		return
+	}
+	e := p.pending
+	if e == nil {
+		// The acknowledgement of an attention, or the response to a
+		// request we missed.
+		return
+	}
+	p.pending = nil
+	if e.RequestType == "prelogin" {
+		p.parsePrelogin(m)
+		return
+	}
+	if m.Truncated {
+		e.Truncated = true
+	}
+	r := newReader(m.body, m.Truncated, p.wide())
+	p.readTokens(r, e)
+	if !e.final && len(m.tail) > 0 {
+		// The response was truncated; the DONE token at the end still
+		// tells us whether the request succeeded.
+		readFinalDone(m.tail, p.wide(), e)
+	}
+	if err := r.Err(); err != nil {
+		p.logger.Debug("Error parsing response", logrus.Fields{"error": err})
+		metrics.Counter("tds.parse_errors").Add()
+	}
+	if e.hasPreparedHandle && e.Query != "" && len(p.statements) < maxStatements {
+		p.statements[e.preparedHandle] = e.Query
+	}
+	if !e.internal {
+		p.requestDone(e, timestamp)
+	}
+}
+
+// parsePrelogin reads the server's PRELOGIN response, which decides whether
+// the connection is encrypted.
+func (p *Parser) parsePrelogin(m *message) {
+	b := m.body
+	for i := 0; i+5 <= len(b) && b[i] != PRELOGIN_TERMINATOR; i += 5 {
+		if b[i] != PRELOGIN_ENCRYPTION {
+			continue
+		}
+		offset := int(binary.BigEndian.Uint16(b[i+1:]))
+		if offset >= len(b) {
+			return
+		}
+		if b[offset] == ENCRYPT_ON || b[offset] == ENCRYPT_REQ {
+			p.logger.Debug("Connection is encrypted", logrus.Fields{})
+			metrics.Counter("tds.encrypted_connections").Add()
+			p.encrypted = true
+		}
+		return
+	}
+}
+
+// readTokens reads the tokens in a response. It has to parse the metadata
+// of result sets to know the length of their rows.
+func (p *Parser) readTokens(r *reader, e *Event) {
+	var columns []typeInfo
+	for len(r.b) > 0 && r.err == nil {
+		token := r.Byte()
+		switch token {
+		case TOKEN_COLMETADATA:
+			columns = readColumnMetadata(r)
+		case TOKEN_ROW:
+			for _, c := range columns {
+				r.Value(c, true, false)
+			}
+			if r.err == nil {
+				e.RowsSent++
+			}
+		case TOKEN_NBCROW:
+			nulls := r.take((len(columns) + 7) / 8)
+			for i, c := range columns {
+				if i/8 < len(nulls) && nulls[i/8]&(1<<uint(i%8)) != 0 {
+					continue
+				}
+				r.Value(c, true, false)
+			}
+			if r.err == nil {
+				e.RowsSent++
+			}
+		case TOKEN_DONE, TOKEN_DONEPROC, TOKEN_DONEINPROC:
+			readDone(r, token, e)
+		case TOKEN_ERROR:
+			readError(newReader(r.take(int(r.Uint16())), false, r.wide), e)
+		case TOKEN_ENVCHANGE:
+			sub := newReader(r.take(int(r.Uint16())), false, r.wide)
+			if sub.Byte() == ENVCHANGE_DATABASE {
+				if database := sub.BVarchar(); sub.err == nil {
+					p.database = database
+				}
+			}
+		case TOKEN_LOGINACK:
+			sub := newReader(r.take(int(r.Uint16())), false, r.wide)
+			sub.Byte() // interface
+			if version := sub.Byte(); sub.err == nil {
+				// Big-endian, unlike in LOGIN7.
+				p.version = version
+				r.wide = p.wide()
+			}
+		case TOKEN_RETURNVALUE:
+			readReturnValue(r, e)
+		case TOKEN_INFO, TOKEN_ORDER, TOKEN_COLINFO, TOKEN_TABNAME, TOKEN_SSPI:
+			r.Skip(int(r.Uint16()))
+		case TOKEN_SESSIONSTATE, TOKEN_FEDAUTHINFO:
+			r.Skip(int(r.Uint32()))
+		case TOKEN_FEATUREEXTACK:
+			for r.err == nil && r.Byte() != 0xFF {
+				r.Skip(int(r.Uint32()))
+			}
+		case TOKEN_RETURNSTATUS, TOKEN_OFFSET:
+			r.Skip(4)
+		default:
+			r.err = fmt.Errorf("Unsupported token 0x%02x", token)
+		}
+	}
+}
+
+func readColumnMetadata(r *reader) []typeInfo {
+	n := int(r.Uint16())
+	if n == 0xFFFF {
+		// No metadata.
+		return nil
+	}
+	if n > maxColumns {
+		r.err = fmt.Errorf("Too many columns (%d)", n)
+		return nil
+	}
+	columns := make([]typeInfo, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		if r.wide {
+			r.Uint32() // user type
+		} else {
+			r.Uint16()
+		}
+		r.Uint16() // flags
+		t := r.TypeInfo()
+		if t.hasTableName() {
+			parts := 1
+			if r.wide {
+				parts = int(r.Byte())
+			}
+			for j := 0; j < parts; j++ {
+				r.USVarchar()
+			}
+		}
+		r.BVarchar() // column name
+		columns = append(columns, t)
+	}
+	return columns
+}
+
+func readDone(r *reader, token byte, e *Event) {
+	status := r.Uint16()
+	r.Uint16() // current command
+	count := r.RowCount()
+	if r.err != nil {
+		return
+	}
+	// DONEPROC's count repeats those of the statements in the procedure.
+	if status&DONE_COUNT != 0 && token != TOKEN_DONEPROC {
+		e.RowsAffected += count
+	}
+	if status&DONE_ERROR != 0 {
+		e.Error = true
+	}
+	if status&DONE_ATTN != 0 {
+		e.Cancelled = true
+	}
+	if status&DONE_MORE == 0 && token != TOKEN_DONEINPROC {
+		e.final = true
+	}
+}
+
+// readFinalDone reads the DONE or DONEPROC token at the end of a truncated
+// response. Its row count only covers the last statement.
+func readFinalDone(tail []byte, wide bool, e *Event) {
+	length := doneLength
+	if !wide {
+		length = doneLengthPre72
+	}
+	if len(tail) < length+1 {
+		return
+	}
+	b := tail[len(tail)-length-1:]
+	if b[0] == TOKEN_DONE || b[0] == TOKEN_DONEPROC {
+		readDone(newReader(b[1:], false, wide), b[0], e)
+	}
+}
+
+func readError(r *reader, e *Event) {
+	number := r.Uint32()
+	r.Byte() // state
+	class := r.Byte()
+	message := r.USVarchar()
+	if r.err != nil || e.ErrorNumber != 0 {
+		return
+	}
+	e.Error = true
+	e.ErrorNumber = int(number)
+	e.ErrorSeverity = int(class)
+	e.ErrorMessage = message
+}
+
+// readReturnValue reads an RPC output parameter; the first parameter of the
+// procedures that prepare statements returns the statement's handle.
+func readReturnValue(r *reader, e *Event) {
+	ordinal := r.Uint16()
+	r.BVarchar() // name
+	r.Byte()     // status
+	if r.wide {
+		r.Uint32() // user type
+	} else {
+		r.Uint16()
+	}
+	r.Uint16() // flags
+	t := r.TypeInfo()
+	v := r.Value(t, false, true)
+	if r.err == nil && ordinal == 0 && len(v) == 4 && preparingProcedures[strings.ToLower(e.Procedure)] {
+		e.preparedHandle = int32(binary.LittleEndian.Uint32(v))
+		e.hasPreparedHandle = true
+	}
+}
+
+// requestDone publishes an event for a request once its response has
+// arrived.
+func (p *Parser) requestDone(e *Event, timestamp time.Time) {
+	e.EventType = "request"
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	if timestamp.After(e.timestamp) {
+		e.DurationMs = float64(timestamp.Sub(e.timestamp).Nanoseconds()) / 1e6
+	}
+	p.publisher.Publish(e, e.timestamp)
+	metrics.Counter("tds.requests_parsed").Add()
+}
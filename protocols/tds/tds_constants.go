@@ -0,0 +1,697 @@
+package tds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+	"unicode/utf16"
+)
+
+// See https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-tds/
+const packetHeaderLength = 8
+
+// Packet types
+const (
+	PACKET_SQL_BATCH           byte = 0x01
+	PACKET_RPC                 byte = 0x03
+	PACKET_TABULAR_RESULT      byte = 0x04
+	PACKET_ATTENTION           byte = 0x06
+	PACKET_BULK_LOAD           byte = 0x07
+	PACKET_FEDAUTH_TOKEN       byte = 0x08
+	PACKET_TRANSACTION_MANAGER byte = 0x0E
+	PACKET_LOGIN7              byte = 0x10
+	PACKET_SSPI                byte = 0x11
+	PACKET_PRELOGIN            byte = 0x12
+)
+
+// packetTLSRecord stands in for the type of TLS records sent outside of TDS
+// packets, which is how a LOGIN7 message is sent when only the login is
+// encrypted. TLS record types (20 to 23) don't clash with packet types.
+const packetTLSRecord byte = 0xFF
+
+const (
+	tlsRecordHeaderLength = 5
+	tlsRecordTypeMin      = 0x14
+	tlsRecordTypeMax      = 0x17
+	tlsHandshake          = 0x16
+)
+
+// Connections using MARS (Multiple Active Result Sets) multiplex sessions
+// with SMP (Session Multiplex Protocol) headers, which start with this.
+const smpID = 0x53
+
+// Packet status flags
+const STATUS_EOM byte = 0x01
+
+// PRELOGIN options
+const (
+	PRELOGIN_ENCRYPTION byte = 0x01
+	PRELOGIN_TERMINATOR byte = 0xFF
+)
+
+// Values of the PRELOGIN ENCRYPTION option
+const (
+	ENCRYPT_OFF     byte = 0x00 // Only the login is encrypted
+	ENCRYPT_ON      byte = 0x01
+	ENCRYPT_NOT_SUP byte = 0x02
+	ENCRYPT_REQ     byte = 0x03
+)
+
+// Offsets of fields in the fixed part of a LOGIN7 message. Variable-length
+// fields are described by an offset and a length in characters.
+const (
+	login7TDSVersion     = 4
+	login7HostName       = 36
+	login7UserName       = 40
+	login7AppName        = 48
+	login7Database       = 68
+	login7MinFixedLength = 72
+)
+
+// The first version of TDS (7.2, SQL Server 2005) with 64-bit row counts,
+// four-byte column user types, and ALL_HEADERS in SQLBatch and RPC messages.
+const tdsVersion72 = 0x72
+
+// Tokens in tabular result streams
+const (
+	TOKEN_OFFSET             byte = 0x78
+	TOKEN_RETURNSTATUS       byte = 0x79
+	TOKEN_COLMETADATA        byte = 0x81
+	TOKEN_ALTMETADATA        byte = 0x88
+	TOKEN_DATACLASSIFICATION byte = 0xA3
+	TOKEN_TABNAME            byte = 0xA4
+	TOKEN_COLINFO            byte = 0xA5
+	TOKEN_ORDER              byte = 0xA9
+	TOKEN_ERROR              byte = 0xAA
+	TOKEN_INFO               byte = 0xAB
+	TOKEN_RETURNVALUE        byte = 0xAC
+	TOKEN_LOGINACK           byte = 0xAD
+	TOKEN_FEATUREEXTACK      byte = 0xAE
+	TOKEN_ROW                byte = 0xD1
+	TOKEN_NBCROW             byte = 0xD2
+	TOKEN_ALTROW             byte = 0xD3
+	TOKEN_ENVCHANGE          byte = 0xE3
+	TOKEN_SESSIONSTATE       byte = 0xE4
+	TOKEN_SSPI               byte = 0xED
+	TOKEN_FEDAUTHINFO        byte = 0xEE
+	TOKEN_DONE               byte = 0xFD
+	TOKEN_DONEPROC           byte = 0xFE
+	TOKEN_DONEINPROC         byte = 0xFF
+)
+
+// DONE token status flags
+const (
+	DONE_MORE  uint16 = 0x0001
+	DONE_ERROR uint16 = 0x0002
+	DONE_COUNT uint16 = 0x0010
+	DONE_ATTN  uint16 = 0x0020
+)
+
+// The length of a DONE, DONEPROC or DONEINPROC token, after its type.
+const (
+	doneLength      = 12
+	doneLengthPre72 = 8
+)
+
+// ENVCHANGE types
+const ENVCHANGE_DATABASE byte = 1
+
+// Data types
+const (
+	TYPE_NULL            byte = 0x1F
+	TYPE_INT1            byte = 0x30
+	TYPE_BIT             byte = 0x32
+	TYPE_INT2            byte = 0x34
+	TYPE_INT4            byte = 0x38
+	TYPE_DATETIM4        byte = 0x3A
+	TYPE_FLT4            byte = 0x3B
+	TYPE_MONEY           byte = 0x3C
+	TYPE_DATETIME        byte = 0x3D
+	TYPE_FLT8            byte = 0x3E
+	TYPE_MONEY4          byte = 0x7A
+	TYPE_INT8            byte = 0x7F
+	TYPE_GUID            byte = 0x24
+	TYPE_VARBINARY       byte = 0x25
+	TYPE_INTN            byte = 0x26
+	TYPE_DATEN           byte = 0x28
+	TYPE_TIMEN           byte = 0x29
+	TYPE_DATETIME2N      byte = 0x2A
+	TYPE_DATETIMEOFFSETN byte = 0x2B
+	TYPE_BINARY          byte = 0x2D
+	TYPE_BITN            byte = 0x68
+	TYPE_DECIMALN        byte = 0x6A
+	TYPE_NUMERICN        byte = 0x6C
+	TYPE_FLTN            byte = 0x6D
+	TYPE_MONEYN          byte = 0x6E
+	TYPE_DATETIMN        byte = 0x6F
+	TYPE_IMAGE           byte = 0x22
+	TYPE_TEXT            byte = 0x23
+	TYPE_SSVARIANT       byte = 0x62
+	TYPE_NTEXT           byte = 0x63
+	TYPE_BIGVARBINARY    byte = 0xA5
+	TYPE_BIGVARCHAR      byte = 0xA7
+	TYPE_BIGBINARY       byte = 0xAD
+	TYPE_BIGCHAR         byte = 0xAF
+	TYPE_NVARCHAR        byte = 0xE7
+	TYPE_NCHAR           byte = 0xEF
+	TYPE_UDT             byte = 0xF0
+	TYPE_XML             byte = 0xF1
+	collationLength           = 5
+)
+
+var fixedLengthTypes = map[byte]int{
+	TYPE_NULL:     0,
+	TYPE_INT1:     1,
+	TYPE_BIT:      1,
+	TYPE_INT2:     2,
+	TYPE_INT4:     4,
+	TYPE_DATETIM4: 4,
+	TYPE_FLT4:     4,
+	TYPE_MONEY:    8,
+	TYPE_DATETIME: 8,
+	TYPE_FLT8:     8,
+	TYPE_MONEY4:   4,
+	TYPE_INT8:     8,
+}
+
+// The stored procedures RPC requests can name by ID rather than by name.
+var procNames = map[uint16]string{
+	1:  "sp_cursor",
+	2:  "sp_cursoropen",
+	3:  "sp_cursorprepare",
+	4:  "sp_cursorexecute",
+	5:  "sp_cursorprepexec",
+	6:  "sp_cursorunprepare",
+	7:  "sp_cursorfetch",
+	8:  "sp_cursoroption",
+	9:  "sp_cursorclose",
+	10: "sp_executesql",
+	11: "sp_prepare",
+	12: "sp_execute",
+	13: "sp_prepexec",
+	14: "sp_prepexecrpc",
+	15: "sp_unprepare",
+}
+
+// The position of the parameter holding the statement text, for the system
+// stored procedures that take one.
+var statementParams = map[string]int{
+	"sp_cursoropen":     1,
+	"sp_cursorprepare":  2,
+	"sp_cursorprepexec": 3,
+	"sp_executesql":     0,
+	"sp_prepare":        2,
+	"sp_prepexec":       2,
+}
+
+// The stored procedures that prepare statements, returning their handles.
+var preparingProcedures = map[string]bool{
+	"sp_cursorprepare":  true,
+	"sp_cursorprepexec": true,
+	"sp_prepare":        true,
+	"sp_prepexec":       true,
+}
+
+var requestTypes = map[byte]string{
+	PACKET_SQL_BATCH:           "sql_batch",
+	PACKET_RPC:                 "rpc",
+	PACKET_BULK_LOAD:           "bulk_load",
+	PACKET_TRANSACTION_MANAGER: "transaction_manager",
+}
+
+// Safety constraints:
+// Don't remember more than this many prepared statement handles per
+// connection.
+const maxStatements = 1024
+
+// Don't accept more columns than this in a result set; SQL Server allows
+// at most 4096.
+const maxColumns = 4096
+
+// The number of bytes at the end of a truncated message to keep, which is
+// enough for the final DONE token.
+const tailLength = doneLength + 1
+
+var errUnsupportedType = errors.New("Unsupported data type")
+
+// message is a TDS message, reassembled from its packets.
+type message struct {
+	Type      byte
+	Length    int  // Total length of the packets' data
+	Truncated bool // Whether body holds only a prefix of the data
+	body      []byte
+	tail      []byte // The end of the data, if it's truncated
+	timestamp time.Time
+}
+
+// messageAssembler reads messages from one direction of a connection. A
+// message is split into packets, and packets are split across the sniffer's
+// messages, so the assembler keeps the start of an incomplete message until
+// the rest arrives.
+type messageAssembler struct {
+	header    [packetHeaderLength]byte
+	headerLen int  // How much of the current packet's header has arrived
+	inPacket  bool // Whether the header has all arrived
+	eom       bool // Whether the current packet ends its message
+	remaining int  // Bytes of the current packet still to arrive
+	message   *message
+	body      bytes.Buffer
+	tail      tailBuffer
+	start     time.Time // When the message started to arrive
+}
+
+// next reads the rest of the current message from r, buffering at most
+// maxLength bytes of it. It returns io.EOF if r runs out first.
+func (a *messageAssembler) next(r io.Reader, maxLength int, timestamp time.Time) (*message, error) {
+	for {
+		if !a.inPacket {
+			if err := a.readHeader(r, timestamp); err != nil {
+				return nil, err
+			}
+		}
+		limit := maxLength
+		if a.message.Type == packetTLSRecord {
+			limit = 0
+		}
+		for a.remaining > 0 {
+			toBuffer := limit - a.body.Len()
+			if toBuffer > a.remaining {
+				toBuffer = a.remaining
+			}
+			var n int64
+			var err error
+			if toBuffer > 0 {
+				// Copying into a bytes.Buffer grows it as data actually
+				// arrives, rather than allocating based on the declared
+				// length up front.
+				n, err = io.CopyN(&a.body, r, int64(toBuffer))
+			} else if a.message.Type == packetTLSRecord {
+				n, err = io.CopyN(ioutil.Discard, r, int64(a.remaining))
+			} else {
+				n, err = io.CopyN(&a.tail, r, int64(a.remaining))
+			}
+			a.remaining -= int(n)
+			a.message.Length += int(n)
+			if err != nil {
+				return nil, err
+			}
+		}
+		a.inPacket = false
+		a.headerLen = 0
+		if a.eom {
+			m := a.message
+			m.body = append([]byte(nil), a.body.Bytes()...)
+			m.Truncated = len(m.body) < m.Length
+			if m.Truncated {
+				m.tail = a.tail.Bytes()
+			}
+			a.reset()
+			return m, nil
+		}
+	}
+}
+
+func (a *messageAssembler) readHeader(r io.Reader, timestamp time.Time) error {
+	if a.headerLen == 0 {
+		if _, err := io.ReadFull(r, a.header[:1]); err != nil {
+			return err
+		}
+		a.headerLen = 1
+		if a.message == nil {
+			a.start = timestamp
+		}
+	}
+	want := packetHeaderLength
+	if a.header[0] == smpID {
+		return errMARS
+	} else if isTLSRecord(a.header[0]) {
+		want = tlsRecordHeaderLength
+	}
+	n, err := io.ReadFull(r, a.header[a.headerLen:want])
+	a.headerLen += n
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	} else if err != nil {
+		return err
+	}
+	var packetType byte
+	var length int
+	if want == tlsRecordHeaderLength {
+		packetType = packetTLSRecord
+		length = int(binary.BigEndian.Uint16(a.header[3:5]))
+		a.eom = true
+	} else {
+		packetType = a.header[0]
+		length = int(binary.BigEndian.Uint16(a.header[2:4])) - packetHeaderLength
+		a.eom = a.header[1]&STATUS_EOM != 0
+		if packetType == 0 || packetType > PACKET_PRELOGIN || length < 0 {
+			return fmt.Errorf("Bad packet header % x", a.header)
+		}
+	}
+	if a.message == nil {
+		a.message = &message{Type: packetType, timestamp: a.start}
+	} else if a.message.Type != packetType {
+		return fmt.Errorf("Packet type changed from %d to %d within a message", a.message.Type, packetType)
+	}
+	a.inPacket = true
+	a.remaining = length
+	return nil
+}
+
+func isTLSRecord(b byte) bool {
+	return b >= tlsRecordTypeMin && b <= tlsRecordTypeMax
+}
+
+var errMARS = errors.New("MARS connections are not supported")
+
+// idle reports whether no message is partway through arriving.
+func (a *messageAssembler) idle() bool {
+	return a.headerLen == 0 && a.message == nil
+}
+
+func (a *messageAssembler) reset() {
+	a.headerLen = 0
+	a.inPacket = false
+	a.remaining = 0
+	a.message = nil
+	a.body.Reset()
+	a.tail.Reset()
+}
+
+// tailBuffer is an io.Writer that keeps the last tailLength bytes written
+// to it.
+type tailBuffer struct {
+	b []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	if len(p) >= tailLength {
+		t.b = append(t.b[:0], p[len(p)-tailLength:]...)
+		return len(p), nil
+	}
+	t.b = append(t.b, p...)
+	if len(t.b) > tailLength {
+		t.b = append(t.b[:0], t.b[len(t.b)-tailLength:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) Bytes() []byte {
+	return append([]byte(nil), t.b...)
+}
+
+func (t *tailBuffer) Reset() {
+	t.b = t.b[:0]
+}
+
+// skipAllHeaders returns the data of a SQLBatch or RPC message without its
+// ALL_HEADERS, which TDS 7.2 and later put first. Rather than rely on having
+// seen the login to know the version, it checks that the headers' lengths
+// add up, which text and procedure names in UCS-2 won't.
+func skipAllHeaders(b []byte) []byte {
+	if len(b) < 4 {
+		return b
+	}
+	total := int(binary.LittleEndian.Uint32(b))
+	if total < 4 || total > len(b) {
+		return b
+	}
+	for i := 4; i < total; {
+		if total-i < 6 {
+			return b
+		}
+		length := int(binary.LittleEndian.Uint32(b[i:]))
+		if length < 6 || i+length > total {
+			return b
+		}
+		i += length
+	}
+	return b[total:]
+}
+
+// ucs2 decodes little-endian UTF-16, in which TDS sends strings.
+func ucs2(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+var errTruncated = errors.New("Truncated message")
+
+// reader wraps a message with convenience functions for parsing TDS's
+// little-endian types. Like the Postgres parser's reader, it stores the
+// first error it encounters, and callers must check reader.Err().
+type reader struct {
+	b         []byte
+	truncated bool // Whether the message is truncated
+	wide      bool // Whether the connection uses TDS 7.2 or later
+	err       error
+}
+
+func newReader(body []byte, truncated bool, wide bool) *reader {
+	return &reader{b: body, truncated: truncated, wide: wide}
+}
+
+// Err returns the error the reader encountered, if any. Running out of a
+// truncated message isn't an error; the fields that were cut off are just
+// left empty.
+func (r *reader) Err() error {
+	if r.err == errTruncated {
+		return nil
+	}
+	return r.err
+}
+
+// take returns the next n bytes. If the message is truncated, it may
+// return fewer.
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 {
+		r.err = fmt.Errorf("Bad length %d", n)
+		return nil
+	}
+	if len(r.b) < n {
+		if r.truncated {
+			r.err = errTruncated
+		} else {
+			r.err = io.ErrUnexpectedEOF
+		}
+		b := r.b
+		r.b = nil
+		return b
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) Byte() byte {
+	if b := r.take(1); len(b) == 1 {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) Uint16() uint16 {
+	if b := r.take(2); len(b) == 2 {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) Uint32() uint32 {
+	if b := r.take(4); len(b) == 4 {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) Uint64() uint64 {
+	if b := r.take(8); len(b) == 8 {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) Skip(n int) {
+	r.take(n)
+}
+
+// BVarchar reads a string with a one-byte length in characters.
+func (r *reader) BVarchar() string {
+	return ucs2(r.take(2 * int(r.Byte())))
+}
+
+// USVarchar reads a string with a two-byte length in characters.
+func (r *reader) USVarchar() string {
+	return ucs2(r.take(2 * int(r.Uint16())))
+}
+
+// RowCount reads the row count in a DONE token, which is 64 bits from TDS
+// 7.2.
+func (r *reader) RowCount() uint64 {
+	if r.wide {
+		return r.Uint64()
+	}
+	return uint64(r.Uint32())
+}
+
+// typeInfo describes the type of a column or parameter.
+type typeInfo struct {
+	Type    byte
+	Size    int  // Fixed or maximum length
+	partial bool // Whether values are sent in chunks ("PLP")
+}
+
+// isText reports whether values of the type are strings, rather than
+// binary.
+func (t typeInfo) isText() bool {
+	switch t.Type {
+	case TYPE_BIGVARCHAR, TYPE_BIGCHAR, TYPE_TEXT, TYPE_NVARCHAR, TYPE_NCHAR, TYPE_NTEXT:
+		return true
+	}
+	return false
+}
+
+func (t typeInfo) isUnicode() bool {
+	return t.Type == TYPE_NVARCHAR || t.Type == TYPE_NCHAR || t.Type == TYPE_NTEXT
+}
+
+// hasTableName reports whether the type's column metadata includes the
+// name of its table.
+func (t typeInfo) hasTableName() bool {
+	return t.Type == TYPE_TEXT || t.Type == TYPE_NTEXT || t.Type == TYPE_IMAGE
+}
+
+// TypeInfo reads a TYPE_INFO structure.
+func (r *reader) TypeInfo() typeInfo {
+	t := typeInfo{Type: r.Byte()}
+	if r.err != nil {
+		return t
+	}
+	if size, ok := fixedLengthTypes[t.Type]; ok {
+		t.Size = size
+		return t
+	}
+	switch t.Type {
+	case TYPE_GUID, TYPE_INTN, TYPE_BITN, TYPE_FLTN, TYPE_MONEYN, TYPE_DATETIMN,
+		TYPE_VARBINARY, TYPE_BINARY:
+		t.Size = int(r.Byte())
+	case TYPE_DECIMALN, TYPE_NUMERICN:
+		t.Size = int(r.Byte())
+		r.Skip(2) // precision and scale
+	case TYPE_DATEN:
+	case TYPE_TIMEN, TYPE_DATETIME2N, TYPE_DATETIMEOFFSETN:
+		r.Skip(1) // scale
+	case TYPE_BIGVARBINARY, TYPE_BIGBINARY, TYPE_BIGVARCHAR, TYPE_BIGCHAR, TYPE_NVARCHAR, TYPE_NCHAR:
+		t.Size = int(r.Uint16())
+		t.partial = t.Size == 0xFFFF
+		if t.isText() {
+			r.Skip(collationLength)
+		}
+	case TYPE_IMAGE, TYPE_TEXT, TYPE_NTEXT, TYPE_SSVARIANT:
+		t.Size = int(r.Uint32())
+		if t.isText() {
+			r.Skip(collationLength)
+		}
+	case TYPE_XML:
+		t.partial = true
+		if r.Byte() != 0 {
+			r.BVarchar() // database
+			r.BVarchar() // owning schema
+			r.USVarchar()
+		}
+	case TYPE_UDT:
+		t.partial = true
+		r.Uint16() // maximum length
+		r.BVarchar()
+		r.BVarchar()
+		r.BVarchar()
+		r.USVarchar() // assembly-qualified name
+	default:
+		if r.err == nil {
+			r.err = errUnsupportedType
+		}
+	}
+	return t
+}
+
+// Value reads a value of type t; in a row, text and image values are
+// preceded by a text pointer. It returns nil for NULL, and if keep is false,
+// for anything else, to avoid copying values we're just skipping.
+func (r *reader) Value(t typeInfo, row bool, keep bool) []byte {
+	if t.partial {
+		return r.partialValue(keep)
+	}
+	var b []byte
+	if _, ok := fixedLengthTypes[t.Type]; ok {
+		b = r.take(t.Size)
+	} else {
+		switch t.Type {
+		case TYPE_BIGVARBINARY, TYPE_BIGBINARY, TYPE_BIGVARCHAR, TYPE_BIGCHAR, TYPE_NVARCHAR, TYPE_NCHAR:
+			n := r.Uint16()
+			if n == 0xFFFF {
+				return nil
+			}
+			b = r.take(int(n))
+		case TYPE_IMAGE, TYPE_TEXT, TYPE_NTEXT:
+			if row {
+				pointer := r.Byte()
+				if pointer == 0 {
+					return nil
+				}
+				r.Skip(int(pointer))
+				r.Skip(8) // timestamp
+			}
+			n := r.Uint32()
+			if n == 0xFFFFFFFF {
+				return nil
+			}
+			b = r.take(int(n))
+		case TYPE_SSVARIANT:
+			b = r.take(int(r.Uint32()))
+		default:
+			b = r.take(int(r.Byte()))
+		}
+	}
+	if !keep {
+		return nil
+	}
+	return b
+}
+
+// partialValue reads a value sent as a sequence of chunks.
+func (r *reader) partialValue(keep bool) []byte {
+	if r.Uint64() == 0xFFFFFFFFFFFFFFFF {
+		return nil
+	}
+	var b []byte
+	for r.err == nil {
+		n := r.Uint32()
+		if n == 0 {
+			break
+		}
+		chunk := r.take(int(n))
+		if keep {
+			b = append(b, chunk...)
+		}
+	}
+	return b
+}
+
+// Text reads a value of type t as a string.
+func (r *reader) Text(t typeInfo) string {
+	b := r.Value(t, false, true)
+	if t.isUnicode() {
+		return ucs2(b)
+	}
+	return string(b)
+}
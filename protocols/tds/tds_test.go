@@ -0,0 +1,460 @@
+package tds
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLBatch(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genPacket(PACKET_LOGIN7, genLogin7(0x74000004, "web-1", "app", "orders-api", "shop")),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, concat(
+		loginAck(0x74), envChangeDatabase("shop", "master"), done(TOKEN_DONE, 0, 0))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genBatch("SELECT id, name FROM users"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, concat(
+		colMetadata(
+			column([]byte{TYPE_INT4}, "id"),
+			column(concat([]byte{TYPE_NVARCHAR}, uint16b(200), make([]byte, 5)), "name")),
+		[]byte{TOKEN_ROW}, uint32b(1), uint16b(10), ucs2b("alice"),
+		[]byte{TOKEN_ROW}, uint32b(2), uint16b(6), ucs2b("bob"),
+		// A row whose name is NULL.
+		[]byte{TOKEN_NBCROW, 0x02}, uint32b(3),
+		done(TOKEN_DONE, DONE_COUNT, 3))),
+		sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 1, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "request",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 2,
+			"user": "app",
+			"database": "shop",
+			"application_name": "orders-api",
+			"host_name": "web-1",
+			"request_type": "sql_batch",
+			"query": "SELECT id, name FROM users",
+			"rows_affected": 3,
+			"rows_sent": 3,
+			"error": false
+		}`, string(tp.Output[0]))
+	}
+}
+
+func TestMultipleStatements(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genBatch("UPDATE a SET x = 1; USE reports; DELETE FROM b"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, concat(
+		done(TOKEN_DONE, DONE_MORE|DONE_COUNT, 4),
+		envChangeDatabase("reports", "shop"),
+		done(TOKEN_DONE, DONE_MORE, 0),
+		[]byte{TOKEN_INFO}, uint16b(4), []byte{1, 2, 3, 4},
+		done(TOKEN_DONE, DONE_COUNT, 2))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genBatch("SELECT 1"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, done(TOKEN_DONE, 0, 0)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, float64(6), events[0]["rows_affected"])
+		assert.Equal(t, "reports", events[1]["database"])
+	}
+}
+
+func TestEncryptedLogin(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genPacket(PACKET_PRELOGIN, genPrelogin(ENCRYPT_OFF)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, genPrelogin(ENCRYPT_OFF)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	// The TLS handshake is carried in PRELOGIN packets...
+	ms.Append(genPacket(PACKET_PRELOGIN, []byte{0x16, 0x03, 0x01, 0x00, 0x02, 0x01, 0x00}), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_PRELOGIN, []byte{0x16, 0x03, 0x03, 0x00, 0x02, 0x02, 0x00}), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	// ...but the login is sent as bare TLS records.
+	ms.Append([]byte{0x17, 0x03, 0x03, 0x00, 0x04, 0xde, 0xad, 0xbe, 0xef}, sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, concat(
+		loginAck(0x74), envChangeDatabase("shop", "master"), done(TOKEN_DONE, 0, 0))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genBatch("SELECT 1"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, done(TOKEN_DONE, DONE_COUNT, 1)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "SELECT 1", events[0]["query"])
+		assert.Equal(t, "shop", events[0]["database"])
+		assert.Nil(t, events[0]["user"])
+	}
+}
+
+func TestEncryptedConnection(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genPacket(PACKET_PRELOGIN, genPrelogin(ENCRYPT_ON)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, genPrelogin(ENCRYPT_ON)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	ms.Append(genBatch("SELECT 1"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, done(TOKEN_DONE, 0, 0)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	assert.Equal(t, 0, len(tp.Output))
+}
+
+func TestExecuteSQL(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRPC(uint16b(0xFFFF), uint16b(10), uint16b(0),
+		nvarcharParam("", "SELECT * FROM users WHERE id = @p1"),
+		nvarcharParam("", "@p1 int"),
+		param("@p1", []byte{TYPE_INTN, 4}, []byte{4, 42, 0, 0, 0})), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, concat(
+		colMetadata(column([]byte{TYPE_INTN, 4}, "id")),
+		[]byte{TOKEN_ROW, 4}, uint32b(42),
+		done(TOKEN_DONEINPROC, DONE_MORE|DONE_COUNT, 1),
+		[]byte{TOKEN_RETURNSTATUS}, uint32b(0),
+		done(TOKEN_DONEPROC, DONE_COUNT, 1))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "rpc", events[0]["request_type"])
+		assert.Equal(t, "sp_executesql", events[0]["procedure"])
+		assert.Equal(t, "SELECT * FROM users WHERE id = @p1", events[0]["query"])
+		assert.Equal(t, float64(1), events[0]["rows_affected"])
+		assert.Equal(t, float64(1), events[0]["rows_sent"])
+	}
+}
+
+func TestPrepareAndExecute(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	query := "UPDATE users SET name = @p1 WHERE id = @p2"
+	ms.Append(genRPC(uint16b(0xFFFF), uint16b(13), uint16b(0),
+		param("@handle", []byte{TYPE_INTN, 4}, []byte{0}),
+		nvarcharParam("", "@p1 nvarchar(4000), @p2 int"),
+		nvarcharParam("", query),
+		nvarcharParam("", "carol"),
+		param("", []byte{TYPE_INTN, 4}, []byte{4, 7, 0, 0, 0})), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, concat(
+		[]byte{TOKEN_RETURNVALUE}, uint16b(0), bVarchar("@handle"), []byte{1},
+		uint32b(0), uint16b(0), []byte{TYPE_INTN, 4}, []byte{4}, uint32b(1),
+		done(TOKEN_DONEINPROC, DONE_MORE|DONE_COUNT, 1),
+		done(TOKEN_DONEPROC, 0, 0))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	// The procedure can also be named.
+	ms.Append(genRPC(uint16b(10), ucs2b("sp_execute"), uint16b(0),
+		param("", []byte{TYPE_INTN, 4}, []byte{4, 1, 0, 0, 0}),
+		nvarcharParam("", "dave"),
+		param("", []byte{TYPE_INTN, 4}, []byte{4, 8, 0, 0, 0})), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, concat(
+		done(TOKEN_DONEINPROC, DONE_MORE|DONE_COUNT, 1),
+		done(TOKEN_DONEPROC, 0, 0))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "sp_prepexec", events[0]["procedure"])
+		assert.Equal(t, query, events[0]["query"])
+		assert.Equal(t, "sp_execute", events[1]["procedure"])
+		assert.Equal(t, query, events[1]["query"])
+		assert.Equal(t, float64(1), events[1]["rows_affected"])
+	}
+}
+
+func TestStoredProcedure(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRPC(uint16b(11), ucs2b("dbo.GetUser"), uint16b(0),
+		param("@id", []byte{TYPE_INTN, 4}, []byte{4, 42, 0, 0, 0})), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, done(TOKEN_DONEPROC, 0, 0)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "dbo.GetUser", events[0]["procedure"])
+		assert.Equal(t, "", events[0]["query"])
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genBatch("SELECT * FROM nope"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, concat(
+		errorToken(208, 16, "Invalid object name 'nope'."),
+		done(TOKEN_DONE, DONE_ERROR, 0))),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, true, events[0]["error"])
+		assert.Equal(t, float64(208), events[0]["error_number"])
+		assert.Equal(t, float64(16), events[0]["error_severity"])
+		assert.Equal(t, "Invalid object name 'nope'.", events[0]["error_message"])
+	}
+}
+
+func TestPacketsSplitAcrossMessages(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	query := "SELECT * FROM users WHERE name = 'a very long name indeed'"
+	batch := genPackets(PACKET_SQL_BATCH, concat(allHeaders(), ucs2b(query)), 40)
+	ms.Append(batch[:30], sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(batch[30:], sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow())
+	response := genPackets(PACKET_TABULAR_RESULT, concat(
+		colMetadata(column([]byte{TYPE_INT8}, "id")),
+		[]byte{TOKEN_ROW}, make([]byte, 8),
+		[]byte{TOKEN_ROW}, make([]byte, 8),
+		done(TOKEN_DONE, DONE_COUNT, 2)), 20)
+	ms.Append(response[:3], sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow().Reverse())
+	ms.Append(response[3:], sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, query, events[0]["query"])
+		assert.Equal(t, float64(2), events[0]["rows_sent"])
+		assert.Equal(t, float64(3), events[0]["duration_ms"])
+	}
+}
+
+func TestAttention(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genBatch("WAITFOR DELAY '01:00'"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_ATTENTION, nil), sniffertest.DefaultDate().Add(time.Second), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, done(TOKEN_DONE, DONE_ATTN, 0)),
+		sniffertest.DefaultDate().Add(time.Second), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, true, events[0]["cancelled"])
+		assert.Equal(t, float64(1000), events[0]["duration_ms"])
+	}
+}
+
+func TestResyncAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genBatch("SELECT 1"), sniffertest.DefaultDate(), defaultFlow())
+	response := genPacket(PACKET_TABULAR_RESULT, done(TOKEN_DONE, DONE_COUNT, 1))
+	ms.AppendSkipped(response[3:], sniffertest.DefaultDate(), defaultFlow().Reverse(), 3)
+	ms.Append(genBatch("SELECT 2"), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, done(TOKEN_DONE, DONE_COUNT, 1)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "SELECT 2", events[0]["query"])
+	}
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	pf := ParserFactory{
+		Options:   Options{Port: 1433, MaxMessageSize: 64},
+		Publisher: tp,
+	}
+	parser := pf.New(defaultFlow())
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genBatch("SELECT id FROM events"), sniffertest.DefaultDate(), defaultFlow())
+	var rows []byte
+	for i := 0; i < 100; i++ {
+		rows = append(rows, concat([]byte{TOKEN_ROW}, uint32b(uint32(i)))...)
+	}
+	ms.Append(genPackets(PACKET_TABULAR_RESULT, concat(
+		colMetadata(column([]byte{TYPE_INT4}, "id")),
+		rows,
+		done(TOKEN_DONE, DONE_COUNT, 100)), 200), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, true, events[0]["truncated"])
+		assert.Equal(t, float64(100), events[0]["rows_affected"])
+		assert.True(t, events[0]["rows_sent"].(float64) < 100)
+	}
+}
+
+func TestMARS(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat([]byte{smpID, 0x08}, uint16b(0), uint32b(16+30), uint32b(1), uint32b(4),
+		genBatch("SELECT 1")), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genPacket(PACKET_TABULAR_RESULT, done(TOKEN_DONE, 0, 0)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	assert.Equal(t, 0, len(tp.Output))
+}
+
+func TestSkipAllHeaders(t *testing.T) {
+	text := ucs2b("SELECT 1")
+	assert.Equal(t, text, skipAllHeaders(concat(allHeaders(), text)))
+	// TDS 7.1 and earlier don't send them.
+	assert.Equal(t, text, skipAllHeaders(text))
+	assert.Equal(t, []byte{1, 0}, skipAllHeaders([]byte{1, 0}))
+}
+
+func genPacket(packetType byte, data []byte) []byte {
+	return genPackets(packetType, data, 4096)
+}
+
+// genPackets splits a message into packets of at most size bytes.
+func genPackets(packetType byte, data []byte, size int) []byte {
+	var b []byte
+	for {
+		n := len(data)
+		if n > size-packetHeaderLength {
+			n = size - packetHeaderLength
+		}
+		var status byte
+		if n == len(data) {
+			status = STATUS_EOM
+		}
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(n+packetHeaderLength))
+		b = concat(b, []byte{packetType, status}, length, []byte{0, 0, 1, 0}, data[:n])
+		data = data[n:]
+		if status == STATUS_EOM {
+			return b
+		}
+	}
+}
+
+func genBatch(query string) []byte {
+	return genPacket(PACKET_SQL_BATCH, concat(allHeaders(), ucs2b(query)))
+}
+
+func genRPC(parts ...[]byte) []byte {
+	return genPacket(PACKET_RPC, concat(allHeaders(), concat(parts...)))
+}
+
+// allHeaders returns ALL_HEADERS with a transaction descriptor.
+func allHeaders() []byte {
+	return concat(uint32b(22), uint32b(18), uint16b(2), make([]byte, 8), uint32b(1))
+}
+
+func genLogin7(version uint32, host string, user string, app string, database string) []byte {
+	const fixedLength = 94
+	fixed := make([]byte, fixedLength)
+	binary.LittleEndian.PutUint32(fixed[login7TDSVersion:], version)
+	var data []byte
+	for _, f := range []struct {
+		offset int
+		value  string
+	}{{login7HostName, host}, {login7UserName, user}, {login7AppName, app}, {login7Database, database}} {
+		binary.LittleEndian.PutUint16(fixed[f.offset:], uint16(fixedLength+len(data)))
+		binary.LittleEndian.PutUint16(fixed[f.offset+2:], uint16(len(f.value)))
+		data = append(data, ucs2b(f.value)...)
+	}
+	binary.LittleEndian.PutUint32(fixed, uint32(fixedLength+len(data)))
+	return concat(fixed, data)
+}
+
+// genPrelogin returns PRELOGIN options with just a version and the
+// encryption option.
+func genPrelogin(encryption byte) []byte {
+	return concat(
+		[]byte{0x00}, []byte{0, 11}, []byte{0, 6},
+		[]byte{PRELOGIN_ENCRYPTION}, []byte{0, 17}, []byte{0, 1},
+		[]byte{PRELOGIN_TERMINATOR},
+		[]byte{15, 0, 0x07, 0xd0, 0, 0},
+		[]byte{encryption})
+}
+
+func loginAck(version byte) []byte {
+	body := concat([]byte{1, version, 0, 0, 4}, bVarchar("Microsoft SQL Server"), []byte{16, 0, 0x10, 0x7f})
+	return concat([]byte{TOKEN_LOGINACK}, uint16b(uint16(len(body))), body)
+}
+
+func envChangeDatabase(newValue string, oldValue string) []byte {
+	body := concat([]byte{ENVCHANGE_DATABASE}, bVarchar(newValue), bVarchar(oldValue))
+	return concat([]byte{TOKEN_ENVCHANGE}, uint16b(uint16(len(body))), body)
+}
+
+func errorToken(number uint32, class byte, message string) []byte {
+	body := concat(uint32b(number), []byte{1, class}, uint16b(uint16(len(message))), ucs2b(message),
+		bVarchar("db-1"), bVarchar(""), uint32b(1))
+	return concat([]byte{TOKEN_ERROR}, uint16b(uint16(len(body))), body)
+}
+
+func done(token byte, status uint16, count uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, count)
+	return concat([]byte{token}, uint16b(status), uint16b(0xC1), b)
+}
+
+func colMetadata(columns ...[]byte) []byte {
+	return concat([]byte{TOKEN_COLMETADATA}, uint16b(uint16(len(columns))), concat(columns...))
+}
+
+func column(typeInfo []byte, name string) []byte {
+	return concat(uint32b(0), uint16b(0x0009), typeInfo, bVarchar(name))
+}
+
+func param(name string, typeInfo []byte, value []byte) []byte {
+	return concat(bVarchar(name), []byte{0}, typeInfo, value)
+}
+
+func nvarcharParam(name string, value string) []byte {
+	return param(name, concat([]byte{TYPE_NVARCHAR}, uint16b(8000), make([]byte, 5)),
+		concat(uint16b(uint16(2*len(value))), ucs2b(value)))
+}
+
+func bVarchar(s string) []byte {
+	return concat([]byte{byte(len(s))}, ucs2b(s))
+}
+
+func ucs2b(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return b
+}
+
+func uint16b(n uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, n)
+	return b
+}
+
+func uint32b(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, n)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(1433)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		Options:   Options{Port: 1433, MaxMessageSize: 1048576},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
@@ -0,0 +1,327 @@
+// Package tls recognizes connections that have switched to TLS, so that
+// protocol parsers can stop trying to parse ciphertext. We can't see inside
+// encrypted connections, but the handshake is sent in the clear, and tells
+// us the TLS version, server name and cipher suite.
+package tls
+
+import (
+	cryptotls "crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+// Event summarizes an encrypted connection once it closes.
+type Event struct {
+	EventType  string  `json:"event_type"`
+	Protocol   string  `json:"protocol"` // The protocol running over TLS
+	ClientIP   string  `json:"client_ip"`
+	ServerIP   string  `json:"server_ip"`
+	DurationMs float64 `json:"duration_ms"`
+	// From the handshake, if we saw it.
+	TLSVersion  string `json:"tls_version,omitempty"`
+	ServerName  string `json:"server_name,omitempty"`
+	CipherSuite string `json:"cipher_suite,omitempty"`
+	// Bytes sent in each direction since the connection switched to TLS.
+	BytesToServer   int64 `json:"bytes_to_server"`
+	BytesFromServer int64 `json:"bytes_from_server"`
+	timestamp       time.Time
+	end             time.Time
+}
+
+// TLS record content types, handshake message types and extensions that we
+// look at.
+// https://tools.ietf.org/html/rfc8446#appendix-B
+const (
+	recordTypeHandshake       byte   = 0x16
+	handshakeTypeClientHello  byte   = 0x01
+	handshakeTypeServerHello  byte   = 0x02
+	extensionServerName       uint16 = 0x0000
+	extensionSupportedVersion uint16 = 0x002b
+	serverNameTypeHostName    byte   = 0x00
+)
+
+const recordHeaderLength = 5
+const handshakeHeaderLength = 4
+
+// Safety constraints:
+// Don't buffer more than this much of each direction's first handshake
+// message. Hello messages are usually a few hundred bytes.
+const maxHandshakeLength = 16384
+
+// ClientHelloPrefixLength is the number of bytes that IsClientHello needs.
+const ClientHelloPrefixLength = recordHeaderLength + 1
+
+// IsClientHello reports whether b starts with a TLS record containing a
+// ClientHello message, which is how every TLS connection begins.
+func IsClientHello(b []byte) bool {
+	if len(b) < ClientHelloPrefixLength {
+		return false
+	}
+	// The record version is 3.x, where x is at most 4 (TLS 1.3).
+	return b[0] == recordTypeHandshake && b[1] == 3 && b[2] <= 4 &&
+		binary.BigEndian.Uint16(b[3:5]) > 0 && b[5] == handshakeTypeClientHello
+}
+
+var versionNames = map[uint16]string{
+	0x0300: "SSL 3.0",
+	0x0301: "TLS 1.0",
+	0x0302: "TLS 1.1",
+	0x0303: "TLS 1.2",
+	0x0304: "TLS 1.3",
+}
+
+// A Connection tracks a connection after it has switched to TLS.
+type Connection struct {
+	event       Event
+	clientHello handshakeBuffer
+	serverHello handshakeBuffer
+	logger      *logging.Logger
+}
+
+// NewConnection starts tracking a connection running protocol over TLS,
+// from the client to the server in flow.
+func NewConnection(protocol string, flow sniffer.IPPortTuple, start time.Time) *Connection {
+	metrics.Counter("tls.connections_detected").Add()
+	return &Connection{
+		event: Event{
+			EventType: "tls_connection",
+			Protocol:  protocol,
+			ClientIP:  flow.SrcIP.String(),
+			ServerIP:  flow.DstIP.String(),
+			timestamp: start,
+			end:       start,
+		},
+		logger: logging.NewLogger(logrus.Fields{"flow": flow, "component": "tls"}),
+	}
+}
+
+// Observe reads r to the end, counting the bytes in it and looking for
+// handshake messages.
+func (c *Connection) Observe(r io.Reader, timestamp time.Time, toServer bool) {
+	if timestamp.After(c.event.end) {
+		c.event.end = timestamp
+	}
+	hello := &c.serverHello
+	if toServer {
+		hello = &c.clientHello
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if toServer {
+			c.event.BytesToServer += int64(n)
+		} else {
+			c.event.BytesFromServer += int64(n)
+		}
+		if n > 0 && !hello.done {
+			if msg := hello.write(buf[:n]); msg != nil {
+				c.parseHello(msg, toServer)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *Connection) parseHello(msg []byte, toServer bool) {
+	var err error
+	if toServer {
+		err = c.parseClientHello(msg)
+	} else {
+		err = c.parseServerHello(msg)
+	}
+	if err != nil {
+		c.logger.Debug("Error parsing TLS handshake",
+			logrus.Fields{"error": err, "toServer": toServer})
+		metrics.Counter("tls.parse_errors").Add()
+	}
+}
+
+// Publish publishes a summary of the connection; call it once the
+// connection closes.
+func (c *Connection) Publish(publisher publish.Publisher) {
+	e := c.event
+	e.DurationMs = float64(e.end.Sub(e.timestamp).Nanoseconds()) / 1e6
+	publisher.Publish(&e, e.timestamp)
+	metrics.Counter("tls.connections_parsed").Add()
+}
+
+// https://tools.ietf.org/html/rfc8446#section-4.1.2
+func (c *Connection) parseClientHello(msg []byte) error {
+	r := &reader{b: msg}
+	if r.byte() != handshakeTypeClientHello {
+		return fmt.Errorf("Expected ClientHello, got handshake type %#x", msg[0])
+	}
+	r.skip(3)      // length
+	r.skip(2 + 32) // version, random
+	r.skip(int(r.byte()))
+	r.skip(int(r.uint16())) // cipher suites
+	r.skip(int(r.byte()))   // compression methods
+	if r.err != nil {
+		return r.err
+	}
+	return r.extensions(func(extensionType uint16, data *reader) {
+		if extensionType != extensionServerName {
+			return
+		}
+		// A list of names, of which only host names are defined.
+		list := &reader{b: data.bytes(int(data.uint16()))}
+		for list.err == nil && len(list.b) > 0 {
+			nameType := list.byte()
+			name := list.bytes(int(list.uint16()))
+			if list.err == nil && nameType == serverNameTypeHostName {
+				c.event.ServerName = string(name)
+				return
+			}
+		}
+	})
+}
+
+// https://tools.ietf.org/html/rfc8446#section-4.1.3
+func (c *Connection) parseServerHello(msg []byte) error {
+	r := &reader{b: msg}
+	if r.byte() != handshakeTypeServerHello {
+		return fmt.Errorf("Expected ServerHello, got handshake type %#x", msg[0])
+	}
+	r.skip(3) // length
+	version := r.uint16()
+	r.skip(32) // random
+	r.skip(int(r.byte()))
+	cipherSuite := r.uint16()
+	r.skip(1) // compression method
+	if r.err != nil {
+		return r.err
+	}
+	c.event.CipherSuite = cryptotls.CipherSuiteName(cipherSuite)
+	if len(r.b) > 0 {
+		// TLS 1.3 servers send 1.2 as the legacy version, and the real
+		// one in an extension.
+		err := r.extensions(func(extensionType uint16, data *reader) {
+			if extensionType == extensionSupportedVersion {
+				if v := data.uint16(); data.err == nil {
+					version = v
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	c.event.TLSVersion = versionNames[version]
+	if c.event.TLSVersion == "" {
+		c.event.TLSVersion = fmt.Sprintf("%#04x", version)
+	}
+	return nil
+}
+
+// handshakeBuffer collects the first handshake message in one direction of
+// a connection, which may be split across several records.
+type handshakeBuffer struct {
+	raw  []byte // Bytes of incomplete records
+	msg  []byte // Concatenated record payloads
+	done bool
+}
+
+// write adds b to the buffer, and returns the first handshake message once
+// it's complete.
+func (h *handshakeBuffer) write(b []byte) []byte {
+	h.raw = append(h.raw, b...)
+	for len(h.raw) >= recordHeaderLength {
+		length := int(binary.BigEndian.Uint16(h.raw[3:5]))
+		if h.raw[0] != recordTypeHandshake ||
+			len(h.msg)+length > maxHandshakeLength+handshakeHeaderLength {
+			// Not something we can parse.
+			h.finish()
+			return nil
+		}
+		if len(h.raw) < recordHeaderLength+length {
+			break
+		}
+		h.msg = append(h.msg, h.raw[recordHeaderLength:recordHeaderLength+length]...)
+		h.raw = h.raw[recordHeaderLength+length:]
+		if len(h.msg) >= handshakeHeaderLength {
+			msgLength := int(h.msg[1])<<16 | int(h.msg[2])<<8 | int(h.msg[3])
+			if len(h.msg) >= handshakeHeaderLength+msgLength {
+				msg := h.msg[:handshakeHeaderLength+msgLength]
+				h.finish()
+				return msg
+			}
+		}
+	}
+	if len(h.raw) > maxHandshakeLength+recordHeaderLength {
+		h.finish()
+	}
+	return nil
+}
+
+func (h *handshakeBuffer) finish() {
+	h.done = true
+	h.raw = nil
+	h.msg = nil
+}
+
+// reader parses big-endian TLS data structures. Like the MySQL parser's
+// errReader, it stores the first error it encounters, and callers must check
+// reader.err.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *reader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// extensions calls f with the type and contents of each extension in the
+// extensions block that ends a hello message.
+func (r *reader) extensions(f func(extensionType uint16, data *reader)) error {
+	block := &reader{b: r.bytes(int(r.uint16()))}
+	if r.err != nil {
+		return r.err
+	}
+	for len(block.b) > 0 {
+		extensionType := block.uint16()
+		data := block.bytes(int(block.uint16()))
+		if block.err != nil {
+			return block.err
+		}
+		f(extensionType, &reader{b: data})
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package tls
+
+import (
+	"bytes"
+	cryptotls "crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnection(t *testing.T) {
+	clientHello := realClientHello("db.example.com")
+	assert.True(t, IsClientHello(clientHello))
+
+	tp := &sniffertest.Publisher{}
+	c := NewConnection("mysql", defaultFlow(), sniffertest.DefaultDate())
+	// Split the ClientHello across reads to check that it's reassembled.
+	c.Observe(bytes.NewReader(clientHello[:20]), sniffertest.DefaultDate(), true)
+	c.Observe(bytes.NewReader(clientHello[20:]), sniffertest.DefaultDate(), true)
+	serverHello := genServerHello(0x0303, cryptotls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, 0x0304)
+	c.Observe(bytes.NewReader(append(serverHello, 0x17, 0x03, 0x03, 0x00, 0x01, 0xaa)),
+		sniffertest.DefaultDate().Add(5*time.Millisecond), false)
+	c.Publish(tp)
+
+	if assert.Equal(t, 1, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "tls_connection",
+			"protocol": "mysql",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 5,
+			"tls_version": "TLS 1.3",
+			"server_name": "db.example.com",
+			"cipher_suite": "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"bytes_to_server": `+strconv.Itoa(len(clientHello))+`,
+			"bytes_from_server": `+strconv.Itoa(len(serverHello)+6)+`
+		}`, string(tp.Output[0]))
+	}
+}
+
+func TestServerHelloWithoutExtensions(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	c := NewConnection("mongodb", defaultFlow(), sniffertest.DefaultDate())
+	serverHello := genServerHello(0x0302, cryptotls.TLS_RSA_WITH_AES_128_CBC_SHA, 0)
+	c.Observe(bytes.NewReader(serverHello), sniffertest.DefaultDate(), false)
+	c.Publish(tp)
+	var ret map[string]interface{}
+	json.Unmarshal(tp.Output[0], &ret)
+	assert.Equal(t, "TLS 1.1", ret["tls_version"])
+	assert.Equal(t, "TLS_RSA_WITH_AES_128_CBC_SHA", ret["cipher_suite"])
+	assert.Nil(t, ret["server_name"])
+}
+
+func TestIsClientHello(t *testing.T) {
+	assert.True(t, IsClientHello([]byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01}))
+	assert.False(t, IsClientHello([]byte{0x16, 0x03, 0x01, 0x02, 0x00}))
+	assert.False(t, IsClientHello([]byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x02}))
+	assert.False(t, IsClientHello([]byte{0x17, 0x03, 0x03, 0x02, 0x00, 0x01}))
+	// A MySQL COM_QUERY packet.
+	assert.False(t, IsClientHello([]byte{0x09, 0x00, 0x00, 0x00, 0x03, 'S'}))
+}
+
+func TestGarbageHandshake(t *testing.T) {
+	c := NewConnection("mysql", defaultFlow(), sniffertest.DefaultDate())
+	c.Observe(bytes.NewReader([]byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x01, 0xff, 0xff, 0xff}), sniffertest.DefaultDate(), true)
+	assert.False(t, c.clientHello.done)
+	c.Observe(bytes.NewReader(bytes.Repeat([]byte{0x16, 0x03, 0x01, 0xff, 0xff}, 10000)), sniffertest.DefaultDate(), true)
+	assert.True(t, c.clientHello.done)
+	assert.Equal(t, int64(50009), c.event.BytesToServer)
+}
+
+// realClientHello returns the first flight that crypto/tls sends as a
+// client.
+func realClientHello(serverName string) []byte {
+	client, server := net.Pipe()
+	go func() {
+		conn := cryptotls.Client(client, &cryptotls.Config{ServerName: serverName})
+		conn.Handshake()
+	}()
+	var buf bytes.Buffer
+	header := make([]byte, 5)
+	server.Read(header)
+	buf.Write(header)
+	body := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+	for n := 0; n < len(body); {
+		m, _ := server.Read(body[n:])
+		n += m
+	}
+	buf.Write(body)
+	server.Close()
+	return buf.Bytes()
+}
+
+// genServerHello returns a ServerHello record. If supportedVersion is
+// nonzero, it's sent in a supported_versions extension.
+func genServerHello(version uint16, cipherSuite uint16, supportedVersion uint16) []byte {
+	var body []byte
+	body = append(body, byte(version>>8), byte(version))
+	body = append(body, bytes.Repeat([]byte{0x01}, 32)...) // random
+	body = append(body, 0x00)                              // session ID
+	body = append(body, byte(cipherSuite>>8), byte(cipherSuite))
+	body = append(body, 0x00) // compression method
+	if supportedVersion != 0 {
+		body = append(body, 0x00, 0x06, 0x00, 0x2b, 0x00, 0x02,
+			byte(supportedVersion>>8), byte(supportedVersion))
+	}
+	msg := append([]byte{handshakeTypeServerHello, 0x00, byte(len(body) >> 8), byte(len(body))}, body...)
+	return append([]byte{recordTypeHandshake, 0x03, 0x03, byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(3306)
+}
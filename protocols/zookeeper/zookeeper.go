@@ -0,0 +1,449 @@
+// Package zookeeper parses the ZooKeeper client protocol. Each request is
+// tagged with an xid, which the server's reply carries, so replies are
+// matched to requests by xid. Replies don't say which operation they're
+// for, so only replies whose request we saw can be decoded. The server also
+// sends watch notifications, under a special xid, whenever it likes.
+//
+// The operations of a multi request are reported with an event each, so
+// that every path they touch is counted.
+package zookeeper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codahale/metrics"
+	"github.com/honeycombio/honeycomb-tcpagent/logging"
+	"github.com/honeycombio/honeycomb-tcpagent/protocols/tls"
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+type Options struct {
+	Port uint16 `long:"port" description:"ZooKeeper client port" default:"2181"`
+}
+
+// ParserFactory implements sniffer.ConsumerFactory
+type ParserFactory struct {
+	Options   Options
+	Publisher publish.Publisher
+}
+
+func (pf *ParserFactory) New(flow sniffer.IPPortTuple) sniffer.Consumer {
+	if flow.DstPort != pf.Options.Port {
+		flow = flow.Reverse()
+	}
+	return &Parser{
+		options:   pf.Options,
+		flow:      flow,
+		pending:   make(map[int32]*request),
+		logger:    logging.NewLogger(logrus.Fields{"flow": flow, "component": "zookeeper"}),
+		publisher: pf.Publisher,
+	}
+}
+
+func (pf *ParserFactory) BPFFilter() string {
+	return fmt.Sprintf("tcp port %d", pf.Options.Port)
+}
+
+// Parser implements sniffer.Consumer
+type Parser struct {
+	options    Options
+	flow       sniffer.IPPortTuple
+	client     frameAssembler
+	server     frameAssembler
+	pending    map[int32]*request // Requests awaiting replies, by xid
+	connecting *Event             // A connect request awaiting its response
+	sessionID  string
+	tls        *tls.Connection
+	logger     *logging.Logger
+	publisher  publish.Publisher
+}
+
+// request is a request awaiting its reply.
+type request struct {
+	op int32
+	// One per operation, so multi requests may have several.
+	events []*Event
+}
+
+// Event describes a connection handshake, an operation and its reply, or a
+// watch notification.
+type Event struct {
+	// "connect", "request" or "watch".
+	EventType  string  `json:"event_type"`
+	ClientIP   string  `json:"client_ip"`
+	ServerIP   string  `json:"server_ip"`
+	DurationMs float64 `json:"duration_ms"`
+	// As ZooKeeper formats them, e.g. "0x100006f8a0c0000".
+	SessionID string `json:"session_id,omitempty"`
+	// The operation, e.g. "getData", "create" or "multi".
+	Op   string `json:"op,omitempty"`
+	Xid  int32  `json:"xid,omitempty"`
+	Zxid int64  `json:"zxid,omitempty"`
+	Path string `json:"path,omitempty"`
+	// Whether the operation is part of a multi request.
+	Multi bool `json:"multi,omitempty"`
+	// Whether a read left a watch on the path.
+	Watch bool `json:"watch,omitempty"`
+	// For creates, e.g. "ephemeral_sequential", and the path created,
+	// which differs from the path asked for for sequential nodes.
+	CreateMode  string `json:"create_mode,omitempty"`
+	CreatedPath string `json:"created_path,omitempty"`
+	// The size of the data written by a create or setData, or read by a
+	// getData.
+	DataBytes int `json:"data_bytes,omitempty"`
+	// The number of children listed by getChildren.
+	Children   int    `json:"children,omitempty"`
+	AuthScheme string `json:"auth_scheme,omitempty"`
+	// For watch notifications, e.g. "NodeDataChanged" and "SyncConnected".
+	WatchEvent string `json:"watch_event,omitempty"`
+	State      string `json:"state,omitempty"`
+	// For connects, the session timeout the server agreed to, or the one
+	// the client asked for if there was no response.
+	TimeoutMs     int  `json:"timeout_ms,omitempty"`
+	ReadOnly      bool `json:"read_only,omitempty"`
+	RequestBytes  int  `json:"request_bytes,omitempty"`
+	ResponseBytes int  `json:"response_bytes,omitempty"`
+	// Whether the request or reply was too long to buffer whole, so that
+	// some of the above may be missing.
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     bool   `json:"error"`
+	ErrorCode int    `json:"error_code,omitempty"`
+	ErrorName string `json:"error_name,omitempty"`
+	timestamp time.Time
+}
+
+func (p *Parser) On(ms sniffer.MessageStream) {
+	for {
+		m, ok := ms.Next()
+		if !ok {
+			p.logger.Debug("Message stream closed", logrus.Fields{})
+			if p.tls != nil {
+				p.tls.Publish(p.publisher)
+			}
+			return
+		}
+		toServer := m.Flow().DstPort == p.options.Port
+		if p.tls != nil {
+			p.tls.Observe(m, m.Timestamp(), toServer)
+			continue
+		}
+		a := &p.server
+		if toServer {
+			a = &p.client
+		}
+		if m.Skipped() > 0 {
+			// The message most likely starts partway through a frame;
+			// the next one in this direction should start afresh.
+			p.desynchronize(a, "skipped bytes")
+			io.Copy(ioutil.Discard, m)
+			continue
+		}
+		br := bufio.NewReader(m)
+		if toServer && a.idle() {
+			if b, err := br.Peek(tls.ClientHelloPrefixLength); err == nil && tls.IsClientHello(b) {
+				p.logger.Debug("Connection uses TLS", logrus.Fields{})
+				p.pending = make(map[int32]*request)
+				p.tls = tls.NewConnection("zookeeper", p.flow, m.Timestamp())
+				p.tls.Observe(br, m.Timestamp(), toServer)
+				continue
+			}
+		}
+		err := p.parseFrames(a, br, m.Timestamp(), toServer)
+		if err != io.EOF {
+			p.logger.Debug("Error parsing message",
+				logrus.Fields{"error": err, "toServer": toServer})
+			metrics.Counter("zookeeper.parse_errors").Add()
+			p.desynchronize(a, err.Error())
+			io.Copy(ioutil.Discard, br)
+		}
+	}
+}
+
+// desynchronize forgets about any partial frame in one direction once we
+// can no longer tell where frames start. Xids still match replies to
+// requests, so pending requests are kept.
+func (p *Parser) desynchronize(a *frameAssembler, reason string) {
+	p.logger.Debug("Stream desynchronized", logrus.Fields{"reason": reason})
+	metrics.Counter("zookeeper.desyncs").Add()
+	a.reset()
+}
+
+func (p *Parser) parseFrames(a *frameAssembler, r io.Reader, timestamp time.Time, toServer bool) error {
+	for {
+		f, err := a.next(r, timestamp)
+		if err != nil {
+			return err
+		}
+		p.logger.Debug("Parsed frame", logrus.Fields{
+			"length":   f.Length,
+			"toServer": toServer})
+		if toServer {
+			err = p.parseRequest(f)
+		} else {
+			err = p.parseResponse(f, timestamp)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isConnect reports whether a frame is a connect request or response.
+// They have no header, and start with the protocol version, which is zero;
+// other requests and replies start with an xid, which is never zero.
+func isConnect(f *frame, minLength int) bool {
+	return f.Length >= minLength && len(f.body) >= 4 && binary.BigEndian.Uint32(f.body) == 0
+}
+
+func formatSessionID(id int64) string {
+	return fmt.Sprintf("0x%x", uint64(id))
+}
+
+func (p *Parser) parseRequest(f *frame) error {
+	r := newReader(f)
+	if isConnect(f, connectRequestLength) {
+		r.Int()  // protocol version
+		r.Long() // last zxid seen
+		e := &Event{
+			EventType:    "connect",
+			Op:           "connect",
+			TimeoutMs:    int(r.Int()),
+			RequestBytes: f.Length,
+			timestamp:    f.timestamp,
+		}
+		// Clients reconnecting to an existing session give its ID.
+		if sessionID := r.Long(); sessionID != 0 {
+			e.SessionID = formatSessionID(sessionID)
+		}
+		p.connecting = e
+		return r.Err()
+	}
+	xid := r.Int()
+	op := r.Int()
+	if r.err != nil {
+		return r.Err()
+	}
+	if xid == XID_PING || op == OP_PING {
+		return nil
+	}
+	req := &request{op: op}
+	if op == OP_MULTI || op == OP_MULTI_READ {
+		for len(req.events) < maxMultiOps {
+			subOp := r.Int()
+			done := r.Bool()
+			r.Int() // error
+			if done || r.err != nil {
+				break
+			}
+			e := p.newEvent(subOp, xid, f)
+			e.Multi = true
+			readRequest(r, subOp, e)
+			req.events = append(req.events, e)
+		}
+	}
+	if len(req.events) == 0 {
+		e := p.newEvent(op, xid, f)
+		readRequest(r, op, e)
+		req.events = append(req.events, e)
+	}
+	if old, ok := p.pending[xid]; ok {
+		p.logger.Debug("Xid reused before reply", logrus.Fields{
+			"xid": xid,
+			"op":  opName(old.op)})
+	} else if len(p.pending) >= maxPendingRequests {
+		p.logger.Debug("Too many pending requests", logrus.Fields{})
+		p.pending = make(map[int32]*request)
+	}
+	p.pending[xid] = req
+	return r.Err()
+}
+
+func (p *Parser) newEvent(op int32, xid int32, f *frame) *Event {
+	return &Event{
+		EventType:    "request",
+		SessionID:    p.sessionID,
+		Op:           opName(op),
+		Xid:          xid,
+		RequestBytes: f.Length,
+		Truncated:    f.Truncated,
+		timestamp:    f.timestamp,
+	}
+}
+
+// readRequest reads the body of a request for an operation. The operations
+// of a multi request follow one another, so the bodies of those that can be
+// part of one are read whole.
+func readRequest(r *reader, op int32, e *Event) {
+	switch op {
+	case OP_CREATE, OP_CREATE2, OP_CREATE_CONTAINER, OP_CREATE_TTL:
+		e.Path = r.UString()
+		e.DataBytes = r.Buffer()
+		r.ACLs()
+		e.CreateMode = createModes[r.Int()]
+		if op == OP_CREATE_TTL {
+			r.Long() // TTL
+		}
+	case OP_SET_DATA:
+		e.Path = r.UString()
+		e.DataBytes = r.Buffer()
+		r.Int() // version
+	case OP_DELETE, OP_CHECK:
+		e.Path = r.UString()
+		r.Int() // version
+	case OP_EXISTS, OP_GET_DATA, OP_GET_CHILDREN, OP_GET_CHILDREN2:
+		e.Path = r.UString()
+		e.Watch = r.Bool()
+	case OP_DELETE_CONTAINER, OP_SYNC, OP_GET_ACL, OP_SET_ACL,
+		OP_GET_EPHEMERALS, OP_GET_ALL_CHILDREN_NUMBER, OP_ADD_WATCH,
+		OP_CHECK_WATCHES, OP_REMOVE_WATCHES:
+		e.Path = r.UString()
+	case OP_AUTH:
+		r.Int() // type
+		e.AuthScheme = r.UString()
+	}
+}
+
+func (p *Parser) parseResponse(f *frame, timestamp time.Time) error {
+	r := newReader(f)
+	if p.connecting != nil && isConnect(f, connectResponseLength) {
+		r.Int() // protocol version
+		e := p.connecting
+		p.connecting = nil
+		e.TimeoutMs = int(r.Int())
+		sessionID := r.Long()
+		r.Buffer() // password
+		if len(r.b) > 0 {
+			e.ReadOnly = r.Bool()
+		}
+		e.ResponseBytes = f.Length
+		if r.err != nil {
+			return r.Err()
+		}
+		if e.TimeoutMs <= 0 {
+			// The session the client asked to resume has expired.
+			setError(e, ERR_SESSION_EXPIRED)
+			p.sessionID = ""
+		} else {
+			e.SessionID = formatSessionID(sessionID)
+			p.sessionID = e.SessionID
+		}
+		p.publish(e, timestamp)
+		return nil
+	}
+	xid := r.Int()
+	zxid := r.Long()
+	code := r.Int()
+	if r.err != nil {
+		return r.Err()
+	}
+	switch xid {
+	case XID_PING:
+		return nil
+	case XID_NOTIFICATION:
+		e := &Event{
+			EventType:  "watch",
+			SessionID:  p.sessionID,
+			WatchEvent: watchEventNames[r.Int()],
+			State:      stateNames[r.Int()],
+			Path:       r.UString(),
+			timestamp:  f.timestamp,
+		}
+		if r.err != nil {
+			return r.Err()
+		}
+		p.publish(e, f.timestamp)
+		return nil
+	}
+	req, ok := p.pending[xid]
+	if !ok {
+		metrics.Counter("zookeeper.unmatched_responses").Add()
+		return nil
+	}
+	delete(p.pending, xid)
+	for _, e := range req.events {
+		if zxid > 0 {
+			e.Zxid = zxid
+		}
+		e.ResponseBytes = f.Length
+		if f.Truncated {
+			e.Truncated = true
+		}
+	}
+	multi := req.op == OP_MULTI || req.op == OP_MULTI_READ
+	if multi && len(r.b) > 0 {
+		// Each operation has a result, which for failed operations is an
+		// error code.
+		for _, e := range req.events {
+			op := r.Int()
+			done := r.Bool()
+			r.Int() // error
+			if done || r.err != nil {
+				break
+			}
+			if op == OP_ERROR {
+				setError(e, r.Int())
+			} else {
+				readResponse(r, op, e)
+			}
+		}
+	} else if code == ERR_OK {
+		readResponse(r, req.op, req.events[0])
+	} else {
+		for _, e := range req.events {
+			setError(e, code)
+		}
+	}
+	for _, e := range req.events {
+		p.publish(e, timestamp)
+	}
+	return r.Err()
+}
+
+// readResponse reads the body of a successful reply to an operation.
+func readResponse(r *reader, op int32, e *Event) {
+	switch op {
+	case OP_CREATE:
+		e.CreatedPath = r.UString()
+	case OP_CREATE2, OP_CREATE_CONTAINER, OP_CREATE_TTL:
+		e.CreatedPath = r.UString()
+		r.Skip(statLength)
+	case OP_GET_DATA:
+		e.DataBytes = r.Buffer()
+		r.Skip(statLength)
+	case OP_GET_CHILDREN, OP_GET_EPHEMERALS:
+		e.Children = r.StringVector()
+	case OP_GET_CHILDREN2:
+		e.Children = r.StringVector()
+		r.Skip(statLength)
+	case OP_GET_ALL_CHILDREN_NUMBER:
+		e.Children = int(r.Int())
+	case OP_EXISTS, OP_SET_DATA:
+		r.Skip(statLength)
+	}
+}
+
+func setError(e *Event, code int32) {
+	if code == ERR_OK {
+		return
+	}
+	e.Error = true
+	e.ErrorCode = int(code)
+	e.ErrorName = errorNames[code]
+}
+
+func (p *Parser) publish(e *Event, timestamp time.Time) {
+	e.ClientIP = p.flow.SrcIP.String()
+	e.ServerIP = p.flow.DstIP.String()
+	if timestamp.After(e.timestamp) {
+		e.DurationMs = float64(timestamp.Sub(e.timestamp).Nanoseconds()) / 1e6
+	}
+	p.publisher.Publish(e, e.timestamp)
+	metrics.Counter("zookeeper.events_parsed").Add()
+}
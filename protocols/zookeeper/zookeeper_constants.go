@@ -0,0 +1,402 @@
+package zookeeper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// See the jute definitions in
+// https://github.com/apache/zookeeper/blob/master/zookeeper-jute/src/main/resources/zookeeper.jute
+// and ZooDefs.OpCode.
+const (
+	OP_NOTIFICATION            int32 = 0
+	OP_CREATE                  int32 = 1
+	OP_DELETE                  int32 = 2
+	OP_EXISTS                  int32 = 3
+	OP_GET_DATA                int32 = 4
+	OP_SET_DATA                int32 = 5
+	OP_GET_ACL                 int32 = 6
+	OP_SET_ACL                 int32 = 7
+	OP_GET_CHILDREN            int32 = 8
+	OP_SYNC                    int32 = 9
+	OP_PING                    int32 = 11
+	OP_GET_CHILDREN2           int32 = 12
+	OP_CHECK                   int32 = 13
+	OP_MULTI                   int32 = 14
+	OP_CREATE2                 int32 = 15
+	OP_RECONFIG                int32 = 16
+	OP_CHECK_WATCHES           int32 = 17
+	OP_REMOVE_WATCHES          int32 = 18
+	OP_CREATE_CONTAINER        int32 = 19
+	OP_DELETE_CONTAINER        int32 = 20
+	OP_CREATE_TTL              int32 = 21
+	OP_MULTI_READ              int32 = 22
+	OP_AUTH                    int32 = 100
+	OP_SET_WATCHES             int32 = 101
+	OP_SASL                    int32 = 102
+	OP_GET_EPHEMERALS          int32 = 103
+	OP_GET_ALL_CHILDREN_NUMBER int32 = 104
+	OP_SET_WATCHES2            int32 = 105
+	OP_ADD_WATCH               int32 = 106
+	OP_WHO_AM_I                int32 = 107
+	OP_CREATE_SESSION          int32 = -10
+	OP_CLOSE_SESSION           int32 = -11
+	// The type of a multi result that failed.
+	OP_ERROR int32 = -1
+)
+
+var opNames = map[int32]string{
+	0:   "notification",
+	1:   "create",
+	2:   "delete",
+	3:   "exists",
+	4:   "getData",
+	5:   "setData",
+	6:   "getACL",
+	7:   "setACL",
+	8:   "getChildren",
+	9:   "sync",
+	11:  "ping",
+	12:  "getChildren2",
+	13:  "check",
+	14:  "multi",
+	15:  "create2",
+	16:  "reconfig",
+	17:  "checkWatches",
+	18:  "removeWatches",
+	19:  "createContainer",
+	20:  "deleteContainer",
+	21:  "createTTL",
+	22:  "multiRead",
+	100: "auth",
+	101: "setWatches",
+	102: "sasl",
+	103: "getEphemerals",
+	104: "getAllChildrenNumber",
+	105: "setWatches2",
+	106: "addWatch",
+	107: "whoAmI",
+	-10: "createSession",
+	-11: "closeSession",
+}
+
+func opName(op int32) string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", op)
+}
+
+// Special xids, used instead of a request's sequence number.
+const (
+	XID_NOTIFICATION int32 = -1
+	XID_PING         int32 = -2
+	XID_AUTH         int32 = -4
+	XID_SET_WATCHES  int32 = -8
+)
+
+// Create modes, the flags of create requests.
+var createModes = map[int32]string{
+	0: "persistent",
+	1: "ephemeral",
+	2: "persistent_sequential",
+	3: "ephemeral_sequential",
+	4: "container",
+	5: "persistent_ttl",
+	6: "persistent_sequential_ttl",
+}
+
+// KeeperException.Code
+const (
+	ERR_OK              int32 = 0
+	ERR_SESSION_EXPIRED int32 = -112
+)
+
+var errorNames = map[int32]string{
+	-1:   "SYSTEMERROR",
+	-2:   "RUNTIMEINCONSISTENCY",
+	-3:   "DATAINCONSISTENCY",
+	-4:   "CONNECTIONLOSS",
+	-5:   "MARSHALLINGERROR",
+	-6:   "UNIMPLEMENTED",
+	-7:   "OPERATIONTIMEOUT",
+	-8:   "BADARGUMENTS",
+	-13:  "NEWCONFIGNOQUORUM",
+	-14:  "RECONFIGINPROGRESS",
+	-15:  "UNKNOWNSESSION",
+	-100: "APIERROR",
+	-101: "NONODE",
+	-102: "NOAUTH",
+	-103: "BADVERSION",
+	-108: "NOCHILDRENFOREPHEMERALS",
+	-110: "NODEEXISTS",
+	-111: "NOTEMPTY",
+	-112: "SESSIONEXPIRED",
+	-113: "INVALIDCALLBACK",
+	-114: "INVALIDACL",
+	-115: "AUTHFAILED",
+	-118: "SESSIONMOVED",
+	-119: "NOTREADONLY",
+	-120: "EPHEMERALONLOCALSESSION",
+	-121: "NOWATCHER",
+	-122: "REQUESTTIMEOUT",
+	-123: "RECONFIGDISABLED",
+	-124: "SESSIONCLOSEDREQUIRESASL",
+	-125: "QUOTAEXCEEDED",
+	-127: "THROTTLEDOP",
+}
+
+// Watcher.Event.EventType
+var watchEventNames = map[int32]string{
+	-1: "None",
+	1:  "NodeCreated",
+	2:  "NodeDeleted",
+	3:  "NodeDataChanged",
+	4:  "NodeChildrenChanged",
+	5:  "DataWatchRemoved",
+	6:  "ChildWatchRemoved",
+	7:  "PersistentWatchRemoved",
+}
+
+// Watcher.Event.KeeperState
+var stateNames = map[int32]string{
+	0:    "Disconnected",
+	3:    "SyncConnected",
+	4:    "AuthFailed",
+	5:    "ConnectedReadOnly",
+	6:    "SaslAuthenticated",
+	7:    "Closed",
+	-112: "Expired",
+}
+
+// The lengths of the fixed parts of connect requests and responses, up to
+// and including the session ID.
+const (
+	connectRequestLength  = 24
+	connectResponseLength = 16
+)
+
+// The length of a Stat.
+const statLength = 68
+
+// Safety constraints:
+// Don't track more than this many outstanding requests per connection.
+const maxPendingRequests = 1024
+
+// Don't buffer more than this much of a request or response. Servers
+// reject packets over jute.maxbuffer, which defaults to 1MB, but
+// getChildren responses aren't limited.
+const maxBufferedLength = 1 << 20
+
+// Don't accept frames longer than this.
+const maxFrameLength = 1 << 30
+
+// Don't parse more than this many operations of a multi request.
+const maxMultiOps = 1024
+
+// frame is a request or response, without its length.
+type frame struct {
+	Length    int  // Length of the frame
+	Truncated bool // Whether body holds only a prefix of the frame
+	body      []byte
+	timestamp time.Time // When the frame started to arrive
+}
+
+// frameAssembler reads frames from one direction of a connection, keeping
+// the start of an incomplete frame until the rest arrives.
+type frameAssembler struct {
+	size      [4]byte
+	sizeLen   int    // How much of size has arrived
+	frame     *frame // The frame being read, once its size has arrived
+	body      bytes.Buffer
+	remaining int       // Bytes of the frame still to arrive
+	start     time.Time // When the frame started to arrive
+}
+
+// next reads the rest of the current frame from r. It returns io.EOF if r
+// runs out first.
+func (a *frameAssembler) next(r io.Reader, timestamp time.Time) (*frame, error) {
+	if a.frame == nil {
+		n, err := io.ReadFull(r, a.size[a.sizeLen:])
+		if a.sizeLen == 0 && n > 0 {
+			a.start = timestamp
+		}
+		a.sizeLen += n
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		length := int(int32(binary.BigEndian.Uint32(a.size[:])))
+		if length < 0 || length > maxFrameLength {
+			return nil, fmt.Errorf("Bad frame length %d", length)
+		}
+		a.frame = &frame{Length: length, timestamp: a.start}
+		a.remaining = length
+	}
+	for a.remaining > 0 {
+		toBuffer := maxBufferedLength - a.body.Len()
+		if toBuffer > a.remaining {
+			toBuffer = a.remaining
+		}
+		var n int64
+		var err error
+		if toBuffer > 0 {
+			// Copying into a bytes.Buffer grows it as data actually
+			// arrives, rather than allocating based on the declared
+			// length up front.
+			n, err = io.CopyN(&a.body, r, int64(toBuffer))
+		} else {
+			n, err = io.CopyN(ioutil.Discard, r, int64(a.remaining))
+		}
+		a.remaining -= int(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f := a.frame
+	f.body = append([]byte(nil), a.body.Bytes()...)
+	f.Truncated = len(f.body) < f.Length
+	a.reset()
+	return f, nil
+}
+
+// idle reports whether no frame is partway through arriving.
+func (a *frameAssembler) idle() bool {
+	return a.sizeLen == 0
+}
+
+func (a *frameAssembler) reset() {
+	a.sizeLen = 0
+	a.frame = nil
+	a.body.Reset()
+	a.remaining = 0
+}
+
+var errTruncated = errors.New("Truncated frame")
+
+// reader wraps a frame with convenience functions for parsing jute types.
+// Like the Postgres parser's reader, it stores the first error it
+// encounters, and callers must check reader.Err().
+type reader struct {
+	b         []byte
+	truncated bool // Whether the frame is truncated
+	err       error
+}
+
+func newReader(f *frame) *reader {
+	return &reader{b: f.body, truncated: f.Truncated}
+}
+
+// Err returns the error the reader encountered, if any. Running out of a
+// truncated frame isn't an error; the fields that were cut off are just
+// left empty.
+func (r *reader) Err() error {
+	if r.err == errTruncated {
+		return nil
+	}
+	return r.err
+}
+
+// take returns the next n bytes. If the frame is truncated, it may return
+// fewer.
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 {
+		r.err = fmt.Errorf("Bad length %d", n)
+		return nil
+	}
+	if len(r.b) < n {
+		if r.truncated {
+			r.err = errTruncated
+		} else {
+			r.err = io.ErrUnexpectedEOF
+		}
+		b := r.b
+		r.b = nil
+		return b
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) Bool() bool {
+	if b := r.take(1); len(b) == 1 {
+		return b[0] != 0
+	}
+	return false
+}
+
+func (r *reader) Int() int32 {
+	if b := r.take(4); len(b) == 4 {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *reader) Long() int64 {
+	if b := r.take(8); len(b) == 8 {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *reader) Skip(n int) {
+	r.take(n)
+}
+
+// Buffer reads the length of a (nullable) buffer, and skips it. The length
+// of a null buffer is zero.
+func (r *reader) Buffer() int {
+	n := int(r.Int())
+	if n < 0 {
+		return 0
+	}
+	r.Skip(n)
+	return n
+}
+
+// UString reads a (nullable) ustring.
+func (r *reader) UString() string {
+	n := int(r.Int())
+	if n < 0 {
+		return ""
+	}
+	return string(r.take(n))
+}
+
+// VectorLength reads the number of elements of a (nullable) vector, which
+// is zero if it's null.
+func (r *reader) VectorLength() int {
+	if n := int(r.Int()); n > 0 {
+		return n
+	}
+	return 0
+}
+
+// StringVector reads a vector of strings, returning how many there were.
+func (r *reader) StringVector() int {
+	n := r.VectorLength()
+	for i := 0; i < n && r.err == nil; i++ {
+		r.UString()
+	}
+	return n
+}
+
+// ACLs skips a vector of ACLs.
+func (r *reader) ACLs() {
+	n := r.VectorLength()
+	for i := 0; i < n && r.err == nil; i++ {
+		r.Int()     // perms
+		r.UString() // scheme
+		r.UString() // id
+	}
+}
@@ -0,0 +1,386 @@
+package zookeeper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/publish"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer/sniffertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnect(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genConnectRequest(30000, 0), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genConnectResponse(10000, 0x100006f8a0c0000), sniffertest.DefaultDate().Add(4*time.Millisecond), defaultFlow().Reverse())
+	ms.Append(genRequest(1, OP_GET_DATA, ustring("/config"), boolb(false)),
+		sniffertest.DefaultDate().Add(5*time.Millisecond), defaultFlow())
+	ms.Append(genReply(1, 100, ERR_OK, buffer(10), stat()),
+		sniffertest.DefaultDate().Add(6*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	if assert.Equal(t, 2, len(tp.Output)) {
+		assert.JSONEq(t, `{
+			"event_type": "connect",
+			"client_ip": "10.0.0.22",
+			"server_ip": "10.0.0.23",
+			"duration_ms": 4,
+			"session_id": "0x100006f8a0c0000",
+			"op": "connect",
+			"timeout_ms": 10000,
+			"request_bytes": 45,
+			"response_bytes": 37,
+			"error": false
+		}`, string(tp.Output[0]))
+		events := tp.Events()
+		assert.Equal(t, "0x100006f8a0c0000", events[1]["session_id"])
+	}
+}
+
+func TestSessionExpired(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genConnectRequest(30000, 0x1234), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genConnectResponse(0, 0), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "0x1234", events[0]["session_id"])
+		assert.Equal(t, true, events[0]["error"])
+		assert.Equal(t, "SESSIONEXPIRED", events[0]["error_name"])
+	}
+}
+
+func TestGetData(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(7, OP_GET_DATA, ustring("/services/api/leader"), boolb(true)),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genReply(7, 0x2000001f4, ERR_OK, buffer(512), stat()),
+		sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "request", events[0]["event_type"])
+		assert.Equal(t, "getData", events[0]["op"])
+		assert.Equal(t, float64(7), events[0]["xid"])
+		assert.Equal(t, float64(0x2000001f4), events[0]["zxid"])
+		assert.Equal(t, "/services/api/leader", events[0]["path"])
+		assert.Equal(t, true, events[0]["watch"])
+		assert.Equal(t, float64(512), events[0]["data_bytes"])
+		assert.Equal(t, float64(2), events[0]["duration_ms"])
+	}
+}
+
+func TestCreateAndSetData(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genRequest(1, OP_CREATE, ustring("/locks/lock-"), buffer(3), acls(), int32b(3)),
+		genRequest(2, OP_SET_DATA, ustring("/config"), buffer(40), int32b(-1))),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genReply(1, 10, ERR_OK, ustring("/locks/lock-0000000042")),
+		genReply(2, 11, ERR_OK, stat())),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "create", events[0]["op"])
+		assert.Equal(t, "/locks/lock-", events[0]["path"])
+		assert.Equal(t, "ephemeral_sequential", events[0]["create_mode"])
+		assert.Equal(t, "/locks/lock-0000000042", events[0]["created_path"])
+		assert.Equal(t, float64(3), events[0]["data_bytes"])
+		assert.Equal(t, "setData", events[1]["op"])
+		assert.Equal(t, "/config", events[1]["path"])
+		assert.Equal(t, float64(40), events[1]["data_bytes"])
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genRequest(1, OP_EXISTS, ustring("/missing"), boolb(true)),
+		genRequest(2, OP_DELETE, ustring("/config"), int32b(3))),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genReply(1, 10, -101),
+		genReply(2, 10, -103)),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "exists", events[0]["op"])
+		assert.Equal(t, true, events[0]["error"])
+		assert.Equal(t, float64(-101), events[0]["error_code"])
+		assert.Equal(t, "NONODE", events[0]["error_name"])
+		assert.Equal(t, "delete", events[1]["op"])
+		assert.Equal(t, "BADVERSION", events[1]["error_name"])
+	}
+}
+
+func TestGetChildren(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genRequest(1, OP_GET_CHILDREN, ustring("/brokers/ids"), boolb(true)),
+		genRequest(2, OP_GET_CHILDREN2, ustring("/brokers/topics"), boolb(false))),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genReply(1, 10, ERR_OK, int32b(3), ustring("1"), ustring("2"), ustring("3")),
+		genReply(2, 10, ERR_OK, int32b(1), ustring("orders"), stat())),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "getChildren", events[0]["op"])
+		assert.Equal(t, float64(3), events[0]["children"])
+		assert.Equal(t, "getChildren2", events[1]["op"])
+		assert.Equal(t, float64(1), events[1]["children"])
+	}
+}
+
+func TestMulti(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(4, OP_MULTI,
+		multiHeader(OP_CHECK, false), ustring("/config"), int32b(5),
+		multiHeader(OP_CREATE, false), ustring("/jobs/job-"), buffer(8), acls(), int32b(2),
+		multiHeader(OP_SET_DATA, false), ustring("/config"), buffer(16), int32b(5),
+		multiHeader(OP_DELETE, false), ustring("/jobs/old"), int32b(-1),
+		multiHeader(-1, true)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genReply(4, 20, ERR_OK,
+		multiHeader(OP_CHECK, false),
+		multiHeader(OP_CREATE, false), ustring("/jobs/job-0000000007"),
+		multiHeader(OP_SET_DATA, false), stat(),
+		multiHeader(OP_DELETE, false),
+		multiHeader(-1, true)), sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 4, len(events)) {
+		for _, e := range events {
+			assert.Equal(t, true, e["multi"])
+			assert.Equal(t, float64(4), e["xid"])
+			assert.Equal(t, float64(3), e["duration_ms"])
+			assert.Equal(t, false, e["error"])
+		}
+		assert.Equal(t, "check", events[0]["op"])
+		assert.Equal(t, "/config", events[0]["path"])
+		assert.Equal(t, "create", events[1]["op"])
+		assert.Equal(t, "/jobs/job-0000000007", events[1]["created_path"])
+		assert.Equal(t, "setData", events[2]["op"])
+		assert.Equal(t, float64(16), events[2]["data_bytes"])
+		assert.Equal(t, "delete", events[3]["op"])
+		assert.Equal(t, "/jobs/old", events[3]["path"])
+	}
+}
+
+func TestFailedMulti(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(4, OP_MULTI,
+		multiHeader(OP_CHECK, false), ustring("/config"), int32b(5),
+		multiHeader(OP_DELETE, false), ustring("/jobs/old"), int32b(-1),
+		multiHeader(-1, true)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genReply(4, 20, ERR_OK,
+		multiHeader(OP_ERROR, false), int32b(-103),
+		multiHeader(OP_ERROR, false), int32b(-2),
+		multiHeader(-1, true)), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "BADVERSION", events[0]["error_name"])
+		assert.Equal(t, "RUNTIMEINCONSISTENCY", events[1]["error_name"])
+	}
+}
+
+func TestWatchNotification(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genReply(XID_NOTIFICATION, -1, ERR_OK,
+		int32b(3), int32b(3), ustring("/config")), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "watch", events[0]["event_type"])
+		assert.Equal(t, "NodeDataChanged", events[0]["watch_event"])
+		assert.Equal(t, "SyncConnected", events[0]["state"])
+		assert.Equal(t, "/config", events[0]["path"])
+		assert.Equal(t, nil, events[0]["zxid"])
+	}
+}
+
+func TestPingsAndAuth(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genRequest(XID_PING, OP_PING),
+		genRequest(XID_AUTH, OP_AUTH, int32b(0), ustring("digest"), buffer(12))),
+		sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(concat(
+		genReply(XID_PING, 10, ERR_OK),
+		genReply(XID_AUTH, 0, -115),
+		// A reply to a request we didn't see.
+		genReply(9, 10, ERR_OK, stat())),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "auth", events[0]["op"])
+		assert.Equal(t, "digest", events[0]["auth_scheme"])
+		assert.Equal(t, "AUTHFAILED", events[0]["error_name"])
+	}
+}
+
+func TestFrameSplitAcrossMessages(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(1, OP_GET_DATA, ustring("/config"), boolb(false)), sniffertest.DefaultDate(), defaultFlow())
+	reply := genReply(1, 10, ERR_OK, buffer(300), stat())
+	ms.Append(reply[:2], sniffertest.DefaultDate().Add(time.Millisecond), defaultFlow().Reverse())
+	// The client sends another request while the reply is arriving.
+	ms.Append(genRequest(2, OP_SYNC, ustring("/")), sniffertest.DefaultDate().Add(2*time.Millisecond), defaultFlow())
+	ms.Append(reply[2:100], sniffertest.DefaultDate().Add(3*time.Millisecond), defaultFlow().Reverse())
+	ms.Append(concat(reply[100:], genReply(2, 11, ERR_OK, ustring("/"))),
+		sniffertest.DefaultDate().Add(4*time.Millisecond), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, float64(300), events[0]["data_bytes"])
+		assert.Equal(t, float64(4), events[0]["duration_ms"])
+		assert.Equal(t, "sync", events[1]["op"])
+		assert.Equal(t, float64(2), events[1]["duration_ms"])
+	}
+}
+
+func TestResyncAfterSkippedBytes(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(concat(
+		genRequest(1, OP_EXISTS, ustring("/a"), boolb(false)),
+		genRequest(2, OP_EXISTS, ustring("/b"), boolb(false))), sniffertest.DefaultDate(), defaultFlow())
+	reply := genReply(1, 10, ERR_OK, stat())
+	ms.AppendSkipped(reply[3:], sniffertest.DefaultDate(), defaultFlow().Reverse(), 3)
+	ms.Append(genReply(2, 10, ERR_OK, stat()), sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "/b", events[0]["path"])
+	}
+}
+
+func TestTruncatedGetData(t *testing.T) {
+	tp := &sniffertest.Publisher{}
+	parser := newParser(tp)
+	ms := &sniffertest.MessageStream{}
+	ms.Append(genRequest(1, OP_GET_DATA, ustring("/big"), boolb(false)), sniffertest.DefaultDate(), defaultFlow())
+	ms.Append(genReply(1, 10, ERR_OK, buffer(maxBufferedLength+100), stat()),
+		sniffertest.DefaultDate(), defaultFlow().Reverse())
+	parser.On(ms)
+	events := tp.Events()
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, float64(maxBufferedLength+100), events[0]["data_bytes"])
+		assert.Equal(t, true, events[0]["truncated"])
+		assert.Equal(t, false, events[0]["error"])
+	}
+}
+
+func genFrame(b []byte) []byte {
+	return concat(int32b(int32(len(b))), b)
+}
+
+func genConnectRequest(timeout int32, sessionID int64) []byte {
+	return genFrame(concat(
+		int32b(0), int64b(0), int32b(timeout), int64b(sessionID),
+		buffer(16), boolb(false)))
+}
+
+func genConnectResponse(timeout int32, sessionID int64) []byte {
+	return genFrame(concat(
+		int32b(0), int32b(timeout), int64b(sessionID), buffer(16), boolb(false)))
+}
+
+func genRequest(xid int32, op int32, body ...[]byte) []byte {
+	return genFrame(concat(int32b(xid), int32b(op), concat(body...)))
+}
+
+func genReply(xid int32, zxid int64, code int32, body ...[]byte) []byte {
+	return genFrame(concat(int32b(xid), int64b(zxid), int32b(code), concat(body...)))
+}
+
+func multiHeader(op int32, done bool) []byte {
+	return concat(int32b(op), boolb(done), int32b(-1))
+}
+
+func int32b(n int32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+func int64b(n int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return b
+}
+
+func boolb(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func ustring(s string) []byte {
+	return concat(int32b(int32(len(s))), []byte(s))
+}
+
+// buffer generates a buffer of n bytes.
+func buffer(n int) []byte {
+	return concat(int32b(int32(n)), bytes.Repeat([]byte{'x'}, n))
+}
+
+// acls generates the world:anyone ACL.
+func acls() []byte {
+	return concat(int32b(1), int32b(31), ustring("world"), ustring("anyone"))
+}
+
+func stat() []byte {
+	return make([]byte, statLength)
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func defaultFlow() sniffer.IPPortTuple {
+	return sniffertest.DefaultFlow(2181)
+}
+
+func newParser(publisher publish.Publisher) sniffer.Consumer {
+	pf := ParserFactory{
+		Options:   Options{Port: 2181},
+		Publisher: publisher,
+	}
+	return pf.New(defaultFlow())
+}
@@ -0,0 +1,99 @@
+// Package sniffertest provides fixtures for testing consumers: a message
+// stream to feed them, and a publisher that collects the events they publish.
+package sniffertest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"time"
+
+	"github.com/honeycombio/honeycomb-tcpagent/sniffer"
+)
+
+// Implements sniffer.Message
+type message struct {
+	flow    sniffer.IPPortTuple
+	ts      time.Time
+	skipped int
+	r       io.Reader
+}
+
+func (m *message) Flow() sniffer.IPPortTuple { return m.flow }
+func (m *message) Timestamp() time.Time      { return m.ts }
+func (m *message) Skipped() int              { return m.skipped }
+func (m *message) Read(p []byte) (int, error) {
+	return m.r.Read(p)
+}
+
+// MessageStream implements sniffer.MessageStream, returning the messages
+// appended to it in order.
+type MessageStream struct {
+	messages []sniffer.Message
+	index    int
+}
+
+func (ms *MessageStream) Append(b []byte, ts time.Time, flow sniffer.IPPortTuple) {
+	ms.AppendSkipped(b, ts, flow, 0)
+}
+
+// AppendSkipped appends a message that follows skipped bytes.
+func (ms *MessageStream) AppendSkipped(b []byte, ts time.Time, flow sniffer.IPPortTuple, skipped int) {
+	ms.messages = append(ms.messages, &message{
+		r:       bytes.NewReader(b),
+		flow:    flow,
+		ts:      ts,
+		skipped: skipped,
+	})
+}
+
+func (ms *MessageStream) Next() (sniffer.Message, bool) {
+	if ms.index < len(ms.messages) {
+		m := ms.messages[ms.index]
+		ms.index++
+		return m, true
+	}
+	return nil, false
+}
+
+// Done reports whether all of the messages have been returned.
+func (ms *MessageStream) Done() bool {
+	return ms.index == len(ms.messages)
+}
+
+// DefaultFlow returns a flow from a client to a server listening on port.
+func DefaultFlow(port uint16) sniffer.IPPortTuple {
+	return sniffer.IPPortTuple{
+		SrcIP:   net.IPv4(10, 0, 0, 22),
+		DstIP:   net.IPv4(10, 0, 0, 23),
+		SrcPort: 44444,
+		DstPort: port,
+	}
+}
+
+// DefaultDate returns the time that test messages are sent at, or after.
+func DefaultDate() time.Time {
+	return time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+}
+
+// Publisher implements publish.Publisher, collecting each event as JSON.
+type Publisher struct {
+	Output [][]byte
+}
+
+func (tp *Publisher) Publish(data interface{}, timestamp time.Time) {
+	m, _ := json.Marshal(data)
+	tp.Output = append(tp.Output, m)
+}
+
+// Events decodes the events that have been published.
+func (tp *Publisher) Events() []map[string]interface{} {
+	var events []map[string]interface{}
+	for _, o := range tp.Output {
+		var ret map[string]interface{}
+		json.Unmarshal(o, &ret)
+		events = append(events, ret)
+	}
+	return events
+}
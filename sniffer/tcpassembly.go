@@ -27,6 +27,12 @@ type ConsumerFactory interface {
 type Message interface {
 	Timestamp() time.Time
 	Flow() IPPortTuple
+	// Skipped returns the number of bytes that were lost (e.g., due to
+	// dropped packets) immediately before this message, or -1 if the
+	// capture started partway through the stream, so it's unknown.
+	// Consumers of protocols that can't correlate requests and responses
+	// by ID should treat a positive value as a reason to resynchronize.
+	Skipped() int
 	io.Reader
 }
 
@@ -87,6 +93,7 @@ func (s *Stream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.Assemb
 		s.current = &message{
 			flow:      s.getFlow(dir),
 			timestamp: timestamp,
+			skipped:   skipped,
 			bytes:     make(chan []byte, 32),
 		}
 		s.Unlock()
@@ -101,6 +108,7 @@ func (s *Stream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.Assemb
 type message struct {
 	flow      IPPortTuple
 	timestamp time.Time
+	skipped   int
 	bytes     chan []byte
 	current   []byte
 }
@@ -113,6 +121,10 @@ func (m *message) Flow() IPPortTuple {
 	return m.flow
 }
 
+func (m *message) Skipped() int {
+	return m.skipped
+}
+
 func (m *message) Read(p []byte) (int, error) {
 	ok := true
 	for ok && len(m.current) == 0 {